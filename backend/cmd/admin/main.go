@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"backend/internal/config"
+	"backend/internal/server"
+)
+
+const usage = `usage: admin indices <command> [flags]
+
+Commands:
+  status   show the index behind the alias of every embedding model
+  setup    create the missing indices
+  migrate  copy the chunks of indices with an out of date mapping to new ones
+
+Flags are those of the API server; run "admin indices status -h" to list them.
+`
+
+var commands = map[string]func(context.Context, *config.Config, io.Writer) error{
+	"status":  server.IndexStatus,
+	"setup":   server.SetupIndices,
+	"migrate": server.MigrateIndices,
+}
+
+func main() {
+	if len(os.Args) < 3 || os.Args[1] != "indices" {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	command, ok := commands[os.Args[2]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", os.Args[2], usage)
+		os.Exit(2)
+	}
+
+	cfg, err := config.LoadElasticsearch(os.Args[3:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	// An interrupted migration leaves the old index in place and writable
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if err := command(ctx, cfg, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
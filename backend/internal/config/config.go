@@ -0,0 +1,558 @@
+// Package config loads the settings of the API into one struct. Settings
+// come from built-in defaults, an optional YAML file, environment variables
+// and command-line flags, each overriding the ones before, and are checked
+// before the server starts.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/joho/godotenv/autoload"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds every setting of the API.
+type Config struct {
+	// Env names the environment the API runs in, such as "local" or "prod".
+	Env  string `yaml:"env"`
+	Port int    `yaml:"port"`
+
+	Server        Server        `yaml:"server"`
+	Log           Log           `yaml:"log"`
+	CORS          CORS          `yaml:"cors"`
+	RateLimits    RateLimits    `yaml:"rate_limits"`
+	Database      Database      `yaml:"database"`
+	Elasticsearch Elasticsearch `yaml:"elasticsearch"`
+	OpenAI        OpenAI        `yaml:"openai"`
+	Embeddings    Embeddings    `yaml:"embeddings"`
+	QueryCache    QueryCache    `yaml:"query_cache"`
+	Captions      Captions      `yaml:"captions"`
+	Storage       Storage       `yaml:"storage"`
+	Uploads       Uploads       `yaml:"uploads"`
+	Pipeline      Pipeline      `yaml:"pipeline"`
+}
+
+// Server configures the HTTP server.
+type Server struct {
+	// ReadTimeout and WriteTimeout bound how long a request may take to
+	// arrive and to be answered. Handlers that move whole files, such as
+	// resumable uploads and table bundles, set their own.
+	ReadTimeout  time.Duration `yaml:"read_timeout"`
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+	// StagingDir is the local directory that buffers the parts of resumable
+	// uploads on their way to the blob store.
+	StagingDir string `yaml:"staging_dir"`
+}
+
+// Log configures logging.
+type Log struct {
+	// Level is "debug", "info", "warn" or "error".
+	Level string `yaml:"level"`
+	// Format is "text" or "json".
+	Format string `yaml:"format"`
+}
+
+// CORS controls which web origins may call the API from a browser. Public
+// reads are open to any origin; everything else, and requests with
+// credentials, only to the allowed origins.
+type CORS struct {
+	// AllowedOrigins are origins like "https://app.example.com", or
+	// "https://*.example.com" for any subdomain of example.com.
+	AllowedOrigins []string `yaml:"allowed_origins"`
+	// MaxAge is how many seconds browsers may cache a preflight response.
+	MaxAge int `yaml:"max_age"`
+}
+
+// RateLimits throttles the routes that cost money or capacity, per client IP
+// and, for requests with credentials, per user as well.
+type RateLimits struct {
+	// Store is "memory", which limits each replica on its own, or
+	// "postgres", which shares the limits between replicas.
+	Store string `yaml:"store"`
+	// TrustProxy identifies clients by the last address of X-Forwarded-For
+	// rather than that of the connection. Set it only behind a reverse proxy
+	// that adds the header, since clients can forge it.
+	TrustProxy bool `yaml:"trust_proxy"`
+
+	Search    RateLimit `yaml:"search"`
+	Upload    RateLimit `yaml:"upload"`
+	Ingestion RateLimit `yaml:"ingestion"`
+	// Render limits the pages of documents rendered as images.
+	Render RateLimit `yaml:"render"`
+}
+
+// RateLimit lets a client make Burst requests at once, and PerMinute a
+// minute after that. A PerMinute of 0 turns the limit off.
+type RateLimit struct {
+	PerMinute int `yaml:"per_minute"`
+	Burst     int `yaml:"burst"`
+}
+
+// Database locates the Postgres database.
+type Database struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	Name     string `yaml:"name"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	Schema   string `yaml:"schema"`
+}
+
+// Elasticsearch locates the cluster and the index chunks are written to.
+type Elasticsearch struct {
+	URL    string `yaml:"url"`
+	APIKey string `yaml:"api_key"`
+	Index  string `yaml:"index"`
+}
+
+// OpenAI holds the credentials for embedding text and captioning images.
+type OpenAI struct {
+	APIKey string `yaml:"api_key"`
+}
+
+// Embeddings selects the embedding model new tables use.
+type Embeddings struct {
+	// Version is the version of the model, which tables created before a
+	// change of version can be migrated to.
+	Version int `yaml:"version"`
+}
+
+// QueryCache keeps the embeddings of search queries, so that a repeated query
+// does not call the embedding API again.
+type QueryCache struct {
+	// Size is how many embeddings are kept in memory; 0 keeps none.
+	Size int `yaml:"size"`
+	// TTL is how long an embedding is reused, such as "24h".
+	TTL time.Duration `yaml:"ttl"`
+	// Persistent also keeps embeddings in Postgres, where they outlive
+	// restarts and are shared between replicas.
+	Persistent bool `yaml:"persistent"`
+}
+
+// Captions selects how extracted images are described.
+type Captions struct {
+	// Provider is "openai" or "none". When empty, OpenAI is used if an API
+	// key is configured.
+	Provider string `yaml:"provider"`
+	Model    string `yaml:"model"`
+}
+
+// Storage selects where uploaded files are kept.
+type Storage struct {
+	// Backend is "local" or "s3".
+	Backend    string `yaml:"backend"`
+	LocalDir   string `yaml:"local_dir"`
+	SigningKey string `yaml:"signing_key"`
+	S3         S3     `yaml:"s3"`
+}
+
+// S3 locates an S3 compatible bucket.
+type S3 struct {
+	Endpoint        string `yaml:"endpoint"`
+	Region          string `yaml:"region"`
+	Bucket          string `yaml:"bucket"`
+	AccessKeyID     string `yaml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key"`
+	UseSSL          bool   `yaml:"use_ssl"`
+}
+
+// Uploads limits what users can upload.
+type Uploads struct {
+	// MaxBytes is the largest single file accepted.
+	MaxBytes int64 `yaml:"max_bytes"`
+	// UserQuotaBytes is the total size of the files a user may store.
+	UserQuotaBytes int64 `yaml:"user_quota_bytes"`
+}
+
+// Pipeline holds the credentials only the ingestion pipeline uses.
+type Pipeline struct {
+	// ArynAPIKey authenticates the partitioner.
+	ArynAPIKey string `yaml:"aryn_api_key"`
+	// AnthropicAPIKey authenticates the model that summarizes images.
+	AnthropicAPIKey string `yaml:"anthropic_api_key"`
+}
+
+// Default returns the settings used for anything not configured.
+func Default() *Config {
+	return &Config{
+		Env:  "local",
+		Port: 8080,
+		Server: Server{
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: 30 * time.Second,
+			StagingDir:   "staging",
+		},
+		Log: Log{Level: "info", Format: "text"},
+		CORS: CORS{
+			AllowedOrigins: []string{"http://localhost:3000"}, // The frontend's dev server
+			MaxAge:         600,
+		},
+		RateLimits: RateLimits{
+			Store:     "memory",
+			Search:    RateLimit{PerMinute: 30, Burst: 10}, // Every search embeds its query
+			Upload:    RateLimit{PerMinute: 20, Burst: 10},
+			Ingestion: RateLimit{PerMinute: 5, Burst: 3},
+			Render:    RateLimit{PerMinute: 60, Burst: 20},
+		},
+		Database: Database{
+			Port: 5432,
+		},
+		Embeddings: Embeddings{Version: 1},
+		QueryCache: QueryCache{
+			Size: 2000, // About 12MB of 1536-dimensional embeddings
+			TTL:  24 * time.Hour,
+		},
+		Captions: Captions{Model: "gpt-4o-mini"},
+		Storage: Storage{
+			Backend:  "local",
+			LocalDir: "uploads",
+			S3:       S3{UseSSL: true},
+		},
+		Uploads: Uploads{
+			MaxBytes:       100 << 20, // 100MB
+			UserQuotaBytes: 1 << 30,   // 1GB
+		},
+	}
+}
+
+// Load reads the configuration for a run of the API with the command-line
+// arguments args (without the program name). The YAML file named by -config
+// or CONFIG_FILE is read if given. The result has been validated.
+func Load(args []string) (*Config, error) {
+	cfg, err := load(args)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// LoadElasticsearch reads the configuration like Load, for commands that only
+// use Elasticsearch: only its settings are validated, so the rest of what the
+// API needs does not have to be set.
+func LoadElasticsearch(args []string) (*Config, error) {
+	cfg, err := load(args)
+	if err != nil {
+		return nil, err
+	}
+	if errs := cfg.Elasticsearch.validate(); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid configuration:\n%w", errors.Join(errs...))
+	}
+	return cfg, nil
+}
+
+// load reads the configuration Load does, without validating it.
+func load(args []string) (*Config, error) {
+	fs := flag.NewFlagSet("api", flag.ContinueOnError)
+	file := fs.String("config", os.Getenv("CONFIG_FILE"), "read settings from this YAML file")
+	port := fs.Int("port", 0, "listen on this port")
+	logLevel := fs.String("log-level", "", "log at this level: debug, info, warn or error")
+	logFormat := fs.String("log-format", "", "log in this format: text or json")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := Default()
+	if *file != "" {
+		if err := cfg.loadFile(*file); err != nil {
+			return nil, err
+		}
+	}
+	if err := cfg.loadEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+
+	// Only flags given on the command line override the settings
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "port":
+			cfg.Port = *port
+		case "log-level":
+			cfg.Log.Level = *logLevel
+		case "log-format":
+			cfg.Log.Format = *logFormat
+		}
+	})
+	return cfg, nil
+}
+
+// loadFile overrides the settings with those in the YAML file at path.
+// Unknown keys are errors, so typos do not go unnoticed.
+func (c *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error reading config file: %v", err)
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil {
+		return fmt.Errorf("error parsing config file %s: %v", path, err)
+	}
+	return nil
+}
+
+// loadEnv overrides the settings with the environment variables lookup finds.
+// Empty variables count as unset, as docker compose passes unset ones on.
+func (c *Config) loadEnv(lookup func(string) (string, bool)) error {
+	vars := []struct {
+		name string
+		dst  interface{}
+	}{
+		{"APP_ENV", &c.Env},
+		{"PORT", &c.Port},
+		{"SERVER_READ_TIMEOUT", &c.Server.ReadTimeout},
+		{"SERVER_WRITE_TIMEOUT", &c.Server.WriteTimeout},
+		{"UPLOAD_STAGING_DIR", &c.Server.StagingDir},
+		{"LOG_LEVEL", &c.Log.Level},
+		{"LOG_FORMAT", &c.Log.Format},
+		{"CORS_ALLOWED_ORIGINS", &c.CORS.AllowedOrigins},
+		{"CORS_MAX_AGE", &c.CORS.MaxAge},
+		{"RATE_LIMIT_STORE", &c.RateLimits.Store},
+		{"RATE_LIMIT_TRUST_PROXY", &c.RateLimits.TrustProxy},
+		{"RATE_LIMIT_SEARCH_PER_MINUTE", &c.RateLimits.Search.PerMinute},
+		{"RATE_LIMIT_SEARCH_BURST", &c.RateLimits.Search.Burst},
+		{"RATE_LIMIT_UPLOAD_PER_MINUTE", &c.RateLimits.Upload.PerMinute},
+		{"RATE_LIMIT_UPLOAD_BURST", &c.RateLimits.Upload.Burst},
+		{"RATE_LIMIT_INGESTION_PER_MINUTE", &c.RateLimits.Ingestion.PerMinute},
+		{"RATE_LIMIT_INGESTION_BURST", &c.RateLimits.Ingestion.Burst},
+		{"RATE_LIMIT_RENDER_PER_MINUTE", &c.RateLimits.Render.PerMinute},
+		{"RATE_LIMIT_RENDER_BURST", &c.RateLimits.Render.Burst},
+		{"BLUEPRINT_DB_HOST", &c.Database.Host},
+		{"BLUEPRINT_DB_PORT", &c.Database.Port},
+		{"BLUEPRINT_DB_DATABASE", &c.Database.Name},
+		{"BLUEPRINT_DB_USERNAME", &c.Database.Username},
+		{"BLUEPRINT_DB_PASSWORD", &c.Database.Password},
+		{"BLUEPRINT_DB_SCHEMA", &c.Database.Schema},
+		{"ELASTICSEARCH_URL", &c.Elasticsearch.URL},
+		{"ELASTICSEARCH_API_KEY", &c.Elasticsearch.APIKey},
+		{"ELASTICSEARCH_INDEX", &c.Elasticsearch.Index},
+		{"OPENAI_API_KEY", &c.OpenAI.APIKey},
+		{"EMBEDDING_VERSION", &c.Embeddings.Version},
+		{"QUERY_CACHE_SIZE", &c.QueryCache.Size},
+		{"QUERY_CACHE_TTL", &c.QueryCache.TTL},
+		{"QUERY_CACHE_PERSISTENT", &c.QueryCache.Persistent},
+		{"CAPTION_PROVIDER", &c.Captions.Provider},
+		{"CAPTION_MODEL", &c.Captions.Model},
+		{"BLOB_STORE", &c.Storage.Backend},
+		{"BLOB_LOCAL_DIR", &c.Storage.LocalDir},
+		{"BLOB_SIGNING_KEY", &c.Storage.SigningKey},
+		{"S3_ENDPOINT", &c.Storage.S3.Endpoint},
+		{"S3_REGION", &c.Storage.S3.Region},
+		{"S3_BUCKET", &c.Storage.S3.Bucket},
+		{"S3_ACCESS_KEY_ID", &c.Storage.S3.AccessKeyID},
+		{"S3_SECRET_ACCESS_KEY", &c.Storage.S3.SecretAccessKey},
+		{"S3_USE_SSL", &c.Storage.S3.UseSSL},
+		{"UPLOAD_MAX_BYTES", &c.Uploads.MaxBytes},
+		{"UPLOAD_USER_QUOTA_BYTES", &c.Uploads.UserQuotaBytes},
+		{"ARYN_API_KEY", &c.Pipeline.ArynAPIKey},
+		{"ANTHROPIC_API_KEY", &c.Pipeline.AnthropicAPIKey},
+	}
+
+	var errs []error
+	for _, v := range vars {
+		value, ok := lookup(v.name)
+		if !ok || value == "" {
+			continue
+		}
+		if err := setValue(v.dst, value); err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s %q: %v", v.name, value, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// setValue parses value into the setting dst points to.
+func setValue(dst interface{}, value string) error {
+	switch dst := dst.(type) {
+	case *string:
+		*dst = value
+	case *int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("must be a number")
+		}
+		*dst = n
+	case *int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("must be a number")
+		}
+		*dst = n
+	case *time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("must be a duration like 30m or 24h")
+		}
+		*dst = d
+	case *bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("must be true or false")
+		}
+		*dst = b
+	case *[]string:
+		// Lists are comma separated
+		var list []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		*dst = list
+	default:
+		panic(fmt.Sprintf("unsupported setting type %T", dst))
+	}
+	return nil
+}
+
+// Validate checks that the settings are complete and consistent. The errors
+// name the environment variables that set the settings at fault.
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+	required := func(name, value string) {
+		if value == "" {
+			fail("%s is required", name)
+		}
+	}
+
+	if c.Port < 1 || c.Port > 65535 {
+		fail("PORT must be between 1 and 65535, got %d", c.Port)
+	}
+	if c.Server.ReadTimeout <= 0 {
+		fail("SERVER_READ_TIMEOUT must be positive, got %s", c.Server.ReadTimeout)
+	}
+	if c.Server.WriteTimeout <= 0 {
+		fail("SERVER_WRITE_TIMEOUT must be positive, got %s", c.Server.WriteTimeout)
+	}
+	required("UPLOAD_STAGING_DIR", c.Server.StagingDir)
+
+	switch strings.ToLower(c.Log.Level) {
+	case "", "debug", "info", "warn", "error":
+	default:
+		fail("LOG_LEVEL must be debug, info, warn or error, got %q", c.Log.Level)
+	}
+	switch strings.ToLower(c.Log.Format) {
+	case "", "text", "json":
+	default:
+		fail("LOG_FORMAT must be text or json, got %q", c.Log.Format)
+	}
+
+	for _, origin := range c.CORS.AllowedOrigins {
+		if err := validateOrigin(origin); err != nil {
+			fail("CORS_ALLOWED_ORIGINS: %v", err)
+		}
+	}
+	if c.CORS.MaxAge < 0 {
+		fail("CORS_MAX_AGE must not be negative, got %d", c.CORS.MaxAge)
+	}
+
+	switch c.RateLimits.Store {
+	case "memory", "postgres":
+	default:
+		fail("RATE_LIMIT_STORE must be memory or postgres, got %q", c.RateLimits.Store)
+	}
+	for _, limit := range []struct {
+		name string
+		RateLimit
+	}{
+		{"SEARCH", c.RateLimits.Search},
+		{"UPLOAD", c.RateLimits.Upload},
+		{"INGESTION", c.RateLimits.Ingestion},
+		{"RENDER", c.RateLimits.Render},
+	} {
+		if limit.PerMinute < 0 {
+			fail("RATE_LIMIT_%s_PER_MINUTE must not be negative, got %d", limit.name, limit.PerMinute)
+		}
+		if limit.PerMinute > 0 && limit.Burst < 1 {
+			fail("RATE_LIMIT_%s_BURST must be at least 1, got %d", limit.name, limit.Burst)
+		}
+	}
+
+	required("BLUEPRINT_DB_HOST", c.Database.Host)
+	required("BLUEPRINT_DB_DATABASE", c.Database.Name)
+	required("BLUEPRINT_DB_USERNAME", c.Database.Username)
+	if c.Database.Port < 1 || c.Database.Port > 65535 {
+		fail("BLUEPRINT_DB_PORT must be between 1 and 65535, got %d", c.Database.Port)
+	}
+
+	errs = append(errs, c.Elasticsearch.validate()...)
+
+	if c.Embeddings.Version < 1 {
+		fail("EMBEDDING_VERSION must be at least 1, got %d", c.Embeddings.Version)
+	}
+	if c.QueryCache.Size < 0 {
+		fail("QUERY_CACHE_SIZE must not be negative, got %d", c.QueryCache.Size)
+	}
+	if (c.QueryCache.Size > 0 || c.QueryCache.Persistent) && c.QueryCache.TTL <= 0 {
+		fail("QUERY_CACHE_TTL must be positive, got %s", c.QueryCache.TTL)
+	}
+
+	switch c.Captions.Provider {
+	case "", "none":
+	case "openai":
+		required("OPENAI_API_KEY (needed by CAPTION_PROVIDER openai)", c.OpenAI.APIKey)
+	default:
+		fail("CAPTION_PROVIDER must be openai or none, got %q", c.Captions.Provider)
+	}
+
+	switch c.Storage.Backend {
+	case "local":
+		required("BLOB_LOCAL_DIR", c.Storage.LocalDir)
+	case "s3":
+		required("S3_ENDPOINT", c.Storage.S3.Endpoint)
+		required("S3_BUCKET", c.Storage.S3.Bucket)
+	default:
+		fail("BLOB_STORE must be local or s3, got %q", c.Storage.Backend)
+	}
+
+	if c.Uploads.MaxBytes <= 0 {
+		fail("UPLOAD_MAX_BYTES must be a positive number of bytes, got %d", c.Uploads.MaxBytes)
+	}
+	if c.Uploads.UserQuotaBytes <= 0 {
+		fail("UPLOAD_USER_QUOTA_BYTES must be a positive number of bytes, got %d", c.Uploads.UserQuotaBytes)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// validate returns what is wrong with the Elasticsearch settings.
+func (e Elasticsearch) validate() []error {
+	var errs []error
+	if e.URL == "" {
+		errs = append(errs, fmt.Errorf("ELASTICSEARCH_URL is required"))
+	} else if u, err := url.Parse(e.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("ELASTICSEARCH_URL must be an http or https URL, got %q", e.URL))
+	}
+	if e.Index == "" {
+		errs = append(errs, fmt.Errorf("ELASTICSEARCH_INDEX is required"))
+	}
+	return errs
+}
+
+// validateOrigin checks that origin is a scheme and host, with an optional
+// port, where the host may start with "*." to stand for any subdomain.
+func validateOrigin(origin string) error {
+	u, err := url.Parse(strings.Replace(origin, "://*.", "://wildcard.", 1))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+		u.Path != "" || u.RawQuery != "" || u.User != nil || strings.Contains(u.Host, "*") {
+		return fmt.Errorf("%q is not an origin like https://app.example.com or https://*.example.com", origin)
+	}
+	return nil
+}
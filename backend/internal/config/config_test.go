@@ -0,0 +1,178 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setRequiredEnv sets the settings that have no defaults.
+func setRequiredEnv(t *testing.T) {
+	t.Helper()
+	t.Setenv("CONFIG_FILE", "")
+	t.Setenv("BLUEPRINT_DB_HOST", "db")
+	t.Setenv("BLUEPRINT_DB_DATABASE", "sharetome")
+	t.Setenv("BLUEPRINT_DB_USERNAME", "app")
+	t.Setenv("ELASTICSEARCH_URL", "http://es:9200")
+	t.Setenv("ELASTICSEARCH_INDEX", "chunks")
+}
+
+func TestLoad(t *testing.T) {
+	setRequiredEnv(t)
+	t.Setenv("PORT", "9000")
+	t.Setenv("UPLOAD_MAX_BYTES", "1024")
+	t.Setenv("S3_USE_SSL", "false")
+	t.Setenv("SERVER_WRITE_TIMEOUT", "2m")
+	t.Setenv("CORS_ALLOWED_ORIGINS", "https://sharetome.app, https://*.sharetome.app")
+
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	yaml := "port: 7000\nlog:\n  format: json\nelasticsearch:\n  index: from-file\n  api_key: secret\nquery_cache:\n  ttl: 90m\n"
+	if err := os.WriteFile(file, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Load([]string{"-config", file, "-log-level", "debug"})
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	// The environment overrides the file, and flags override both
+	if cfg.Port != 9000 {
+		t.Errorf("Port = %d; want 9000 from PORT", cfg.Port)
+	}
+	if cfg.Elasticsearch.Index != "chunks" || cfg.Elasticsearch.APIKey != "secret" {
+		t.Errorf("Elasticsearch = %+v; want the index from the environment and the key from the file", cfg.Elasticsearch)
+	}
+	if cfg.Log.Level != "debug" || cfg.Log.Format != "json" {
+		t.Errorf("Log = %+v; want debug from the flag and json from the file", cfg.Log)
+	}
+	if cfg.Uploads.MaxBytes != 1024 || cfg.Uploads.UserQuotaBytes != 1<<30 {
+		t.Errorf("Uploads = %+v; want 1024 and the default quota", cfg.Uploads)
+	}
+	if want := []string{"https://sharetome.app", "https://*.sharetome.app"}; !reflect.DeepEqual(cfg.CORS.AllowedOrigins, want) {
+		t.Errorf("CORS.AllowedOrigins = %q; want %q", cfg.CORS.AllowedOrigins, want)
+	}
+	if cfg.QueryCache.TTL != 90*time.Minute || cfg.QueryCache.Size != 2000 {
+		t.Errorf("QueryCache = %+v; want a TTL of 90m and the default size", cfg.QueryCache)
+	}
+	if cfg.Server.WriteTimeout != 2*time.Minute || cfg.Server.ReadTimeout != 10*time.Second || cfg.Server.StagingDir != "staging" {
+		t.Errorf("Server = %+v; want a write timeout of 2m and the defaults", cfg.Server)
+	}
+	if cfg.Storage.S3.UseSSL || cfg.Database.Port != 5432 {
+		t.Errorf("got UseSSL %v, database port %d; want false and the default", cfg.Storage.S3.UseSSL, cfg.Database.Port)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	setRequiredEnv(t)
+
+	tests := []struct {
+		name string
+		env  map[string]string
+		args []string
+		want []string
+	}{
+		{
+			name: "missing settings",
+			env:  map[string]string{"BLUEPRINT_DB_HOST": "", "ELASTICSEARCH_INDEX": ""},
+			want: []string{"BLUEPRINT_DB_HOST is required", "ELASTICSEARCH_INDEX is required"},
+		},
+		{
+			name: "unparsable number",
+			env:  map[string]string{"PORT": "eighty"},
+			want: []string{`invalid PORT "eighty"`},
+		},
+		{
+			name: "unparsable duration",
+			env:  map[string]string{"QUERY_CACHE_TTL": "1 day"},
+			want: []string{`invalid QUERY_CACHE_TTL "1 day": must be a duration`},
+		},
+		{
+			name: "out of range",
+			args: []string{"-port", "70000"},
+			want: []string{"PORT must be between 1 and 65535"},
+		},
+		{
+			name: "bad origins",
+			env:  map[string]string{"CORS_ALLOWED_ORIGINS": "*,https://app.example.com/,https://a.*.example.com"},
+			want: []string{`"*" is not an origin`, `"https://app.example.com/" is not an origin`, `"https://a.*.example.com" is not an origin`},
+		},
+		{
+			name: "bad rate limits",
+			env:  map[string]string{"RATE_LIMIT_STORE": "redis", "RATE_LIMIT_SEARCH_BURST": "0", "RATE_LIMIT_UPLOAD_PER_MINUTE": "-1"},
+			want: []string{"RATE_LIMIT_STORE must be memory or postgres", "RATE_LIMIT_SEARCH_BURST must be at least 1", "RATE_LIMIT_UPLOAD_PER_MINUTE"},
+		},
+		{
+			name: "bad server settings",
+			env:  map[string]string{"SERVER_READ_TIMEOUT": "0s", "SERVER_WRITE_TIMEOUT": "-1s"},
+			want: []string{"SERVER_READ_TIMEOUT must be positive", "SERVER_WRITE_TIMEOUT must be positive"},
+		},
+		{
+			name: "bad values",
+			env: map[string]string{
+				"ELASTICSEARCH_URL": "es:9200",
+				"BLOB_STORE":        "s3",
+				"CAPTION_PROVIDER":  "openai",
+				"OPENAI_API_KEY":    "",
+				"EMBEDDING_VERSION": "0",
+			},
+			want: []string{"ELASTICSEARCH_URL must be an http or https URL", "S3_BUCKET is required", "OPENAI_API_KEY", "EMBEDDING_VERSION must be at least 1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			_, err := Load(tt.args)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not mention %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadUnknownKey(t *testing.T) {
+	setRequiredEnv(t)
+
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(file, []byte("elasticsearch:\n  indx: chunks\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load([]string{"-config", file}); err == nil || !strings.Contains(err.Error(), "indx") {
+		t.Errorf("err = %v; want the unknown key reported", err)
+	}
+}
+
+func TestLoadElasticsearch(t *testing.T) {
+	setRequiredEnv(t)
+	// Settings only the API needs may be missing or wrong
+	t.Setenv("BLUEPRINT_DB_HOST", "")
+	t.Setenv("CAPTION_PROVIDER", "openai")
+	t.Setenv("OPENAI_API_KEY", "")
+
+	cfg, err := LoadElasticsearch(nil)
+	if err != nil {
+		t.Fatalf("LoadElasticsearch: %v", err)
+	}
+	if cfg.Elasticsearch.URL != "http://es:9200" || cfg.Elasticsearch.Index != "chunks" {
+		t.Errorf("Elasticsearch = %+v; want the settings of the environment", cfg.Elasticsearch)
+	}
+
+	t.Setenv("ELASTICSEARCH_URL", "es:9200")
+	t.Setenv("ELASTICSEARCH_INDEX", "")
+	_, err = LoadElasticsearch(nil)
+	for _, want := range []string{"ELASTICSEARCH_URL must be an http or https URL", "ELASTICSEARCH_INDEX is required"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("err = %v; want it to mention %q", err, want)
+		}
+	}
+}
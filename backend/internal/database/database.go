@@ -5,13 +5,17 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
-	"os"
+	"log/slog"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/XSAM/otelsql"
 	"github.com/google/uuid"
 	_ "github.com/jackc/pgx/v5/stdlib"
-	_ "github.com/joho/godotenv/autoload"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+
+	"backend/internal/config"
 )
 
 // Service represents a service that interacts with a database.
@@ -20,6 +24,12 @@ type Service interface {
 	// The keys and values in the map are service-specific.
 	Health() map[string]string
 
+	// Ping checks that the database can be reached.
+	Ping(ctx context.Context) error
+
+	// Stats returns the statistics of the connection pool.
+	Stats() sql.DBStats
+
 	// Close terminates the database connection.
 	// It returns an error if the connection cannot be closed.
 	Close() error
@@ -38,44 +48,234 @@ type Service interface {
 
 	// UpdateTableVisibility updates the visibility of a table
 	UpdateTableVisibility(ctx context.Context, tableID string, isPublic bool) error
+
+	// UpdateTableContentTypes sets the file types a table accepts
+	UpdateTableContentTypes(ctx context.Context, tableID string, contentTypes []string) error
+
+	// SetTableEmbedding records the embedding model and version a table's chunks are embedded with
+	SetTableEmbedding(ctx context.Context, tableID, model string, version int) error
+
+	// DeleteTable removes a table along with its documents, jobs and stars
+	DeleteTable(ctx context.Context, tableID string) error
+
+	// AddTableDocument registers an uploaded document in a table
+	AddTableDocument(ctx context.Context, tableID, userID, fileName, filePath, sha256 string) (*TableDocument, error)
+
+	// GetTableDocumentByHash retrieves the document of a table with the given content hash
+	GetTableDocumentByHash(ctx context.Context, tableID, sha256 string) (*TableDocument, error)
+
+	// FindIngestedDocumentByHash retrieves any ingested document with the given content hash
+	FindIngestedDocumentByHash(ctx context.Context, sha256 string) (*TableDocument, error)
+
+	// MarkDocumentIngested records that a document's chunks are indexed
+	MarkDocumentIngested(ctx context.Context, documentID string) error
+
+	// GetTableDocuments retrieves all documents registered in a table
+	GetTableDocuments(ctx context.Context, tableID string) ([]TableDocument, error)
+
+	// GetTableDocument retrieves a single document by its ID
+	GetTableDocument(ctx context.Context, documentID string) (*TableDocument, error)
+
+	// ReplaceExtractedTables replaces the tables extracted from a document
+	ReplaceExtractedTables(ctx context.Context, documentID, tableID string, tables []ExtractedTable) error
+
+	// GetExtractedTables retrieves the tables extracted from the documents of a table, without cells
+	GetExtractedTables(ctx context.Context, tableID string) ([]ExtractedTable, error)
+
+	// GetDocumentExtractedTables retrieves the tables extracted from a document
+	GetDocumentExtractedTables(ctx context.Context, documentID string) ([]ExtractedTable, error)
+
+	// GetExtractedTable retrieves a single extracted table by its element ID
+	GetExtractedTable(ctx context.Context, elementID string) (*ExtractedTable, error)
+
+	// UpdateTableDetails sets the description and tags of a table
+	UpdateTableDetails(ctx context.Context, tableID, description string, tags []string) error
+
+	// ListPublicTables retrieves a page of the public table directory
+	ListPublicTables(ctx context.Context, query PublicTableQuery) ([]PublicTable, error)
+
+	// SetDisplayName sets the name a user is shown under as a table owner
+	SetDisplayName(ctx context.Context, userID, displayName string) error
+
+	// StarTable stars a table for a user; starring a starred table does nothing
+	StarTable(ctx context.Context, userID, tableID string) error
+
+	// UnstarTable removes a user's star from a table
+	UnstarTable(ctx context.Context, userID, tableID string) error
+
+	// GetStarredTables retrieves the tables a user starred that they can still read
+	GetStarredTables(ctx context.Context, userID string) ([]PublicTable, error)
+
+	// GetFeed retrieves documents added to the tables a user starred since they starred them
+	GetFeed(ctx context.Context, userID string, limit int) ([]FeedItem, error)
+
+	// RecordTableEvent appends an event to the table event log
+	RecordTableEvent(ctx context.Context, event TableEvent) error
+
+	// GetTableEvents retrieves a page of a table's events, newest first
+	GetTableEvents(ctx context.Context, tableID string, before int64, limit int) ([]TableEvent, error)
+
+	// GetUserEvents retrieves a page of the events a user performed or that happened to their tables
+	GetUserEvents(ctx context.Context, userID string, before int64, limit int) ([]TableEvent, error)
+
+	// ForkTable creates a table owned by userID that records sourceTableID as its upstream
+	ForkTable(ctx context.Context, sourceTableID, userID, tableName string) (string, error)
+
+	// UpdateTableSyncedAt records when a fork last pulled its upstream table
+	UpdateTableSyncedAt(ctx context.Context, tableID string, syncedAt time.Time) error
+
+	// AddForkedDocument registers a copy of an upstream document in a fork
+	AddForkedDocument(ctx context.Context, tableID, userID string, source TableDocument) (*TableDocument, error)
+	// LinkForkedDocument records a document of a fork as the copy of an upstream document
+	LinkForkedDocument(ctx context.Context, documentID, sourceDocumentID string) error
+
+	// CreateIngestionJob inserts a new pending ingestion job for a table
+	CreateIngestionJob(ctx context.Context, tableID, userID, kind string, total int) (*IngestionJob, error)
+
+	// GetIngestionJob retrieves an ingestion job by its ID
+	GetIngestionJob(ctx context.Context, jobID string) (*IngestionJob, error)
+
+	// UpdateIngestionJob records the status and progress of an ingestion job
+	UpdateIngestionJob(ctx context.Context, job *IngestionJob) error
+
+	// CreateUpload registers a new resumable upload
+	CreateUpload(ctx context.Context, userID, fileName, contentType string, size int64) (*Upload, error)
+
+	// GetUpload retrieves a resumable upload by its ID
+	GetUpload(ctx context.Context, uploadID string) (*Upload, error)
+
+	// AppendUploadPart records a part of an upload received at offset, failing with ErrConflict if the offset has moved on
+	AppendUploadPart(ctx context.Context, uploadID string, offset, size int64, filePath string) error
+
+	// GetUploadParts retrieves the parts of an unfinished upload in order
+	GetUploadParts(ctx context.Context, uploadID string) ([]UploadPart, error)
+
+	// CompleteUpload marks an upload as finished and stored at filePath
+	CompleteUpload(ctx context.Context, uploadID, filePath, contentType, sha256 string) error
+
+	// DeleteUpload removes a resumable upload
+	DeleteUpload(ctx context.Context, uploadID string) error
+
+	// GetUploadByFilePath retrieves the completed upload stored under a key
+	GetUploadByFilePath(ctx context.Context, filePath string) (*Upload, error)
+
+	// GetUserStorageUsage returns the bytes reserved by all uploads of a user
+	GetUserStorageUsage(ctx context.Context, userID string) (int64, error)
+
+	// TakeRateLimitToken takes a token from a rate limit bucket, returning how long until there is one if it is empty
+	TakeRateLimitToken(ctx context.Context, key string, interval time.Duration, burst int) (time.Duration, error)
+
+	// DeleteFullRateLimits removes the rate limit buckets that are full
+	DeleteFullRateLimits(ctx context.Context) error
+
+	// AcquireTableLock takes the lock of a table for holder until ttl from now, reporting false if another holder has it
+	AcquireTableLock(ctx context.Context, tableID, holder string, ttl time.Duration) (bool, error)
+
+	// RenewTableLock extends the lock holder has on a table to ttl from now
+	RenewTableLock(ctx context.Context, tableID, holder string, ttl time.Duration) error
+
+	// ReleaseTableLock frees the lock holder has on a table
+	ReleaseTableLock(ctx context.Context, tableID, holder string) error
+
+	// GetQueryEmbedding retrieves a cached query embedding younger than maxAge, or nil
+	GetQueryEmbedding(ctx context.Context, key string, maxAge time.Duration) ([]float32, error)
+
+	// PutQueryEmbedding caches the embedding of a query
+	PutQueryEmbedding(ctx context.Context, key, model string, embedding []float32) error
+
+	// DeleteQueryEmbeddings removes the cached query embeddings older than maxAge
+	DeleteQueryEmbeddings(ctx context.Context, maxAge time.Duration) error
 }
 
 type service struct {
 	db *sql.DB
+	// name is the name of the database, for logs.
+	name string
 }
 
 type UserTable struct {
+	UserID    string `json:"-"`
 	TableID   string `json:"table_id"`
 	TableName string `json:"table_name"`
 	IsPublic  bool   `json:"public"`
+	// Description and Tags describe the table in the public directory.
+	Description string   `json:"description"`
+	Tags        []string `json:"tags"`
+	// AllowedContentTypes lists the file types the table accepts; empty
+	// means the server's default upload policy applies.
+	AllowedContentTypes []string `json:"allowed_content_types,omitempty"`
+	// ForkedFrom is the table this one was forked from, and SyncedAt when
+	// it last pulled that table's documents.
+	ForkedFrom string     `json:"forked_from,omitempty"`
+	SyncedAt   *time.Time `json:"synced_at,omitempty"`
+	// ForkCount is the number of tables forked from this one, and StarCount
+	// the number of users who starred it.
+	ForkCount int `json:"fork_count"`
+	StarCount int `json:"star_count"`
+	// EmbeddingModel is the model the table's chunks are embedded with, and
+	// EmbeddingVersion its version, which selects the index they are in.
+	EmbeddingModel   string `json:"embedding_model"`
+	EmbeddingVersion int    `json:"embedding_version"`
 }
 
-var (
-	database   = os.Getenv("BLUEPRINT_DB_DATABASE")
-	password   = os.Getenv("BLUEPRINT_DB_PASSWORD")
-	username   = os.Getenv("BLUEPRINT_DB_USERNAME")
-	port       = os.Getenv("BLUEPRINT_DB_PORT")
-	host       = os.Getenv("BLUEPRINT_DB_HOST")
-	schema     = os.Getenv("BLUEPRINT_DB_SCHEMA")
-	dbInstance *service
-)
+// tableColumns selects a UserTable from user_tables aliased as t.
+const tableColumns = `t.user_id, t.table_id, t.table_name, t.public, t.description, t.tags, t.allowed_content_types,
+	COALESCE(t.forked_from, ''), t.synced_at,
+	(SELECT COUNT(*) FROM user_tables f WHERE f.forked_from = t.table_id),
+	(SELECT COUNT(*) FROM table_stars st WHERE st.table_id = t.table_id),
+	t.embedding_model, t.embedding_version`
+
+func scanTable(row interface{ Scan(...interface{}) error }, table *UserTable) error {
+	var tags, contentTypes string
+	var syncedAt sql.NullTime
+	err := row.Scan(&table.UserID, &table.TableID, &table.TableName, &table.IsPublic, &table.Description, &tags, &contentTypes,
+		&table.ForkedFrom, &syncedAt, &table.ForkCount, &table.StarCount, &table.EmbeddingModel, &table.EmbeddingVersion)
+	if err != nil {
+		return err
+	}
+	table.Tags = splitList(tags)
+	table.AllowedContentTypes = splitList(contentTypes)
+	if syncedAt.Valid {
+		table.SyncedAt = &syncedAt.Time
+	}
+	return nil
+}
+
+var dbInstance *service
 
-func New() Service {
+// New connects to the database cfg locates. Later calls reuse the first
+// connection.
+func New(cfg config.Database) Service {
 	// Reuse Connection
 	if dbInstance != nil {
 		return dbInstance
 	}
-	connStr := fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=disable&search_path=%s", username, password, host, port, database, schema)
-	db, err := sql.Open("pgx", connStr)
+	connStr := fmt.Sprintf("postgres://%s:%s@%s:%d/%s?sslmode=disable&search_path=%s", cfg.Username, cfg.Password, cfg.Host, cfg.Port, cfg.Name, cfg.Schema)
+	// Queries made with a traced context show up as spans of their own
+	db, err := otelsql.Open("pgx", connStr,
+		otelsql.WithAttributes(semconv.DBSystemPostgreSQL),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{OmitConnResetSession: true, OmitRows: true}),
+	)
 	if err != nil {
 		log.Fatal(err)
 	}
 	dbInstance = &service{
-		db: db,
+		db:   db,
+		name: cfg.Name,
 	}
 	return dbInstance
 }
 
+// Stats returns the statistics of the connection pool.
+func (s *service) Stats() sql.DBStats {
+	return s.db.Stats()
+}
+
+// Ping checks that the database can be reached.
+func (s *service) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
 // Health checks the health of the database connection by pinging the database.
 // It returns a map with keys indicating various health statistics.
 func (s *service) Health() map[string]string {
@@ -89,7 +289,7 @@ func (s *service) Health() map[string]string {
 	if err != nil {
 		stats["status"] = "down"
 		stats["error"] = fmt.Sprintf("db down: %v", err)
-		log.Fatalf("db down: %v", err) // Log the error and terminate the program
+		slog.Error("Database down", "err", err)
 		return stats
 	}
 
@@ -132,13 +332,12 @@ func (s *service) Health() map[string]string {
 // If the connection is successfully closed, it returns nil.
 // If an error occurs while closing the connection, it returns the error.
 func (s *service) Close() error {
-	log.Printf("Disconnected from database: %s", database)
+	slog.Info("Disconnected from database", "database", s.name)
 	return s.db.Close()
 }
 
 // CreateUserTable inserts a new record into the user_tables table
 func (s *service) CreateUserTable(ctx context.Context, userID, tableName string, isPublic bool) (string, error) {
-	fmt.Println("dbcreate 1")
 	tableID := uuid.New().String()
 	
 	query := `
@@ -149,7 +348,7 @@ func (s *service) CreateUserTable(ctx context.Context, userID, tableName string,
 	var returnedTableID string
 	err := s.db.QueryRowContext(ctx, query, userID, tableID, tableName, isPublic).Scan(&returnedTableID)
 	if err != nil {
-		return "", fmt.Errorf("failed to create user table: %v", err)
+		return "", queryError("failed to create user table", err)
 	}
 	
 	return returnedTableID, nil
@@ -158,10 +357,10 @@ func (s *service) CreateUserTable(ctx context.Context, userID, tableName string,
 // GetUserTables retrieves all tables for a given user from the database
 func (s *service) GetUserTables(ctx context.Context, userID string) ([]UserTable, error) {
 	query := `
-		SELECT table_id, table_name, public
-		FROM user_tables
-		WHERE user_id = $1
-		ORDER BY table_name`
+		SELECT ` + tableColumns + `
+		FROM user_tables t
+		WHERE t.user_id = $1
+		ORDER BY t.table_name`
 
 	rows, err := s.db.QueryContext(ctx, query, userID)
 	if err != nil {
@@ -172,7 +371,7 @@ func (s *service) GetUserTables(ctx context.Context, userID string) ([]UserTable
 	var tables []UserTable
 	for rows.Next() {
 		var table UserTable
-		if err := rows.Scan(&table.TableID, &table.TableName, &table.IsPublic); err != nil {
+		if err := scanTable(rows, &table); err != nil {
 			return nil, fmt.Errorf("failed to scan user table row: %v", err)
 		}
 		tables = append(tables, table)
@@ -205,13 +404,13 @@ func (s *service) TableExists(ctx context.Context, userID, tableName string) (bo
 // GetTableByID retrieves a table by its ID from the database
 func (s *service) GetTableByID(ctx context.Context, tableID string) (*UserTable, error) {
 	query := `
-		SELECT table_id, table_name, public
-		FROM user_tables
-		WHERE table_id = $1
+		SELECT ` + tableColumns + `
+		FROM user_tables t
+		WHERE t.table_id = $1
 	`
 
 	var table UserTable
-	err := s.db.QueryRowContext(ctx, query, tableID).Scan(&table.TableID, &table.TableName, &table.IsPublic)
+	err := scanTable(s.db.QueryRowContext(ctx, query, tableID), &table)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -225,19 +424,33 @@ func (s *service) GetTableByID(ctx context.Context, tableID string) (*UserTable,
 // UpdateTableVisibility updates the visibility of a table in the database
 func (s *service) UpdateTableVisibility(ctx context.Context, tableID string, isPublic bool) error {
 	query := `UPDATE user_tables SET public = $1 WHERE table_id = $2`
-	result, err := s.db.ExecContext(ctx, query, isPublic, tableID)
-	if err != nil {
-		return err
-	}
+	return s.execOne(ctx, "table", query, isPublic, tableID)
+}
 
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		return err
-	}
+// UpdateTableContentTypes sets the file types a table accepts
+func (s *service) UpdateTableContentTypes(ctx context.Context, tableID string, contentTypes []string) error {
+	query := `UPDATE user_tables SET allowed_content_types = $1, updated_at = CURRENT_TIMESTAMP WHERE table_id = $2`
+	return s.execOne(ctx, "table", query, strings.Join(contentTypes, ","), tableID)
+}
 
-	if rowsAffected == 0 {
-		return fmt.Errorf("table not found")
-	}
+// SetTableEmbedding records the embedding model and version a table's chunks
+// are embedded with
+func (s *service) SetTableEmbedding(ctx context.Context, tableID, model string, version int) error {
+	query := `UPDATE user_tables SET embedding_model = $1, embedding_version = $2, updated_at = CURRENT_TIMESTAMP WHERE table_id = $3`
+	return s.execOne(ctx, "table", query, model, version, tableID)
+}
 
-	return nil
+// DeleteTable removes a table. Its documents, jobs, extracted tables and stars
+// go with it through their foreign keys, and forks of it become independent.
+func (s *service) DeleteTable(ctx context.Context, tableID string) error {
+	query := `DELETE FROM user_tables WHERE table_id = $1`
+	return s.execOne(ctx, "table", query, tableID)
+}
+
+// splitList splits a comma separated column into its values
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
 }
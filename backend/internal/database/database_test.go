@@ -2,15 +2,27 @@ package database
 
 import (
 	"context"
+	"database/sql"
+	"errors"
+	"fmt"
 	"log"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/google/uuid"
+
 	"github.com/testcontainers/testcontainers-go"
 	"github.com/testcontainers/testcontainers-go/modules/postgres"
 	"github.com/testcontainers/testcontainers-go/wait"
+
+	"backend/internal/config"
 )
 
+// testConfig locates the database started for the tests.
+var testConfig config.Database
+
 func mustStartPostgresContainer() (func(context.Context) error, error) {
 	var (
 		dbName = "database"
@@ -32,25 +44,29 @@ func mustStartPostgresContainer() (func(context.Context) error, error) {
 	if err != nil {
 		return nil, err
 	}
+	terminate := func(ctx context.Context) error {
+		return dbContainer.Terminate(ctx)
+	}
 
-	database = dbName
-	password = dbPwd
-	username = dbUser
+	testConfig.Name = dbName
+	testConfig.Password = dbPwd
+	testConfig.Username = dbUser
+	testConfig.Schema = "public"
 
 	dbHost, err := dbContainer.Host(context.Background())
 	if err != nil {
-		return dbContainer.Terminate, err
+		return terminate, err
 	}
 
 	dbPort, err := dbContainer.MappedPort(context.Background(), "5432/tcp")
 	if err != nil {
-		return dbContainer.Terminate, err
+		return terminate, err
 	}
 
-	host = dbHost
-	port = dbPort.Port()
+	testConfig.Host = dbHost
+	testConfig.Port = dbPort.Int()
 
-	return dbContainer.Terminate, err
+	return terminate, err
 }
 
 func TestMain(m *testing.M) {
@@ -58,6 +74,9 @@ func TestMain(m *testing.M) {
 	if err != nil {
 		log.Fatalf("could not start postgres container: %v", err)
 	}
+	if err := applyMigrations(); err != nil {
+		log.Fatalf("could not apply migrations: %v", err)
+	}
 
 	m.Run()
 
@@ -66,15 +85,324 @@ func TestMain(m *testing.M) {
 	}
 }
 
+// applyMigrations creates the schema the server runs against.
+func applyMigrations() error {
+	files, err := filepath.Glob(filepath.Join("..", "..", "migrations", "*.sql"))
+	if err != nil {
+		return err
+	}
+	db, err := sql.Open("pgx", testConnString())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// The files are numbered in the order they apply
+	for _, file := range files {
+		migration, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if _, err := db.Exec(string(migration)); err != nil {
+			return fmt.Errorf("%s: %v", filepath.Base(file), err)
+		}
+	}
+	return nil
+}
+
+func testConnString() string {
+	return fmt.Sprintf("postgres://%s:%s@%s:%d/%s?sslmode=disable&search_path=%s", testConfig.Username, testConfig.Password, testConfig.Host, testConfig.Port, testConfig.Name, testConfig.Schema)
+}
+
+// newTestService connects to the test database without sharing the
+// connection New keeps, which TestClose closes.
+func newTestService(t *testing.T) *service {
+	t.Helper()
+	db, err := sql.Open("pgx", testConnString())
+	if err != nil {
+		t.Fatalf("error connecting to the database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return &service{db: db, name: testConfig.Name}
+}
+
+func TestUploadParts(t *testing.T) {
+	s := newTestService(t)
+	ctx := context.Background()
+
+	upload, err := s.CreateUpload(ctx, "alice-"+uuid.NewString(), "a.pdf", "", 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AppendUploadPart(ctx, upload.UploadID, 0, 10, "tus/a/1"); err != nil {
+		t.Fatal(err)
+	}
+	// A second request continuing from the same offset loses
+	if err := s.AppendUploadPart(ctx, upload.UploadID, 0, 5, "tus/a/2"); !errors.Is(err, ErrConflict) {
+		t.Errorf("AppendUploadPart at a stale offset = %v; want ErrConflict", err)
+	}
+	if err := s.AppendUploadPart(ctx, upload.UploadID, 10, 20, "tus/a/3"); err != nil {
+		t.Fatal(err)
+	}
+
+	parts, err := s.GetUploadParts(ctx, upload.UploadID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []UploadPart{{0, 10, "tus/a/1"}, {10, 20, "tus/a/3"}}
+	if fmt.Sprint(parts) != fmt.Sprint(want) {
+		t.Errorf("parts = %v; want %v", parts, want)
+	}
+	got, err := s.GetUpload(ctx, upload.UploadID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Offset != 30 {
+		t.Errorf("offset = %d; want 30", got.Offset)
+	}
+
+	if err := s.CompleteUpload(ctx, upload.UploadID, "a/a.pdf", "application/pdf", "sum"); err != nil {
+		t.Fatal(err)
+	}
+	if parts, _ := s.GetUploadParts(ctx, upload.UploadID); len(parts) != 0 {
+		t.Errorf("parts of a completed upload = %v; want none", parts)
+	}
+	if err := s.CompleteUpload(ctx, upload.UploadID, "b/a.pdf", "application/pdf", "sum"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("completing twice = %v; want ErrNotFound", err)
+	}
+	if err := s.AppendUploadPart(ctx, upload.UploadID, 30, 1, "tus/a/4"); !errors.Is(err, ErrConflict) {
+		t.Errorf("AppendUploadPart to a completed upload = %v; want ErrConflict", err)
+	}
+}
+
+func TestListPublicTablesPaging(t *testing.T) {
+	s := newTestService(t)
+	ctx := context.Background()
+
+	// A tag of its own keeps tables other tests create out of the pages
+	userID, tag := "alice-"+uuid.NewString(), uuid.NewString()
+	for i, public := range []bool{true, true, false, true} {
+		tableID, err := s.CreateUserTable(ctx, userID, fmt.Sprintf("papers %d", i), public)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.UpdateTableDetails(ctx, tableID, "", []string{tag}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for offset, want := range []int{2, 1, 0} {
+		page, err := s.ListPublicTables(ctx, PublicTableQuery{Tags: []string{tag}, Limit: 2, Offset: offset * 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) != want {
+			t.Errorf("page %d has %d tables; want %d", offset, len(page), want)
+		}
+		for _, table := range page {
+			if seen[table.TableID] {
+				t.Errorf("table %s listed on two pages", table.TableID)
+			}
+			seen[table.TableID] = true
+			if table.TableName == "papers 2" {
+				t.Errorf("private table %s listed", table.TableID)
+			}
+		}
+	}
+	if len(seen) != 3 {
+		t.Errorf("pages list %d tables; want the 3 public ones", len(seen))
+	}
+}
+
+func TestGetFeed(t *testing.T) {
+	s := newTestService(t)
+	ctx := context.Background()
+
+	alice, bob := "alice-"+uuid.NewString(), "bob-"+uuid.NewString()
+	tableID, err := s.CreateUserTable(ctx, alice, "papers", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AddTableDocument(ctx, tableID, alice, "before.pdf", "a/before.pdf", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.StarTable(ctx, bob, tableID); err != nil {
+		t.Fatal(err)
+	}
+	added, err := s.AddTableDocument(ctx, tableID, alice, "after.pdf", "a/after.pdf", "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only what the owner adds is news
+	if _, err := s.AddTableDocument(ctx, tableID, bob, "other.pdf", "b/other.pdf", "3"); err != nil {
+		t.Fatal(err)
+	}
+
+	feed, err := s.GetFeed(ctx, bob, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(feed) != 1 || feed[0].DocumentID != added.DocumentID || feed[0].TableName != "papers" {
+		t.Errorf("feed = %+v; want only after.pdf", feed)
+	}
+
+	if err := s.UpdateTableVisibility(ctx, tableID, false); err != nil {
+		t.Fatal(err)
+	}
+	if feed, err := s.GetFeed(ctx, bob, 10); err != nil || len(feed) != 0 {
+		t.Errorf("feed of a table made private = %+v, %v; want none", feed, err)
+	}
+}
+
+func TestTableEvents(t *testing.T) {
+	s := newTestService(t)
+	ctx := context.Background()
+
+	alice := "alice-" + uuid.NewString()
+	tableID, err := s.CreateUserTable(ctx, alice, "papers", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, action := range []string{EventTableCreated, EventDocumentAdded, EventVisibilityChanged} {
+		event := TableEvent{TableID: tableID, ActorID: alice, Action: action, Metadata: map[string]interface{}{"action": action}}
+		if err := s.RecordTableEvent(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	page, err := s.GetTableEvents(ctx, tableID, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 2 || page[0].Action != EventVisibilityChanged || page[1].Action != EventDocumentAdded {
+		t.Fatalf("first page = %+v; want the 2 newest events", page)
+	}
+	if page[0].Metadata["action"] != EventVisibilityChanged {
+		t.Errorf("metadata = %v; want it stored with the event", page[0].Metadata)
+	}
+	page, err = s.GetTableEvents(ctx, tableID, page[1].EventID, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 1 || page[0].Action != EventTableCreated {
+		t.Errorf("second page = %+v; want the oldest event", page)
+	}
+
+	// Events of the tables a user owns are theirs whoever performed them
+	if err := s.RecordTableEvent(ctx, TableEvent{TableID: tableID, ActorID: "bob", Action: EventTableForked}); err != nil {
+		t.Fatal(err)
+	}
+	if events, err := s.GetUserEvents(ctx, alice, 0, 10); err != nil || len(events) != 4 {
+		t.Errorf("user events = %+v, %v; want all 4", events, err)
+	}
+}
+
+func TestTakeRateLimitToken(t *testing.T) {
+	s := newTestService(t)
+	ctx := context.Background()
+
+	key, interval := "search:ip:"+uuid.NewString(), 200*time.Millisecond
+	for i := 0; i < 2; i++ {
+		if wait, err := s.TakeRateLimitToken(ctx, key, interval, 2); err != nil || wait != 0 {
+			t.Fatalf("take %d = %s, %v; want a token from the full bucket", i, wait, err)
+		}
+	}
+	wait, err := s.TakeRateLimitToken(ctx, key, interval, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait <= 0 || wait > interval {
+		t.Fatalf("take from an empty bucket = %s; want a wait of up to %s", wait, interval)
+	}
+
+	// The bucket gains a token every interval
+	time.Sleep(wait + 20*time.Millisecond)
+	if wait, err := s.TakeRateLimitToken(ctx, key, interval, 2); err != nil || wait != 0 {
+		t.Errorf("take after refilling = %s, %v; want a token", wait, err)
+	}
+	if wait, err := s.TakeRateLimitToken(ctx, key, interval, 2); err != nil || wait <= 0 {
+		t.Errorf("take after the refilled token = %s, %v; want a wait", wait, err)
+	}
+}
+
+func TestDeleteQueryEmbeddings(t *testing.T) {
+	s := newTestService(t)
+	ctx := context.Background()
+
+	old, fresh := "old-"+uuid.NewString(), "fresh-"+uuid.NewString()
+	for _, key := range []string{old, fresh} {
+		if err := s.PutQueryEmbedding(ctx, key, "m1", []float32{0.5, -1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.db.ExecContext(ctx, `UPDATE query_embeddings SET created_at = now() - interval '2 hours' WHERE key = $1`, old); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.DeleteQueryEmbeddings(ctx, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	// A longer maxAge than the TTL would find the old one had it been kept
+	if got, err := s.GetQueryEmbedding(ctx, old, 24*time.Hour); err != nil || got != nil {
+		t.Errorf("embedding older than the TTL = %v, %v; want it deleted", got, err)
+	}
+	got, err := s.GetQueryEmbedding(ctx, fresh, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(got) != fmt.Sprint([]float32{0.5, -1}) {
+		t.Errorf("fresh embedding = %v; want it kept", got)
+	}
+}
+
+func TestTableLocks(t *testing.T) {
+	s := newTestService(t)
+	ctx := context.Background()
+
+	tableID, err := s.CreateUserTable(ctx, "alice-"+uuid.NewString(), "papers", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if taken, err := s.AcquireTableLock(ctx, tableID, "a", 200*time.Millisecond); err != nil || !taken {
+		t.Fatalf("AcquireTableLock = %v, %v; want the free lock taken", taken, err)
+	}
+	if taken, err := s.AcquireTableLock(ctx, tableID, "b", time.Minute); err != nil || taken {
+		t.Fatalf("AcquireTableLock of a held lock = %v, %v; want false", taken, err)
+	}
+	if err := s.RenewTableLock(ctx, tableID, "b", time.Minute); !errors.Is(err, ErrNotFound) {
+		t.Errorf("RenewTableLock by another holder = %v; want ErrNotFound", err)
+	}
+
+	// A lock its holder stopped renewing frees itself
+	time.Sleep(250 * time.Millisecond)
+	if taken, err := s.AcquireTableLock(ctx, tableID, "b", time.Minute); err != nil || !taken {
+		t.Fatalf("AcquireTableLock of an expired lock = %v, %v; want it taken", taken, err)
+	}
+	// Releasing a lock taken over by another holder leaves it held
+	if err := s.ReleaseTableLock(ctx, tableID, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if taken, _ := s.AcquireTableLock(ctx, tableID, "c", time.Minute); taken {
+		t.Error("lock released by a former holder")
+	}
+	if err := s.ReleaseTableLock(ctx, tableID, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if taken, err := s.AcquireTableLock(ctx, tableID, "c", time.Minute); err != nil || !taken {
+		t.Errorf("AcquireTableLock after release = %v, %v; want it taken", taken, err)
+	}
+}
+
 func TestNew(t *testing.T) {
-	srv := New()
+	srv := New(testConfig)
 	if srv == nil {
 		t.Fatal("New() returned nil")
 	}
 }
 
 func TestHealth(t *testing.T) {
-	srv := New()
+	srv := New(testConfig)
 
 	stats := srv.Health()
 
@@ -92,7 +420,7 @@ func TestHealth(t *testing.T) {
 }
 
 func TestClose(t *testing.T) {
-	srv := New()
+	srv := New(testConfig)
 
 	if srv.Close() != nil {
 		t.Fatalf("expected Close() to return nil")
@@ -0,0 +1,134 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Orders of the public table directory
+const (
+	PublicTableSortRecent  = "recent"
+	PublicTableSortPopular = "popular"
+)
+
+// PublicTable is an entry of the public table directory.
+type PublicTable struct {
+	TableID     string   `json:"table_id"`
+	TableName   string   `json:"table_name"`
+	Description string   `json:"description"`
+	Tags        []string `json:"tags"`
+	// OwnerName is the owner's display name, empty if they have not set one.
+	OwnerName     string    `json:"owner_display_name"`
+	DocumentCount int       `json:"document_count"`
+	ForkCount     int       `json:"fork_count"`
+	StarCount     int       `json:"star_count"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// publicTableSelect selects PublicTables from user_tables aliased as t; the
+// query it starts must go on with WHERE conditions and publicTableGroupBy. A
+// table was last updated when it or any of its documents last changed.
+const publicTableSelect = `
+	SELECT t.table_id, t.table_name, t.description, t.tags,
+		COALESCE(p.display_name, ''),
+		COUNT(d.document_id) AS document_count,
+		(SELECT COUNT(*) FROM user_tables f WHERE f.forked_from = t.table_id) AS fork_count,
+		(SELECT COUNT(*) FROM table_stars st WHERE st.table_id = t.table_id) AS star_count,
+		GREATEST(t.updated_at, MAX(d.updated_at)) AS updated_at
+	FROM user_tables t
+	LEFT JOIN user_profiles p ON p.user_id = t.user_id
+	LEFT JOIN table_documents d ON d.table_id = t.table_id`
+
+const publicTableGroupBy = `
+	GROUP BY t.table_id, t.table_name, t.description, t.tags, t.updated_at, p.display_name`
+
+// queryPublicTables runs a query started with publicTableSelect.
+func (s *service) queryPublicTables(ctx context.Context, query string, args ...interface{}) ([]PublicTable, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query public tables: %v", err)
+	}
+	defer rows.Close()
+
+	tables := []PublicTable{}
+	for rows.Next() {
+		var table PublicTable
+		var tags string
+		if err := rows.Scan(&table.TableID, &table.TableName, &table.Description, &tags,
+			&table.OwnerName, &table.DocumentCount, &table.ForkCount, &table.StarCount, &table.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan public table row: %v", err)
+		}
+		table.Tags = splitList(tags)
+		tables = append(tables, table)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating public table rows: %v", err)
+	}
+
+	return tables, nil
+}
+
+// PublicTableQuery selects a page of the public table directory.
+type PublicTableQuery struct {
+	// Search matches words of table names and descriptions.
+	Search string
+	// Tags restricts the directory to tables carrying all of them.
+	Tags   []string
+	Sort   string
+	Limit  int
+	Offset int
+}
+
+// UpdateTableDetails sets the description and tags of a table
+func (s *service) UpdateTableDetails(ctx context.Context, tableID, description string, tags []string) error {
+	query := `UPDATE user_tables SET description = $1, tags = $2, updated_at = CURRENT_TIMESTAMP WHERE table_id = $3`
+	return s.execOne(ctx, "table", query, description, strings.Join(tags, ","), tableID)
+}
+
+// ListPublicTables retrieves a page of public tables matching query. Popular
+// tables are those starred, then forked, the most.
+func (s *service) ListPublicTables(ctx context.Context, query PublicTableQuery) ([]PublicTable, error) {
+	var where []string
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	where = append(where, "t.public")
+	if query.Search != "" {
+		where = append(where, fmt.Sprintf(
+			"to_tsvector('simple', t.table_name || ' ' || t.description) @@ plainto_tsquery('simple', %s)", arg(query.Search)))
+	}
+	for _, tag := range query.Tags {
+		where = append(where, fmt.Sprintf("%s = ANY(string_to_array(t.tags, ','))", arg(tag)))
+	}
+
+	order := "updated_at DESC"
+	if query.Sort == PublicTableSortPopular {
+		order = "star_count DESC, fork_count DESC, updated_at DESC"
+	}
+
+	sqlQuery := publicTableSelect + `
+		WHERE ` + strings.Join(where, " AND ") + publicTableGroupBy + `
+		ORDER BY ` + order + `, t.table_id
+		LIMIT ` + arg(query.Limit) + ` OFFSET ` + arg(query.Offset)
+
+	return s.queryPublicTables(ctx, sqlQuery, args...)
+}
+
+// SetDisplayName sets the name a user is shown under as a table owner
+func (s *service) SetDisplayName(ctx context.Context, userID, displayName string) error {
+	query := `
+		INSERT INTO user_profiles (user_id, display_name)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET display_name = EXCLUDED.display_name, updated_at = CURRENT_TIMESTAMP`
+
+	if _, err := s.db.ExecContext(ctx, query, userID, displayName); err != nil {
+		return fmt.Errorf("failed to set display name: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// TableDocument is an uploaded file registered in a table. FilePath points at
+// the stored original so the document can be ingested again later.
+type TableDocument struct {
+	DocumentID string `json:"document_id"`
+	TableID    string `json:"table_id"`
+	UserID     string `json:"-"`
+	FileName   string `json:"file_name"`
+	FilePath   string `json:"file_path"`
+	SHA256     string `json:"sha256,omitempty"`
+	// SourceDocumentID is the upstream document a forked document copies.
+	SourceDocumentID string `json:"source_document_id,omitempty"`
+	// Ingested is set once the document's chunks are indexed.
+	Ingested  bool      `json:"ingested"`
+	CreatedAt time.Time `json:"created_at"`
+	// UpdatedAt changes whenever the document is ingested again.
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+const documentColumns = `document_id, table_id, user_id, file_name, file_path, sha256, source_document_id, ingested, created_at, updated_at`
+
+func scanDocument(row interface{ Scan(...interface{}) error }, doc *TableDocument) error {
+	return row.Scan(&doc.DocumentID, &doc.TableID, &doc.UserID, &doc.FileName, &doc.FilePath, &doc.SHA256,
+		&doc.SourceDocumentID, &doc.Ingested, &doc.CreatedAt, &doc.UpdatedAt)
+}
+
+// AddTableDocument inserts a new record into the table_documents table
+func (s *service) AddTableDocument(ctx context.Context, tableID, userID, fileName, filePath, sha256 string) (*TableDocument, error) {
+	doc := TableDocument{
+		DocumentID: uuid.New().String(),
+		TableID:    tableID,
+		UserID:     userID,
+		FileName:   fileName,
+		FilePath:   filePath,
+		SHA256:     sha256,
+	}
+
+	query := `
+		INSERT INTO table_documents (document_id, table_id, user_id, file_name, file_path, sha256)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING created_at, updated_at`
+
+	err := s.db.QueryRowContext(ctx, query, doc.DocumentID, tableID, userID, fileName, filePath, sha256).Scan(&doc.CreatedAt, &doc.UpdatedAt)
+	if err != nil {
+		return nil, queryError("failed to add table document", err)
+	}
+
+	return &doc, nil
+}
+
+// GetTableDocuments retrieves all documents registered in a table
+func (s *service) GetTableDocuments(ctx context.Context, tableID string) ([]TableDocument, error) {
+	query := `
+		SELECT ` + documentColumns + `
+		FROM table_documents
+		WHERE table_id = $1
+		ORDER BY created_at`
+
+	rows, err := s.db.QueryContext(ctx, query, tableID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query table documents: %v", err)
+	}
+	defer rows.Close()
+
+	var docs []TableDocument
+	for rows.Next() {
+		var doc TableDocument
+		if err := scanDocument(rows, &doc); err != nil {
+			return nil, fmt.Errorf("failed to scan table document row: %v", err)
+		}
+		docs = append(docs, doc)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating table document rows: %v", err)
+	}
+
+	return docs, nil
+}
+
+// GetTableDocument retrieves a single document by its ID
+func (s *service) GetTableDocument(ctx context.Context, documentID string) (*TableDocument, error) {
+	query := `
+		SELECT ` + documentColumns + `
+		FROM table_documents
+		WHERE document_id = $1`
+	return s.queryDocument(ctx, query, documentID)
+}
+
+// GetTableDocumentByHash retrieves the document of a table with the given content hash
+func (s *service) GetTableDocumentByHash(ctx context.Context, tableID, sha256 string) (*TableDocument, error) {
+	query := `
+		SELECT ` + documentColumns + `
+		FROM table_documents
+		WHERE table_id = $1 AND sha256 = $2 AND sha256 <> ''`
+	return s.queryDocument(ctx, query, tableID, sha256)
+}
+
+// FindIngestedDocumentByHash retrieves the oldest ingested document, in any
+// table, with the given content hash
+func (s *service) FindIngestedDocumentByHash(ctx context.Context, sha256 string) (*TableDocument, error) {
+	query := `
+		SELECT ` + documentColumns + `
+		FROM table_documents
+		WHERE sha256 = $1 AND sha256 <> '' AND ingested
+		ORDER BY created_at
+		LIMIT 1`
+	return s.queryDocument(ctx, query, sha256)
+}
+
+// MarkDocumentIngested records that a document's chunks are indexed
+func (s *service) MarkDocumentIngested(ctx context.Context, documentID string) error {
+	query := `UPDATE table_documents SET ingested = true, updated_at = CURRENT_TIMESTAMP WHERE document_id = $1`
+	return s.execOne(ctx, "document", query, documentID)
+}
+
+// queryDocument runs a query returning at most one document
+func (s *service) queryDocument(ctx context.Context, query string, args ...interface{}) (*TableDocument, error) {
+	var doc TableDocument
+	err := scanDocument(s.db.QueryRowContext(ctx, query, args...), &doc)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting table document: %v", err)
+	}
+
+	return &doc, nil
+}
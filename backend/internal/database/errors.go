@@ -0,0 +1,43 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Errors the service's methods wrap, so callers can tell why an operation
+// failed with errors.Is rather than by its message
+var (
+	// ErrNotFound means the record an operation applies to does not exist
+	ErrNotFound = errors.New("not found")
+	// ErrConflict means a record with the same unique key already exists
+	ErrConflict = errors.New("already exists")
+	// ErrForbidden means the user may not perform the operation
+	ErrForbidden = errors.New("forbidden")
+	// ErrInvalid means a record to be stored is malformed
+	ErrInvalid = errors.New("invalid")
+)
+
+// Postgres error codes of constraint violations
+const (
+	foreignKeyViolation = "23503"
+	uniqueViolation     = "23505"
+)
+
+// queryError describes err, the failure of the operation what, wrapping
+// ErrConflict for unique key violations and ErrNotFound for rows that
+// reference a record that does not exist.
+func queryError(what string, err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case uniqueViolation:
+			return fmt.Errorf("%s: %w: %v", what, ErrConflict, err)
+		case foreignKeyViolation:
+			return fmt.Errorf("%s: %w: %v", what, ErrNotFound, err)
+		}
+	}
+	return fmt.Errorf("%s: %v", what, err)
+}
@@ -0,0 +1,115 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Actions recorded in the table event log
+const (
+	EventTableCreated        = "table.created"
+	EventTableImported       = "table.imported"
+	EventTableForked         = "table.forked"
+	EventUpstreamPulled      = "table.pulled"
+	EventVisibilityChanged   = "table.visibility_changed"
+	EventContentTypesChanged = "table.content_types_changed"
+	EventDetailsChanged      = "table.details_changed"
+	EventTableReindexed      = "table.reindexed"
+	EventEmbeddingsMigrated  = "table.embeddings_migrated"
+	EventTableDeleted        = "table.deleted"
+	EventDocumentAdded       = "document.added"
+	EventDocumentReindexed   = "document.reindexed"
+)
+
+// TableEvent is an entry of the append-only log of changes made to tables:
+// who (ActorID) did what (Action) to which table and, for actions on a part
+// of it such as a document, which part (Target).
+type TableEvent struct {
+	EventID   int64                  `json:"event_id"`
+	TableID   string                 `json:"table_id"`
+	ActorID   string                 `json:"actor_id"`
+	Action    string                 `json:"action"`
+	Target    string                 `json:"target,omitempty"`
+	Metadata  map[string]interface{} `json:"metadata,omitempty"`
+	CreatedAt time.Time              `json:"created_at"`
+}
+
+// RecordTableEvent appends an event to the table event log
+func (s *service) RecordTableEvent(ctx context.Context, event TableEvent) error {
+	metadata := []byte("{}")
+	if len(event.Metadata) > 0 {
+		var err error
+		if metadata, err = json.Marshal(event.Metadata); err != nil {
+			return fmt.Errorf("failed to encode event metadata: %v", err)
+		}
+	}
+
+	query := `
+		INSERT INTO table_events (table_id, actor_id, action, target, metadata)
+		VALUES ($1, $2, $3, $4, $5)`
+
+	if _, err := s.db.ExecContext(ctx, query, event.TableID, event.ActorID, event.Action, event.Target, metadata); err != nil {
+		return fmt.Errorf("failed to record table event: %v", err)
+	}
+	return nil
+}
+
+// GetTableEvents retrieves up to limit events of a table older than the event
+// before, newest first. A before of 0 starts from the newest event.
+func (s *service) GetTableEvents(ctx context.Context, tableID string, before int64, limit int) ([]TableEvent, error) {
+	query := `
+		SELECT ` + eventColumns + `
+		FROM table_events
+		WHERE table_id = $1 AND ($2 = 0 OR id < $2)
+		ORDER BY id DESC
+		LIMIT $3`
+
+	return s.queryTableEvents(ctx, query, tableID, before, limit)
+}
+
+// GetUserEvents retrieves up to limit events older than the event before
+// that a user either performed or that happened to tables they own, newest
+// first. A before of 0 starts from the newest event.
+func (s *service) GetUserEvents(ctx context.Context, userID string, before int64, limit int) ([]TableEvent, error) {
+	query := `
+		SELECT ` + eventColumns + `
+		FROM table_events
+		WHERE (actor_id = $1 OR table_id IN (SELECT table_id FROM user_tables WHERE user_id = $1))
+			AND ($2 = 0 OR id < $2)
+		ORDER BY id DESC
+		LIMIT $3`
+
+	return s.queryTableEvents(ctx, query, userID, before, limit)
+}
+
+const eventColumns = `id, table_id, actor_id, action, target, metadata, created_at`
+
+func (s *service) queryTableEvents(ctx context.Context, query string, args ...interface{}) ([]TableEvent, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query table events: %v", err)
+	}
+	defer rows.Close()
+
+	events := []TableEvent{}
+	for rows.Next() {
+		var event TableEvent
+		var metadata []byte
+		if err := rows.Scan(&event.EventID, &event.TableID, &event.ActorID, &event.Action,
+			&event.Target, &metadata, &event.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan table event row: %v", err)
+		}
+		if err := json.Unmarshal(metadata, &event.Metadata); err != nil {
+			return nil, fmt.Errorf("failed to decode event metadata: %v", err)
+		}
+		events = append(events, event)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating table event rows: %v", err)
+	}
+
+	return events, nil
+}
@@ -0,0 +1,245 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ExtractedTable is a table the partitioner found in a document, with the
+// structure of its cells.
+type ExtractedTable struct {
+	ElementID  string `json:"element_id"`
+	DocumentID string `json:"document_id"`
+	TableID    string `json:"table_id"`
+	// FileName is the name of the document the table was found in.
+	FileName string `json:"file_name"`
+	// Index orders the tables of a document.
+	Index      int       `json:"index"`
+	PageNumber int       `json:"page_number"`
+	Caption    string    `json:"caption,omitempty"`
+	BBox       []float64 `json:"bbox,omitempty"`
+	NumRows    int       `json:"num_rows"`
+	NumCols    int       `json:"num_cols"`
+	// Cells is only loaded when a single table is retrieved.
+	Cells     []TableCell `json:"cells,omitempty"`
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+// TableCell is a cell of an extracted table. A cell spanning several rows or
+// columns lists all of them.
+type TableCell struct {
+	Content  string `json:"content"`
+	Rows     []int  `json:"rows"`
+	Cols     []int  `json:"cols"`
+	IsHeader bool   `json:"is_header,omitempty"`
+}
+
+// MaxTableCells bounds the rows times columns of an extracted table, so that
+// laying its cells out as a grid takes bounded memory
+const MaxTableCells = 1 << 20
+
+// GridSize returns the number of rows and columns the cells of t span, which
+// may exceed what t declares
+func (t *ExtractedTable) GridSize() (rows, cols int) {
+	rows, cols = t.NumRows, t.NumCols
+	for _, c := range t.Cells {
+		for _, row := range c.Rows {
+			rows = max(rows, row+1)
+		}
+		for _, col := range c.Cols {
+			cols = max(cols, col+1)
+		}
+	}
+	return rows, cols
+}
+
+// Validate checks that the cells of t have no negative indices and that its
+// grid has at most MaxTableCells cells, wrapping ErrInvalid otherwise
+func (t *ExtractedTable) Validate() error {
+	if t.NumRows < 0 || t.NumCols < 0 {
+		return fmt.Errorf("extracted table %d: %w size %dx%d", t.Index, ErrInvalid, t.NumRows, t.NumCols)
+	}
+	for _, c := range t.Cells {
+		for _, i := range slices.Concat(c.Rows, c.Cols) {
+			if i < 0 {
+				return fmt.Errorf("extracted table %d: %w cell index %d", t.Index, ErrInvalid, i)
+			}
+		}
+	}
+	// Either side alone may overflow the product
+	rows, cols := t.GridSize()
+	if rows > MaxTableCells || cols > MaxTableCells || rows*cols > MaxTableCells {
+		return fmt.Errorf("extracted table %d: %w size %dx%d, over %d cells", t.Index, ErrInvalid, rows, cols, MaxTableCells)
+	}
+	return nil
+}
+
+// ReplaceExtractedTables replaces the extracted tables of a document,
+// failing with ErrInvalid if any of them does not validate
+func (s *service) ReplaceExtractedTables(ctx context.Context, documentID, tableID string, tables []ExtractedTable) error {
+	for i := range tables {
+		if err := tables[i].Validate(); err != nil {
+			return err
+		}
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM extracted_tables WHERE document_id = $1`, documentID); err != nil {
+		return fmt.Errorf("failed to delete extracted tables: %v", err)
+	}
+
+	query := `
+		INSERT INTO extracted_tables (element_id, document_id, table_id, element_index, page_number, caption, bbox, num_rows, num_cols, cells)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
+
+	for _, t := range tables {
+		var bbox []byte
+		if len(t.BBox) > 0 {
+			if bbox, err = json.Marshal(t.BBox); err != nil {
+				return fmt.Errorf("failed to encode bbox: %v", err)
+			}
+		}
+		cells, err := json.Marshal(t.Cells)
+		if err != nil {
+			return fmt.Errorf("failed to encode cells: %v", err)
+		}
+
+		_, err = tx.ExecContext(ctx, query, uuid.New().String(), documentID, tableID, t.Index, t.PageNumber, t.Caption, bbox, t.NumRows, t.NumCols, cells)
+		if err != nil {
+			return queryError("failed to insert extracted table", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit extracted tables: %v", err)
+	}
+	return nil
+}
+
+// GetExtractedTables retrieves the extracted tables of all documents in a
+// table, without their cells
+func (s *service) GetExtractedTables(ctx context.Context, tableID string) ([]ExtractedTable, error) {
+	query := `
+		SELECT e.element_id, e.document_id, e.table_id, d.file_name, e.element_index, e.page_number, e.caption, e.bbox, e.num_rows, e.num_cols, e.created_at
+		FROM extracted_tables e
+		JOIN table_documents d ON d.document_id = e.document_id
+		WHERE e.table_id = $1
+		ORDER BY d.created_at, e.element_index`
+
+	rows, err := s.db.QueryContext(ctx, query, tableID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query extracted tables: %v", err)
+	}
+	defer rows.Close()
+
+	var tables []ExtractedTable
+	for rows.Next() {
+		var t ExtractedTable
+		var bbox []byte
+		if err := rows.Scan(&t.ElementID, &t.DocumentID, &t.TableID, &t.FileName, &t.Index, &t.PageNumber, &t.Caption, &bbox, &t.NumRows, &t.NumCols, &t.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan extracted table row: %v", err)
+		}
+		if err := unmarshalOptional(bbox, &t.BBox); err != nil {
+			return nil, fmt.Errorf("failed to decode bbox: %v", err)
+		}
+		tables = append(tables, t)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating extracted table rows: %v", err)
+	}
+
+	return tables, nil
+}
+
+const extractedTableColumns = `e.element_id, e.document_id, e.table_id, d.file_name, e.element_index, e.page_number, e.caption, e.bbox, e.num_rows, e.num_cols, e.cells, e.created_at`
+
+func scanExtractedTable(row interface{ Scan(...interface{}) error }, t *ExtractedTable) error {
+	var bbox, cells []byte
+	err := row.Scan(
+		&t.ElementID, &t.DocumentID, &t.TableID, &t.FileName, &t.Index, &t.PageNumber,
+		&t.Caption, &bbox, &t.NumRows, &t.NumCols, &cells, &t.CreatedAt,
+	)
+	if err != nil {
+		return err
+	}
+	if err := unmarshalOptional(bbox, &t.BBox); err != nil {
+		return fmt.Errorf("failed to decode bbox: %v", err)
+	}
+	if err := unmarshalOptional(cells, &t.Cells); err != nil {
+		return fmt.Errorf("failed to decode cells: %v", err)
+	}
+	return nil
+}
+
+// GetDocumentExtractedTables retrieves the extracted tables of a document,
+// including their cells
+func (s *service) GetDocumentExtractedTables(ctx context.Context, documentID string) ([]ExtractedTable, error) {
+	query := `
+		SELECT ` + extractedTableColumns + `
+		FROM extracted_tables e
+		JOIN table_documents d ON d.document_id = e.document_id
+		WHERE e.document_id = $1
+		ORDER BY e.element_index`
+
+	rows, err := s.db.QueryContext(ctx, query, documentID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query extracted tables: %v", err)
+	}
+	defer rows.Close()
+
+	var tables []ExtractedTable
+	for rows.Next() {
+		var t ExtractedTable
+		if err := scanExtractedTable(rows, &t); err != nil {
+			return nil, fmt.Errorf("failed to scan extracted table row: %v", err)
+		}
+		tables = append(tables, t)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating extracted table rows: %v", err)
+	}
+
+	return tables, nil
+}
+
+// GetExtractedTable retrieves a single extracted table, including its cells
+func (s *service) GetExtractedTable(ctx context.Context, elementID string) (*ExtractedTable, error) {
+	query := `
+		SELECT ` + extractedTableColumns + `
+		FROM extracted_tables e
+		JOIN table_documents d ON d.document_id = e.document_id
+		WHERE e.element_id = $1`
+
+	var t ExtractedTable
+	err := scanExtractedTable(s.db.QueryRowContext(ctx, query, elementID), &t)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting extracted table: %v", err)
+	}
+
+	return &t, nil
+}
+
+// unmarshalOptional decodes a nullable JSONB column into v, leaving v alone
+// for NULL.
+func unmarshalOptional(data []byte, v interface{}) error {
+	if len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,75 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ForkTable inserts a new private table owned by userID that records
+// sourceTableID as the table it was forked from, copying its description,
+// tags and content type allowlist
+func (s *service) ForkTable(ctx context.Context, sourceTableID, userID, tableName string) (string, error) {
+	tableID := uuid.New().String()
+
+	query := `
+		INSERT INTO user_tables (user_id, table_id, table_name, public, description, tags, allowed_content_types, forked_from,
+			embedding_model, embedding_version)
+		SELECT $1, $2, $3, false, description, tags, allowed_content_types, table_id, embedding_model, embedding_version
+		FROM user_tables
+		WHERE table_id = $4
+		RETURNING table_id`
+
+	var returnedTableID string
+	err := s.db.QueryRowContext(ctx, query, userID, tableID, tableName, sourceTableID).Scan(&returnedTableID)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("table %w", ErrNotFound)
+	}
+	if err != nil {
+		return "", queryError("failed to fork table", err)
+	}
+
+	return returnedTableID, nil
+}
+
+// UpdateTableSyncedAt records when a fork last pulled its upstream table
+func (s *service) UpdateTableSyncedAt(ctx context.Context, tableID string, syncedAt time.Time) error {
+	query := `UPDATE user_tables SET synced_at = $1, updated_at = CURRENT_TIMESTAMP WHERE table_id = $2`
+	return s.execOne(ctx, "table", query, syncedAt, tableID)
+}
+
+// AddForkedDocument inserts a copy of an upstream document into a fork. The
+// copy shares the upstream's stored original, which is never modified.
+func (s *service) AddForkedDocument(ctx context.Context, tableID, userID string, source TableDocument) (*TableDocument, error) {
+	doc := TableDocument{
+		DocumentID:       uuid.New().String(),
+		TableID:          tableID,
+		UserID:           userID,
+		FileName:         source.FileName,
+		FilePath:         source.FilePath,
+		SHA256:           source.SHA256,
+		SourceDocumentID: source.DocumentID,
+	}
+
+	query := `
+		INSERT INTO table_documents (document_id, table_id, user_id, file_name, file_path, sha256, source_document_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING created_at, updated_at`
+
+	err := s.db.QueryRowContext(ctx, query, doc.DocumentID, tableID, userID, doc.FileName, doc.FilePath, doc.SHA256, doc.SourceDocumentID).Scan(&doc.CreatedAt, &doc.UpdatedAt)
+	if err != nil {
+		return nil, queryError("failed to add forked document", err)
+	}
+
+	return &doc, nil
+}
+
+// LinkForkedDocument records a document of a fork as the copy of an upstream
+// document, for a fork that already holds the same file
+func (s *service) LinkForkedDocument(ctx context.Context, documentID, sourceDocumentID string) error {
+	query := `UPDATE table_documents SET source_document_id = $1, updated_at = CURRENT_TIMESTAMP WHERE document_id = $2`
+	return s.execOne(ctx, "document", query, sourceDocumentID, documentID)
+}
@@ -0,0 +1,105 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Ingestion job kinds and statuses stored in the ingestion_jobs table.
+const (
+	JobKindReindex = "reindex"
+	JobKindImport  = "import"
+	JobKindFork    = "fork"
+	JobKindPull    = "pull"
+	JobKindMigrate = "migrate"
+
+	JobStatusPending   = "pending"
+	JobStatusRunning   = "running"
+	JobStatusSucceeded = "succeeded"
+	JobStatusFailed    = "failed"
+)
+
+// IngestionJob tracks the progress of ingesting a batch of documents.
+// Total, Completed and Failed count documents.
+type IngestionJob struct {
+	JobID     string    `json:"job_id"`
+	TableID   string    `json:"table_id"`
+	UserID    string    `json:"-"`
+	Kind      string    `json:"kind"`
+	Status    string    `json:"status"`
+	Total     int       `json:"total"`
+	Completed int       `json:"completed"`
+	Failed    int       `json:"failed"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// CreateIngestionJob inserts a new pending record into the ingestion_jobs table
+func (s *service) CreateIngestionJob(ctx context.Context, tableID, userID, kind string, total int) (*IngestionJob, error) {
+	job := IngestionJob{
+		JobID:   uuid.New().String(),
+		TableID: tableID,
+		UserID:  userID,
+		Kind:    kind,
+		Status:  JobStatusPending,
+		Total:   total,
+	}
+
+	query := `
+		INSERT INTO ingestion_jobs (job_id, table_id, user_id, kind, status, total)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING created_at, updated_at`
+
+	err := s.db.QueryRowContext(ctx, query, job.JobID, tableID, userID, kind, job.Status, total).Scan(&job.CreatedAt, &job.UpdatedAt)
+	if err != nil {
+		return nil, queryError("failed to create ingestion job", err)
+	}
+
+	return &job, nil
+}
+
+// GetIngestionJob retrieves an ingestion job by its ID
+func (s *service) GetIngestionJob(ctx context.Context, jobID string) (*IngestionJob, error) {
+	query := `
+		SELECT job_id, table_id, user_id, kind, status, total, completed, failed, error, created_at, updated_at
+		FROM ingestion_jobs
+		WHERE job_id = $1`
+
+	var job IngestionJob
+	err := s.db.QueryRowContext(ctx, query, jobID).Scan(
+		&job.JobID, &job.TableID, &job.UserID, &job.Kind, &job.Status,
+		&job.Total, &job.Completed, &job.Failed, &job.Error, &job.CreatedAt, &job.UpdatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting ingestion job: %v", err)
+	}
+
+	return &job, nil
+}
+
+// UpdateIngestionJob stores the status, progress counters and error of a job
+func (s *service) UpdateIngestionJob(ctx context.Context, job *IngestionJob) error {
+	query := `
+		UPDATE ingestion_jobs
+		SET status = $1, completed = $2, failed = $3, error = $4, updated_at = CURRENT_TIMESTAMP
+		WHERE job_id = $5
+		RETURNING updated_at`
+
+	err := s.db.QueryRowContext(ctx, query, job.Status, job.Completed, job.Failed, job.Error, job.JobID).Scan(&job.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("ingestion job %w", ErrNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update ingestion job: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+)
+
+// GetQueryEmbedding retrieves the embedding stored under key if it was stored
+// less than maxAge ago, and nil otherwise.
+func (s *service) GetQueryEmbedding(ctx context.Context, key string, maxAge time.Duration) ([]float32, error) {
+	query := `
+		SELECT embedding FROM query_embeddings
+		WHERE key = $1 AND created_at > now() - make_interval(secs => $2)`
+
+	var data []byte
+	err := s.db.QueryRowContext(ctx, query, key, maxAge.Seconds()).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting query embedding: %v", err)
+	}
+	if len(data)%4 != 0 {
+		return nil, fmt.Errorf("error getting query embedding: %d bytes are not float32s", len(data))
+	}
+
+	embedding := make([]float32, len(data)/4)
+	for i := range embedding {
+		embedding[i] = math.Float32frombits(binary.LittleEndian.Uint32(data[i*4:]))
+	}
+	return embedding, nil
+}
+
+// PutQueryEmbedding stores the embedding of a query made with model under key,
+// replacing any stored before.
+func (s *service) PutQueryEmbedding(ctx context.Context, key, model string, embedding []float32) error {
+	data := make([]byte, 0, len(embedding)*4)
+	for _, v := range embedding {
+		data = binary.LittleEndian.AppendUint32(data, math.Float32bits(v))
+	}
+
+	query := `
+		INSERT INTO query_embeddings (key, model, embedding)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (key) DO UPDATE
+		SET model = EXCLUDED.model, embedding = EXCLUDED.embedding, created_at = CURRENT_TIMESTAMP`
+
+	if _, err := s.db.ExecContext(ctx, query, key, model, data); err != nil {
+		return fmt.Errorf("failed to store query embedding: %v", err)
+	}
+	return nil
+}
+
+// DeleteQueryEmbeddings removes the query embeddings stored more than maxAge
+// ago.
+func (s *service) DeleteQueryEmbeddings(ctx context.Context, maxAge time.Duration) error {
+	query := `DELETE FROM query_embeddings WHERE created_at <= now() - make_interval(secs => $1)`
+	if _, err := s.db.ExecContext(ctx, query, maxAge.Seconds()); err != nil {
+		return fmt.Errorf("failed to delete query embeddings: %v", err)
+	}
+	return nil
+}
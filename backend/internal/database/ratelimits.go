@@ -0,0 +1,54 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// TakeRateLimitToken takes a token from the rate limit bucket key, which holds
+// burst tokens and gains one every interval. It returns 0 if it took one, or
+// else how long until there is one. The bucket is the time it is full again,
+// by the database's clock, so that every replica sees the same buckets.
+func (s *service) TakeRateLimitToken(ctx context.Context, key string, interval time.Duration, burst int) (time.Duration, error) {
+	// A missing bucket is full. The update only happens if the bucket is
+	// not empty, that is if it is full again within burst intervals of
+	// taking the token.
+	query := `
+		INSERT INTO rate_limits AS b (key, full_at)
+		VALUES ($1, now() + make_interval(secs => $2))
+		ON CONFLICT (key) DO UPDATE
+		SET full_at = GREATEST(b.full_at, now()) + make_interval(secs => $2)
+		WHERE GREATEST(b.full_at, now()) + make_interval(secs => $2) <= now() + make_interval(secs => $3)
+		RETURNING true`
+
+	var taken bool
+	capacity := interval * time.Duration(burst)
+	err := s.db.QueryRowContext(ctx, query, key, interval.Seconds(), capacity.Seconds()).Scan(&taken)
+	if err == nil {
+		return 0, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, fmt.Errorf("failed to take rate limit token: %v", err)
+	}
+
+	var untilFull float64
+	query = `SELECT EXTRACT(EPOCH FROM full_at - now())::float8 FROM rate_limits WHERE key = $1`
+	if err := s.db.QueryRowContext(ctx, query, key).Scan(&untilFull); err != nil {
+		return 0, fmt.Errorf("failed to get rate limit bucket: %v", err)
+	}
+	wait := time.Duration(untilFull*float64(time.Second)) + interval - capacity
+	// Another replica may have refilled the bucket in between
+	return max(wait, time.Millisecond), nil
+}
+
+// DeleteFullRateLimits removes the rate limit buckets that are full, which
+// are the same as missing ones.
+func (s *service) DeleteFullRateLimits(ctx context.Context) error {
+	query := `DELETE FROM rate_limits WHERE full_at <= now()`
+	if _, err := s.db.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to delete full rate limit buckets: %v", err)
+	}
+	return nil
+}
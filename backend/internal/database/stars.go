@@ -0,0 +1,87 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// FeedItem is an entry of a user's activity feed: a document added to a table
+// they starred.
+type FeedItem struct {
+	TableID    string    `json:"table_id"`
+	TableName  string    `json:"table_name"`
+	DocumentID string    `json:"document_id"`
+	FileName   string    `json:"file_name"`
+	AddedAt    time.Time `json:"added_at"`
+}
+
+// StarTable stars a table for a user; starring a starred table does nothing
+func (s *service) StarTable(ctx context.Context, userID, tableID string) error {
+	query := `
+		INSERT INTO table_stars (user_id, table_id)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id, table_id) DO NOTHING`
+
+	if _, err := s.db.ExecContext(ctx, query, userID, tableID); err != nil {
+		return queryError("failed to star table", err)
+	}
+	return nil
+}
+
+// UnstarTable removes a user's star from a table
+func (s *service) UnstarTable(ctx context.Context, userID, tableID string) error {
+	query := `DELETE FROM table_stars WHERE user_id = $1 AND table_id = $2`
+	if _, err := s.db.ExecContext(ctx, query, userID, tableID); err != nil {
+		return fmt.Errorf("failed to unstar table: %v", err)
+	}
+	return nil
+}
+
+// GetStarredTables retrieves the tables a user starred, most recently starred
+// first. Tables made private since are left out until they are public again.
+func (s *service) GetStarredTables(ctx context.Context, userID string) ([]PublicTable, error) {
+	query := publicTableSelect + `
+		JOIN table_stars s ON s.table_id = t.table_id AND s.user_id = $1
+		WHERE t.public OR t.user_id = $1` + publicTableGroupBy + `, s.created_at
+		ORDER BY s.created_at DESC, t.table_id`
+
+	return s.queryPublicTables(ctx, query, userID)
+}
+
+// GetFeed retrieves the documents owners added to the tables a user starred
+// since the user starred them, newest first
+func (s *service) GetFeed(ctx context.Context, userID string, limit int) ([]FeedItem, error) {
+	query := `
+		SELECT t.table_id, t.table_name, d.document_id, d.file_name, d.created_at
+		FROM table_stars s
+		JOIN user_tables t ON t.table_id = s.table_id
+		JOIN table_documents d ON d.table_id = t.table_id
+		WHERE s.user_id = $1
+			AND (t.public OR t.user_id = $1)
+			AND d.user_id = t.user_id
+			AND d.created_at > s.created_at
+		ORDER BY d.created_at DESC, d.document_id
+		LIMIT $2`
+
+	rows, err := s.db.QueryContext(ctx, query, userID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query feed: %v", err)
+	}
+	defer rows.Close()
+
+	items := []FeedItem{}
+	for rows.Next() {
+		var item FeedItem
+		if err := rows.Scan(&item.TableID, &item.TableName, &item.DocumentID, &item.FileName, &item.AddedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan feed row: %v", err)
+		}
+		items = append(items, item)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating feed rows: %v", err)
+	}
+
+	return items, nil
+}
@@ -0,0 +1,48 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// AcquireTableLock takes the lock of a table for holder until ttl from now,
+// reporting false if another holder has it. A lock its holder let expire is
+// free to take, by the database's clock.
+func (s *service) AcquireTableLock(ctx context.Context, tableID, holder string, ttl time.Duration) (bool, error) {
+	query := `
+		INSERT INTO table_locks AS l (table_id, holder, expires_at)
+		VALUES ($1, $2, now() + make_interval(secs => $3))
+		ON CONFLICT (table_id) DO UPDATE
+		SET holder = EXCLUDED.holder, expires_at = EXCLUDED.expires_at
+		WHERE l.expires_at <= now()
+		RETURNING true`
+
+	var taken bool
+	err := s.db.QueryRowContext(ctx, query, tableID, holder, ttl.Seconds()).Scan(&taken)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, queryError("failed to acquire table lock", err)
+	}
+	return true, nil
+}
+
+// RenewTableLock extends the lock holder has on a table to ttl from now,
+// failing with ErrNotFound if holder no longer has it.
+func (s *service) RenewTableLock(ctx context.Context, tableID, holder string, ttl time.Duration) error {
+	query := `UPDATE table_locks SET expires_at = now() + make_interval(secs => $3) WHERE table_id = $1 AND holder = $2`
+	return s.execOne(ctx, "table lock", query, tableID, holder, ttl.Seconds())
+}
+
+// ReleaseTableLock frees the lock holder has on a table. Releasing a lock
+// holder does not have, such as that of a deleted table, does nothing.
+func (s *service) ReleaseTableLock(ctx context.Context, tableID, holder string) error {
+	query := `DELETE FROM table_locks WHERE table_id = $1 AND holder = $2`
+	if _, err := s.db.ExecContext(ctx, query, tableID, holder); err != nil {
+		return fmt.Errorf("failed to release table lock: %v", err)
+	}
+	return nil
+}
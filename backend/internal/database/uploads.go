@@ -0,0 +1,244 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Upload is a resumable upload. Offset is the number of bytes received so far;
+// once it reaches Size the upload is Completed and FilePath points at the
+// stored file, ready to be attached to a table.
+type Upload struct {
+	UploadID    string    `json:"upload_id"`
+	UserID      string    `json:"-"`
+	FileName    string    `json:"file_name"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	Offset      int64     `json:"offset"`
+	FilePath    string    `json:"file_path,omitempty"`
+	SHA256      string    `json:"sha256,omitempty"`
+	Completed   bool      `json:"completed"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// CreateUpload inserts a new record into the uploads table
+func (s *service) CreateUpload(ctx context.Context, userID, fileName, contentType string, size int64) (*Upload, error) {
+	upload := Upload{
+		UploadID:    uuid.New().String(),
+		UserID:      userID,
+		FileName:    fileName,
+		ContentType: contentType,
+		Size:        size,
+	}
+
+	query := `
+		INSERT INTO uploads (upload_id, user_id, file_name, content_type, size)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING created_at`
+
+	err := s.db.QueryRowContext(ctx, query, upload.UploadID, userID, fileName, contentType, size).Scan(&upload.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upload: %v", err)
+	}
+
+	return &upload, nil
+}
+
+// GetUpload retrieves a resumable upload by its ID
+func (s *service) GetUpload(ctx context.Context, uploadID string) (*Upload, error) {
+	query := `
+		SELECT upload_id, user_id, file_name, content_type, size, upload_offset, file_path, sha256, completed, created_at
+		FROM uploads
+		WHERE upload_id = $1`
+
+	var upload Upload
+	err := s.db.QueryRowContext(ctx, query, uploadID).Scan(
+		&upload.UploadID, &upload.UserID, &upload.FileName, &upload.ContentType,
+		&upload.Size, &upload.Offset, &upload.FilePath, &upload.SHA256, &upload.Completed, &upload.CreatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting upload: %v", err)
+	}
+
+	return &upload, nil
+}
+
+// GetUploadByFilePath retrieves the completed upload stored under a key
+func (s *service) GetUploadByFilePath(ctx context.Context, filePath string) (*Upload, error) {
+	query := `
+		SELECT upload_id, user_id, file_name, content_type, size, upload_offset, file_path, sha256, completed, created_at
+		FROM uploads
+		WHERE file_path = $1 AND completed`
+
+	var upload Upload
+	err := s.db.QueryRowContext(ctx, query, filePath).Scan(
+		&upload.UploadID, &upload.UserID, &upload.FileName, &upload.ContentType,
+		&upload.Size, &upload.Offset, &upload.FilePath, &upload.SHA256, &upload.Completed, &upload.CreatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting upload by file path: %v", err)
+	}
+
+	return &upload, nil
+}
+
+// GetUserStorageUsage returns the bytes reserved by all uploads of a user,
+// counting unfinished uploads at their declared size
+func (s *service) GetUserStorageUsage(ctx context.Context, userID string) (int64, error) {
+	query := `SELECT COALESCE(SUM(size), 0) FROM uploads WHERE user_id = $1`
+
+	var usage int64
+	if err := s.db.QueryRowContext(ctx, query, userID).Scan(&usage); err != nil {
+		return 0, fmt.Errorf("failed to get storage usage: %v", err)
+	}
+
+	return usage, nil
+}
+
+// UploadPart is a part of an unfinished upload, stored under FilePath.
+type UploadPart struct {
+	Offset   int64
+	Size     int64
+	FilePath string
+}
+
+// AppendUploadPart records a part of size bytes stored at filePath as the
+// continuation of an upload that has received offset bytes. It fails with
+// ErrConflict if the upload has received more since, or is completed, so that
+// of two requests continuing an upload from the same offset only one succeeds.
+func (s *service) AppendUploadPart(ctx context.Context, uploadID string, offset, size int64, filePath string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var current int64
+	var completed bool
+	err = tx.QueryRowContext(ctx, `SELECT upload_offset, completed FROM uploads WHERE upload_id = $1 FOR UPDATE`, uploadID).Scan(&current, &completed)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("upload %w", ErrNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("error getting upload: %v", err)
+	}
+	if completed || current != offset {
+		return fmt.Errorf("upload offset: %w", ErrConflict)
+	}
+
+	query := `
+		INSERT INTO upload_parts (upload_id, part_offset, size, file_path)
+		VALUES ($1, $2, $3, $4)`
+	if _, err := tx.ExecContext(ctx, query, uploadID, offset, size, filePath); err != nil {
+		return queryError("failed to record upload part", err)
+	}
+	query = `UPDATE uploads SET upload_offset = $1, updated_at = CURRENT_TIMESTAMP WHERE upload_id = $2`
+	if _, err := tx.ExecContext(ctx, query, offset+size, uploadID); err != nil {
+		return fmt.Errorf("failed to update upload offset: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit upload part: %v", err)
+	}
+	return nil
+}
+
+// GetUploadParts retrieves the parts of an upload in order
+func (s *service) GetUploadParts(ctx context.Context, uploadID string) ([]UploadPart, error) {
+	query := `
+		SELECT part_offset, size, file_path
+		FROM upload_parts
+		WHERE upload_id = $1
+		ORDER BY part_offset`
+
+	rows, err := s.db.QueryContext(ctx, query, uploadID)
+	if err != nil {
+		return nil, fmt.Errorf("error getting upload parts: %v", err)
+	}
+	defer rows.Close()
+
+	var parts []UploadPart
+	for rows.Next() {
+		var part UploadPart
+		if err := rows.Scan(&part.Offset, &part.Size, &part.FilePath); err != nil {
+			return nil, fmt.Errorf("error scanning upload part: %v", err)
+		}
+		parts = append(parts, part)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating upload parts: %v", err)
+	}
+
+	return parts, nil
+}
+
+// CompleteUpload marks an upload as finished and stored at filePath, recording
+// the content type sniffed from the stored bytes and their SHA-256, and
+// forgets its parts. It fails with ErrNotFound if the upload was completed
+// already.
+func (s *service) CompleteUpload(ctx context.Context, uploadID, filePath, contentType, sha256 string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE uploads
+		SET completed = true, upload_offset = size, file_path = $1, content_type = $2, sha256 = $3, updated_at = CURRENT_TIMESTAMP
+		WHERE upload_id = $4 AND NOT completed`
+	result, err := tx.ExecContext(ctx, query, filePath, contentType, sha256, uploadID)
+	if err != nil {
+		return fmt.Errorf("failed to complete upload: %v", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("upload %w", ErrNotFound)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM upload_parts WHERE upload_id = $1`, uploadID); err != nil {
+		return fmt.Errorf("failed to delete upload parts: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit upload: %v", err)
+	}
+	return nil
+}
+
+// DeleteUpload removes a resumable upload from the uploads table, along with
+// the records of its parts
+func (s *service) DeleteUpload(ctx context.Context, uploadID string) error {
+	query := `DELETE FROM uploads WHERE upload_id = $1`
+	return s.execOne(ctx, "upload", query, uploadID)
+}
+
+// execOne runs a statement that is expected to affect exactly one row and
+// reports "<what> not found", wrapping ErrNotFound, when it affected none.
+func (s *service) execOne(ctx context.Context, what, query string, args ...interface{}) error {
+	result, err := s.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("%s %w", what, ErrNotFound)
+	}
+
+	return nil
+}
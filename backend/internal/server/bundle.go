@@ -0,0 +1,737 @@
+package server
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"backend/internal/database"
+)
+
+// bundleVersion is the version of the export format written by this server.
+// Import accepts bundles up to this version.
+const bundleVersion = 1
+
+// bundleTimeout bounds how long a bundle may take to be exported or imported,
+// replacing the server-wide ReadTimeout and WriteTimeout.
+const bundleTimeout = time.Hour
+
+// Files of a table bundle. Originals are stored under files/ and extracted
+// images under images/, at the paths the registry and chunks name.
+const (
+	bundleManifestFile        = "manifest.json"
+	bundleTableFile           = "table.json"
+	bundleDocumentsFile       = "documents.json"
+	bundleExtractedTablesFile = "extracted_tables.json"
+	bundleChunksFile          = "chunks.jsonl"
+	bundleImagesDir           = "images/"
+)
+
+// imageContentTypes are the types of the images extracted from documents.
+var imageContentTypes = []string{"image/jpeg", "image/png"}
+
+// bundleManifest identifies a table bundle and how its chunks were embedded.
+type bundleManifest struct {
+	Version        int       `json:"version"`
+	ExportedAt     time.Time `json:"exported_at"`
+	EmbeddingModel string    `json:"embedding_model"`
+}
+
+// bundleTable is the metadata of the exported table.
+type bundleTable struct {
+	TableName           string   `json:"table_name"`
+	IsPublic            bool     `json:"public"`
+	AllowedContentTypes []string `json:"allowed_content_types,omitempty"`
+}
+
+// bundleDocument is an entry of the document registry. File is the path of
+// the original within the bundle.
+type bundleDocument struct {
+	DocumentID string    `json:"document_id"`
+	FileName   string    `json:"file_name"`
+	SHA256     string    `json:"sha256,omitempty"`
+	File       string    `json:"file"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// exportTableHandler streams a zip of everything needed to rebuild a table
+// elsewhere: its metadata, document registry, original files, extracted
+// tables and images, and every indexed chunk with its embedding.
+func (s *Server) exportTableHandler(w http.ResponseWriter, r *http.Request) {
+	tableID := r.PathValue("id")
+
+	userID := userIDFromRequest(r)
+	if userID == "" {
+		writeError(w, r, http.StatusUnauthorized, "Invalid or missing Authorization header")
+		return
+	}
+
+	ctx := r.Context()
+	table, err := s.db.GetTableByID(ctx, tableID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error getting table", "err", err)
+		writeFailure(w, r, err, "Failed to get table")
+		return
+	}
+	if table == nil || table.UserID != userID {
+		writeError(w, r, http.StatusNotFound, "Table not found")
+		return
+	}
+
+	docs, err := s.db.GetTableDocuments(ctx, tableID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error getting table documents", "err", err)
+		writeFailure(w, r, err, "Failed to get table documents")
+		return
+	}
+
+	indexName := s.chunkIndex(tableModel(table))
+	extendDeadlines(w, r, bundleTimeout)
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", sanitizeFileName(table.TableName)+".zip"))
+
+	// Once the zip has started, errors can only be reported by cutting it
+	// short, which clients detect as a corrupt archive.
+	zw := zip.NewWriter(w)
+	if err := s.writeBundle(ctx, zw, indexName, table, docs); err != nil {
+		slog.ErrorContext(ctx, "Error exporting table", "table_id", tableID, "err", err)
+		return
+	}
+	if err := zw.Close(); err != nil {
+		slog.ErrorContext(ctx, "Error exporting table", "table_id", tableID, "err", err)
+	}
+}
+
+// writeBundle writes the files of a table bundle to zw.
+func (s *Server) writeBundle(ctx context.Context, zw *zip.Writer, indexName string, table *database.UserTable, docs []database.TableDocument) error {
+	manifest := bundleManifest{
+		Version:        bundleVersion,
+		ExportedAt:     time.Now().UTC(),
+		EmbeddingModel: tableModel(table).Name,
+	}
+	if err := writeZipJSON(zw, bundleManifestFile, manifest); err != nil {
+		return err
+	}
+
+	meta := bundleTable{
+		TableName:           table.TableName,
+		IsPublic:            table.IsPublic,
+		AllowedContentTypes: table.AllowedContentTypes,
+	}
+	if err := writeZipJSON(zw, bundleTableFile, meta); err != nil {
+		return err
+	}
+
+	registry := make([]bundleDocument, 0, len(docs))
+	var extracted []database.ExtractedTable
+	for _, doc := range docs {
+		entry := bundleDocument{
+			DocumentID: doc.DocumentID,
+			FileName:   doc.FileName,
+			SHA256:     doc.SHA256,
+			File:       path.Join("files", doc.DocumentID, sanitizeFileName(doc.FileName)),
+			CreatedAt:  doc.CreatedAt,
+		}
+		if err := s.copyBlobToZip(ctx, zw, doc.FilePath, entry.File); err != nil {
+			return err
+		}
+		registry = append(registry, entry)
+
+		tables, err := s.db.GetDocumentExtractedTables(ctx, doc.DocumentID)
+		if err != nil {
+			return err
+		}
+		extracted = append(extracted, tables...)
+	}
+	if err := writeZipJSON(zw, bundleDocumentsFile, registry); err != nil {
+		return err
+	}
+	if err := writeZipJSON(zw, bundleExtractedTablesFile, extracted); err != nil {
+		return err
+	}
+
+	chunks, err := zw.Create(bundleChunksFile)
+	if err != nil {
+		return err
+	}
+	images := make(map[string]bool)
+	err = s.scrollChunks(ctx, indexName, "table_id", table.TableID, func(source map[string]interface{}) error {
+		if key, _ := chunkImageKey(source); key != "" {
+			images[key] = true
+		}
+		line, err := json.Marshal(source)
+		if err != nil {
+			return err
+		}
+		_, err = chunks.Write(append(line, '\n'))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for key := range images {
+		if err := s.copyBlobToZip(ctx, zw, key, key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeZipJSON adds a file holding v as JSON to zw.
+func writeZipJSON(zw *zip.Writer, name string, v interface{}) error {
+	f, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(f).Encode(v)
+}
+
+// copyBlobToZip adds the blob stored under key to zw as name.
+func (s *Server) copyBlobToZip(ctx context.Context, zw *zip.Writer, key, name string) error {
+	blob, err := s.blobs.Get(ctx, key)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %v", key, err)
+	}
+	defer blob.Close()
+
+	f, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, blob); err != nil {
+		return fmt.Errorf("error copying %s: %v", key, err)
+	}
+	return nil
+}
+
+// chunkImageKey returns the image key of an image chunk, or "" for other
+// chunks, along with the chunk properties that hold it.
+func chunkImageKey(source map[string]interface{}) (string, map[string]interface{}) {
+	outer, _ := source["properties"].(map[string]interface{})
+	key, _ := outer["image_key"].(string)
+	if !strings.HasPrefix(key, "images/") {
+		return "", outer
+	}
+	return key, outer
+}
+
+// bundleOverhead is how far an imported bundle may exceed the user's storage
+// quota, leaving room for chunks and embeddings on top of the original files,
+// which must fit the quota themselves.
+const bundleOverhead = 1 << 30
+
+// importTableHandler rebuilds a table from a bundle written by
+// exportTableHandler, owned by the caller. If the bundle's chunks were
+// embedded with a model this server knows they are indexed as they are, and
+// the table keeps using that model; otherwise the documents are ingested again
+// in the background.
+func (s *Server) importTableHandler(w http.ResponseWriter, r *http.Request) {
+	userID := userIDFromRequest(r)
+	if userID == "" {
+		writeError(w, r, http.StatusUnauthorized, "Invalid or missing Authorization header")
+		return
+	}
+	extendDeadlines(w, r, bundleTimeout)
+
+	// zip needs random access, so the bundle is spooled to disk first
+	body := http.MaxBytesReader(w, r.Body, s.uploadPolicy.userQuota+bundleOverhead)
+	tmp, err := os.CreateTemp("", "import-*.zip")
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error creating temporary file", "err", err)
+		writeFailure(w, r, err, "Failed to import table")
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	size, err := io.Copy(tmp, body)
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			writeError(w, r, http.StatusRequestEntityTooLarge, "Bundle is too large")
+			return
+		}
+		writeError(w, r, http.StatusBadRequest, "Failed to read bundle")
+		return
+	}
+
+	zr, err := zip.NewReader(tmp, size)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Bundle is not a valid zip file")
+		return
+	}
+
+	bundle, err := readBundle(zr)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx := r.Context()
+	if name := r.URL.Query().Get("table_name"); name != "" {
+		bundle.table.TableName = name
+	}
+	if err := s.checkImport(ctx, userID, bundle); err != nil {
+		writePolicyError(w, r, err)
+		return
+	}
+
+	result, err := s.importBundle(ctx, userID, bundle)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error importing table", "err", err)
+		writeFailure(w, r, err, "Failed to import table")
+		return
+	}
+	s.recordEvent(ctx, result.TableID, userID, database.EventTableImported, "", map[string]interface{}{
+		"documents": result.Documents,
+		"chunks":    result.Chunks,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", apiPrefix+"/tables/"+result.TableID)
+	if result.Job != nil {
+		w.WriteHeader(http.StatusAccepted)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		slog.ErrorContext(ctx, "Failed to encode response", "err", err)
+	}
+}
+
+// tableBundle is a bundle opened for import.
+type tableBundle struct {
+	zr        *zip.Reader
+	manifest  bundleManifest
+	table     bundleTable
+	documents []bundleDocument
+	extracted []database.ExtractedTable
+	// sizes holds the uncompressed size of each original, by document ID.
+	sizes map[string]int64
+	// contentTypes holds the sniffed type of each original, by document ID.
+	contentTypes map[string]string
+	// imageSize is the uncompressed size of the extracted images.
+	imageSize int64
+}
+
+// readBundle reads and checks the metadata of a bundle.
+func readBundle(zr *zip.Reader) (*tableBundle, error) {
+	b := &tableBundle{zr: zr, sizes: make(map[string]int64), contentTypes: make(map[string]string)}
+
+	if err := readZipJSON(zr, bundleManifestFile, &b.manifest); err != nil {
+		return nil, err
+	}
+	if b.manifest.Version < 1 || b.manifest.Version > bundleVersion {
+		return nil, fmt.Errorf("unsupported bundle version %d", b.manifest.Version)
+	}
+	if err := readZipJSON(zr, bundleTableFile, &b.table); err != nil {
+		return nil, err
+	}
+	if b.table.TableName == "" {
+		return nil, fmt.Errorf("bundle has no table name")
+	}
+	if err := validateContentTypes(b.table.AllowedContentTypes); err != nil {
+		return nil, err
+	}
+	if err := readZipJSON(zr, bundleDocumentsFile, &b.documents); err != nil {
+		return nil, err
+	}
+	if err := readZipJSON(zr, bundleExtractedTablesFile, &b.extracted); err != nil {
+		return nil, err
+	}
+	for i := range b.extracted {
+		if err := b.extracted[i].Validate(); err != nil {
+			return nil, fmt.Errorf("bundle has an invalid extracted table: %v", err)
+		}
+	}
+
+	for _, doc := range b.documents {
+		size, err := zipFileSize(zr, doc.File)
+		if err != nil {
+			return nil, fmt.Errorf("bundle is missing %s", doc.File)
+		}
+		b.sizes[doc.DocumentID] = size
+		if b.contentTypes[doc.DocumentID], err = zipContentType(zr, doc.File); err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", doc.File, err)
+		}
+	}
+	for _, f := range zr.File {
+		if strings.HasPrefix(f.Name, bundleImagesDir) {
+			b.imageSize += int64(f.UncompressedSize64)
+		}
+	}
+	if _, err := zr.Open(bundleChunksFile); err != nil {
+		return nil, fmt.Errorf("bundle is missing %s", bundleChunksFile)
+	}
+
+	return b, nil
+}
+
+// zipFileSize returns the uncompressed size of the file name in zr.
+func zipFileSize(zr *zip.Reader, name string) (int64, error) {
+	f, err := zr.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// zipContentType sniffs the type of the file name in zr from its first bytes.
+func zipContentType(zr *zip.Reader, name string) (string, error) {
+	f, err := zr.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	head, err := bufio.NewReader(f).Peek(512)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	contentType, _, _ := strings.Cut(http.DetectContentType(head), ";")
+	return contentType, nil
+}
+
+// readZipJSON decodes the JSON file name in zr into v.
+func readZipJSON(zr *zip.Reader, name string, v interface{}) error {
+	f, err := zr.Open(name)
+	if err != nil {
+		return fmt.Errorf("bundle is missing %s", name)
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(v); err != nil {
+		return fmt.Errorf("invalid %s: %v", name, err)
+	}
+	return nil
+}
+
+// checkImport applies the upload policy to the originals in a bundle before
+// anything is created, so an import either fits or is rejected up front. The
+// extracted images count towards the quota along with the originals.
+func (s *Server) checkImport(ctx context.Context, userID string, b *tableBundle) error {
+	exists, err := s.db.TableExists(ctx, userID, b.table.TableName)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return &policyError{
+			status:  http.StatusConflict,
+			message: fmt.Sprintf("A table named %q already exists; pass table_name to import under another name", b.table.TableName),
+		}
+	}
+
+	allowed := allowedContentTypes(&database.UserTable{AllowedContentTypes: b.table.AllowedContentTypes})
+	for _, doc := range b.documents {
+		if err := checkContentType(b.contentTypes[doc.DocumentID], allowed); err != nil {
+			return err
+		}
+	}
+
+	total := b.imageSize
+	for _, size := range b.sizes {
+		if size > s.uploadPolicy.maxFileSize {
+			return &policyError{
+				status:  http.StatusRequestEntityTooLarge,
+				message: fmt.Sprintf("Bundle contains a file over the maximum size of %d bytes", s.uploadPolicy.maxFileSize),
+			}
+		}
+		total += size
+	}
+
+	usage, err := s.db.GetUserStorageUsage(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if usage+total > s.uploadPolicy.userQuota {
+		return &policyError{
+			status:  http.StatusForbidden,
+			message: fmt.Sprintf("Storage quota exceeded: importing %d bytes with %d of %d bytes used", total, usage, s.uploadPolicy.userQuota),
+		}
+	}
+
+	return nil
+}
+
+// importResult is the response to an import. Job is set when the documents
+// are being ingested again.
+type importResult struct {
+	TableID   string                 `json:"table_id"`
+	Documents int                    `json:"documents"`
+	Chunks    int                    `json:"chunks"`
+	Job       *database.IngestionJob `json:"job,omitempty"`
+}
+
+// importUndo records what an import has created so far, so that a failed
+// import can be removed again.
+type importUndo struct {
+	tableID   string
+	uploadIDs []string
+	blobKeys  []string
+	// indexed is set once chunks may have been written to the index.
+	indexed bool
+}
+
+// undoImport removes what a failed import created. Chunks go first and blobs
+// last, so that whatever is left if it fails too is still owned by a record.
+// Errors are logged, since the import has failed already.
+func (s *Server) undoImport(ctx context.Context, undo *importUndo) {
+	if undo.indexed {
+		if err := s.deleteChunks(ctx, s.chunkIndices(), "table_id", undo.tableID); err != nil {
+			slog.ErrorContext(ctx, "Error deleting chunks of failed import", "table_id", undo.tableID, "err", err)
+		}
+	}
+	if undo.tableID != "" {
+		if err := s.db.DeleteTable(ctx, undo.tableID); err != nil {
+			slog.ErrorContext(ctx, "Error deleting table of failed import", "table_id", undo.tableID, "err", err)
+		}
+	}
+	for _, uploadID := range undo.uploadIDs {
+		if err := s.db.DeleteUpload(ctx, uploadID); err != nil {
+			slog.ErrorContext(ctx, "Error deleting upload of failed import", "upload_id", uploadID, "err", err)
+		}
+	}
+	for _, key := range undo.blobKeys {
+		s.deleteBlob(ctx, key)
+	}
+}
+
+// importBundle creates the table and documents of a bundle for userID and
+// indexes or re-ingests their chunks. If it fails, whatever it created is
+// removed again.
+func (s *Server) importBundle(ctx context.Context, userID string, b *tableBundle) (result *importResult, err error) {
+	model, known := modelNamed(b.manifest.EmbeddingModel)
+	if !known {
+		model = s.model
+	}
+
+	undo := &importUndo{}
+	defer func() {
+		if err != nil {
+			s.undoImport(context.WithoutCancel(ctx), undo)
+		}
+	}()
+
+	tableID, err := s.db.CreateUserTable(ctx, userID, b.table.TableName, b.table.IsPublic)
+	if err != nil {
+		return nil, err
+	}
+	undo.tableID = tableID
+	if err := s.db.SetTableEmbedding(ctx, tableID, model.Name, model.Version); err != nil {
+		return nil, err
+	}
+	if len(b.table.AllowedContentTypes) > 0 {
+		if err := s.db.UpdateTableContentTypes(ctx, tableID, b.table.AllowedContentTypes); err != nil {
+			return nil, err
+		}
+	}
+	result = &importResult{TableID: tableID}
+
+	// Imported documents get new IDs; docIDs maps the bundle's to them
+	docIDs := make(map[string]database.TableDocument)
+	var docs []database.TableDocument
+	for _, entry := range b.documents {
+		doc, err := s.importDocument(ctx, userID, tableID, b, entry, undo)
+		if err != nil {
+			return nil, err
+		}
+		docIDs[entry.DocumentID] = *doc
+		docs = append(docs, *doc)
+	}
+	result.Documents = len(docs)
+
+	extracted := make(map[string][]database.ExtractedTable)
+	for _, t := range b.extracted {
+		extracted[t.DocumentID] = append(extracted[t.DocumentID], t)
+	}
+	for oldID, doc := range docIDs {
+		if tables := extracted[oldID]; len(tables) > 0 {
+			if err := s.db.ReplaceExtractedTables(ctx, doc.DocumentID, tableID, tables); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if !known {
+		slog.InfoContext(ctx, "Bundle was embedded with an unknown model; ingesting table again",
+			"bundle_model", b.manifest.EmbeddingModel, "model", model.Name, "table_id", tableID)
+		if len(docs) == 0 {
+			return result, nil
+		}
+		if err := s.lockTable(ctx, tableID); err != nil {
+			return nil, err
+		}
+		job, err := s.db.CreateIngestionJob(ctx, tableID, userID, database.JobKindImport, len(docs))
+		if err != nil {
+			s.unlockTable(tableID)
+			return nil, err
+		}
+		snapshot := *job
+		go s.runIngestionJob(job, docs, false)
+		result.Job = &snapshot
+		return result, nil
+	}
+
+	if err := s.ensureIndex(ctx, model); err != nil {
+		return nil, err
+	}
+	undo.indexed = true
+	result.Chunks, err = s.importChunks(ctx, b, s.chunkIndex(model), docIDs, undo)
+	if err != nil {
+		return nil, err
+	}
+	for _, doc := range docs {
+		if err := s.db.MarkDocumentIngested(ctx, doc.DocumentID); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// importDocument stores the original of a bundled document and registers it
+// in tableID, recording it as an upload so it counts towards the quota.
+func (s *Server) importDocument(ctx context.Context, userID, tableID string, b *tableBundle, entry bundleDocument, undo *importUndo) (*database.TableDocument, error) {
+	f, err := b.zr.Open(entry.File)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	contentType := b.contentTypes[entry.DocumentID]
+	size := b.sizes[entry.DocumentID]
+	upload, err := s.db.CreateUpload(ctx, userID, entry.FileName, contentType, size)
+	if err != nil {
+		return nil, err
+	}
+	undo.uploadIDs = append(undo.uploadIDs, upload.UploadID)
+
+	key := newBlobKey(entry.FileName)
+	undo.blobKeys = append(undo.blobKeys, key)
+	hash := sha256.New()
+	if err := s.blobs.Put(ctx, key, io.TeeReader(f, hash), size, contentType); err != nil {
+		return nil, fmt.Errorf("error storing %s: %v", entry.File, err)
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if err := s.db.CompleteUpload(ctx, upload.UploadID, key, contentType, sum); err != nil {
+		return nil, err
+	}
+
+	return s.db.AddTableDocument(ctx, tableID, userID, entry.FileName, key, sum)
+}
+
+// importBatchSize is how many chunks importChunks indexes per bulk request.
+const importBatchSize = 500
+
+// importChunks indexes the chunks of a bundle in indexName as chunks of the
+// imported documents, storing the images of image chunks again, and returns
+// how many were indexed.
+func (s *Server) importChunks(ctx context.Context, b *tableBundle, indexName string, docIDs map[string]database.TableDocument, undo *importUndo) (int, error) {
+	f, err := b.zr.Open(bundleChunksFile)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	generation := uuid.New().String()
+	var body bytes.Buffer
+	count, batched := 0, 0
+	dec := json.NewDecoder(f)
+	for {
+		var source map[string]interface{}
+		err := dec.Decode(&source)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, fmt.Errorf("invalid %s: %v", bundleChunksFile, err)
+		}
+
+		props := chunkProperties(source)
+		oldID, _ := props["document_id"].(string)
+		doc, ok := docIDs[oldID]
+		if !ok {
+			// Chunks of documents missing from the registry have no
+			// original to point at
+			continue
+		}
+		props["table_id"] = doc.TableID
+		props["document_id"] = doc.DocumentID
+		props["user_id"] = doc.UserID
+		props["file_name"] = doc.FileName
+		props["path"] = doc.FilePath
+		props["generation"] = generation
+
+		if key, outer := chunkImageKey(source); key != "" {
+			newKey := path.Join("images", doc.DocumentID, path.Base(key))
+			undo.blobKeys = append(undo.blobKeys, newKey)
+			if err := s.importBlob(ctx, b.zr, key, newKey); err != nil {
+				return count, err
+			}
+			outer["image_key"] = newKey
+		}
+
+		body.WriteString(`{"index":{}}` + "\n")
+		body.WriteString(mustToJSON(source) + "\n")
+		count++
+		batched++
+
+		if batched == importBatchSize {
+			if err := s.bulkIndex(ctx, indexName, &body); err != nil {
+				return count, err
+			}
+			body.Reset()
+			batched = 0
+		}
+	}
+
+	if batched > 0 {
+		if err := s.bulkIndex(ctx, indexName, &body); err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// importBlob stores the bundle image name under key, with its sniffed type,
+// which must be one of imageContentTypes.
+func (s *Server) importBlob(ctx context.Context, zr *zip.Reader, name, key string) error {
+	f, err := zr.Open(name)
+	if err != nil {
+		return fmt.Errorf("bundle is missing %s", name)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	br := bufio.NewReader(f)
+	head, _ := br.Peek(512)
+	contentType, _, _ := strings.Cut(http.DetectContentType(head), ";")
+	if err := checkContentType(contentType, imageContentTypes); err != nil {
+		return err
+	}
+	return s.blobs.Put(ctx, key, br, info.Size(), contentType)
+}
@@ -0,0 +1,295 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"backend/internal/database"
+	"backend/internal/storage"
+)
+
+const testBundleChunks = `{"hits":{"hits":[
+	{"_source":{"text_representation":"hello","embedding":[0.1,0.2],"properties":{"page_number":1,"properties":{"document_id":"d1","table_id":"t1","user_id":"alice"}}}},
+	{"_source":{"type":"image","text_representation":"a chart","embedding":[0.3,0.4],"properties":{"page_number":1,"image_key":"images/d1/0.png","properties":{"document_id":"d1","table_id":"t1","user_id":"alice"}}}}]},
+	"errors":false}`
+
+// exportTestBundle exports table t1 of a reindex test server, with the
+// chunks in testBundleChunks.
+func exportTestBundle(t *testing.T) []byte {
+	t.Helper()
+	s, _, _, _ := newReindexTestServer(t)
+	es, _ := newFakeES(t, testBundleChunks)
+	s.es = es
+	if err := s.blobs.Put(context.Background(), "images/d1/0.png", strings.NewReader(testPNG), int64(len(testPNG)), "image/png"); err != nil {
+		t.Fatalf("error storing image: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/table/t1/export", nil)
+	req.Header.Set("Authorization", "Bearer alice")
+	rr := httptest.NewRecorder()
+	s.RegisterRoutes().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200; got %d: %s", rr.Code, rr.Body.String())
+	}
+	return rr.Body.Bytes()
+}
+
+func newImportTestServer(t *testing.T) (*Server, *fakeDB, func() []esRequest) {
+	t.Helper()
+	blobs, err := storage.NewLocalStore(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("error creating blob store: %v", err)
+	}
+	es, esRequests := newFakeES(t, `{"errors":false}`)
+	db := newFakeDB()
+	s := &Server{
+		index:        "chunks",
+		db:           db,
+		es:           es,
+		blobs:        blobs,
+		uploadPolicy: uploadPolicy{maxFileSize: 1 << 20, userQuota: 1 << 20},
+		runScript: func(ctx context.Context, args ...string) ([]byte, error) {
+			return nil, nil
+		},
+	}
+	return s, db, esRequests
+}
+
+func importBundle(t *testing.T, s *Server, bundle []byte, query string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/tables/import"+query, bytes.NewReader(bundle))
+	req.Header.Set("Authorization", "Bearer bob")
+	rr := httptest.NewRecorder()
+	s.RegisterRoutes().ServeHTTP(rr, req)
+	return rr
+}
+
+func TestExportBundleContents(t *testing.T) {
+	bundle := exportTestBundle(t)
+	zr, err := zip.NewReader(bytes.NewReader(bundle), int64(len(bundle)))
+	if err != nil {
+		t.Fatalf("export is not a zip: %v", err)
+	}
+
+	var manifest bundleManifest
+	if err := readZipJSON(zr, bundleManifestFile, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Version != bundleVersion || manifest.EmbeddingModel != firstModel.Name {
+		t.Errorf("unexpected manifest %+v", manifest)
+	}
+
+	var docs []bundleDocument
+	if err := readZipJSON(zr, bundleDocumentsFile, &docs); err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 2 {
+		t.Fatalf("expected 2 documents in the registry; got %d", len(docs))
+	}
+	for _, name := range []string{docs[0].File, docs[1].File, bundleChunksFile, "images/d1/0.png"} {
+		if _, err := zr.Open(name); err != nil {
+			t.Errorf("expected %s in bundle: %v", name, err)
+		}
+	}
+
+	f, _ := zr.Open(bundleChunksFile)
+	chunks, _ := io.ReadAll(f)
+	if n := strings.Count(string(chunks), "\n"); n != 2 {
+		t.Errorf("expected 2 chunk lines; got %d", n)
+	}
+	if !strings.Contains(string(chunks), `"embedding":[0.1,0.2]`) {
+		t.Errorf("expected chunks to keep their embeddings; got %s", chunks)
+	}
+}
+
+func TestImportBundleReusesEmbeddings(t *testing.T) {
+	bundle := exportTestBundle(t)
+	s, db, esRequests := newImportTestServer(t)
+
+	rr := importBundle(t, s, bundle, "")
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected status 201; got %d: %s", rr.Code, rr.Body.String())
+	}
+	var result importResult
+	if err := json.NewDecoder(rr.Body).Decode(&result); err != nil {
+		t.Fatalf("error decoding response: %v", err)
+	}
+	if result.Documents != 2 || result.Chunks != 2 || result.Job != nil {
+		t.Errorf("expected 2 documents and 2 chunks without a job; got %+v", result)
+	}
+
+	table := db.tables[result.TableID]
+	if table == nil || table.UserID != "bob" || table.TableName != "notes" {
+		t.Fatalf("expected table notes owned by bob; got %+v", table)
+	}
+
+	var newDoc string
+	for _, doc := range db.docs {
+		if !doc.Ingested {
+			t.Errorf("expected imported document %s to be marked ingested", doc.DocumentID)
+		}
+		if doc.FileName == "a.pdf" {
+			newDoc = doc.DocumentID
+		}
+	}
+	if _, err := s.blobs.Stat(context.Background(), "images/"+newDoc+"/0.png"); err != nil {
+		t.Errorf("expected image to be stored for the new document: %v", err)
+	}
+
+	requests := esRequests()
+	if len(requests) != 1 {
+		t.Fatalf("expected a single bulk request; got %d", len(requests))
+	}
+	for _, want := range []string{`"table_id":"` + result.TableID + `"`, `"document_id":"` + newDoc + `"`, `"user_id":"bob"`, `"embedding":[0.1,0.2]`, `"image_key":"images/` + newDoc + `/0.png"`} {
+		if !strings.Contains(requests[0].Body, want) {
+			t.Errorf("expected bulk body to contain %s; got %s", want, requests[0].Body)
+		}
+	}
+
+	if rr := importBundle(t, s, bundle, ""); rr.Code != http.StatusConflict {
+		t.Errorf("expected importing the same name twice to conflict; got %d", rr.Code)
+	}
+	if rr := importBundle(t, s, bundle, "?table_name=copy"); rr.Code != http.StatusCreated {
+		t.Errorf("expected import under another name to succeed; got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestImportBundleReingestsOtherModels(t *testing.T) {
+	bundle := rewriteZipFile(t, exportTestBundle(t), bundleManifestFile, `{"version":1,"embedding_model":"other-model"}`)
+	s, db, esRequests := newImportTestServer(t)
+
+	rr := importBundle(t, s, bundle, "")
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected status 202; got %d: %s", rr.Code, rr.Body.String())
+	}
+	var result importResult
+	if err := json.NewDecoder(rr.Body).Decode(&result); err != nil {
+		t.Fatalf("error decoding response: %v", err)
+	}
+	if result.Job == nil || result.Job.Kind != database.JobKindImport {
+		t.Fatalf("expected an import job; got %+v", result)
+	}
+	waitForJob(t, db, result.Job.JobID)
+
+	for _, r := range esRequests() {
+		if strings.HasSuffix(r.Path, "/_bulk") {
+			t.Errorf("expected chunks embedded with another model not to be indexed; got %s", r.Body)
+		}
+	}
+}
+
+func TestImportBundleRejectsNewerVersions(t *testing.T) {
+	bundle := rewriteZipFile(t, exportTestBundle(t), bundleManifestFile, `{"version":99}`)
+	s, _, _ := newImportTestServer(t)
+
+	if rr := importBundle(t, s, bundle, ""); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400; got %d", rr.Code)
+	}
+}
+
+func TestImportBundleRejectsHugeExtractedTables(t *testing.T) {
+	bundle := rewriteZipFile(t, exportTestBundle(t), bundleExtractedTablesFile,
+		`[{"document_id":"d1","num_rows":1000000000,"num_cols":1000000000,"cells":[]}]`)
+	s, db, _ := newImportTestServer(t)
+
+	if rr := importBundle(t, s, bundle, ""); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400; got %d: %s", rr.Code, rr.Body.String())
+	}
+	if len(db.tables) != 0 {
+		t.Errorf("expected no table to be created; got %v", db.tables)
+	}
+}
+
+func TestImportBundleChecksContentTypes(t *testing.T) {
+	bundle := exportTestBundle(t)
+	zr, err := zip.NewReader(bytes.NewReader(bundle), int64(len(bundle)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var docs []bundleDocument
+	if err := readZipJSON(zr, bundleDocumentsFile, &docs); err != nil {
+		t.Fatal(err)
+	}
+	bundle = rewriteZipFile(t, bundle, docs[0].File, "<html><script>alert(1)</script></html>")
+	s, db, _ := newImportTestServer(t)
+
+	if rr := importBundle(t, s, bundle, ""); rr.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("expected status 415; got %d: %s", rr.Code, rr.Body.String())
+	}
+	if len(db.tables) != 0 || len(db.uploads) != 0 {
+		t.Errorf("expected nothing to be created; got tables %v and uploads %v", db.tables, db.uploads)
+	}
+}
+
+func TestImportBundleRollsBackOnFailure(t *testing.T) {
+	// The image is only checked as the chunks are indexed, after the
+	// documents have been stored
+	bundle := rewriteZipFile(t, exportTestBundle(t), "images/d1/0.png", "<html></html>")
+	s, db, esRequests := newImportTestServer(t)
+	dir := t.TempDir()
+	blobs, err := storage.NewLocalStore(dir, nil)
+	if err != nil {
+		t.Fatalf("error creating blob store: %v", err)
+	}
+	s.blobs = blobs
+
+	if rr := importBundle(t, s, bundle, ""); rr.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("expected status 415; got %d: %s", rr.Code, rr.Body.String())
+	}
+	if len(db.tables) != 0 || len(db.docs) != 0 || len(db.uploads) != 0 {
+		t.Errorf("expected the import to be rolled back; got tables %v, documents %v and uploads %v", db.tables, db.docs, db.uploads)
+	}
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			t.Errorf("expected the imported blobs to be deleted; found %s", path)
+		}
+		return nil
+	})
+	deleted := false
+	for _, r := range esRequests() {
+		deleted = deleted || strings.HasSuffix(r.Path, "/_delete_by_query")
+	}
+	if !deleted {
+		t.Errorf("expected the imported chunks to be deleted; requests: %+v", esRequests())
+	}
+}
+
+// rewriteZipFile returns a copy of the zip data with the file name replaced.
+func rewriteZipFile(t *testing.T, data []byte, name, content string) []byte {
+	t.Helper()
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range zr.File {
+		w, err := zw.Create(f.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Name == name {
+			io.WriteString(w, content)
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(w, rc)
+		rc.Close()
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
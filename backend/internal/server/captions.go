@@ -0,0 +1,150 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"backend/internal/config"
+)
+
+// imageCaptioner describes images in text so that they can be embedded and
+// searched like the rest of a document.
+type imageCaptioner interface {
+	Caption(ctx context.Context, image []byte, contentType string) (string, error)
+}
+
+const (
+	openAIChatEndpoint  = "https://api.openai.com/v1/chat/completions"
+	defaultCaptionModel = "gpt-4o-mini"
+
+	captionPrompt = "Describe this image from a document so that it can be found by a text search. " +
+		"Mention any text, labels, numbers and the kind of figure it is. Answer with the description only."
+)
+
+// newImageCaptioner creates the captioner cfg selects: "openai" uses the
+// OpenAI vision model cfg.Model, "none" disables captioning. When unset,
+// OpenAI is used if an API key is configured. A nil captioner means images
+// are not indexed.
+func newImageCaptioner(cfg config.Captions, apiKey string) (imageCaptioner, error) {
+	provider := cfg.Provider
+	if provider == "" && apiKey != "" {
+		provider = "openai"
+	}
+
+	switch provider {
+	case "", "none":
+		return nil, nil
+	case "openai":
+		if apiKey == "" {
+			return nil, fmt.Errorf("CAPTION_PROVIDER is openai but OPENAI_API_KEY is not set")
+		}
+		model := cfg.Model
+		if model == "" {
+			model = defaultCaptionModel
+		}
+		return &openAICaptioner{apiKey: apiKey, model: model, client: captionClient}, nil
+	default:
+		return nil, fmt.Errorf("unknown CAPTION_PROVIDER %q", provider)
+	}
+}
+
+// Requests to caption an image give up after captionTimeout in all. Models
+// answer only once the whole caption is written, so an attempt may wait
+// longer for a response than one to embed text; failures that may pass are
+// retried like those of the embedding API.
+const (
+	captionTimeout         = 2 * time.Minute
+	captionResponseTimeout = time.Minute
+)
+
+// captionClient makes the requests to caption images, tracing each attempt.
+var captionClient = &http.Client{
+	Timeout: captionTimeout,
+	Transport: retryTransport{
+		next:     tracedTransport(captionTransport(), func(*http.Request) string { return "openai captions" }),
+		attempts: embeddingAttempts,
+		backoff:  embeddingBackoff,
+	},
+}
+
+// captionTransport connects to the chat API, giving up on an attempt that
+// gets no response in time so that another one can be made.
+func captionTransport() http.RoundTripper {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSHandshakeTimeout = 5 * time.Second
+	t.ResponseHeaderTimeout = captionResponseTimeout
+	return t
+}
+
+// openAICaptioner captions images with an OpenAI chat model that accepts
+// image input.
+type openAICaptioner struct {
+	apiKey string
+	model  string
+	client *http.Client
+}
+
+func (c *openAICaptioner) Caption(ctx context.Context, image []byte, contentType string) (string, error) {
+	dataURL := fmt.Sprintf("data:%s;base64,%s", contentType, base64.StdEncoding.EncodeToString(image))
+	reqBody := map[string]interface{}{
+		"model":      c.model,
+		"max_tokens": 300,
+		"messages": []map[string]interface{}{
+			{
+				"role": "user",
+				"content": []map[string]interface{}{
+					{"type": "text", "text": captionPrompt},
+					{"type": "image_url", "image_url": map[string]string{"url": dataURL}},
+				},
+			},
+		},
+	}
+
+	jsonBody, err := json.Marshal(reqBody)
+	if err != nil {
+		return "", fmt.Errorf("error marshaling request: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, openAIChatEndpoint, bytes.NewReader(jsonBody))
+	if err != nil {
+		return "", fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.apiKey)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error making request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("error reading response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var chatResp struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(body, &chatResp); err != nil {
+		return "", fmt.Errorf("error unmarshaling response: %v", err)
+	}
+	if len(chatResp.Choices) == 0 || chatResp.Choices[0].Message.Content == "" {
+		return "", fmt.Errorf("no caption in response")
+	}
+
+	return chatResp.Choices[0].Message.Content, nil
+}
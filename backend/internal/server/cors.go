@@ -0,0 +1,176 @@
+package server
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"backend/internal/config"
+)
+
+// corsMethods are the methods a preflight may ask for, if the route allows them.
+var corsMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete,
+}
+
+// Request headers browsers may send cross-origin. Only allowed origins may
+// send credentials, so only they may send Authorization and upload.
+var (
+	openCORSHeaders    = []string{"Accept", "Content-Type", "Range", requestIDHeader}
+	allowedCORSHeaders = []string{"Accept", "Content-Type", "Range", requestIDHeader,
+		"Authorization", "Tus-Resumable", "Upload-Length", "Upload-Metadata", "Upload-Offset"}
+)
+
+// exposedCORSHeaders are the response headers scripts of other origins may read.
+const exposedCORSHeaders = "Location, Link, Deprecation, Retry-After, " + requestIDHeader + ", " +
+	"Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size, Upload-Length, Upload-Offset"
+
+// corsPolicy decides which web origins may call which routes of mux from a
+// browser. Allowed origins may call every route, with credentials; any other
+// origin may only read the routes in open, without them.
+type corsPolicy struct {
+	cfg  config.CORS
+	mux  *http.ServeMux
+	open map[string]bool
+}
+
+// middleware answers preflight requests and adds the CORS headers of the
+// policy to other requests with an Origin. Changes requested by origins the
+// policy does not allow are rejected, since browsers send some of them, such
+// as form posts, without asking first.
+func (p *corsPolicy) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+
+		// tus clients discover the server's capabilities with OPTIONS
+		// requests of their own, which are not preflights
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			p.preflight(w, r, origin)
+			return
+		}
+
+		switch {
+		case p.allowed(origin):
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+			w.Header().Set("Access-Control-Expose-Headers", exposedCORSHeaders)
+		case p.isOpen(r):
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.Header().Set("Access-Control-Expose-Headers", exposedCORSHeaders)
+		case r.Method != http.MethodGet && r.Method != http.MethodHead:
+			writeError(w, r, http.StatusForbidden, "Origin "+origin+" is not allowed")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// preflight answers a browser asking whether origin may send a request with
+// the method and headers it names. Requests the policy does not allow are
+// refused without CORS headers, which fails them in the browser.
+func (p *corsPolicy) preflight(w http.ResponseWriter, r *http.Request, origin string) {
+	w.Header().Add("Vary", "Access-Control-Request-Method")
+	w.Header().Add("Vary", "Access-Control-Request-Headers")
+
+	method := r.Header.Get("Access-Control-Request-Method")
+	methods := p.routeMethods(r)
+	headers := allowedCORSHeaders
+	trusted := p.allowed(origin)
+	if !trusted {
+		// Other origins may only read open routes
+		var open []string
+		for _, m := range methods {
+			if (m == http.MethodGet || m == http.MethodHead) && p.isOpen(withMethod(r, m)) {
+				open = append(open, m)
+			}
+		}
+		methods, headers = open, openCORSHeaders
+	}
+
+	if !slices.Contains(methods, method) || !allowsHeaders(headers, r.Header.Get("Access-Control-Request-Headers")) {
+		writeError(w, r, http.StatusForbidden, "Cross-origin request is not allowed")
+		return
+	}
+
+	h := w.Header()
+	if trusted {
+		h.Set("Access-Control-Allow-Origin", origin)
+		h.Set("Access-Control-Allow-Credentials", "true")
+	} else {
+		h.Set("Access-Control-Allow-Origin", "*")
+	}
+	h.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	h.Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+	if p.cfg.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(p.cfg.MaxAge))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// allowed reports whether origin is on the allowlist, either exactly or as a
+// subdomain of a "*." entry.
+func (p *corsPolicy) allowed(origin string) bool {
+	for _, pattern := range p.cfg.AllowedOrigins {
+		if origin == pattern {
+			return true
+		}
+		// "https://*.example.com" splits into "https://" and ".example.com"
+		prefix, suffix, ok := strings.Cut(pattern, "*")
+		if !ok || len(origin) <= len(prefix)+len(suffix) ||
+			!strings.HasPrefix(origin, prefix) || !strings.HasSuffix(origin, suffix) {
+			continue
+		}
+		if sub := origin[len(prefix) : len(origin)-len(suffix)]; !strings.ContainsAny(sub, ":/") {
+			return true
+		}
+	}
+	return false
+}
+
+// isOpen reports whether r is a read of a route any origin may read.
+func (p *corsPolicy) isOpen(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	_, pattern := p.mux.Handler(r)
+	return p.open[pattern]
+}
+
+// routeMethods returns the methods the route of r's path accepts.
+func (p *corsPolicy) routeMethods(r *http.Request) []string {
+	var methods []string
+	for _, m := range corsMethods {
+		if _, pattern := p.mux.Handler(withMethod(r, m)); pattern != "" {
+			methods = append(methods, m)
+		}
+	}
+	return methods
+}
+
+// withMethod returns a copy of r with another method.
+func withMethod(r *http.Request, method string) *http.Request {
+	r = r.Clone(r.Context())
+	r.Method = method
+	return r
+}
+
+// allowsHeaders reports whether every header of a comma separated
+// Access-Control-Request-Headers list is in allowed.
+func allowsHeaders(allowed []string, requested string) bool {
+	for _, name := range strings.Split(requested, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !slices.ContainsFunc(allowed, func(a string) bool { return strings.EqualFold(a, name) }) {
+			return false
+		}
+	}
+	return true
+}
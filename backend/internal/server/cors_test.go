@@ -0,0 +1,121 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"backend/internal/config"
+	"backend/internal/database"
+)
+
+func TestCORSAllowedOrigins(t *testing.T) {
+	p := &corsPolicy{cfg: config.CORS{AllowedOrigins: []string{"https://sharetome.app", "https://*.sharetome.app"}}}
+
+	tests := map[string]bool{
+		"https://sharetome.app":            true,
+		"https://beta.sharetome.app":       true,
+		"https://a.b.sharetome.app":        true,
+		"http://sharetome.app":             false,
+		"https://.sharetome.app":           false,
+		"https://evilsharetome.app":        false,
+		"https://sharetome.app.evil.com":   false,
+		"https://evil.com:1.sharetome.app": false,
+	}
+	for origin, want := range tests {
+		if got := p.allowed(origin); got != want {
+			t.Errorf("allowed(%q) = %v; want %v", origin, got, want)
+		}
+	}
+}
+
+func TestCORS(t *testing.T) {
+	db := newFakeDB()
+	db.tables["t1"] = &database.UserTable{UserID: "alice", TableID: "t1", TableName: "notes", IsPublic: true}
+	s := &Server{db: db, cors: config.CORS{AllowedOrigins: []string{"https://sharetome.app"}, MaxAge: 600}}
+	handler := s.RegisterRoutes()
+
+	tests := []struct {
+		name           string
+		method, path   string
+		origin         string
+		requestMethod  string // Access-Control-Request-Method of preflights
+		requestHeaders string
+		status         int
+		allowOrigin    string
+		allowMethods   string
+	}{
+		{
+			name: "preflight from allowed origin", method: http.MethodOptions, path: "/api/v1/tables/t1",
+			origin: "https://sharetome.app", requestMethod: http.MethodPatch, requestHeaders: "authorization, content-type",
+			status: http.StatusNoContent, allowOrigin: "https://sharetome.app", allowMethods: "GET, HEAD, PATCH, DELETE",
+		},
+		{
+			name: "preflight for a method the route lacks", method: http.MethodOptions, path: "/api/v1/tables/t1",
+			origin: "https://sharetome.app", requestMethod: http.MethodPost,
+			status: http.StatusForbidden,
+		},
+		{
+			name: "public read preflight from another origin", method: http.MethodOptions, path: "/api/v1/tables/t1/search",
+			origin: "https://blog.example.com", requestMethod: http.MethodGet, requestHeaders: "accept",
+			status: http.StatusNoContent, allowOrigin: "*", allowMethods: "GET, HEAD",
+		},
+		{
+			name: "credentials from another origin", method: http.MethodOptions, path: "/api/v1/tables/t1",
+			origin: "https://blog.example.com", requestMethod: http.MethodGet, requestHeaders: "authorization",
+			status: http.StatusForbidden,
+		},
+		{
+			name: "change from another origin", method: http.MethodOptions, path: "/api/v1/tables/t1",
+			origin: "https://blog.example.com", requestMethod: http.MethodDelete,
+			status: http.StatusForbidden,
+		},
+		{
+			name: "public read from another origin", method: http.MethodGet, path: "/table?table_id=t1",
+			origin: "https://blog.example.com",
+			status: http.StatusOK, allowOrigin: "*",
+		},
+		{
+			name: "private read from another origin", method: http.MethodGet, path: "/api/v1/me/starred",
+			origin: "https://blog.example.com",
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "form post from another origin", method: http.MethodPost, path: "/api/v1/tables",
+			origin: "https://blog.example.com",
+			status: http.StatusForbidden,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req.Header.Set("Origin", tt.origin)
+			if tt.requestMethod != "" {
+				req.Header.Set("Access-Control-Request-Method", tt.requestMethod)
+				req.Header.Set("Access-Control-Request-Headers", tt.requestHeaders)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tt.status {
+				t.Errorf("status = %d; want %d", rr.Code, tt.status)
+			}
+			if got := rr.Header().Get("Access-Control-Allow-Origin"); got != tt.allowOrigin {
+				t.Errorf("Access-Control-Allow-Origin = %q; want %q", got, tt.allowOrigin)
+			}
+			if got := rr.Header().Get("Access-Control-Allow-Methods"); got != tt.allowMethods {
+				t.Errorf("Access-Control-Allow-Methods = %q; want %q", got, tt.allowMethods)
+			}
+			if got := rr.Header().Get("Vary"); got != "Origin" && tt.requestMethod == "" {
+				t.Errorf("Vary = %q; want Origin", got)
+			}
+			wantCredentials := ""
+			if tt.allowOrigin == tt.origin {
+				wantCredentials = "true"
+			}
+			if got := rr.Header().Get("Access-Control-Allow-Credentials"); got != wantCredentials {
+				t.Errorf("Access-Control-Allow-Credentials = %q; want %q", got, wantCredentials)
+			}
+		})
+	}
+}
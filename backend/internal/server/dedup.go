@@ -0,0 +1,265 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"backend/internal/database"
+)
+
+// addTableDocument registers upload as a document of tableID. If the table
+// already holds a document with the same content, nothing is added and that
+// document is returned as existing instead.
+func (s *Server) addTableDocument(ctx context.Context, tableID, userID, fileName string, upload *database.Upload) (doc, existing *database.TableDocument, err error) {
+	if upload.SHA256 != "" {
+		existing, err = s.db.GetTableDocumentByHash(ctx, tableID, upload.SHA256)
+		if err != nil || existing != nil {
+			return nil, existing, err
+		}
+	}
+
+	doc, err = s.db.AddTableDocument(ctx, tableID, userID, fileName, upload.FilePath, upload.SHA256)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.recordEvent(ctx, tableID, userID, database.EventDocumentAdded, doc.DocumentID, map[string]interface{}{
+		"file_name": fileName,
+	})
+	return doc, nil, nil
+}
+
+// ingestNewDocument indexes a newly added document. When the same content has
+// already been ingested for another table, its chunks and embeddings are
+// copied instead of running the pipeline and paying for the embeddings again.
+func (s *Server) ingestNewDocument(ctx context.Context, doc database.TableDocument) error {
+	if doc.SHA256 != "" {
+		src, err := s.db.FindIngestedDocumentByHash(ctx, doc.SHA256)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error looking up documents by hash", "sha256", doc.SHA256, "err", err)
+		}
+		if src != nil && src.DocumentID != doc.DocumentID {
+			err := s.copyChunks(ctx, *src, doc)
+			if err == nil {
+				err = s.copyExtractedTables(ctx, *src, doc)
+			}
+			if err == nil {
+				slog.InfoContext(ctx, "Reused chunks of duplicate document", "source_document_id", src.DocumentID, "document_id", doc.DocumentID)
+				return s.db.MarkDocumentIngested(ctx, doc.DocumentID)
+			}
+			slog.WarnContext(ctx, "Error reusing chunks of duplicate document, ingesting instead", "source_document_id", src.DocumentID, "document_id", doc.DocumentID, "err", err)
+		}
+	}
+
+	return s.ingestDocument(ctx, doc, false)
+}
+
+// copyChunks indexes a copy of every chunk of src as a chunk of dst, then
+// removes any chunks dst had before. It fails with errOtherModel if the tables
+// of src and dst are embedded with different models.
+func (s *Server) copyChunks(ctx context.Context, src, dst database.TableDocument) (err error) {
+	srcModel, err := s.documentModel(ctx, src)
+	if err != nil {
+		return err
+	}
+	model, err := s.documentModel(ctx, dst)
+	if err != nil {
+		return err
+	}
+	if srcModel != model {
+		return fmt.Errorf("%w: document %s uses %s, not %s", errOtherModel, src.DocumentID, srcModel.Name, model.Name)
+	}
+	indexName := s.chunkIndex(model)
+
+	generation := uuid.New().String()
+	var body bytes.Buffer
+	count, batched := 0, 0
+	defer func() {
+		// Chunks of a copy that failed part way would only duplicate those
+		// the document already has
+		if err == nil || count == 0 {
+			return
+		}
+		if cleanupErr := s.deleteGeneration(context.WithoutCancel(ctx), indexName, dst.DocumentID, generation); cleanupErr != nil {
+			slog.ErrorContext(ctx, "Error deleting chunks of failed copy", "document_id", dst.DocumentID, "generation", generation, "err", cleanupErr)
+		}
+	}()
+
+	err = s.scrollChunks(ctx, indexName, "document_id", src.DocumentID, func(source map[string]interface{}) error {
+		props := chunkProperties(source)
+		props["table_id"] = dst.TableID
+		props["document_id"] = dst.DocumentID
+		props["user_id"] = dst.UserID
+		props["file_name"] = dst.FileName
+		props["path"] = dst.FilePath
+		props["generation"] = generation
+
+		body.WriteString(`{"index":{}}` + "\n")
+		body.WriteString(mustToJSON(source) + "\n")
+		count++
+		batched++
+
+		if batched == importBatchSize {
+			if err := s.bulkIndex(ctx, indexName, &body); err != nil {
+				return err
+			}
+			body.Reset()
+			batched = 0
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return fmt.Errorf("document %s has no indexed chunks", src.DocumentID)
+	}
+
+	if batched > 0 {
+		if err := s.bulkIndex(ctx, indexName, &body); err != nil {
+			return err
+		}
+	}
+	// Only now is the copy complete, so the old chunks can go
+	return s.deleteStaleChunks(ctx, indexName, dst.DocumentID, generation)
+}
+
+// scrollPageSize is how many chunks scrollChunks reads per request.
+const scrollPageSize = 500
+
+// scrollChunks calls fn with the source of every chunk whose property field
+// (table_id, document_id, ...) equals value, reading them page by page.
+func (s *Server) scrollChunks(ctx context.Context, indexName, field, value string, fn func(source map[string]interface{}) error) error {
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"filter": []map[string]interface{}{
+					{
+						"term": map[string]interface{}{
+							"properties.properties." + field + ".keyword": value,
+						},
+					},
+				},
+			},
+		},
+	}
+
+	res, err := s.es.Search(
+		s.es.Search.WithContext(ctx),
+		s.es.Search.WithIndex(indexName),
+		s.es.Search.WithBody(strings.NewReader(mustToJSON(query))),
+		s.es.Search.WithSize(scrollPageSize),
+		s.es.Search.WithSort("_doc"),
+		s.es.Search.WithScroll(time.Minute),
+	)
+
+	var scrollID string
+	defer func() {
+		if scrollID != "" {
+			if res, err := s.es.ClearScroll(s.es.ClearScroll.WithScrollID(scrollID)); err == nil {
+				res.Body.Close()
+			}
+		}
+	}()
+
+	for {
+		if err != nil {
+			return fmt.Errorf("error searching chunks: %v", err)
+		}
+		if res.IsError() {
+			res.Body.Close()
+			return fmt.Errorf("error searching chunks: %s", res.String())
+		}
+
+		var page struct {
+			ScrollID string `json:"_scroll_id"`
+			Hits     struct {
+				Hits []struct {
+					Source map[string]interface{} `json:"_source"`
+				} `json:"hits"`
+			} `json:"hits"`
+		}
+		err = json.NewDecoder(res.Body).Decode(&page)
+		res.Body.Close()
+		if err != nil {
+			return fmt.Errorf("error parsing chunks: %v", err)
+		}
+		scrollID = page.ScrollID
+
+		for _, hit := range page.Hits.Hits {
+			if err := fn(hit.Source); err != nil {
+				return err
+			}
+		}
+		// A short page is the last one
+		if len(page.Hits.Hits) < scrollPageSize || scrollID == "" {
+			return nil
+		}
+
+		res, err = s.es.Scroll(
+			s.es.Scroll.WithContext(ctx),
+			s.es.Scroll.WithScrollID(scrollID),
+			s.es.Scroll.WithScroll(time.Minute),
+		)
+	}
+}
+
+// copyExtractedTables gives dst a copy of the tables extracted from src.
+func (s *Server) copyExtractedTables(ctx context.Context, src, dst database.TableDocument) error {
+	tables, err := s.db.GetDocumentExtractedTables(ctx, src.DocumentID)
+	if err != nil {
+		return err
+	}
+	return s.db.ReplaceExtractedTables(ctx, dst.DocumentID, dst.TableID, tables)
+}
+
+// bulkIndex sends an NDJSON bulk request and fails if any action failed.
+func (s *Server) bulkIndex(ctx context.Context, indexName string, body *bytes.Buffer) error {
+	res, err := s.es.Bulk(
+		body,
+		s.es.Bulk.WithContext(ctx),
+		s.es.Bulk.WithIndex(indexName),
+		s.es.Bulk.WithRefresh("true"),
+	)
+	if err != nil {
+		return fmt.Errorf("error indexing chunks: %v", err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("error indexing chunks: %s", res.String())
+	}
+
+	var result struct {
+		Errors bool `json:"errors"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return fmt.Errorf("error parsing bulk response: %v", err)
+	}
+	if result.Errors {
+		return fmt.Errorf("some chunks failed to index")
+	}
+
+	return nil
+}
+
+// chunkProperties returns the document properties of an indexed chunk, which
+// the pipeline's Elasticsearch writer nests under properties.properties.
+func chunkProperties(source map[string]interface{}) map[string]interface{} {
+	outer, _ := source["properties"].(map[string]interface{})
+	if outer == nil {
+		outer = make(map[string]interface{})
+		source["properties"] = outer
+	}
+	inner, _ := outer["properties"].(map[string]interface{})
+	if inner == nil {
+		inner = make(map[string]interface{})
+		outer["properties"] = inner
+	}
+	return inner
+}
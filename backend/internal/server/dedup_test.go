@@ -0,0 +1,131 @@
+package server
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	"backend/internal/database"
+	"backend/internal/storage"
+)
+
+func TestAddTableDocumentLinksDuplicates(t *testing.T) {
+	db := newFakeDB()
+	s := &Server{db: db}
+	ctx := context.Background()
+
+	upload := &database.Upload{FileName: "a.pdf", FilePath: "k1/a.pdf", SHA256: "abc"}
+	doc, existing, err := s.addTableDocument(ctx, "t1", "alice", "a.pdf", upload)
+	if err != nil || doc == nil || existing != nil {
+		t.Fatalf("first add = %v, %v, %v; want new document", doc, existing, err)
+	}
+
+	again := &database.Upload{FileName: "copy.pdf", FilePath: "k2/copy.pdf", SHA256: "abc"}
+	dup, existing, err := s.addTableDocument(ctx, "t1", "alice", "copy.pdf", again)
+	if err != nil || dup != nil || existing == nil || existing.DocumentID != doc.DocumentID {
+		t.Fatalf("second add = %v, %v, %v; want existing %s", dup, existing, err, doc.DocumentID)
+	}
+
+	other, existing, err := s.addTableDocument(ctx, "t2", "alice", "a.pdf", again)
+	if err != nil || other == nil || existing != nil {
+		t.Fatalf("add to other table = %v, %v, %v; want new document", other, existing, err)
+	}
+}
+
+func TestIngestNewDocumentReusesChunks(t *testing.T) {
+
+	db := newFakeDB()
+	db.tables["t1"] = &database.UserTable{UserID: "alice", TableID: "t1", TableName: "notes"}
+	db.tables["t2"] = &database.UserTable{UserID: "bob", TableID: "t2", TableName: "papers"}
+	db.docs["d1"] = &database.TableDocument{DocumentID: "d1", TableID: "t1", UserID: "alice", FileName: "a.pdf", FilePath: "k1/a.pdf", SHA256: "abc", Ingested: true}
+	db.docs["d2"] = &database.TableDocument{DocumentID: "d2", TableID: "t2", UserID: "bob", FileName: "b.pdf", FilePath: "k2/b.pdf", SHA256: "abc"}
+
+	es, esRequests := newFakeES(t, `{"errors":false,"hits":{"hits":[{"_source":{"text_representation":"hello","embedding":[0.1,0.2],"properties":{"properties":{"document_id":"d1","table_id":"t1","user_id":"alice"}}}}]}}`)
+
+	ran := false
+	s := &Server{
+		index: "chunks",
+		db:    db,
+		es:    es,
+		runScript: func(ctx context.Context, args ...string) ([]byte, error) {
+			ran = true
+			return nil, nil
+		},
+	}
+
+	if err := s.ingestNewDocument(context.Background(), *db.docs["d2"]); err != nil {
+		t.Fatalf("ingestNewDocument: %v", err)
+	}
+	if ran {
+		t.Error("pipeline ran for a document whose content was already ingested")
+	}
+	if !db.docs["d2"].Ingested {
+		t.Error("document not marked ingested")
+	}
+
+	requests := esRequests()
+	if len(requests) != 3 {
+		t.Fatalf("got %d elasticsearch requests, want search, bulk and stale chunk deletion", len(requests))
+	}
+	if !strings.Contains(requests[0].Body, `"d1"`) {
+		t.Errorf("search body %s does not filter on the source document", requests[0].Body)
+	}
+	bulk := requests[1]
+	if !strings.HasSuffix(bulk.Path, "/_bulk") {
+		t.Errorf("second request path = %s, want bulk", bulk.Path)
+	}
+	for _, want := range []string{`"document_id":"d2"`, `"table_id":"t2"`, `"user_id":"bob"`, `"embedding":[0.1,0.2]`} {
+		if !strings.Contains(bulk.Body, want) {
+			t.Errorf("bulk body %s does not contain %s", bulk.Body, want)
+		}
+	}
+}
+
+func TestIngestNewDocumentOfOtherModel(t *testing.T) {
+	db := newFakeDB()
+	db.tables["t1"] = &database.UserTable{UserID: "alice", TableID: "t1", TableName: "notes"}
+	db.tables["t2"] = &database.UserTable{UserID: "bob", TableID: "t2", TableName: "papers", EmbeddingVersion: 2}
+	db.docs["d1"] = &database.TableDocument{DocumentID: "d1", TableID: "t1", UserID: "alice", FileName: "a.pdf", FilePath: "k1/a.pdf", SHA256: "abc", Ingested: true}
+	db.docs["d2"] = &database.TableDocument{DocumentID: "d2", TableID: "t2", UserID: "bob", FileName: "b.pdf", FilePath: "k2/b.pdf", SHA256: "abc"}
+
+	blobs, err := storage.NewLocalStore(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("error creating blob store: %v", err)
+	}
+	if err := blobs.Put(context.Background(), "k2/b.pdf", strings.NewReader("%PDF-1.7"), 8, "application/pdf"); err != nil {
+		t.Fatalf("error storing document: %v", err)
+	}
+	es, esRequests := newFakeES(t, `{"deleted":0}`)
+
+	var args []string
+	s := &Server{
+		index: "chunks",
+		db:    db,
+		es:    es,
+		blobs: blobs,
+		runScript: func(ctx context.Context, a ...string) ([]byte, error) {
+			args = a
+			return nil, nil
+		},
+	}
+
+	// Embeddings of the other model cannot be searched with this table's
+	if err := s.ingestNewDocument(context.Background(), *db.docs["d2"]); err != nil {
+		t.Fatalf("ingestNewDocument: %v", err)
+	}
+	if args == nil {
+		t.Fatal("pipeline did not run for a document whose copy is embedded with another model")
+	}
+	large := embeddingModels[2]
+	for flag, want := range map[string]string{"--embedding-model": large.Name, "--dimensions": "3072", "--index": "chunks_v2"} {
+		if i := slices.Index(args, flag); i < 0 || i+1 == len(args) || args[i+1] != want {
+			t.Errorf("pipeline args %v; want %s %s", args, flag, want)
+		}
+	}
+	for _, r := range esRequests() {
+		if strings.HasSuffix(r.Path, "/_search") || strings.HasSuffix(r.Path, "/_bulk") {
+			t.Errorf("chunks were copied: %s %s", r.Method, r.Path)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"backend/internal/database"
+)
+
+// Limits on what owners can say about their tables and themselves
+const (
+	maxDescriptionLength = 2000
+	maxTags              = 10
+	maxTagLength         = 32
+	maxDisplayNameLength = 64
+)
+
+// Page sizes of the public table directory
+const (
+	defaultDirectoryLimit = 20
+	maxDirectoryLimit     = 100
+)
+
+// publicTablesHandler lists public tables, optionally filtered by a text
+// search over names and descriptions (q) and by tags (tag, repeatable or comma
+// separated), sorted by recency or popularity.
+func (s *Server) publicTablesHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	query := database.PublicTableQuery{
+		Search: strings.TrimSpace(params.Get("q")),
+		Sort:   params.Get("sort"),
+		Tags:   normalizeTags(params["tag"]),
+		Limit:  defaultDirectoryLimit,
+	}
+
+	switch query.Sort {
+	case "":
+		query.Sort = database.PublicTableSortRecent
+	case database.PublicTableSortRecent, database.PublicTableSortPopular:
+	default:
+		writeError(w, r, http.StatusBadRequest, fmt.Sprintf("sort must be %q or %q", database.PublicTableSortRecent, database.PublicTableSortPopular))
+		return
+	}
+
+	var err error
+	if v := params.Get("limit"); v != "" {
+		if query.Limit, err = strconv.Atoi(v); err != nil || query.Limit < 1 || query.Limit > maxDirectoryLimit {
+			writeError(w, r, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxDirectoryLimit))
+			return
+		}
+	}
+	if v := params.Get("offset"); v != "" {
+		if query.Offset, err = strconv.Atoi(v); err != nil || query.Offset < 0 {
+			writeError(w, r, http.StatusBadRequest, "offset must be a non-negative integer")
+			return
+		}
+	}
+
+	tables, err := s.db.ListPublicTables(r.Context(), query)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error listing public tables", "err", err)
+		writeFailure(w, r, err, "Failed to list public tables")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(tables); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode response", "err", err)
+	}
+}
+
+type updateTableDetailsRequest struct {
+	Description string   `json:"description"`
+	Tags        []string `json:"tags"`
+}
+
+// updateTableDetailsHandler sets the description and tags a table is listed
+// with in the public directory.
+func (s *Server) updateTableDetailsHandler(w http.ResponseWriter, r *http.Request) {
+	tableID := r.PathValue("id")
+
+	userID := userIDFromRequest(r)
+	if userID == "" {
+		writeError(w, r, http.StatusUnauthorized, "Invalid or missing Authorization header")
+		return
+	}
+
+	var req updateTableDetailsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	description, tags, err := normalizeTableDetails(req.Description, req.Tags)
+	if err != nil {
+		writePolicyError(w, r, err)
+		return
+	}
+
+	ctx := r.Context()
+	table, err := s.db.GetTableByID(ctx, tableID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error getting table", "err", err)
+		writeFailure(w, r, err, "Failed to get table")
+		return
+	}
+	if table == nil || table.UserID != userID {
+		writeError(w, r, http.StatusNotFound, "Table not found")
+		return
+	}
+
+	if err := s.db.UpdateTableDetails(ctx, tableID, description, tags); err != nil {
+		slog.ErrorContext(ctx, "Error updating table details", "err", err)
+		writeFailure(w, r, err, "Failed to update table details")
+		return
+	}
+	s.recordEvent(ctx, tableID, userID, database.EventDetailsChanged, "", map[string]interface{}{
+		"description": description,
+		"tags":        tags,
+	})
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// normalizeTableDetails trims a description and normalizes tags, rejecting
+// them with a policyError if they are over the limits.
+func normalizeTableDetails(description string, tags []string) (string, []string, error) {
+	description = strings.TrimSpace(description)
+	if utf8.RuneCountInString(description) > maxDescriptionLength {
+		return "", nil, &policyError{
+			status:  http.StatusBadRequest,
+			message: fmt.Sprintf("Description is longer than %d characters", maxDescriptionLength),
+		}
+	}
+	tags = normalizeTags(tags)
+	if len(tags) > maxTags {
+		return "", nil, &policyError{
+			status:  http.StatusBadRequest,
+			message: fmt.Sprintf("A table can have at most %d tags", maxTags),
+		}
+	}
+	for _, tag := range tags {
+		if utf8.RuneCountInString(tag) > maxTagLength {
+			return "", nil, &policyError{
+				status:  http.StatusBadRequest,
+				message: fmt.Sprintf("Tag %q is longer than %d characters", tag, maxTagLength),
+			}
+		}
+	}
+	return description, tags, nil
+}
+
+// normalizeTags lowercases and trims tags, dropping empty and repeated ones.
+// Commas separate stored tags, so they cannot appear inside one.
+func normalizeTags(tags []string) []string {
+	var normalized []string
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		for _, part := range strings.Split(tag, ",") {
+			part = strings.ToLower(strings.TrimSpace(part))
+			if part == "" || seen[part] {
+				continue
+			}
+			seen[part] = true
+			normalized = append(normalized, part)
+		}
+	}
+	return normalized
+}
+
+type updateProfileRequest struct {
+	DisplayName string `json:"display_name"`
+}
+
+// updateProfileHandler sets the name the caller is shown under as the owner
+// of public tables.
+func (s *Server) updateProfileHandler(w http.ResponseWriter, r *http.Request) {
+	userID := userIDFromRequest(r)
+	if userID == "" {
+		writeError(w, r, http.StatusUnauthorized, "Invalid or missing Authorization header")
+		return
+	}
+
+	var req updateProfileRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	req.DisplayName = strings.TrimSpace(req.DisplayName)
+	if req.DisplayName == "" || utf8.RuneCountInString(req.DisplayName) > maxDisplayNameLength {
+		writeError(w, r, http.StatusBadRequest, fmt.Sprintf("display_name must be 1 to %d characters", maxDisplayNameLength))
+		return
+	}
+
+	if err := s.db.SetDisplayName(r.Context(), userID, req.DisplayName); err != nil {
+		slog.ErrorContext(r.Context(), "Error setting display name", "err", err)
+		writeFailure(w, r, err, "Failed to update profile")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
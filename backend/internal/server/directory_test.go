@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"backend/internal/database"
+)
+
+// directoryDB records the directory queries it is asked.
+type directoryDB struct {
+	*fakeDB
+	queries []database.PublicTableQuery
+}
+
+func (d *directoryDB) ListPublicTables(ctx context.Context, query database.PublicTableQuery) ([]database.PublicTable, error) {
+	d.queries = append(d.queries, query)
+	return []database.PublicTable{}, nil
+}
+
+func TestPublicTablesQuery(t *testing.T) {
+	db := &directoryDB{fakeDB: newFakeDB()}
+	handler := (&Server{db: db}).RegisterRoutes()
+
+	tests := []struct {
+		query  string
+		status int
+		want   database.PublicTableQuery
+	}{
+		{"", http.StatusOK, database.PublicTableQuery{Sort: "recent", Limit: 20}},
+		{"?q=+tax+forms&tag=Finance&tag=gov,finance&sort=popular&limit=5&offset=10", http.StatusOK,
+			database.PublicTableQuery{Search: "tax forms", Tags: []string{"finance", "gov"}, Sort: "popular", Limit: 5, Offset: 10}},
+		{"?sort=stars", http.StatusBadRequest, database.PublicTableQuery{}},
+		{"?limit=1000", http.StatusBadRequest, database.PublicTableQuery{}},
+		{"?offset=-1", http.StatusBadRequest, database.PublicTableQuery{}},
+	}
+	for _, tt := range tests {
+		db.queries = nil
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/public/tables"+tt.query, nil))
+		if rr.Code != tt.status {
+			t.Errorf("%q: expected status %d; got %d: %s", tt.query, tt.status, rr.Code, rr.Body.String())
+			continue
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		if len(db.queries) != 1 || !reflect.DeepEqual(db.queries[0], tt.want) {
+			t.Errorf("%q: queried %+v; want %+v", tt.query, db.queries, tt.want)
+		}
+		if body := strings.TrimSpace(rr.Body.String()); body != "[]" {
+			t.Errorf("%q: body = %s; want []", tt.query, body)
+		}
+	}
+}
+
+func TestUpdateTableDetails(t *testing.T) {
+	db := newFakeDB()
+	db.tables["t1"] = &database.UserTable{UserID: "alice", TableID: "t1", TableName: "notes", IsPublic: true}
+	handler := (&Server{db: db}).RegisterRoutes()
+
+	put := func(user, body string) int {
+		req := httptest.NewRequest(http.MethodPut, "/table/t1/details", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+user)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if code := put("alice", `{"description":" Lecture notes ","tags":["CS", "cs", " ml "]}`); code != http.StatusOK {
+		t.Fatalf("expected status 200; got %d", code)
+	}
+	table := db.tables["t1"]
+	if table.Description != "Lecture notes" || !reflect.DeepEqual(table.Tags, []string{"cs", "ml"}) {
+		t.Errorf("details = %q %v; want trimmed description and normalized tags", table.Description, table.Tags)
+	}
+
+	if code := put("bob", `{"description":"mine now"}`); code != http.StatusNotFound {
+		t.Errorf("update by non-owner: expected status 404; got %d", code)
+	}
+	if code := put("alice", `{"tags":["a","b","c","d","e","f","g","h","i","j","k"]}`); code != http.StatusBadRequest {
+		t.Errorf("too many tags: expected status 400; got %d", code)
+	}
+}
@@ -3,7 +3,7 @@ import sycamore
 import json
 import os
 from elasticsearch import Elasticsearch
-from sycamore.data import Document
+from sycamore.data import Document, ImageElement
 from sycamore.functions.tokenizer import OpenAITokenizer
 from sycamore.llms import AnthropicModels, Anthropic
 from sycamore.transforms import COALESCE_WHITESPACE
@@ -15,47 +15,126 @@ from sycamore.utils.pdf_utils import show_pages
 from sycamore.transforms.summarize_images import SummarizeImages
 from sycamore.context import ExecMode
 
+from contextlib import contextmanager
 from dotenv import load_dotenv
 
 load_dotenv()
 
 
+def required_env(name):
+    value = os.getenv(name)
+    if not value:
+        raise SystemExit(f"{name} is not set")
+    return value
+
+
+@contextmanager
+def traced(name, **attributes):
+    """Run the enclosed code in a span continuing the trace the server passed
+    in TRACEPARENT and TRACESTATE. Spans are only recorded when OpenTelemetry
+    is installed and configured, e.g. by running under opentelemetry-instrument.
+    """
+    try:
+        from opentelemetry import trace
+        from opentelemetry.trace.propagation.tracecontext import TraceContextTextMapPropagator
+    except ImportError:
+        yield
+        return
+
+    carrier = {}
+    for key in ("traceparent", "tracestate"):
+        if os.environ.get(key.upper()):
+            carrier[key] = os.environ[key.upper()]
+    parent = TraceContextTextMapPropagator().extract(carrier)
+    tracer = trace.get_tracer("doc_upload")
+    with tracer.start_as_current_span(name, context=parent, attributes=attributes):
+        yield
+
+
 # Sycamore uses lazy execution for efficiency, so the ETL pipeline will only execute when running cells with specific functions.
 
 
-def process_documents(file_path, file_name, user_id, table_id):
+def process_documents(
+    file_path,
+    file_name,
+    user_id,
+    table_id,
+    document_id="",
+    generation="",
+    recompute=False,
+    source_path="",
+    binary_format="pdf",
+    tables_output="",
+    images_output="",
+    embedding_model="text-embedding-3-small",
+    embedding_version=1,
+    dimensions=1536,
+    index_name="",
+):
+    # file_path is the local copy to read; source_path is where the original
+    # is stored and what search results point at.
+    source_path = source_path or file_path
     print("file_path", file_path)
+    print("source_path", source_path)
     print("file_name", file_name)
     print("user_id", user_id)
     print("table_id", table_id)
+    print("document_id", document_id)
+    print("generation", generation)
+    print("embedding_model", embedding_model, "version", embedding_version)
 
     # Initialize the Sycamore context
     ctx = sycamore.init(ExecMode.LOCAL)
-    # Set the embedding model and its parameters
-    model_name = "text-embedding-3-small"
+    # The server picks the embedding model of the table; every chunk records
+    # it so chunks of different models are never compared
+    model_name = embedding_model
     max_tokens = 8191
-    dimensions = 1536
     # Initialize the tokenizer
     tokenizer = OpenAITokenizer(model_name)
 
-    print("test1")
+    # Cache partitions per document so one upload never reads another's output.
+    # Reindexing recomputes them, since the cache is what we are trying to refresh.
+    materialize_path = "./materialize/partitioned"
+    if document_id:
+        materialize_path = os.path.join("./materialize", document_id)
 
-    ds = (
-        ctx.read.binary(file_path, binary_format="pdf")
-        # Partition and extract tables and images
-        .partition(
-            partitioner=ArynPartitioner(
-                threshold="auto",
-                use_ocr=True,
-                extract_table_structure=True,
-                extract_images=True,
+    def partition(source_mode):
+        return (
+            ctx.read.binary(file_path, binary_format=binary_format)
+            # Partition and extract tables and images
+            .partition(
+                partitioner=ArynPartitioner(
+                    threshold="auto",
+                    use_ocr=True,
+                    extract_table_structure=True,
+                    extract_images=True,
+                )
+            )
+            # Use materialize to cache output. Pass --recompute when changing upstream code or input files to create a new cache.
+            .materialize(
+                path=materialize_path,
+                source_mode=source_mode,
             )
         )
-        # Use materialize to cache output. If changing upstream code or input files, change setting from USE_STORED to RECOMPUTE to create a new cache.
-        .materialize(
-            path="./materialize/partitioned",
-            source_mode=MaterializeSourceMode.USE_STORED,
-        )
+
+    # Every pass below runs the pipeline again, and would partition the file
+    # again each time it recomputes, so recompute once and read what it stored
+    if recompute:
+        partition(MaterializeSourceMode.RECOMPUTE).execute()
+    partitioned = partition(MaterializeSourceMode.USE_STORED)
+
+    # Merging flattens tables into text and drops image bytes, so keep the
+    # cells and images before that
+    if tables_output or images_output:
+        partitioned_docs = partitioned.take_all()
+    if tables_output:
+        with open(tables_output, "w") as f:
+            json.dump(extract_tables(partitioned_docs), f)
+    if images_output:
+        extract_images(partitioned_docs, images_output)
+
+    ds = (
+        partitioned
         # Merge elements into larger chunks
         .merge(
             merger=GreedySectionMerger(
@@ -71,7 +150,11 @@ def process_documents(file_path, file_name, user_id, table_id):
                         "user_id": user_id,
                         "file_name": file_name,
                         "table_id": table_id,
-                        "path": file_path,
+                        "path": source_path,
+                        "document_id": document_id,
+                        "generation": generation,
+                        "embedding_model": embedding_model,
+                        "embedding_version": embedding_version,
                     }
                 ),
                 d,
@@ -84,7 +167,17 @@ def process_documents(file_path, file_name, user_id, table_id):
     embedded_ds = (
         # Copy document properties to each Document's sub-elements
         ds.spread_properties(
-            ["path", "entity", "file_name", "user_id", "table_id", "file_name"]
+            [
+                "path",
+                "entity",
+                "file_name",
+                "user_id",
+                "table_id",
+                "document_id",
+                "generation",
+                "embedding_model",
+                "embedding_version",
+            ]
         )
         # Convert all Elements to Documents
         .explode()
@@ -96,15 +189,19 @@ def process_documents(file_path, file_name, user_id, table_id):
 
     # Write to a persistent Elasticsearch Index. Note: You must have a specified elasticsearch instance running for this to work.
     # For more information on how to set one up, refer to https://www.elastic.co/guide/en/elasticsearch/reference/current/install-elasticsearch.html
-    url = "https://cc3161c1876b4d0c80715ef38d4eeeb6.us-west1.gcp.cloud.es.io:443"
-    index_name = "sbhacks"
+    # The server passes the cluster and index it searches in, so both agree;
+    # each embedding model has an index of its own. The server creates it,
+    # with the mapping it searches by, before running this script; the mapping
+    # below only applies if the index is missing anyway.
+    url = required_env("ELASTICSEARCH_URL")
+    index_name = index_name or required_env("ELASTICSEARCH_INDEX")
     embedded_ds.write.elasticsearch(
         url=url,
         index_name=index_name,
         es_client_args={"api_key": os.getenv("ELASTICSEARCH_API_KEY")},
         mappings={
             "properties": {
-                "embeddings": {
+                "embedding": {
                     "type": "dense_vector",
                     "dims": dimensions,
                     "index": True,
@@ -117,16 +214,119 @@ def process_documents(file_path, file_name, user_id, table_id):
     return {"status": "success", "message": "Documents processed successfully"}
 
 
-if __name__ == "__main__":
-    import sys
+def extract_tables(docs):
+    """Returns the cell structure of every table element in docs."""
+    tables = []
+    for doc in docs:
+        for element in doc.elements:
+            table = getattr(element, "table", None)
+            if element.type != "table" or table is None:
+                continue
+            tables.append(
+                {
+                    "index": len(tables),
+                    "page_number": element.properties.get("page_number", 0),
+                    "caption": getattr(table, "caption", None) or "",
+                    "bbox": list(element.bbox.coordinates) if element.bbox else None,
+                    "num_rows": table.num_rows,
+                    "num_cols": table.num_cols,
+                    "cells": [
+                        {
+                            "content": cell.content,
+                            "rows": list(cell.rows),
+                            "cols": list(cell.cols),
+                            "is_header": cell.is_header,
+                        }
+                        for cell in table.cells
+                    ],
+                }
+            )
+    return tables
+
+
+def extract_images(docs, output_dir):
+    """Saves every image element in docs as a PNG in output_dir, along with a
+    manifest.json describing where each was found."""
+    images = []
+    for doc in docs:
+        for element in doc.elements:
+            if not isinstance(element, ImageElement):
+                continue
+            image = element.as_image()
+            if image is None:
+                continue
+            file_name = f"{len(images)}.png"
+            image.save(os.path.join(output_dir, file_name), "PNG")
+            images.append(
+                {
+                    "index": len(images),
+                    "file": file_name,
+                    "page_number": element.properties.get("page_number", 0),
+                    "bbox": list(element.bbox.coordinates) if element.bbox else None,
+                }
+            )
 
-    if len(sys.argv) != 5:
-        print("Usage: python doc_upload.py file_path file_name user_id table_name")
-        sys.exit(1)
+    with open(os.path.join(output_dir, "manifest.json"), "w") as f:
+        json.dump(images, f)
 
-    file_path = sys.argv[1]
-    file_name = sys.argv[2]
-    user_id = sys.argv[3]
-    table_name = sys.argv[4]
 
-    process_documents(file_path, file_name, user_id, table_name)
+if __name__ == "__main__":
+    import argparse
+
+    parser = argparse.ArgumentParser(description="Partition, embed and index a document")
+    parser.add_argument("file_path")
+    parser.add_argument("file_name")
+    parser.add_argument("user_id")
+    parser.add_argument("table_id")
+    parser.add_argument("--source-path", default="")
+    parser.add_argument("--binary-format", default="pdf", choices=["pdf", "png", "jpeg"])
+    parser.add_argument("--document-id", default="")
+    parser.add_argument("--generation", default="")
+    parser.add_argument(
+        "--tables-output",
+        default="",
+        help="write the cell structure of extracted tables to this JSON file",
+    )
+    parser.add_argument(
+        "--images-output",
+        default="",
+        help="save extracted images and a manifest.json to this directory",
+    )
+    parser.add_argument(
+        "--recompute",
+        action="store_true",
+        help="ignore cached partitions and partition the file again",
+    )
+    parser.add_argument("--embedding-model", default="text-embedding-3-small")
+    parser.add_argument("--embedding-version", type=int, default=1)
+    parser.add_argument(
+        "--dimensions",
+        type=int,
+        default=1536,
+        help="number of dimensions of the embeddings the model returns",
+    )
+    parser.add_argument(
+        "--index",
+        default="",
+        help="index to write the chunks to instead of ELASTICSEARCH_INDEX",
+    )
+    args = parser.parse_args()
+
+    with traced("process_documents", document_id=args.document_id, table_id=args.table_id):
+        process_documents(
+            args.file_path,
+            args.file_name,
+            args.user_id,
+            args.table_id,
+            document_id=args.document_id,
+            generation=args.generation,
+            recompute=args.recompute,
+            source_path=args.source_path,
+            binary_format=args.binary_format,
+            tables_output=args.tables_output,
+            images_output=args.images_output,
+            embedding_model=args.embedding_model,
+            embedding_version=args.embedding_version,
+            dimensions=args.dimensions,
+            index_name=args.index,
+        )
@@ -0,0 +1,329 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"backend/internal/database"
+	"backend/internal/storage"
+)
+
+// pageNotFoundExit is the status render_page.py exits with when the document
+// has no page with the requested number.
+const pageNotFoundExit = 3
+
+// readableDocument returns a document if the requesting user may read it:
+// documents of public tables are readable by anyone, those of private tables
+// only by the table's owner. Documents the user may not read are reported as
+// not found so their existence is not revealed.
+func (s *Server) readableDocument(w http.ResponseWriter, r *http.Request, documentID string) *database.TableDocument {
+	ctx := r.Context()
+	doc, err := s.db.GetTableDocument(ctx, documentID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error getting document", "err", err)
+		writeFailure(w, r, err, "Failed to get document")
+		return nil
+	}
+	if doc == nil {
+		writeError(w, r, http.StatusNotFound, "Document not found")
+		return nil
+	}
+
+	table, err := s.db.GetTableByID(ctx, doc.TableID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error getting table", "err", err)
+		writeFailure(w, r, err, "Failed to get table")
+		return nil
+	}
+	if table == nil || !canReadTable(r, table) {
+		writeError(w, r, http.StatusNotFound, "Document not found")
+		return nil
+	}
+
+	return doc
+}
+
+// documentFileHandler serves the stored original of a document. Range
+// requests are supported so viewers can fetch large files piecemeal.
+func (s *Server) documentFileHandler(w http.ResponseWriter, r *http.Request) {
+	documentID := r.PathValue("id")
+
+	doc := s.readableDocument(w, r, documentID)
+	if doc == nil {
+		return
+	}
+
+	// The type sniffed when the file was uploaded, not one guessed from its
+	// client supplied name
+	var contentType string
+	upload, err := s.db.GetUploadByFilePath(r.Context(), doc.FilePath)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error getting upload", "err", err)
+		writeFailure(w, r, err, "Failed to get document")
+		return
+	}
+	if upload != nil {
+		contentType = upload.ContentType
+	}
+
+	s.serveBlob(w, r, doc.FilePath, doc.FileName, contentType)
+}
+
+// serveBlob writes the blob stored under key with http.ServeContent, which
+// handles ranges and conditional requests. Blobs that cannot seek are copied
+// to a temporary file first.
+//
+// contentType is the type the blob was found to be when it was stored, or ""
+// to sniff it from the blob now. Only types users may upload are shown
+// inline; anything else is served as a download, so that no file can run as
+// a page of the API's origin.
+func (s *Server) serveBlob(w http.ResponseWriter, r *http.Request, key, name, contentType string) {
+	ctx := r.Context()
+	info, err := s.blobs.Stat(ctx, key)
+	if errors.Is(err, storage.ErrNotFound) {
+		writeError(w, r, http.StatusNotFound, "File not found")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Error reading blob", "key", key, "err", err)
+		writeFailure(w, r, err, "Failed to read file")
+		return
+	}
+
+	blob, err := s.blobs.Get(ctx, key)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error reading blob", "key", key, "err", err)
+		writeFailure(w, r, err, "Failed to read file")
+		return
+	}
+	defer blob.Close()
+
+	content, ok := blob.(io.ReadSeeker)
+	if !ok {
+		localPath, err := s.fetchBlob(ctx, key)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error reading blob", "key", key, "err", err)
+			writeFailure(w, r, err, "Failed to read file")
+			return
+		}
+		defer os.Remove(localPath)
+
+		f, err := os.Open(localPath)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error reading blob", "key", key, "err", err)
+			writeFailure(w, r, err, "Failed to read file")
+			return
+		}
+		defer f.Close()
+		content = f
+	}
+
+	if contentType == "" {
+		if contentType, err = sniffContentType(content); err != nil {
+			slog.ErrorContext(ctx, "Error reading blob", "key", key, "err", err)
+			writeFailure(w, r, err, "Failed to read file")
+			return
+		}
+	}
+	disposition := "inline"
+	if _, ok := supportedContentTypes[contentType]; !ok {
+		contentType = "application/octet-stream"
+		disposition = "attachment"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("%s; filename=%q", disposition, name))
+	http.ServeContent(w, r, name, info.LastModified, content)
+}
+
+// documentPageHandler renders one page of a document as a PNG. With
+// ?highlight=<chunkId> the bounding box the partitioner recorded for that
+// chunk is drawn on the page.
+func (s *Server) documentPageHandler(w http.ResponseWriter, r *http.Request) {
+	documentID := r.PathValue("id")
+	// Patterns match whole segments, so the ".png" of "{n}.png" is checked here
+	page, ok := strings.CutSuffix(r.PathValue("page"), ".png")
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "Page not found")
+		return
+	}
+
+	pageNumber, err := strconv.Atoi(page)
+	if err != nil || pageNumber < 1 {
+		writeError(w, r, http.StatusBadRequest, "Invalid page number")
+		return
+	}
+
+	doc := s.readableDocument(w, r, documentID)
+	if doc == nil {
+		return
+	}
+
+	ctx := r.Context()
+	var bbox []float64
+	chunkID := r.URL.Query().Get("highlight")
+	if chunkID != "" {
+		highlighted, err := s.getChunk(ctx, chunkID)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error getting chunk", "chunk_id", chunkID, "err", err)
+			writeFailure(w, r, err, "Failed to get chunk")
+			return
+		}
+		if highlighted == nil || highlighted.DocumentID != doc.DocumentID {
+			writeError(w, r, http.StatusNotFound, "Chunk not found")
+			return
+		}
+		if highlighted.PageNumber != pageNumber {
+			writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Chunk is on page %d", highlighted.PageNumber))
+			return
+		}
+		bbox = highlighted.BBox
+	}
+
+	png, err := s.documentPage(ctx, doc, pageNumber, chunkID, bbox)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == pageNotFoundExit {
+		writeError(w, r, http.StatusNotFound, "Page not found")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Error rendering page", "document_id", doc.DocumentID, "page", pageNumber, "err", err)
+		writeFailure(w, r, err, "Failed to render page")
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	if _, err := w.Write(png); err != nil {
+		slog.ErrorContext(ctx, "Failed to write response", "err", err)
+	}
+}
+
+// renderDocumentPage draws a page of doc with render_page.py, outlining bbox
+// if it is set, and returns the PNG.
+func (s *Server) renderDocumentPage(ctx context.Context, doc *database.TableDocument, pageNumber int, bbox []float64) ([]byte, error) {
+	localPath, err := s.fetchBlob(ctx, doc.FilePath)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(localPath)
+
+	binaryFormat, err := detectBinaryFormat(localPath)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := os.CreateTemp("", "page-*.png")
+	if err != nil {
+		return nil, fmt.Errorf("error creating temporary file: %v", err)
+	}
+	out.Close()
+	defer os.Remove(out.Name())
+
+	args := []string{
+		localPath, strconv.Itoa(pageNumber), out.Name(),
+		"--binary-format", binaryFormat,
+	}
+	if len(bbox) == 4 {
+		coords := make([]string, len(bbox))
+		for i, c := range bbox {
+			coords[i] = strconv.FormatFloat(c, 'f', -1, 64)
+		}
+		args = append(args, "--bbox", strings.Join(coords, ","))
+	}
+
+	output, err := s.renderPage(ctx, args...)
+	if err != nil {
+		return nil, fmt.Errorf("%w\nOutput: %s", err, output)
+	}
+
+	return os.ReadFile(out.Name())
+}
+
+// chunk is the location of an indexed chunk within its document.
+type chunk struct {
+	DocumentID string
+	// Type is the element type of the chunk, such as "image".
+	Type       string
+	PageNumber int
+	// BBox is the chunk's bounding box as fractions of the page size:
+	// left, top, right, bottom.
+	BBox []float64
+	// ImageKey is where the image of an image chunk is stored.
+	ImageKey string
+}
+
+// getChunk looks up an indexed chunk by its Elasticsearch ID in the index of
+// every model in turn, returning nil if there is no such chunk.
+func (s *Server) getChunk(ctx context.Context, chunkID string) (*chunk, error) {
+	for _, indexName := range s.chunkIndices() {
+		c, err := s.getIndexedChunk(ctx, indexName, chunkID)
+		if c != nil || err != nil {
+			return c, err
+		}
+	}
+	return nil, nil
+}
+
+// getIndexedChunk looks up a chunk in indexName, returning nil if the chunk or
+// the index does not exist.
+func (s *Server) getIndexedChunk(ctx context.Context, indexName, chunkID string) (*chunk, error) {
+	res, err := s.es.Get(indexName, chunkID, s.es.Get.WithContext(ctx))
+	if err != nil {
+		return nil, searchFailure("error getting chunk", nil, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if res.IsError() {
+		return nil, searchFailure("error getting chunk", res, nil)
+	}
+
+	var result struct {
+		Found  bool `json:"found"`
+		Source struct {
+			Type       string    `json:"type"`
+			BBox       []float64 `json:"bbox"`
+			Properties struct {
+				PageNumber int       `json:"page_number"`
+				BBox       []float64 `json:"bbox"`
+				ImageKey   string    `json:"image_key"`
+				Properties struct {
+					DocumentID string `json:"document_id"`
+				} `json:"properties"`
+			} `json:"properties"`
+		} `json:"_source"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("error parsing chunk: %v", err)
+	}
+	if !result.Found {
+		return nil, nil
+	}
+
+	c := &chunk{
+		DocumentID: result.Source.Properties.Properties.DocumentID,
+		Type:       result.Source.Type,
+		PageNumber: result.Source.Properties.PageNumber,
+		BBox:       result.Source.BBox,
+		ImageKey:   result.Source.Properties.ImageKey,
+	}
+	if len(c.BBox) == 0 {
+		c.BBox = result.Source.Properties.BBox
+	}
+	// Images have a single page and the partitioner may not number it
+	if c.PageNumber == 0 {
+		c.PageNumber = 1
+	}
+	return c, nil
+}
@@ -0,0 +1,238 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"backend/internal/database"
+	"backend/internal/storage"
+)
+
+const testPDF = "%PDF-1.7 test document"
+
+func newDocumentTestServer(t *testing.T, esBody string) (*Server, *[][]string) {
+	t.Helper()
+
+	db := newFakeDB()
+	db.tables["private"] = &database.UserTable{UserID: "alice", TableID: "private", TableName: "notes"}
+	db.tables["public"] = &database.UserTable{UserID: "alice", TableID: "public", TableName: "papers", IsPublic: true}
+	db.docs["d1"] = &database.TableDocument{DocumentID: "d1", TableID: "private", UserID: "alice", FileName: "a.pdf", FilePath: "k1/a.pdf"}
+	db.docs["d2"] = &database.TableDocument{DocumentID: "d2", TableID: "public", UserID: "alice", FileName: "b.pdf", FilePath: "k2/b.pdf"}
+
+	blobs, err := storage.NewLocalStore(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("error creating blob store: %v", err)
+	}
+	for _, doc := range db.docs {
+		if err := blobs.Put(context.Background(), doc.FilePath, strings.NewReader(testPDF), int64(len(testPDF)), "application/pdf"); err != nil {
+			t.Fatalf("error storing %s: %v", doc.FilePath, err)
+		}
+	}
+
+	es, _ := newFakeES(t, esBody)
+
+	var renders [][]string
+	s := &Server{
+		index: "chunks",
+		db:    db,
+		es:    es,
+		blobs: blobs,
+		renderPage: func(ctx context.Context, args ...string) ([]byte, error) {
+			renders = append(renders, args)
+			return nil, os.WriteFile(args[2], []byte("\x89PNG page"), 0o600)
+		},
+	}
+	return s, &renders
+}
+
+func TestDocumentFile(t *testing.T) {
+	s, _ := newDocumentTestServer(t, `{}`)
+	handler := s.RegisterRoutes()
+
+	tests := []struct {
+		name       string
+		path       string
+		user       string
+		rangeHdr   string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "owner", path: "/documents/d1/file", user: "alice", wantStatus: http.StatusOK, wantBody: testPDF},
+		{name: "range", path: "/documents/d1/file", user: "alice", rangeHdr: "bytes=0-7", wantStatus: http.StatusPartialContent, wantBody: "%PDF-1.7"},
+		{name: "other user", path: "/documents/d1/file", user: "bob", wantStatus: http.StatusNotFound},
+		{name: "anonymous", path: "/documents/d1/file", wantStatus: http.StatusNotFound},
+		{name: "public table", path: "/documents/d2/file", user: "bob", wantStatus: http.StatusOK, wantBody: testPDF},
+		{name: "missing", path: "/documents/nope/file", user: "alice", wantStatus: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.user != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.user)
+			}
+			if tt.rangeHdr != "" {
+				req.Header.Set("Range", tt.rangeHdr)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rr.Code, tt.wantStatus, rr.Body.String())
+			}
+			if tt.wantBody != "" {
+				body, _ := io.ReadAll(rr.Body)
+				if string(body) != tt.wantBody {
+					t.Errorf("body = %q, want %q", body, tt.wantBody)
+				}
+			}
+		})
+	}
+}
+
+func TestDocumentFileContentType(t *testing.T) {
+	s, _ := newDocumentTestServer(t, `{}`)
+	s.uploadPolicy = uploadPolicy{maxFileSize: 1 << 20, userQuota: 1 << 20}
+	handler := s.RegisterRoutes()
+	db := s.db.(*fakeDB)
+
+	// A file that passes as a PDF but is named to be served as HTML
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", "x.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(part, "%PDF-1.7 <script>alert(document.cookie)</script>")
+	form.Close()
+	req := httptest.NewRequest(http.MethodPost, apiPrefix+"/files", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer alice")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("upload status = %d: %s", rr.Code, rr.Body.String())
+	}
+	var uploaded struct {
+		FilePath string `json:"filePath"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&uploaded); err != nil {
+		t.Fatal(err)
+	}
+	db.docs["d3"] = &database.TableDocument{DocumentID: "d3", TableID: "public", UserID: "alice", FileName: "x.html", FilePath: uploaded.FilePath}
+
+	// A file stored without an upload is sniffed when served
+	const page = "<html><script>alert(document.cookie)</script></html>"
+	if err := s.blobs.Put(context.Background(), "k4/y.pdf", strings.NewReader(page), int64(len(page)), "application/pdf"); err != nil {
+		t.Fatal(err)
+	}
+	db.docs["d4"] = &database.TableDocument{DocumentID: "d4", TableID: "public", UserID: "alice", FileName: "y.pdf", FilePath: "k4/y.pdf"}
+
+	tests := []struct {
+		path            string
+		wantType        string
+		wantDisposition string
+	}{
+		{"/documents/d3/file", "application/pdf", `inline; filename="x.html"`},
+		{"/documents/d4/file", "application/octet-stream", `attachment; filename="y.pdf"`},
+	}
+	for _, tt := range tests {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d: %s", tt.path, rr.Code, rr.Body.String())
+		}
+		if ct := rr.Header().Get("Content-Type"); ct != tt.wantType {
+			t.Errorf("%s: Content-Type = %q, want %q", tt.path, ct, tt.wantType)
+		}
+		if cd := rr.Header().Get("Content-Disposition"); cd != tt.wantDisposition {
+			t.Errorf("%s: Content-Disposition = %q, want %q", tt.path, cd, tt.wantDisposition)
+		}
+		if nosniff := rr.Header().Get("X-Content-Type-Options"); nosniff != "nosniff" {
+			t.Errorf("%s: X-Content-Type-Options = %q, want nosniff", tt.path, nosniff)
+		}
+	}
+}
+
+func TestDocumentPageHighlight(t *testing.T) {
+	s, renders := newDocumentTestServer(t, `{"_id":"c1","found":true,"_source":{"bbox":[0.1,0.2,0.5,0.25],"properties":{"page_number":2,"properties":{"document_id":"d1"}}}}`)
+	handler := s.RegisterRoutes()
+
+	req := httptest.NewRequest(http.MethodGet, "/documents/d1/pages/2.png?highlight=c1", nil)
+	req.Header.Set("Authorization", "Bearer alice")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "image/png" {
+		t.Errorf("Content-Type = %q, want image/png", ct)
+	}
+	if len(*renders) != 1 {
+		t.Fatalf("rendered %d times, want 1", len(*renders))
+	}
+	args := (*renders)[0]
+	if args[1] != "2" {
+		t.Errorf("rendered page %s, want 2", args[1])
+	}
+	if i := slices.Index(args, "--bbox"); i < 0 || args[i+1] != "0.1,0.2,0.5,0.25" {
+		t.Errorf("render args %v do not highlight the chunk's bbox", args)
+	}
+
+	// The chunk is not on page 1 and does not belong to document d2
+	for path, want := range map[string]int{
+		"/documents/d1/pages/1.png?highlight=c1": http.StatusBadRequest,
+		"/documents/d2/pages/2.png?highlight=c1": http.StatusNotFound,
+		"/documents/d1/pages/0.png":              http.StatusBadRequest,
+	} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer alice")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != want {
+			t.Errorf("GET %s: status = %d, want %d", path, rr.Code, want)
+		}
+	}
+}
+
+func TestDocumentPageCache(t *testing.T) {
+	s, renders := newDocumentTestServer(t, `{}`)
+	s.pages = newPageCache(1 << 20)
+	handler := s.RegisterRoutes()
+
+	for _, path := range []string{"/documents/d2/pages/1.png", "/documents/d2/pages/1.png", "/documents/d2/pages/2.png"} {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("GET %s: status = %d: %s", path, rr.Code, rr.Body.String())
+		}
+		if body := rr.Body.String(); body != "\x89PNG page" {
+			t.Errorf("GET %s: body = %q", path, body)
+		}
+	}
+	if len(*renders) != 2 {
+		t.Errorf("rendered %d times, want once per page", len(*renders))
+	}
+
+	// Pages beyond the size of the cache push out the least recently used
+	c := newPageCache(10)
+	c.add("a", []byte("12345"))
+	c.add("b", []byte("12345"))
+	c.get("a")
+	c.add("c", []byte("12345"))
+	if _, ok := c.get("b"); ok {
+		t.Error("least recently used page was kept")
+	}
+	if _, ok := c.get("a"); !ok {
+		t.Error("recently used page was dropped")
+	}
+}
@@ -2,19 +2,67 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand/v2"
 	"net/http"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"backend/internal/database"
 )
 
 const (
 	openAIEndpoint = "https://api.openai.com/v1/embeddings"
-	model          = "text-embedding-3-small"
+	// openAIModelsEndpoint describes models; reading it costs nothing.
+	openAIModelsEndpoint = "https://api.openai.com/v1/models/"
 )
 
+// embeddingModel is a model chunks are embedded with. Vectors of different
+// models cannot be compared, so each version has an index of its own and a
+// table is searched in the index of the version it records.
+type embeddingModel struct {
+	Version    int
+	Name       string
+	Dimensions int
+}
+
+// embeddingModels are the models tables can be embedded with, by version. A
+// version is never reused for another model.
+var embeddingModels = map[int]embeddingModel{
+	1: {Version: 1, Name: "text-embedding-3-small", Dimensions: 1536},
+	2: {Version: 2, Name: "text-embedding-3-large", Dimensions: 3072},
+}
+
+// modelNamed returns the model called name.
+func modelNamed(name string) (embeddingModel, bool) {
+	for _, m := range embeddingModels {
+		if m.Name == name {
+			return m, true
+		}
+	}
+	return embeddingModel{}, false
+}
+
+// tableModel returns the model the chunks of table are embedded with. Tables
+// that record no version, or one this server does not know, are taken to use
+// the first.
+func tableModel(table *database.UserTable) embeddingModel {
+	if m, ok := embeddingModels[table.EmbeddingVersion]; ok {
+		return m
+	}
+	return embeddingModels[1]
+}
+
 type EmbeddingRequest struct {
-	Input string `json:"input"`
+	Input []string `json:"input"`
 	Model string `json:"model"`
 }
 
@@ -32,10 +80,135 @@ type EmbeddingResponse struct {
 	} `json:"usage"`
 }
 
-func getEmbedding(query string, apiKey string) ([]float32, error) {
+// Requests to the embedding API give up after embeddingTimeout in all. Those
+// that fail in a way that may pass are tried up to embeddingAttempts times,
+// waiting twice as long after each attempt, from embeddingBackoff.
+const (
+	embeddingTimeout  = 30 * time.Second
+	embeddingAttempts = 3
+	embeddingBackoff  = 500 * time.Millisecond
+)
+
+// embeddingClient makes the requests to the embedding API, tracing each
+// attempt.
+var embeddingClient = &http.Client{
+	Timeout: embeddingTimeout,
+	Transport: retryTransport{
+		next:     tracedTransport(embeddingTransport(), func(*http.Request) string { return "openai embeddings" }),
+		attempts: embeddingAttempts,
+		backoff:  embeddingBackoff,
+	},
+}
+
+// embeddingTransport connects to the embedding API, giving up on an attempt
+// that gets no response in time so that another one can be made.
+func embeddingTransport() http.RoundTripper {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSHandshakeTimeout = 5 * time.Second
+	t.ResponseHeaderTimeout = 10 * time.Second
+	return t
+}
+
+// maxRetryAfter is the longest Retry-After a retryTransport waits for; a
+// response asking for a longer wait is returned instead.
+const maxRetryAfter = 10 * time.Second
+
+// retryTransport tries a request again when it fails to connect or gets 429,
+// 500, 502, 503 or 504, up to attempts times in all.
+// It waits as long as Retry-After says, or else backoff after the first
+// attempt and twice as long after each further one, with jitter so that
+// clients do not retry in step.
+type retryTransport struct {
+	next     http.RoundTripper
+	attempts int
+	backoff  time.Duration
+}
+
+func (t retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	for attempt := 1; ; attempt++ {
+		resp, err := t.next.RoundTrip(req)
+		if attempt >= t.attempts || !retryable(ctx, resp, err) {
+			return resp, err
+		}
+		// Requests whose body cannot be read again cannot be retried
+		if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+			return resp, err
+		}
+
+		wait := t.backoff << (attempt - 1)
+		wait = wait/2 + rand.N(wait/2+1)
+		if resp != nil {
+			if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+				wait = time.Duration(seconds) * time.Second
+			}
+			if wait > maxRetryAfter {
+				return resp, nil
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(ctx)
+			req.Body = body
+		}
+	}
+}
+
+// retryable reports whether a request that got resp or err may succeed if
+// made again.
+func retryable(ctx context.Context, resp *http.Response, err error) bool {
+	if err != nil {
+		return ctx.Err() == nil
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func getEmbedding(ctx context.Context, model, query string, apiKey string) ([]float32, error) {
+	embeddings, err := getEmbeddings(ctx, model, []string{query}, apiKey)
+	if err != nil {
+		return nil, err
+	}
+	return embeddings[0], nil
+}
+
+// getEmbeddings embeds inputs with model in a single request, returning their
+// embeddings in the same order.
+func getEmbeddings(ctx context.Context, model string, inputs []string, apiKey string) (embeddings [][]float32, err error) {
+	start := time.Now()
+	var tokens int
+	ctx, span := tracer.Start(ctx, "embed", trace.WithAttributes(attribute.String("embedding.model", model), attribute.Int("embedding.inputs", len(inputs))))
+	defer func() {
+		observeEmbedding(start, model, tokens, err)
+		span.SetAttributes(attribute.Int("embedding.tokens", tokens))
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "embedding failed")
+		}
+		span.End()
+	}()
+
 	// Create the request body
 	reqBody := EmbeddingRequest{
-		Input: query,
+		Input: inputs,
 		Model: model,
 	}
 	
@@ -45,7 +218,7 @@ func getEmbedding(query string, apiKey string) ([]float32, error) {
 	}
 
 	// Create the HTTP request
-	req, err := http.NewRequest("POST", openAIEndpoint, bytes.NewBuffer(jsonBody))
+	req, err := http.NewRequestWithContext(ctx, "POST", openAIEndpoint, bytes.NewBuffer(jsonBody))
 	if err != nil {
 		return nil, fmt.Errorf("error creating request: %v", err)
 	}
@@ -55,10 +228,9 @@ func getEmbedding(query string, apiKey string) ([]float32, error) {
 	req.Header.Set("Authorization", "Bearer "+apiKey)
 
 	// Make the request
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := embeddingClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("error making request: %v", err)
+		return nil, fmt.Errorf("%w: error making request: %v", errEmbeddingUnavailable, err)
 	}
 	defer resp.Body.Close()
 
@@ -70,7 +242,7 @@ func getEmbedding(query string, apiKey string) ([]float32, error) {
 
 	// Check if the response status is not 200
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(body))
+		return nil, fmt.Errorf("%w: API request failed with status %d: %s", errEmbeddingUnavailable, resp.StatusCode, string(body))
 	}
 
 	// Parse the response
@@ -78,11 +250,72 @@ func getEmbedding(query string, apiKey string) ([]float32, error) {
 	if err := json.Unmarshal(body, &embeddingResp); err != nil {
 		return nil, fmt.Errorf("error unmarshaling response: %v", err)
 	}
+	tokens = embeddingResp.Usage.TotalTokens
 
-	// Return the embedding
-	if len(embeddingResp.Data) > 0 {
-		return embeddingResp.Data[0].Embedding, nil
+	// Return the embeddings in the order of the inputs
+	if len(embeddingResp.Data) != len(inputs) {
+		return nil, fmt.Errorf("got %d embeddings for %d inputs", len(embeddingResp.Data), len(inputs))
+	}
+	embeddings = make([][]float32, len(inputs))
+	for _, d := range embeddingResp.Data {
+		if d.Index < 0 || d.Index >= len(inputs) || embeddings[d.Index] != nil {
+			return nil, fmt.Errorf("unexpected embedding index %d in response", d.Index)
+		}
+		embeddings[d.Index] = d.Embedding
 	}
+	return embeddings, nil
+}
+
+// embedder turns text into a vector with the named model, in the same space as
+// the chunks embedded with it.
+type embedder func(ctx context.Context, model, text string) ([]float32, error)
+
+// batchEmbedder embeds several texts with the named model at once, returning
+// their vectors in the same order.
+type batchEmbedder func(ctx context.Context, model string, texts []string) ([][]float32, error)
+
+// openAIEmbedder embeds text with OpenAI models, as the pipeline does.
+func openAIEmbedder(apiKey string) embedder {
+	return func(ctx context.Context, model, text string) ([]float32, error) {
+		if apiKey == "" {
+			return nil, fmt.Errorf("OpenAI API key not configured")
+		}
+		return getEmbedding(ctx, model, text, apiKey)
+	}
+}
 
-	return nil, fmt.Errorf("no embedding data in response")
+// openAIBatchEmbedder embeds texts with OpenAI models in a single request.
+func openAIBatchEmbedder(apiKey string) batchEmbedder {
+	return func(ctx context.Context, model string, texts []string) ([][]float32, error) {
+		if apiKey == "" {
+			return nil, fmt.Errorf("OpenAI API key not configured")
+		}
+		return getEmbeddings(ctx, model, texts, apiKey)
+	}
+}
+
+// openAIHealthCheck checks that the embedding API can be reached with apiKey
+// and serves model, without embedding anything.
+func openAIHealthCheck(apiKey, model string) healthCheck {
+	return func(ctx context.Context) (string, error) {
+		if apiKey == "" {
+			return "", fmt.Errorf("OpenAI API key not configured")
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, openAIModelsEndpoint+model, nil)
+		if err != nil {
+			return "", fmt.Errorf("error creating request: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+
+		resp, err := embeddingClient.Do(req)
+		if err != nil {
+			return "", fmt.Errorf("error making request: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("API request failed with status %d", resp.StatusCode)
+		}
+		return model, nil
+	}
 }
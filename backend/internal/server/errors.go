@@ -0,0 +1,209 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+
+	"backend/internal/database"
+)
+
+// Codes of error responses. Clients branch on these rather than on the
+// message, which is for people and may change.
+const (
+	codeBadRequest             = "bad_request"
+	codeUnauthorized           = "unauthorized"
+	codeForbidden              = "forbidden"
+	codeNotFound               = "not_found"
+	codeMethodNotAllowed       = "method_not_allowed"
+	codeConflict               = "conflict"
+	codeGone                   = "gone"
+	codePreconditionFailed     = "precondition_failed"
+	codeTooLarge               = "too_large"
+	codeUnsupportedMediaType   = "unsupported_media_type"
+	codeInternal               = "internal"
+	codeTimeout                = "timeout"
+	codeRateLimited            = "rate_limited"
+	codeJobRunning             = "job_running"
+	codeQuotaExceeded          = "quota_exceeded"
+	codeContentTypeNotAccepted = "content_type_not_accepted"
+	codeSearchUnavailable      = "search_unavailable"
+	codeEmbeddingUnavailable   = "embedding_unavailable"
+)
+
+// Failures of the services the server depends on. They are wrapped by the
+// errors of the operations that hit them and answered with 503, since the
+// request may succeed once the service is back.
+var (
+	errSearchUnavailable    = errors.New("search is unavailable")
+	errEmbeddingUnavailable = errors.New("embedding API is unavailable")
+)
+
+// searchFailure describes the failed Elasticsearch request what from the error
+// of the client or, if there is none, the error response res. It wraps
+// errSearchUnavailable unless the cluster rejected the request itself.
+func searchFailure(what string, res *esapi.Response, err error) error {
+	if err != nil {
+		return fmt.Errorf("%s: %w: %v", what, errSearchUnavailable, err)
+	}
+	if res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= http.StatusInternalServerError {
+		// A missing index has not been created yet, or was lost
+		return fmt.Errorf("%s: %w: %s", what, errSearchUnavailable, res.String())
+	}
+	return fmt.Errorf("%s: %s", what, res.String())
+}
+
+// problem is the body of error responses: an RFC 9457 problem details object
+// with the code of the error and the ID of the request, which is also in the
+// server's logs.
+type problem struct {
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Code      string `json:"code"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// writeError responds with status and a problem describing it with detail,
+// coded after the status.
+func writeError(w http.ResponseWriter, r *http.Request, status int, detail string) {
+	writeProblem(w, r, status, statusCode(status), detail)
+}
+
+// writeProblem responds with status and a problem with the given code and
+// detail.
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, code, detail string) {
+	body, err := json.Marshal(problem{
+		Title:     http.StatusText(status),
+		Status:    status,
+		Code:      code,
+		Detail:    detail,
+		Instance:  r.URL.Path,
+		RequestID: requestID(r.Context()),
+	})
+	if err != nil {
+		http.Error(w, detail, status)
+		return
+	}
+
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/problem+json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(append(body, '\n'))
+}
+
+// writeFailure responds to an operation that failed with err. Errors of the
+// database, search and embedding API that say why it failed get the matching
+// status, policy violations their own, and any other error 500. detail
+// describes the operation, so no internal message reaches the client; policy
+// violations are described by their message.
+func writeFailure(w http.ResponseWriter, r *http.Request, err error, detail string) {
+	var pe *policyError
+	if errors.As(err, &pe) {
+		detail = pe.message
+	}
+	status, code := errorStatus(err)
+	writeProblem(w, r, status, code, detail)
+}
+
+// errorStatus returns the status and code err is answered with.
+func errorStatus(err error) (int, string) {
+	var pe *policyError
+	switch {
+	case errors.As(err, &pe):
+		return pe.status, pe.errorCode()
+	case errors.Is(err, database.ErrNotFound):
+		return http.StatusNotFound, codeNotFound
+	case errors.Is(err, database.ErrConflict):
+		return http.StatusConflict, codeConflict
+	case errors.Is(err, database.ErrForbidden):
+		return http.StatusForbidden, codeForbidden
+	case errors.Is(err, database.ErrInvalid):
+		return http.StatusBadRequest, codeBadRequest
+	case errors.Is(err, errSearchUnavailable):
+		return http.StatusServiceUnavailable, codeSearchUnavailable
+	case errors.Is(err, errEmbeddingUnavailable):
+		return http.StatusServiceUnavailable, codeEmbeddingUnavailable
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, codeTimeout
+	}
+	return http.StatusInternalServerError, codeInternal
+}
+
+// statusCode returns the code of errors that have nothing more specific to
+// say than their status.
+func statusCode(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return codeBadRequest
+	case http.StatusUnauthorized:
+		return codeUnauthorized
+	case http.StatusForbidden:
+		return codeForbidden
+	case http.StatusNotFound:
+		return codeNotFound
+	case http.StatusMethodNotAllowed:
+		return codeMethodNotAllowed
+	case http.StatusConflict:
+		return codeConflict
+	case http.StatusGone:
+		return codeGone
+	case http.StatusPreconditionFailed:
+		return codePreconditionFailed
+	case http.StatusRequestEntityTooLarge:
+		return codeTooLarge
+	case http.StatusUnsupportedMediaType:
+		return codeUnsupportedMediaType
+	case http.StatusTooManyRequests:
+		return codeRateLimited
+	case http.StatusGatewayTimeout:
+		return codeTimeout
+	}
+	return codeInternal
+}
+
+// problemResponses answers the requests no route of mux matches, and those
+// with a method the route does not allow, with problems rather than the plain
+// text ServeMux writes.
+func problemResponses(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, pattern := mux.Handler(r); pattern == "" {
+			w = &problemWriter{ResponseWriter: w, r: r}
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// problemWriter replaces the body of error responses with a problem.
+type problemWriter struct {
+	http.ResponseWriter
+	r       *http.Request
+	problem bool
+}
+
+func (pw *problemWriter) WriteHeader(status int) {
+	if status < http.StatusBadRequest {
+		pw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	pw.problem = true
+	writeError(pw.ResponseWriter, pw.r, status, "")
+}
+
+func (pw *problemWriter) Write(b []byte) (int, error) {
+	if pw.problem {
+		return len(b), nil
+	}
+	return pw.ResponseWriter.Write(b)
+}
+
+func (pw *problemWriter) Unwrap() http.ResponseWriter {
+	return pw.ResponseWriter
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"backend/internal/database"
+)
+
+func TestProblemResponses(t *testing.T) {
+	db := newFakeDB()
+	db.tables["t1"] = &database.UserTable{UserID: "alice", TableID: "t1", TableName: "notes", IsPublic: true}
+	s := &Server{index: "chunks", db: db}
+	s.embed = func(ctx context.Context, model, text string) ([]float32, error) {
+		return nil, fmt.Errorf("%w: API request failed with status 429", errEmbeddingUnavailable)
+	}
+	handler := s.RegisterRoutes()
+
+	tests := []struct {
+		method, path string
+		status       int
+		code         string
+	}{
+		{http.MethodGet, "/nope", http.StatusNotFound, codeNotFound},
+		{http.MethodDelete, "/api/v1/tables", http.StatusMethodNotAllowed, codeMethodNotAllowed},
+		{http.MethodGet, "/api/v1/tables/t2", http.StatusNotFound, codeNotFound},
+		{http.MethodGet, "/api/v1/tables", http.StatusUnauthorized, codeUnauthorized},
+		{http.MethodGet, "/api/v1/tables/t1/search?q=notes", http.StatusServiceUnavailable, codeEmbeddingUnavailable},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		req.Header.Set(requestIDHeader, "req-1")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != tt.status {
+			t.Errorf("%s %s: status = %d; want %d", tt.method, tt.path, rr.Code, tt.status)
+		}
+		if ct := rr.Header().Get("Content-Type"); ct != "application/problem+json" {
+			t.Errorf("%s %s: Content-Type = %q; want a problem", tt.method, tt.path, ct)
+		}
+		var p problem
+		if err := json.NewDecoder(rr.Body).Decode(&p); err != nil {
+			t.Fatalf("%s %s: error decoding problem: %v", tt.method, tt.path, err)
+		}
+		if p.Status != tt.status || p.Code != tt.code || p.RequestID != "req-1" {
+			t.Errorf("%s %s: problem = %+v; want status %d, code %s and the request ID", tt.method, tt.path, p, tt.status, tt.code)
+		}
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{fmt.Errorf("table %w", database.ErrNotFound), http.StatusNotFound, codeNotFound},
+		{fmt.Errorf("failed to create user table: %w: duplicate key", database.ErrConflict), http.StatusConflict, codeConflict},
+		{database.ErrForbidden, http.StatusForbidden, codeForbidden},
+		{fmt.Errorf("error searching chunks: %w: connection refused", errSearchUnavailable), http.StatusServiceUnavailable, codeSearchUnavailable},
+		{fmt.Errorf("error getting embedding: %w", context.DeadlineExceeded), http.StatusGatewayTimeout, codeTimeout},
+		{&policyError{status: http.StatusForbidden, code: codeQuotaExceeded}, http.StatusForbidden, codeQuotaExceeded},
+		{fmt.Errorf("pq: syntax error"), http.StatusInternalServerError, codeInternal},
+	}
+	for _, tt := range tests {
+		status, code := errorStatus(tt.err)
+		if status != tt.status || code != tt.code {
+			t.Errorf("errorStatus(%v) = %d, %s; want %d, %s", tt.err, status, code, tt.status, tt.code)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"backend/internal/database"
+)
+
+// Page sizes of activity logs
+const (
+	defaultActivityLimit = 50
+	maxActivityLimit     = 200
+)
+
+// recordEvent appends an event to the log of tableID. The change it
+// describes has already happened, so failing to record it is only logged.
+func (s *Server) recordEvent(ctx context.Context, tableID, actorID, action, target string, metadata map[string]interface{}) {
+	event := database.TableEvent{
+		TableID:  tableID,
+		ActorID:  actorID,
+		Action:   action,
+		Target:   target,
+		Metadata: metadata,
+	}
+	if err := s.db.RecordTableEvent(ctx, event); err != nil {
+		slog.ErrorContext(ctx, "Error recording table event", "action", action, "table_id", tableID, "err", err)
+	}
+}
+
+// tableActivityHandler lists the events of a table, newest first, to its
+// owner. Pass the event_id of the last event as before to get the next page.
+func (s *Server) tableActivityHandler(w http.ResponseWriter, r *http.Request) {
+	tableID := r.PathValue("id")
+
+	userID := userIDFromRequest(r)
+	if userID == "" {
+		writeError(w, r, http.StatusUnauthorized, "Invalid or missing Authorization header")
+		return
+	}
+
+	before, limit, err := activityPage(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx := r.Context()
+	table, err := s.db.GetTableByID(ctx, tableID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error getting table", "err", err)
+		writeFailure(w, r, err, "Failed to get table")
+		return
+	}
+	// Events name their actors, so only the owner may read them
+	if table == nil || table.UserID != userID {
+		writeError(w, r, http.StatusNotFound, "Table not found")
+		return
+	}
+
+	events, err := s.db.GetTableEvents(ctx, tableID, before, limit)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error getting table events", "err", err)
+		writeFailure(w, r, err, "Failed to get table activity")
+		return
+	}
+	writeEvents(w, r, events)
+}
+
+// myActivityHandler lists, newest first, the events the caller performed and
+// those that happened to their tables.
+func (s *Server) myActivityHandler(w http.ResponseWriter, r *http.Request) {
+	userID := userIDFromRequest(r)
+	if userID == "" {
+		writeError(w, r, http.StatusUnauthorized, "Invalid or missing Authorization header")
+		return
+	}
+
+	before, limit, err := activityPage(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	events, err := s.db.GetUserEvents(r.Context(), userID, before, limit)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error getting user events", "err", err)
+		writeFailure(w, r, err, "Failed to get activity")
+		return
+	}
+	writeEvents(w, r, events)
+}
+
+// activityPage parses the before and limit parameters of an activity request.
+func activityPage(r *http.Request) (before int64, limit int, err error) {
+	params := r.URL.Query()
+	if v := params.Get("before"); v != "" {
+		if before, err = strconv.ParseInt(v, 10, 64); err != nil || before < 1 {
+			return 0, 0, fmt.Errorf("before must be an event ID")
+		}
+	}
+	limit = defaultActivityLimit
+	if v := params.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxActivityLimit {
+			return 0, 0, fmt.Errorf("limit must be between 1 and %d", maxActivityLimit)
+		}
+	}
+	return before, limit, nil
+}
+
+func writeEvents(w http.ResponseWriter, r *http.Request, events []database.TableEvent) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(events); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode response", "err", err)
+	}
+}
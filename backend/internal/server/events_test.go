@@ -0,0 +1,72 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"backend/internal/database"
+)
+
+func TestTableActivity(t *testing.T) {
+	db := newFakeDB()
+	db.tables["t1"] = &database.UserTable{UserID: "alice", TableID: "t1", TableName: "notes"}
+	handler := (&Server{db: db}).RegisterRoutes()
+
+	do := func(method, path, user, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if user != "" {
+			req.Header.Set("Authorization", "Bearer "+user)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := do(http.MethodPatch, "/table/t1/visibility", "bob", `{"is_public":true}`); rr.Code != http.StatusNotFound {
+		t.Errorf("visibility change by non-owner: expected status 404; got %d", rr.Code)
+	}
+	if rr := do(http.MethodPatch, "/table/t1/visibility", "alice", `{"is_public":true}`); rr.Code != http.StatusOK {
+		t.Fatalf("visibility change: expected status 200; got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := do(http.MethodPut, "/table/t1/details", "alice", `{"description":"Lecture notes","tags":["cs"]}`); rr.Code != http.StatusOK {
+		t.Fatalf("details change: expected status 200; got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	rr := do(http.MethodGet, "/table/t1/activity", "alice", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200; got %d: %s", rr.Code, rr.Body.String())
+	}
+	var events []database.TableEvent
+	if err := json.NewDecoder(rr.Body).Decode(&events); err != nil {
+		t.Fatalf("error decoding events: %v", err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("got %d events; want 2", len(events))
+	}
+	if e := events[0]; e.Action != database.EventDetailsChanged || e.ActorID != "alice" || e.Metadata["description"] != "Lecture notes" {
+		t.Errorf("newest event = %+v; want details change by alice", e)
+	}
+	if e := events[1]; e.Action != database.EventVisibilityChanged || e.Metadata["public"] != true {
+		t.Errorf("oldest event = %+v; want visibility change to public", e)
+	}
+
+	rr = do(http.MethodGet, "/table/t1/activity?limit=1&before=2", "alice", "")
+	events = nil
+	if err := json.NewDecoder(rr.Body).Decode(&events); err != nil {
+		t.Fatalf("error decoding events: %v", err)
+	}
+	if len(events) != 1 || events[0].EventID != 1 {
+		t.Errorf("page before event 2 = %+v; want event 1", events)
+	}
+
+	// The table is public now, but its log names who changed it
+	if rr := do(http.MethodGet, "/table/t1/activity", "bob", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("activity of another user's table: expected status 404; got %d", rr.Code)
+	}
+	if rr := do(http.MethodGet, "/table/t1/activity?before=x", "alice", ""); rr.Code != http.StatusBadRequest {
+		t.Errorf("invalid before: expected status 400; got %d", rr.Code)
+	}
+}
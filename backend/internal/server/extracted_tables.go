@@ -0,0 +1,168 @@
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+
+	"backend/internal/database"
+)
+
+// canReadTable reports whether the requesting user may read the contents of
+// table: anyone may read public tables, only the owner private ones.
+func canReadTable(r *http.Request, table *database.UserTable) bool {
+	return table.IsPublic || table.UserID == userIDFromRequest(r)
+}
+
+// readableTable returns a table if the requesting user may read it. Tables
+// the user may not read are reported as not found.
+func (s *Server) readableTable(w http.ResponseWriter, r *http.Request, tableID string) *database.UserTable {
+	table, err := s.db.GetTableByID(r.Context(), tableID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error getting table", "err", err)
+		writeFailure(w, r, err, "Failed to get table")
+		return nil
+	}
+	if table == nil || !canReadTable(r, table) {
+		writeError(w, r, http.StatusNotFound, "Table not found")
+		return nil
+	}
+	return table
+}
+
+// extractedTableSummary is an extracted table as listed, with links to
+// download it.
+type extractedTableSummary struct {
+	database.ExtractedTable
+	CSVURL  string `json:"csv_url"`
+	JSONURL string `json:"json_url"`
+}
+
+// listExtractedTablesHandler lists the data tables found in the documents of
+// a table.
+func (s *Server) listExtractedTablesHandler(w http.ResponseWriter, r *http.Request) {
+	tableID := r.PathValue("id")
+
+	if s.readableTable(w, r, tableID) == nil {
+		return
+	}
+
+	tables, err := s.db.GetExtractedTables(r.Context(), tableID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error getting extracted tables", "err", err)
+		writeFailure(w, r, err, "Failed to get extracted tables")
+		return
+	}
+
+	summaries := make([]extractedTableSummary, 0, len(tables))
+	for _, t := range tables {
+		base := path.Join(apiPrefix, "tables", tableID, "extracted-tables", t.ElementID)
+		summaries = append(summaries, extractedTableSummary{
+			ExtractedTable: t,
+			CSVURL:         base + ".csv",
+			JSONURL:        base + ".json",
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(summaries); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode response", "err", err)
+	}
+}
+
+// downloadExtractedTableHandler serves one extracted table as CSV or JSON,
+// chosen by the extension of the last path segment.
+func (s *Server) downloadExtractedTableHandler(w http.ResponseWriter, r *http.Request) {
+	tableID := r.PathValue("id")
+	name := r.PathValue("name")
+
+	format := path.Ext(name)
+	elementID := strings.TrimSuffix(name, format)
+	if format != ".csv" && format != ".json" {
+		writeError(w, r, http.StatusBadRequest, "Unsupported format; use .csv or .json")
+		return
+	}
+
+	if s.readableTable(w, r, tableID) == nil {
+		return
+	}
+
+	t, err := s.db.GetExtractedTable(r.Context(), elementID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error getting extracted table", "err", err)
+		writeFailure(w, r, err, "Failed to get extracted table")
+		return
+	}
+	if t == nil || t.TableID != tableID {
+		writeError(w, r, http.StatusNotFound, "Extracted table not found")
+		return
+	}
+
+	// Tables stored before they were validated may be too large to lay out
+	if err := t.Validate(); err != nil {
+		slog.WarnContext(r.Context(), "Not rendering extracted table", "element_id", elementID, "err", err)
+		writeError(w, r, http.StatusUnprocessableEntity, "Extracted table is too large or malformed to render")
+		return
+	}
+
+	fileName := fmt.Sprintf("%s-table-%d%s", strings.TrimSuffix(t.FileName, path.Ext(t.FileName)), t.Index+1, format)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fileName))
+
+	rows := tableGrid(t)
+	if format == ".csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		for _, row := range rows {
+			for i, cell := range row {
+				row[i] = csvCell(cell)
+			}
+		}
+		cw := csv.NewWriter(w)
+		if err := cw.WriteAll(rows); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to write response", "err", err)
+		}
+		return
+	}
+
+	resp := struct {
+		*database.ExtractedTable
+		Rows [][]string `json:"rows"`
+	}{t, rows}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode response", "err", err)
+	}
+}
+
+// tableGrid lays the cells of t out as rows of columns. A cell spanning
+// several rows or columns is written to the first of them and the others are
+// left empty. t must be valid, so that the grid has a bounded size.
+func tableGrid(t *database.ExtractedTable) [][]string {
+	numRows, numCols := t.GridSize()
+
+	grid := make([][]string, numRows)
+	for i := range grid {
+		grid[i] = make([]string, numCols)
+	}
+	for _, c := range t.Cells {
+		if len(c.Rows) == 0 || len(c.Cols) == 0 || c.Rows[0] < 0 || c.Cols[0] < 0 {
+			continue
+		}
+		grid[c.Rows[0]][c.Cols[0]] = c.Content
+	}
+	return grid
+}
+
+// csvCell returns content as a CSV cell that spreadsheets show as text.
+// Content extracted from an uploaded document starting with =, +, -, @, a tab
+// or a carriage return would be run as a formula, so it is prefixed with a
+// quote.
+func csvCell(content string) string {
+	if content != "" && strings.ContainsRune("=+-@\t\r", rune(content[0])) {
+		return "'" + content
+	}
+	return content
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"testing"
+
+	"backend/internal/database"
+)
+
+const testExtractedTables = `[{"index":0,"page_number":3,"num_rows":3,"num_cols":2,"cells":[
+	{"content":"Year","rows":[0],"cols":[0],"is_header":true},
+	{"content":"Revenue","rows":[0],"cols":[1],"is_header":true},
+	{"content":"2023","rows":[1],"cols":[0]},
+	{"content":"1,200","rows":[1],"cols":[1]},
+	{"content":"2024","rows":[2],"cols":[0]},
+	{"content":"1,500","rows":[2],"cols":[1]}]}]`
+
+func TestExtractedTables(t *testing.T) {
+	s, db, _, _ := newReindexTestServer(t)
+	s.runScript = func(ctx context.Context, args ...string) ([]byte, error) {
+		i := slices.Index(args, "--tables-output")
+		if i < 0 {
+			t.Fatalf("expected --tables-output in args %v", args)
+		}
+		return nil, os.WriteFile(args[i+1], []byte(testExtractedTables), 0o600)
+	}
+
+	if err := s.ingestDocument(context.Background(), *db.docs["d1"], false); err != nil {
+		t.Fatalf("error ingesting document: %v", err)
+	}
+	handler := s.RegisterRoutes()
+
+	get := func(path, user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if user != "" {
+			req.Header.Set("Authorization", "Bearer "+user)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := get("/table/t1/extracted-tables", "alice")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200; got %d: %s", rr.Code, rr.Body.String())
+	}
+	var list []extractedTableSummary
+	if err := json.NewDecoder(rr.Body).Decode(&list); err != nil {
+		t.Fatalf("error decoding response: %v", err)
+	}
+	if len(list) != 1 || list[0].PageNumber != 3 || list[0].FileName != "a.pdf" {
+		t.Fatalf("expected the table on page 3 of a.pdf; got %+v", list)
+	}
+
+	rr = get(list[0].CSVURL, "alice")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200; got %d: %s", rr.Code, rr.Body.String())
+	}
+	if want := "Year,Revenue\n2023,\"1,200\"\n2024,\"1,500\"\n"; rr.Body.String() != want {
+		t.Errorf("expected CSV %q; got %q", want, rr.Body.String())
+	}
+
+	rr = get(list[0].JSONURL, "alice")
+	var table struct {
+		Rows [][]string `json:"rows"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&table); err != nil {
+		t.Fatalf("error decoding response: %v", err)
+	}
+	if len(table.Rows) != 3 || table.Rows[2][1] != "1,500" {
+		t.Errorf("expected 3 rows ending in 1,500; got %v", table.Rows)
+	}
+
+	if rr := get("/table/t1/extracted-tables", "bob"); rr.Code != http.StatusNotFound {
+		t.Errorf("expected private table to be hidden from other users; got %d", rr.Code)
+	}
+	if rr := get("/table/t1/extracted-tables/"+list[0].ElementID+".xlsx", "alice"); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected unsupported format to be rejected; got %d", rr.Code)
+	}
+}
+
+func TestExtractedTableTooLarge(t *testing.T) {
+	s, db, _, _ := newReindexTestServer(t)
+	huge := `[{"index":0,"num_rows":2,"num_cols":2,"cells":[{"content":"x","rows":[1000000000],"cols":[1000000000]}]}]`
+	s.runScript = func(ctx context.Context, args ...string) ([]byte, error) {
+		i := slices.Index(args, "--tables-output")
+		return nil, os.WriteFile(args[i+1], []byte(huge), 0o600)
+	}
+	if err := s.ingestDocument(context.Background(), *db.docs["d1"], false); err != nil {
+		t.Fatalf("error ingesting document: %v", err)
+	}
+	if tables := db.extracted["d1"]; len(tables) != 0 {
+		t.Errorf("expected the oversized table to be dropped; got %+v", tables)
+	}
+
+	// A table stored before tables were validated is not laid out
+	db.extracted["d1"] = []database.ExtractedTable{{ElementID: "e1", DocumentID: "d1", TableID: "t1", FileName: "a.pdf",
+		NumRows: 1 << 30, NumCols: 1 << 30}}
+	req := httptest.NewRequest(http.MethodGet, "/table/t1/extracted-tables/e1.csv", nil)
+	req.Header.Set("Authorization", "Bearer alice")
+	rr := httptest.NewRecorder()
+	s.RegisterRoutes().ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected status 422; got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestCSVCell(t *testing.T) {
+	for content, want := range map[string]string{
+		"1,200":                    "1,200",
+		"":                         "",
+		"=HYPERLINK(\"http://x\")": "'=HYPERLINK(\"http://x\")",
+		"+1":                       "'+1",
+		"-2+3":                     "'-2+3",
+		"@SUM(A1:A2)":              "'@SUM(A1:A2)",
+		"\t=1":                     "'\t=1",
+		"Total = 3":                "Total = 3",
+	} {
+		if got := csvCell(content); got != want {
+			t.Errorf("csvCell(%q) = %q, want %q", content, got, want)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"backend/internal/database"
+)
+
+type forkTableRequest struct {
+	TableName string `json:"table_name"`
+}
+
+// forkResponse is the response to a fork or pull. Job is set while documents
+// are being copied from upstream.
+type forkResponse struct {
+	Table *database.UserTable    `json:"table"`
+	Job   *database.IngestionJob `json:"job,omitempty"`
+}
+
+// forkTableHandler copies a public table, with its documents and their
+// chunks, into a new private table owned by the caller. The fork remembers
+// its upstream so it can pull later changes. If the fork cannot be set up it
+// is deleted again; documents the background job fails to copy are left for
+// the next pull.
+func (s *Server) forkTableHandler(w http.ResponseWriter, r *http.Request) {
+	tableID := r.PathValue("id")
+
+	userID := userIDFromRequest(r)
+	if userID == "" {
+		writeError(w, r, http.StatusUnauthorized, "Invalid or missing Authorization header")
+		return
+	}
+
+	var req forkTableRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+	}
+
+	upstream := s.readableTable(w, r, tableID)
+	if upstream == nil {
+		return
+	}
+	if req.TableName == "" {
+		req.TableName = upstream.TableName
+	}
+
+	ctx := r.Context()
+	exists, err := s.db.TableExists(ctx, userID, req.TableName)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error checking table existence", "err", err)
+		writeFailure(w, r, err, "Failed to fork table")
+		return
+	}
+	if exists {
+		writeError(w, r, http.StatusConflict, fmt.Sprintf("A table named %q already exists; pass table_name to fork under another name", req.TableName))
+		return
+	}
+
+	upstreamDocs, err := s.db.GetTableDocuments(ctx, tableID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error getting table documents", "err", err)
+		writeFailure(w, r, err, "Failed to get table documents")
+		return
+	}
+
+	forkID, err := s.db.ForkTable(ctx, tableID, userID, req.TableName)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error forking table", "err", err)
+		writeFailure(w, r, err, "Failed to fork table")
+		return
+	}
+
+	// Documents are only registered under the lock, like those of any other
+	// ingestion
+	if err := s.lockTable(ctx, forkID); err != nil {
+		s.discardFork(context.WithoutCancel(ctx), forkID)
+		writeLockFailure(w, r, err)
+		return
+	}
+
+	// Documents still being ingested upstream have no chunks to copy yet;
+	// they arrive with the next pull.
+	var docs []database.TableDocument
+	for _, src := range upstreamDocs {
+		if !src.Ingested {
+			continue
+		}
+		doc, err := s.db.AddForkedDocument(ctx, forkID, userID, src)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error adding forked document", "err", err)
+			s.unlockTable(forkID)
+			s.discardFork(context.WithoutCancel(ctx), forkID)
+			writeFailure(w, r, err, "Failed to fork table")
+			return
+		}
+		docs = append(docs, *doc)
+	}
+
+	job, err := s.startUpstreamSync(ctx, forkID, userID, database.JobKindFork, docs)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error starting fork job", "err", err)
+		s.discardFork(context.WithoutCancel(ctx), forkID)
+		writeFailure(w, r, err, "Failed to fork table")
+		return
+	}
+
+	s.recordEvent(ctx, forkID, userID, database.EventTableForked, "", map[string]interface{}{
+		"upstream_table_id": tableID,
+		"documents":         len(docs),
+	})
+	slog.InfoContext(ctx, "Forked table", "table_id", tableID, "fork_id", forkID)
+	s.writeForkResponse(w, r, forkID, job, http.StatusCreated)
+}
+
+// discardFork deletes a fork that could not be set up, along with the
+// documents registered in it so far. No chunks have been copied yet, since
+// the job that copies them was not started.
+func (s *Server) discardFork(ctx context.Context, forkID string) {
+	if err := s.db.DeleteTable(ctx, forkID); err != nil {
+		slog.ErrorContext(ctx, "Error deleting failed fork", "table_id", forkID, "err", err)
+	}
+}
+
+// pullUpstreamHandler brings a fork up to date with its upstream table:
+// documents added upstream since the fork are copied in, and documents that
+// were re-ingested upstream since the last pull are copied again. Pulls only
+// add and refresh documents; nothing the fork holds is ever removed by one.
+func (s *Server) pullUpstreamHandler(w http.ResponseWriter, r *http.Request) {
+	tableID := r.PathValue("id")
+
+	userID := userIDFromRequest(r)
+	if userID == "" {
+		writeError(w, r, http.StatusUnauthorized, "Invalid or missing Authorization header")
+		return
+	}
+
+	ctx := r.Context()
+	fork, err := s.db.GetTableByID(ctx, tableID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error getting table", "err", err)
+		writeFailure(w, r, err, "Failed to get table")
+		return
+	}
+	if fork == nil || fork.UserID != userID {
+		writeError(w, r, http.StatusNotFound, "Table not found")
+		return
+	}
+	if fork.ForkedFrom == "" {
+		writeError(w, r, http.StatusBadRequest, "Table is not a fork")
+		return
+	}
+
+	upstream, err := s.db.GetTableByID(ctx, fork.ForkedFrom)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error getting table", "err", err)
+		writeFailure(w, r, err, "Failed to get table")
+		return
+	}
+	if upstream == nil || !canReadTable(r, upstream) {
+		writeError(w, r, http.StatusGone, "Upstream table is no longer available")
+		return
+	}
+
+	// upstreamChanges registers the documents the fork lacks, which only a
+	// holder of the lock may do
+	if err := s.lockTable(ctx, tableID); err != nil {
+		writeLockFailure(w, r, err)
+		return
+	}
+
+	docs, err := s.upstreamChanges(ctx, fork, userID)
+	if err != nil {
+		s.unlockTable(tableID)
+		slog.ErrorContext(ctx, "Error comparing fork with upstream", "table_id", tableID, "err", err)
+		writeFailure(w, r, err, "Failed to pull upstream table")
+		return
+	}
+
+	job, err := s.startUpstreamSync(ctx, tableID, userID, database.JobKindPull, docs)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error starting pull job", "err", err)
+		writeFailure(w, r, err, "Failed to pull upstream table")
+		return
+	}
+
+	s.recordEvent(ctx, tableID, userID, database.EventUpstreamPulled, "", map[string]interface{}{
+		"upstream_table_id": fork.ForkedFrom,
+		"documents":         len(docs),
+	})
+	s.writeForkResponse(w, r, tableID, job, http.StatusOK)
+}
+
+// upstreamChanges returns the documents of fork that need copying from
+// upstream, registering copies of upstream documents the fork lacks. A
+// document the fork already holds the same file as, which it may not hold
+// twice, is linked to the upstream document instead. The caller must hold the
+// lock of the fork.
+func (s *Server) upstreamChanges(ctx context.Context, fork *database.UserTable, userID string) ([]database.TableDocument, error) {
+	upstreamDocs, err := s.db.GetTableDocuments(ctx, fork.ForkedFrom)
+	if err != nil {
+		return nil, err
+	}
+	forkDocs, err := s.db.GetTableDocuments(ctx, fork.TableID)
+	if err != nil {
+		return nil, err
+	}
+
+	copies := make(map[string]database.TableDocument)
+	byHash := make(map[string]database.TableDocument)
+	for _, doc := range forkDocs {
+		if doc.SourceDocumentID != "" {
+			copies[doc.SourceDocumentID] = doc
+		}
+		if doc.SHA256 != "" {
+			byHash[doc.SHA256] = doc
+		}
+	}
+
+	var docs []database.TableDocument
+	for _, src := range upstreamDocs {
+		if !src.Ingested {
+			continue
+		}
+		doc, ok := copies[src.DocumentID]
+		if !ok && src.SHA256 != "" {
+			// The file was uploaded to the fork, or copied from an upstream
+			// document that has since been replaced
+			doc, ok = byHash[src.SHA256]
+			if ok {
+				if err := s.db.LinkForkedDocument(ctx, doc.DocumentID, src.DocumentID); err != nil {
+					return nil, err
+				}
+				doc.SourceDocumentID = src.DocumentID
+			}
+		}
+		if !ok {
+			added, err := s.db.AddForkedDocument(ctx, fork.TableID, userID, src)
+			if err != nil {
+				return nil, err
+			}
+			docs = append(docs, *added)
+			continue
+		}
+		if !doc.Ingested || fork.SyncedAt == nil || src.UpdatedAt.After(*fork.SyncedAt) {
+			docs = append(docs, doc)
+		}
+	}
+
+	return docs, nil
+}
+
+// startUpstreamSync copies docs from upstream in the background and records
+// the time the copy started as the fork's last sync once it succeeds, so
+// upstream changes made during the copy are pulled next time. It returns a
+// nil job if there is nothing to copy. The caller must hold the lock of the
+// table, which is released once the copy is done, or at once if none starts.
+func (s *Server) startUpstreamSync(ctx context.Context, tableID, userID, kind string, docs []database.TableDocument) (*database.IngestionJob, error) {
+	startedAt := time.Now()
+	if len(docs) == 0 {
+		defer s.unlockTable(tableID)
+		return nil, s.db.UpdateTableSyncedAt(ctx, tableID, startedAt)
+	}
+
+	job, err := s.db.CreateIngestionJob(ctx, tableID, userID, kind, len(docs))
+	if err != nil {
+		s.unlockTable(tableID)
+		return nil, err
+	}
+
+	// The job is updated in place while it runs
+	snapshot := *job
+	go func() {
+		s.runJob(job, docs, s.copyUpstreamDocument, nil)
+		if job.Status != database.JobStatusSucceeded {
+			return
+		}
+		if err := s.db.UpdateTableSyncedAt(context.Background(), tableID, startedAt); err != nil {
+			slog.Error("Error recording sync of fork", "table_id", tableID, "err", err)
+		}
+	}()
+
+	return &snapshot, nil
+}
+
+// copyUpstreamDocument gives a forked document the current chunks and
+// extracted tables of the upstream document it copies. Embeddings are copied
+// rather than computed again, unless the tables use different models.
+func (s *Server) copyUpstreamDocument(ctx context.Context, doc database.TableDocument) error {
+	src, err := s.db.GetTableDocument(ctx, doc.SourceDocumentID)
+	if err != nil {
+		return err
+	}
+	if src == nil {
+		return fmt.Errorf("upstream document %s no longer exists", doc.SourceDocumentID)
+	}
+
+	err = s.copyChunks(ctx, *src, doc)
+	if errors.Is(err, errOtherModel) {
+		// One of the tables has been migrated to another model since the
+		// fork, so the embeddings cannot be shared
+		return s.ingestDocument(ctx, doc, false)
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.copyExtractedTables(ctx, *src, doc); err != nil {
+		return err
+	}
+	return s.db.MarkDocumentIngested(ctx, doc.DocumentID)
+}
+
+// writeForkResponse responds with the fork and, if documents are being
+// copied, the job doing so.
+func (s *Server) writeForkResponse(w http.ResponseWriter, r *http.Request, tableID string, job *database.IngestionJob, status int) {
+	table, err := s.db.GetTableByID(r.Context(), tableID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error getting table", "err", err)
+		writeFailure(w, r, err, "Failed to get table")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if job != nil {
+		w.Header().Set("Location", apiPrefix+"/jobs/"+job.JobID)
+		status = http.StatusAccepted
+	}
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(forkResponse{Table: table, Job: job}); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode response", "err", err)
+	}
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"backend/internal/database"
+)
+
+func newForkTestServer(t *testing.T) (*Server, *fakeDB, func() []esRequest) {
+	t.Helper()
+
+	db := newFakeDB()
+	db.tables["up"] = &database.UserTable{UserID: "alice", TableID: "up", TableName: "papers", IsPublic: true, AllowedContentTypes: []string{"pdf"}}
+	db.tables["private"] = &database.UserTable{UserID: "alice", TableID: "private", TableName: "drafts"}
+	db.docs["d1"] = &database.TableDocument{DocumentID: "d1", TableID: "up", UserID: "alice", FileName: "a.pdf", FilePath: "alice/a.pdf", Ingested: true}
+
+	es, esRequests := newFakeES(t, `{"errors":false,"deleted":0,"hits":{"hits":[{"_source":{"text_representation":"hello","embedding":[0.1,0.2],"properties":{"properties":{"document_id":"d1","table_id":"up","user_id":"alice"}}}}]}}`)
+
+	s := &Server{
+		index: "chunks",
+		db:    db,
+		es:    es,
+		runScript: func(ctx context.Context, args ...string) ([]byte, error) {
+			t.Error("pipeline ran while copying from upstream")
+			return nil, nil
+		},
+	}
+	return s, db, esRequests
+}
+
+func postFork(t *testing.T, handler http.Handler, path, user, body string) (*httptest.ResponseRecorder, forkResponse) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+user)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	var resp forkResponse
+	if rr.Code < 300 {
+		if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+			t.Fatalf("error decoding response: %v", err)
+		}
+	}
+	return rr, resp
+}
+
+func TestForkTable(t *testing.T) {
+	s, db, esRequests := newForkTestServer(t)
+	handler := s.RegisterRoutes()
+
+	rr, resp := postFork(t, handler, "/table/up/fork", "bob", "")
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected status 202; got %d: %s", rr.Code, rr.Body.String())
+	}
+	if resp.Table == nil {
+		t.Fatal("response has no table")
+	}
+	fork := db.tables[resp.Table.TableID]
+	if fork.UserID != "bob" || fork.TableName != "papers" || fork.IsPublic || fork.ForkedFrom != "up" {
+		t.Fatalf("fork = %+v; want private table papers of bob forked from up", fork)
+	}
+	if resp.Job == nil || resp.Job.Kind != database.JobKindFork {
+		t.Fatalf("job = %+v; want fork job", resp.Job)
+	}
+	if job := waitForJob(t, db, resp.Job.JobID); job.Status != database.JobStatusSucceeded {
+		t.Fatalf("job status = %s: %s", job.Status, job.Error)
+	}
+
+	docs, _ := db.GetTableDocuments(context.Background(), fork.TableID)
+	if len(docs) != 1 || docs[0].SourceDocumentID != "d1" || docs[0].FilePath != "alice/a.pdf" || !docs[0].Ingested {
+		t.Fatalf("fork documents = %+v; want ingested copy of d1", docs)
+	}
+	if synced, _ := db.GetTableByID(context.Background(), fork.TableID); synced.SyncedAt == nil {
+		t.Error("fork has no sync time")
+	}
+	if upstream, _ := db.GetTableByID(context.Background(), "up"); upstream.ForkCount != 1 {
+		t.Errorf("upstream fork count = %d; want 1", upstream.ForkCount)
+	}
+
+	var bulk string
+	for _, r := range esRequests() {
+		if strings.HasSuffix(r.Path, "/_bulk") {
+			bulk = r.Body
+		}
+	}
+	for _, want := range []string{`"document_id":"` + docs[0].DocumentID + `"`, `"table_id":"` + fork.TableID + `"`, `"user_id":"bob"`, `"embedding":[0.1,0.2]`} {
+		if !strings.Contains(bulk, want) {
+			t.Errorf("bulk body %s does not contain %s", bulk, want)
+		}
+	}
+}
+
+func TestForkTableRejected(t *testing.T) {
+	s, _, _ := newForkTestServer(t)
+	handler := s.RegisterRoutes()
+
+	if rr, _ := postFork(t, handler, "/table/private/fork", "bob", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("fork of private table: expected status 404; got %d", rr.Code)
+	}
+	if rr, _ := postFork(t, handler, "/table/up/fork", "alice", ""); rr.Code != http.StatusConflict {
+		t.Errorf("fork under existing name: expected status 409; got %d", rr.Code)
+	}
+	if rr, _ := postFork(t, handler, "/table/up/fork", "alice", `{"table_name":"papers-copy"}`); rr.Code != http.StatusAccepted {
+		t.Errorf("fork under new name: expected status 202; got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestPullUpstream(t *testing.T) {
+	s, db, _ := newForkTestServer(t)
+	handler := s.RegisterRoutes()
+
+	_, resp := postFork(t, handler, "/table/up/fork", "bob", "")
+	waitForJob(t, db, resp.Job.JobID)
+	forkID := resp.Table.TableID
+
+	rr, resp := postFork(t, handler, "/table/"+forkID+"/pull", "bob", "")
+	if rr.Code != http.StatusOK || resp.Job != nil {
+		t.Fatalf("pull with no upstream changes: got %d, job %+v; want 200 and no job", rr.Code, resp.Job)
+	}
+
+	db.docs["d2"] = &database.TableDocument{DocumentID: "d2", TableID: "up", UserID: "alice", FileName: "b.pdf", FilePath: "alice/b.pdf", Ingested: true}
+	db.docs["d1"].UpdatedAt = time.Now().Add(time.Hour)
+
+	rr, resp = postFork(t, handler, "/table/"+forkID+"/pull", "bob", "")
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected status 202; got %d: %s", rr.Code, rr.Body.String())
+	}
+	if resp.Job.Total != 2 {
+		t.Errorf("pull job total = %d; want new and updated document", resp.Job.Total)
+	}
+	waitForJob(t, db, resp.Job.JobID)
+
+	docs, _ := db.GetTableDocuments(context.Background(), forkID)
+	if len(docs) != 2 {
+		t.Errorf("fork has %d documents after pull; want 2", len(docs))
+	}
+
+	if rr, _ := postFork(t, handler, "/table/"+forkID+"/pull", "alice", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("pull by non-owner: expected status 404; got %d", rr.Code)
+	}
+	if rr, _ := postFork(t, handler, "/table/up/pull", "alice", ""); rr.Code != http.StatusBadRequest {
+		t.Errorf("pull of non-fork: expected status 400; got %d", rr.Code)
+	}
+
+	db.tables["up"].IsPublic = false
+	if rr, _ := postFork(t, handler, "/table/"+forkID+"/pull", "bob", ""); rr.Code != http.StatusGone {
+		t.Errorf("pull of private upstream: expected status 410; got %d", rr.Code)
+	}
+}
+
+// failingForkDB fails to register forked documents.
+type failingForkDB struct {
+	*fakeDB
+}
+
+func (f failingForkDB) AddForkedDocument(ctx context.Context, tableID, userID string, source database.TableDocument) (*database.TableDocument, error) {
+	return nil, errors.New("connection reset")
+}
+
+func TestForkTableFailureDeletesFork(t *testing.T) {
+	s, db, _ := newForkTestServer(t)
+	s.db = failingForkDB{db}
+
+	if rr, _ := postFork(t, s.RegisterRoutes(), "/table/up/fork", "bob", ""); rr.Code != http.StatusInternalServerError {
+		t.Fatalf("expected status 500; got %d: %s", rr.Code, rr.Body.String())
+	}
+	for id, table := range db.tables {
+		if table.UserID == "bob" {
+			t.Errorf("fork %s was left behind after failing", id)
+		}
+	}
+}
+
+func TestPullUpstreamLinksSameFile(t *testing.T) {
+	s, db, _ := newForkTestServer(t)
+	handler := s.RegisterRoutes()
+
+	_, resp := postFork(t, handler, "/table/up/fork", "bob", "")
+	waitForJob(t, db, resp.Job.JobID)
+	forkID := resp.Table.TableID
+
+	// bob uploads a file to the fork that is then added upstream as well
+	db.docs["mine"] = &database.TableDocument{DocumentID: "mine", TableID: forkID, UserID: "bob", FileName: "c.pdf", FilePath: "bob/c.pdf", SHA256: "abc", Ingested: true}
+	db.docs["d3"] = &database.TableDocument{DocumentID: "d3", TableID: "up", UserID: "alice", FileName: "c.pdf", FilePath: "alice/c.pdf", SHA256: "abc", Ingested: true}
+
+	rr, resp := postFork(t, handler, "/table/"+forkID+"/pull", "bob", "")
+	if rr.Code != http.StatusOK && rr.Code != http.StatusAccepted {
+		t.Fatalf("expected pull to succeed; got %d: %s", rr.Code, rr.Body.String())
+	}
+	if resp.Job != nil {
+		waitForJob(t, db, resp.Job.JobID)
+	}
+
+	docs, _ := db.GetTableDocuments(context.Background(), forkID)
+	if len(docs) != 2 {
+		t.Fatalf("fork has %d documents after pull; want the copy of d1 and bob's file", len(docs))
+	}
+	if db.docs["mine"].SourceDocumentID != "d3" {
+		t.Errorf("source of bob's file = %q; want it linked to d3", db.docs["mine"].SourceDocumentID)
+	}
+}
+
+func TestPullUpstreamLocksBeforeRegistering(t *testing.T) {
+	s, db, _ := newForkTestServer(t)
+	handler := s.RegisterRoutes()
+
+	_, resp := postFork(t, handler, "/table/up/fork", "bob", "")
+	waitForJob(t, db, resp.Job.JobID)
+	forkID := resp.Table.TableID
+
+	db.docs["d2"] = &database.TableDocument{DocumentID: "d2", TableID: "up", UserID: "alice", FileName: "b.pdf", FilePath: "alice/b.pdf", Ingested: true}
+	db.locks[forkID] = "other-replica"
+
+	if rr, _ := postFork(t, handler, "/table/"+forkID+"/pull", "bob", ""); rr.Code != http.StatusConflict {
+		t.Fatalf("pull of locked fork: expected status 409; got %d", rr.Code)
+	}
+	if docs, _ := db.GetTableDocuments(context.Background(), forkID); len(docs) != 1 {
+		t.Errorf("fork has %d documents after a rejected pull; want 1", len(docs))
+	}
+}
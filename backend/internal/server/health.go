@@ -0,0 +1,200 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// readyCheckTimeout bounds each dependency check of a readiness probe.
+const readyCheckTimeout = 2 * time.Second
+
+// Statuses of readiness checks and of the server as a whole
+const (
+	checkStatusUp   = "up"
+	checkStatusDown = "down"
+
+	readyStatusReady    = "ready"
+	readyStatusDegraded = "degraded"
+	readyStatusUnready  = "unready"
+)
+
+// healthCheck reports whether a dependency works, returning details to show
+// in the readiness response.
+type healthCheck func(ctx context.Context) (string, error)
+
+// readinessCheck is a named health check. The server is not ready while a
+// critical check fails; other failures only degrade it.
+type readinessCheck struct {
+	name     string
+	critical bool
+	check    healthCheck
+}
+
+// checkResult is the outcome of a readiness check.
+type checkResult struct {
+	Status     string  `json:"status"`
+	Critical   bool    `json:"critical"`
+	Detail     string  `json:"detail,omitempty"`
+	Error      string  `json:"error,omitempty"`
+	DurationMS float64 `json:"duration_ms"`
+}
+
+// readinessResponse is the body of a readiness probe.
+type readinessResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks"`
+}
+
+// livezHandler reports that the process is up and serving requests. It does
+// not check dependencies, so an outage of one never gets the server restarted.
+func (s *Server) livezHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]string{"status": "ok"}); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode response", "err", err)
+	}
+}
+
+// readyzHandler checks the server's dependencies in parallel and reports the
+// status of each. It answers 503 while a critical dependency is down.
+func (s *Server) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	checks := s.readinessChecks()
+	results := make([]checkResult, len(checks))
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = runCheck(r.Context(), c)
+		}()
+	}
+	wg.Wait()
+
+	resp := readinessResponse{Status: readyStatusReady, Checks: make(map[string]checkResult)}
+	for i, c := range checks {
+		result := results[i]
+		resp.Checks[c.name] = result
+		if result.Status == checkStatusUp {
+			continue
+		}
+		if c.critical {
+			resp.Status = readyStatusUnready
+		} else if resp.Status == readyStatusReady {
+			resp.Status = readyStatusDegraded
+		}
+		slog.WarnContext(r.Context(), "Readiness check failed", "check", c.name, "err", result.Error)
+	}
+
+	status := http.StatusOK
+	if resp.Status == readyStatusUnready {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode response", "err", err)
+	}
+}
+
+// runCheck runs c with a timeout and records how it went.
+func runCheck(ctx context.Context, c readinessCheck) checkResult {
+	ctx, cancel := context.WithTimeout(ctx, readyCheckTimeout)
+	defer cancel()
+
+	start := time.Now()
+	detail, err := c.check(ctx)
+	result := checkResult{
+		Status:     checkStatusUp,
+		Critical:   c.critical,
+		Detail:     detail,
+		DurationMS: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		result.Status = checkStatusDown
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// readinessChecks lists the dependencies a readiness probe checks. Search and
+// the database are needed by every request; without the embedder or the
+// pipeline only search and ingestion fail.
+func (s *Server) readinessChecks() []readinessCheck {
+	checks := []readinessCheck{
+		{name: "postgres", critical: true, check: s.checkDatabase},
+		{name: "elasticsearch", critical: true, check: s.checkElasticsearch},
+		{name: "ingestion", check: s.checkIngestion},
+	}
+	if s.checkEmbedder != nil {
+		checks = append(checks, readinessCheck{name: "embedder", check: s.checkEmbedder})
+	}
+	return checks
+}
+
+func (s *Server) checkDatabase(ctx context.Context) (string, error) {
+	if err := s.db.Ping(ctx); err != nil {
+		return "", err
+	}
+	stats := s.db.Stats()
+	return fmt.Sprintf("%d open connections, %d in use", stats.OpenConnections, stats.InUse), nil
+}
+
+// checkElasticsearch checks that the cluster is not red and that the index
+// chunks are written to exists.
+func (s *Server) checkElasticsearch(ctx context.Context) (string, error) {
+	indexName := s.chunkIndex(s.model)
+
+	res, err := s.es.Cluster.Health(s.es.Cluster.Health.WithContext(ctx))
+	if err != nil {
+		return "", fmt.Errorf("error getting cluster health: %v", err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return "", fmt.Errorf("error getting cluster health: %s", res.Status())
+	}
+	var health struct {
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&health); err != nil {
+		return "", fmt.Errorf("error parsing cluster health: %v", err)
+	}
+	if health.Status == "red" {
+		return "", fmt.Errorf("cluster status is red")
+	}
+
+	res, err = s.es.Indices.Exists([]string{indexName}, s.es.Indices.Exists.WithContext(ctx))
+	if err != nil {
+		return "", fmt.Errorf("error checking index %s: %v", indexName, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return "", fmt.Errorf("index %s does not exist", indexName)
+	}
+	if res.IsError() {
+		return "", fmt.Errorf("error checking index %s: %s", indexName, res.Status())
+	}
+
+	return fmt.Sprintf("cluster %s, index %s", health.Status, indexName), nil
+}
+
+// checkIngestion reports the running ingestion jobs, and fails if the
+// pipeline's interpreter is missing.
+func (s *Server) checkIngestion(ctx context.Context) (string, error) {
+	running := 0
+	s.ingesting.Range(func(_, _ any) bool {
+		running++
+		return true
+	})
+	detail := fmt.Sprintf("%d jobs running", running)
+
+	if _, err := exec.LookPath("python3"); err != nil {
+		return detail, fmt.Errorf("pipeline interpreter not found: %v", err)
+	}
+	return detail, nil
+}
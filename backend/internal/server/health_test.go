@@ -0,0 +1,59 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLivez(t *testing.T) {
+	rr := httptest.NewRecorder()
+	(&Server{}).livezHandler(rr, httptest.NewRequest(http.MethodGet, "/livez", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("status = %d; want 200", rr.Code)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	es, _ := newFakeES(t, `{"status":"yellow"}`)
+	db := newFakeDB()
+	s := &Server{
+		index: "chunks",
+		db:    db,
+		es:    es,
+		checkEmbedder: func(ctx context.Context) (string, error) {
+			return "", errors.New("connection refused")
+		},
+	}
+
+	get := func() (int, readinessResponse) {
+		rr := httptest.NewRecorder()
+		s.readyzHandler(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		var resp readinessResponse
+		if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+			t.Fatalf("error decoding response: %v", err)
+		}
+		return rr.Code, resp
+	}
+
+	// The embedder is not needed to serve most requests
+	code, resp := get()
+	if code != http.StatusOK || resp.Status != readyStatusDegraded {
+		t.Errorf("got %d %s; want 200 degraded", code, resp.Status)
+	}
+	if resp.Checks["postgres"].Status != checkStatusUp || resp.Checks["elasticsearch"].Status != checkStatusUp {
+		t.Errorf("checks = %+v; want postgres and elasticsearch up", resp.Checks)
+	}
+	if got := resp.Checks["embedder"]; got.Status != checkStatusDown || got.Error != "connection refused" {
+		t.Errorf("embedder check = %+v; want down with its error", got)
+	}
+
+	db.pingErr = errors.New("connection reset")
+	code, resp = get()
+	if code != http.StatusServiceUnavailable || resp.Status != readyStatusUnready {
+		t.Errorf("got %d %s with the database down; want 503 unready", code, resp.Status)
+	}
+}
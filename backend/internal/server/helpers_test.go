@@ -0,0 +1,591 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+
+	"backend/internal/database"
+)
+
+// firstModel is the embedding model of tables that record none.
+var firstModel = embeddingModels[1]
+
+// fakeDB is an in-memory database.Service. Methods a test does not need fall
+// through to the embedded nil interface and panic.
+type fakeDB struct {
+	database.Service
+
+	mu      sync.Mutex
+	tables  map[string]*database.UserTable
+	docs    map[string]*database.TableDocument
+	jobs    map[string]*database.IngestionJob
+	uploads map[string]*database.Upload
+	// uploadParts holds the parts of unfinished uploads by upload ID.
+	uploadParts map[string][]database.UploadPart
+	// extracted holds the extracted tables of each document.
+	extracted map[string][]database.ExtractedTable
+	// stars holds the [user, table] pairs of starred tables.
+	stars map[[2]string]bool
+	// events is the table event log, oldest first.
+	events []database.TableEvent
+	// queryEmbeddings holds the cached query embeddings by key.
+	queryEmbeddings map[string][]float32
+	// locks holds the holder of each locked table.
+	locks map[string]string
+	// pingErr is returned by Ping.
+	pingErr error
+}
+
+func newFakeDB() *fakeDB {
+	return &fakeDB{
+		tables:    make(map[string]*database.UserTable),
+		docs:      make(map[string]*database.TableDocument),
+		jobs:      make(map[string]*database.IngestionJob),
+		uploads:   make(map[string]*database.Upload),
+		extracted: make(map[string][]database.ExtractedTable),
+		stars:     make(map[[2]string]bool),
+
+		uploadParts:     make(map[string][]database.UploadPart),
+		queryEmbeddings: make(map[string][]float32),
+		locks:           make(map[string]string),
+	}
+}
+
+func (f *fakeDB) Ping(ctx context.Context) error {
+	return f.pingErr
+}
+
+func (f *fakeDB) Stats() sql.DBStats {
+	return sql.DBStats{MaxOpenConnections: 10, OpenConnections: 2, InUse: 1, Idle: 1}
+}
+
+func (f *fakeDB) GetTableByID(ctx context.Context, tableID string) (*database.UserTable, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if t, ok := f.tables[tableID]; ok {
+		table := *t
+		for _, other := range f.tables {
+			if other.ForkedFrom == tableID {
+				table.ForkCount++
+			}
+		}
+		for star := range f.stars {
+			if star[1] == tableID {
+				table.StarCount++
+			}
+		}
+		return &table, nil
+	}
+	return nil, nil
+}
+
+func (f *fakeDB) CreateUserTable(ctx context.Context, userID, tableName string, isPublic bool) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	tableID := fmt.Sprintf("table-%d", len(f.tables)+1)
+	f.tables[tableID] = &database.UserTable{UserID: userID, TableID: tableID, TableName: tableName, IsPublic: isPublic}
+	return tableID, nil
+}
+
+func (f *fakeDB) TableExists(ctx context.Context, userID, tableName string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, t := range f.tables {
+		if t.UserID == userID && t.TableName == tableName {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (f *fakeDB) GetTableDocuments(ctx context.Context, tableID string) ([]database.TableDocument, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var docs []database.TableDocument
+	for _, doc := range f.docs {
+		if doc.TableID == tableID {
+			docs = append(docs, *doc)
+		}
+	}
+	return docs, nil
+}
+
+func (f *fakeDB) GetTableDocument(ctx context.Context, documentID string) (*database.TableDocument, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if d, ok := f.docs[documentID]; ok {
+		doc := *d
+		return &doc, nil
+	}
+	return nil, nil
+}
+
+func (f *fakeDB) AddTableDocument(ctx context.Context, tableID, userID, fileName, filePath, sha256 string) (*database.TableDocument, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	doc := &database.TableDocument{
+		DocumentID: fmt.Sprintf("doc-%d", len(f.docs)+1),
+		TableID:    tableID,
+		UserID:     userID,
+		FileName:   fileName,
+		FilePath:   filePath,
+		SHA256:     sha256,
+	}
+	stored := *doc
+	f.docs[doc.DocumentID] = &stored
+	return doc, nil
+}
+
+func (f *fakeDB) ForkTable(ctx context.Context, sourceTableID, userID, tableName string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	tableID := fmt.Sprintf("table-%d", len(f.tables)+1)
+	f.tables[tableID] = &database.UserTable{
+		UserID:              userID,
+		TableID:             tableID,
+		TableName:           tableName,
+		AllowedContentTypes: f.tables[sourceTableID].AllowedContentTypes,
+		ForkedFrom:          sourceTableID,
+	}
+	return tableID, nil
+}
+
+func (f *fakeDB) SetTableEmbedding(ctx context.Context, tableID, model string, version int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tables[tableID].EmbeddingModel = model
+	f.tables[tableID].EmbeddingVersion = version
+	return nil
+}
+
+func (f *fakeDB) UpdateTableVisibility(ctx context.Context, tableID string, isPublic bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tables[tableID].IsPublic = isPublic
+	return nil
+}
+
+func (f *fakeDB) UpdateTableDetails(ctx context.Context, tableID, description string, tags []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tables[tableID].Description = description
+	f.tables[tableID].Tags = tags
+	return nil
+}
+
+func (f *fakeDB) RecordTableEvent(ctx context.Context, event database.TableEvent) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	event.EventID = int64(len(f.events) + 1)
+	f.events = append(f.events, event)
+	return nil
+}
+
+func (f *fakeDB) GetTableEvents(ctx context.Context, tableID string, before int64, limit int) ([]database.TableEvent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	events := []database.TableEvent{}
+	for i := len(f.events) - 1; i >= 0 && len(events) < limit; i-- {
+		event := f.events[i]
+		if event.TableID == tableID && (before == 0 || event.EventID < before) {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+func (f *fakeDB) StarTable(ctx context.Context, userID, tableID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stars[[2]string{userID, tableID}] = true
+	return nil
+}
+
+func (f *fakeDB) UnstarTable(ctx context.Context, userID, tableID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.stars, [2]string{userID, tableID})
+	return nil
+}
+
+func (f *fakeDB) UpdateTableSyncedAt(ctx context.Context, tableID string, syncedAt time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tables[tableID].SyncedAt = &syncedAt
+	return nil
+}
+
+func (f *fakeDB) AddForkedDocument(ctx context.Context, tableID, userID string, source database.TableDocument) (*database.TableDocument, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	doc := &database.TableDocument{
+		DocumentID:       fmt.Sprintf("doc-%d", len(f.docs)+1),
+		TableID:          tableID,
+		UserID:           userID,
+		FileName:         source.FileName,
+		FilePath:         source.FilePath,
+		SHA256:           source.SHA256,
+		SourceDocumentID: source.DocumentID,
+	}
+	stored := *doc
+	f.docs[doc.DocumentID] = &stored
+	return doc, nil
+}
+
+func (f *fakeDB) LinkForkedDocument(ctx context.Context, documentID, sourceDocumentID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	doc, ok := f.docs[documentID]
+	if !ok {
+		return database.ErrNotFound
+	}
+	doc.SourceDocumentID = sourceDocumentID
+	doc.UpdatedAt = time.Now()
+	return nil
+}
+
+func (f *fakeDB) GetTableDocumentByHash(ctx context.Context, tableID, sha256 string) (*database.TableDocument, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, d := range f.docs {
+		if d.TableID == tableID && d.SHA256 == sha256 {
+			doc := *d
+			return &doc, nil
+		}
+	}
+	return nil, nil
+}
+
+func (f *fakeDB) FindIngestedDocumentByHash(ctx context.Context, sha256 string) (*database.TableDocument, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, d := range f.docs {
+		if d.Ingested && d.SHA256 == sha256 {
+			doc := *d
+			return &doc, nil
+		}
+	}
+	return nil, nil
+}
+
+func (f *fakeDB) MarkDocumentIngested(ctx context.Context, documentID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.docs[documentID].Ingested = true
+	return nil
+}
+
+func (f *fakeDB) ReplaceExtractedTables(ctx context.Context, documentID, tableID string, tables []database.ExtractedTable) error {
+	for i := range tables {
+		if err := tables[i].Validate(); err != nil {
+			return err
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	stored := make([]database.ExtractedTable, len(tables))
+	for i, t := range tables {
+		t.ElementID = fmt.Sprintf("%s-table-%d", documentID, i)
+		t.DocumentID = documentID
+		t.TableID = tableID
+		if doc, ok := f.docs[documentID]; ok {
+			t.FileName = doc.FileName
+		}
+		stored[i] = t
+	}
+	f.extracted[documentID] = stored
+	return nil
+}
+
+func (f *fakeDB) GetExtractedTables(ctx context.Context, tableID string) ([]database.ExtractedTable, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var tables []database.ExtractedTable
+	for _, docTables := range f.extracted {
+		for _, t := range docTables {
+			if t.TableID == tableID {
+				t.Cells = nil
+				tables = append(tables, t)
+			}
+		}
+	}
+	return tables, nil
+}
+
+func (f *fakeDB) GetDocumentExtractedTables(ctx context.Context, documentID string) ([]database.ExtractedTable, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]database.ExtractedTable(nil), f.extracted[documentID]...), nil
+}
+
+func (f *fakeDB) GetExtractedTable(ctx context.Context, elementID string) (*database.ExtractedTable, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, docTables := range f.extracted {
+		for _, t := range docTables {
+			if t.ElementID == elementID {
+				return &t, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (f *fakeDB) CreateIngestionJob(ctx context.Context, tableID, userID, kind string, total int) (*database.IngestionJob, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	job := &database.IngestionJob{
+		JobID:   "job-1",
+		TableID: tableID,
+		UserID:  userID,
+		Kind:    kind,
+		Status:  database.JobStatusPending,
+		Total:   total,
+	}
+	stored := *job
+	f.jobs[job.JobID] = &stored
+	return job, nil
+}
+
+func (f *fakeDB) GetIngestionJob(ctx context.Context, jobID string) (*database.IngestionJob, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if j, ok := f.jobs[jobID]; ok {
+		job := *j
+		return &job, nil
+	}
+	return nil, nil
+}
+
+func (f *fakeDB) UpdateIngestionJob(ctx context.Context, job *database.IngestionJob) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	stored := *job
+	f.jobs[job.JobID] = &stored
+	return nil
+}
+
+func (f *fakeDB) CreateUpload(ctx context.Context, userID, fileName, contentType string, size int64) (*database.Upload, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	upload := &database.Upload{
+		UploadID:    fmt.Sprintf("upload-%d", len(f.uploads)+1),
+		UserID:      userID,
+		FileName:    fileName,
+		ContentType: contentType,
+		Size:        size,
+	}
+	stored := *upload
+	f.uploads[upload.UploadID] = &stored
+	return upload, nil
+}
+
+func (f *fakeDB) GetUpload(ctx context.Context, uploadID string) (*database.Upload, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if u, ok := f.uploads[uploadID]; ok {
+		upload := *u
+		return &upload, nil
+	}
+	return nil, nil
+}
+
+func (f *fakeDB) AppendUploadPart(ctx context.Context, uploadID string, offset, size int64, filePath string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	u, ok := f.uploads[uploadID]
+	if !ok {
+		return fmt.Errorf("upload %w", database.ErrNotFound)
+	}
+	if u.Completed || u.Offset != offset {
+		return fmt.Errorf("upload offset: %w", database.ErrConflict)
+	}
+	f.uploadParts[uploadID] = append(f.uploadParts[uploadID], database.UploadPart{Offset: offset, Size: size, FilePath: filePath})
+	u.Offset = offset + size
+	return nil
+}
+
+func (f *fakeDB) GetUploadParts(ctx context.Context, uploadID string) ([]database.UploadPart, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]database.UploadPart(nil), f.uploadParts[uploadID]...), nil
+}
+
+func (f *fakeDB) CompleteUpload(ctx context.Context, uploadID, filePath, contentType, sha256 string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	u := f.uploads[uploadID]
+	if u.Completed {
+		return fmt.Errorf("upload %w", database.ErrNotFound)
+	}
+	delete(f.uploadParts, uploadID)
+	u.Completed = true
+	u.Offset = u.Size
+	u.FilePath = filePath
+	u.ContentType = contentType
+	u.SHA256 = sha256
+	return nil
+}
+
+func (f *fakeDB) GetUploadByFilePath(ctx context.Context, filePath string) (*database.Upload, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, u := range f.uploads {
+		if u.Completed && u.FilePath == filePath {
+			upload := *u
+			return &upload, nil
+		}
+	}
+	return nil, nil
+}
+
+func (f *fakeDB) GetQueryEmbedding(ctx context.Context, key string, maxAge time.Duration) ([]float32, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.queryEmbeddings[key], nil
+}
+
+func (f *fakeDB) PutQueryEmbedding(ctx context.Context, key, model string, embedding []float32) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.queryEmbeddings[key] = embedding
+	return nil
+}
+
+func (f *fakeDB) DeleteQueryEmbeddings(ctx context.Context, maxAge time.Duration) error {
+	return nil
+}
+
+func (f *fakeDB) GetUserStorageUsage(ctx context.Context, userID string) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var usage int64
+	for _, u := range f.uploads {
+		if u.UserID == userID {
+			usage += u.Size
+		}
+	}
+	return usage, nil
+}
+
+func (f *fakeDB) UpdateTableContentTypes(ctx context.Context, tableID string, contentTypes []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tables[tableID].AllowedContentTypes = contentTypes
+	return nil
+}
+
+func (f *fakeDB) DeleteTable(ctx context.Context, tableID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.tables[tableID]; !ok {
+		return fmt.Errorf("table not found")
+	}
+	delete(f.tables, tableID)
+	for id, doc := range f.docs {
+		if doc.TableID == tableID {
+			delete(f.docs, id)
+			delete(f.extracted, id)
+		}
+	}
+	return nil
+}
+
+func (f *fakeDB) DeleteUpload(ctx context.Context, uploadID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.uploads, uploadID)
+	delete(f.uploadParts, uploadID)
+	return nil
+}
+
+func (f *fakeDB) GetUserTables(ctx context.Context, userID string) ([]database.UserTable, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var tables []database.UserTable
+	for _, t := range f.tables {
+		if t.UserID == userID {
+			tables = append(tables, *t)
+		}
+	}
+	return tables, nil
+}
+
+func (f *fakeDB) AcquireTableLock(ctx context.Context, tableID, holder string, ttl time.Duration) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, held := f.locks[tableID]; held {
+		return false, nil
+	}
+	f.locks[tableID] = holder
+	return true, nil
+}
+
+func (f *fakeDB) RenewTableLock(ctx context.Context, tableID, holder string, ttl time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.locks[tableID] != holder {
+		return fmt.Errorf("table lock %w", database.ErrNotFound)
+	}
+	return nil
+}
+
+func (f *fakeDB) ReleaseTableLock(ctx context.Context, tableID, holder string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.locks[tableID] == holder {
+		delete(f.locks, tableID)
+	}
+	return nil
+}
+
+// esRequest is a request received by the fake Elasticsearch server.
+type esRequest struct {
+	Method string
+	Path   string
+	Body   string
+}
+
+// newFakeES starts an HTTP server that answers every request with body and
+// returns a client pointed at it along with a function that reports the
+// requests received so far. Existence checks, which every write to an index
+// starts with, are answered but not reported.
+func newFakeES(t *testing.T, body string) (*elasticsearch.Client, func() []esRequest) {
+	t.Helper()
+
+	var mu sync.Mutex
+	var requests []esRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		if r.Method != http.MethodHead {
+			mu.Lock()
+			requests = append(requests, esRequest{Method: r.Method, Path: r.URL.Path, Body: string(b)})
+			mu.Unlock()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Elastic-Product", "Elasticsearch")
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(srv.Close)
+
+	client, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{srv.URL}})
+	if err != nil {
+		t.Fatalf("error creating elasticsearch client: %v", err)
+	}
+
+	return client, func() []esRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]esRequest(nil), requests...)
+	}
+}
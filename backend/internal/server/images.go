@@ -0,0 +1,162 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"backend/internal/database"
+)
+
+// imageManifest is the file the pipeline writes next to the images it
+// extracted from a document.
+const imageManifest = "manifest.json"
+
+// extractedImage is an entry of the image manifest.
+type extractedImage struct {
+	Index      int       `json:"index"`
+	File       string    `json:"file"`
+	PageNumber int       `json:"page_number"`
+	BBox       []float64 `json:"bbox"`
+}
+
+// imageKey returns the blob storage key of an image extracted from a document.
+func imageKey(documentID string, index int) string {
+	return path.Join("images", documentID, strconv.Itoa(index)+".png")
+}
+
+// indexImages stores the images the pipeline extracted into dir, captions
+// them and indexes each caption, embedded with model, as a chunk of type
+// "image" under generation.
+// Images that cannot be captioned are skipped rather than failing the
+// document, since its text is already indexed.
+func (s *Server) indexImages(ctx context.Context, doc database.TableDocument, model embeddingModel, generation, dir string) error {
+	data, err := os.ReadFile(filepath.Join(dir, imageManifest))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading image manifest: %v", err)
+	}
+
+	var images []extractedImage
+	if err := json.Unmarshal(data, &images); err != nil {
+		return fmt.Errorf("error parsing image manifest: %v", err)
+	}
+	if len(images) == 0 {
+		return nil
+	}
+	if s.captioner == nil {
+		slog.InfoContext(ctx, "Image captioning is disabled; not indexing images", "document_id", doc.DocumentID, "images", len(images))
+		return nil
+	}
+
+	indexName := s.chunkIndex(model)
+
+	var body bytes.Buffer
+	for _, img := range images {
+		source, err := s.imageChunk(ctx, doc, model, generation, dir, img)
+		if err != nil {
+			slog.WarnContext(ctx, "Error indexing image", "document_id", doc.DocumentID, "image", img.Index, "err", err)
+			continue
+		}
+		body.WriteString(`{"index":{}}` + "\n")
+		body.WriteString(mustToJSON(source) + "\n")
+	}
+	if body.Len() == 0 {
+		return nil
+	}
+
+	return s.bulkIndex(ctx, indexName, &body)
+}
+
+// imageChunk stores an extracted image and returns the chunk describing it,
+// laid out like the chunks the pipeline writes.
+func (s *Server) imageChunk(ctx context.Context, doc database.TableDocument, model embeddingModel, generation, dir string, img extractedImage) (map[string]interface{}, error) {
+	// The manifest names files inside dir only
+	if img.File == "" || img.File != filepath.Base(img.File) {
+		return nil, fmt.Errorf("invalid image file %q", img.File)
+	}
+	content, err := os.ReadFile(filepath.Join(dir, img.File))
+	if err != nil {
+		return nil, fmt.Errorf("error reading image: %v", err)
+	}
+
+	contentType := http.DetectContentType(content)
+	key := imageKey(doc.DocumentID, img.Index)
+	if err := s.blobs.Put(ctx, key, bytes.NewReader(content), int64(len(content)), contentType); err != nil {
+		return nil, fmt.Errorf("error storing image: %v", err)
+	}
+
+	caption, err := s.captioner.Caption(ctx, content, contentType)
+	if err != nil {
+		return nil, fmt.Errorf("error captioning image: %v", err)
+	}
+	embedding, err := s.embed(ctx, model.Name, caption)
+	if err != nil {
+		return nil, fmt.Errorf("error embedding caption: %v", err)
+	}
+
+	source := map[string]interface{}{
+		"type":                "image",
+		"text_representation": caption,
+		"embedding":           embedding,
+		"properties": map[string]interface{}{
+			"page_number":        img.PageNumber,
+			"image_key":          key,
+			"image_content_type": contentType,
+			"properties": map[string]interface{}{
+				"table_id":          doc.TableID,
+				"document_id":       doc.DocumentID,
+				"user_id":           doc.UserID,
+				"file_name":         doc.FileName,
+				"path":              doc.FilePath,
+				"generation":        generation,
+				"embedding_model":   model.Name,
+				"embedding_version": model.Version,
+			},
+		},
+	}
+	if len(img.BBox) == 4 {
+		source["bbox"] = img.BBox
+	}
+	return source, nil
+}
+
+// chunkImageHandler serves the image an image chunk was captioned from.
+func (s *Server) chunkImageHandler(w http.ResponseWriter, r *http.Request) {
+	chunkID := r.PathValue("id")
+
+	c, err := s.getChunk(r.Context(), chunkID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error getting chunk", "chunk_id", chunkID, "err", err)
+		writeFailure(w, r, err, "Failed to get chunk")
+		return
+	}
+	if c == nil {
+		writeError(w, r, http.StatusNotFound, "Chunk not found")
+		return
+	}
+
+	if s.readableDocument(w, r, c.DocumentID) == nil {
+		return
+	}
+	// Chunks reused from a duplicate document point at the images of the
+	// original, so any key this server stored images under is accepted.
+	if c.Type != "image" || !strings.HasPrefix(c.ImageKey, "images/") {
+		writeError(w, r, http.StatusNotFound, "Chunk has no image")
+		return
+	}
+
+	// Images are not uploads, so their type is sniffed from the stored bytes
+	s.serveBlob(w, r, c.ImageKey, path.Base(c.ImageKey), "")
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// testPNG is enough of a PNG for content sniffing.
+const testPNG = "\x89PNG\r\n\x1a\n image"
+
+// fakeCaptioner captions every image with the same text.
+type fakeCaptioner struct {
+	caption string
+	calls   int
+}
+
+func (f *fakeCaptioner) Caption(ctx context.Context, image []byte, contentType string) (string, error) {
+	f.calls++
+	if contentType != "image/png" {
+		return "", fmt.Errorf("unexpected content type %s", contentType)
+	}
+	return f.caption, nil
+}
+
+func fakeEmbedder(ctx context.Context, model, text string) ([]float32, error) {
+	return []float32{0.5, 0.25}, nil
+}
+
+func TestIngestIndexesImageCaptions(t *testing.T) {
+	s, db, esRequests, _ := newReindexTestServer(t)
+	captioner := &fakeCaptioner{caption: "A bar chart of yearly revenue"}
+	s.captioner = captioner
+	s.embed = fakeEmbedder
+	s.runScript = func(ctx context.Context, args ...string) ([]byte, error) {
+		i := slices.Index(args, "--images-output")
+		if i < 0 {
+			t.Fatalf("expected --images-output in args %v", args)
+		}
+		dir := args[i+1]
+		if err := os.WriteFile(filepath.Join(dir, "0.png"), []byte(testPNG), 0o600); err != nil {
+			return nil, err
+		}
+		manifest := `[{"index":0,"file":"0.png","page_number":2,"bbox":[0.1,0.1,0.9,0.5]},{"index":1,"file":"../escape.png"}]`
+		return nil, os.WriteFile(filepath.Join(dir, imageManifest), []byte(manifest), 0o600)
+	}
+
+	if err := s.ingestDocument(context.Background(), *db.docs["d1"], false); err != nil {
+		t.Fatalf("error ingesting document: %v", err)
+	}
+
+	if captioner.calls != 1 {
+		t.Errorf("expected 1 image to be captioned; got %d", captioner.calls)
+	}
+	if _, err := s.blobs.Stat(context.Background(), imageKey("d1", 0)); err != nil {
+		t.Errorf("expected image to be stored: %v", err)
+	}
+
+	var bulk *esRequest
+	for _, r := range esRequests() {
+		if strings.HasSuffix(r.Path, "/_bulk") {
+			bulk = &r
+		}
+	}
+	if bulk == nil {
+		t.Fatal("expected image chunks to be bulk indexed")
+	}
+	for _, want := range []string{`"type":"image"`, `"text_representation":"A bar chart of yearly revenue"`, `"image_key":"images/d1/0.png"`, `"document_id":"d1"`} {
+		if !strings.Contains(bulk.Body, want) {
+			t.Errorf("expected bulk body to contain %s; got %s", want, bulk.Body)
+		}
+	}
+	if n := strings.Count(bulk.Body, `"type":"image"`); n != 1 {
+		t.Errorf("expected the escaping manifest entry to be skipped; got %d image chunks", n)
+	}
+}
+
+func TestIngestSkipsImagesWithoutCaptioner(t *testing.T) {
+	s, db, esRequests, _ := newReindexTestServer(t)
+	s.runScript = func(ctx context.Context, args ...string) ([]byte, error) {
+		dir := args[slices.Index(args, "--images-output")+1]
+		os.WriteFile(filepath.Join(dir, "0.png"), []byte(testPNG), 0o600)
+		return nil, os.WriteFile(filepath.Join(dir, imageManifest), []byte(`[{"index":0,"file":"0.png"}]`), 0o600)
+	}
+
+	if err := s.ingestDocument(context.Background(), *db.docs["d1"], false); err != nil {
+		t.Fatalf("error ingesting document: %v", err)
+	}
+	for _, r := range esRequests() {
+		if strings.HasSuffix(r.Path, "/_bulk") {
+			t.Errorf("expected no image chunks without a captioner; got %s", r.Body)
+		}
+	}
+}
+
+func TestChunkImage(t *testing.T) {
+	s, _ := newDocumentTestServer(t, `{"_id":"c1","found":true,"_source":{"type":"image","properties":{"page_number":1,"image_key":"images/d1/0.png","properties":{"document_id":"d1"}}}}`)
+	if err := s.blobs.Put(context.Background(), "images/d1/0.png", strings.NewReader(testPNG), int64(len(testPNG)), "image/png"); err != nil {
+		t.Fatalf("error storing image: %v", err)
+	}
+	handler := s.RegisterRoutes()
+
+	req := httptest.NewRequest(http.MethodGet, "/chunks/c1/image", nil)
+	req.Header.Set("Authorization", "Bearer alice")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200; got %d: %s", rr.Code, rr.Body.String())
+	}
+	if !bytes.Equal(rr.Body.Bytes(), []byte(testPNG)) {
+		t.Errorf("expected image bytes; got %q", rr.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/chunks/c1/image", nil)
+	req.Header.Set("Authorization", "Bearer bob")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected image of a private table to be hidden; got %d", rr.Code)
+	}
+}
@@ -0,0 +1,479 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/elastic/go-elasticsearch/v8"
+
+	"backend/internal/config"
+)
+
+// Chunks are searched and written through an alias per embedding model,
+// named by chunkIndex. Each alias points at a single index, named after the
+// alias and the version of the mapping it was created with, so that a new
+// mapping can be rolled out by copying the chunks to a new index and moving
+// the alias, without searches ever missing it.
+
+// chunkMappingVersion is the version of chunkIndexBody. Change one only along
+// with the other; MigrateIndices then copies the chunks to indices with the
+// new mapping.
+const chunkMappingVersion = 1
+
+// chunkIndex returns the alias of the index holding chunks embedded with m.
+// Chunks of the first model are under the configured name, where they were
+// before models had versions; those of later versions are under names derived
+// from it.
+func (s *Server) chunkIndex(m embeddingModel) string {
+	if m.Version <= 1 {
+		return s.index
+	}
+	return fmt.Sprintf("%s_v%d", s.index, m.Version)
+}
+
+// chunkIndices returns the aliases of every model, for requests that must
+// reach the chunks of a table wherever a migration has left them.
+func (s *Server) chunkIndices() []string {
+	var indices []string
+	for _, m := range sortedModels() {
+		indices = append(indices, s.chunkIndex(m))
+	}
+	return indices
+}
+
+// sortedModels returns the embedding models by version.
+func sortedModels() []embeddingModel {
+	var models []embeddingModel
+	for _, version := range slices.Sorted(maps.Keys(embeddingModels)) {
+		models = append(models, embeddingModels[version])
+	}
+	return models
+}
+
+// versionedIndex returns the name of the index behind alias created with
+// mapping version.
+func versionedIndex(alias string, version int) string {
+	return fmt.Sprintf("%s-m%d", alias, version)
+}
+
+// chunkIndexBody returns the settings and mapping of an index of chunks
+// embedded with m.
+func chunkIndexBody(m embeddingModel) map[string]interface{} {
+	// Identifiers are matched exactly. Their keyword sub-fields keep working
+	// the queries written for indices the pipeline mapped dynamically.
+	id := map[string]interface{}{
+		"type": "keyword",
+		"fields": map[string]interface{}{
+			"keyword": map[string]interface{}{"type": "keyword"},
+		},
+	}
+	text := map[string]interface{}{
+		"type": "text",
+		"fields": map[string]interface{}{
+			"keyword": map[string]interface{}{"type": "keyword", "ignore_above": 256},
+		},
+	}
+
+	return map[string]interface{}{
+		"settings": map[string]interface{}{
+			"analysis": map[string]interface{}{
+				"analyzer": map[string]interface{}{
+					// Chunks are mostly English prose from OCR, where accents
+					// and inflections vary between otherwise equal words
+					"chunk_text": map[string]interface{}{
+						"type":      "custom",
+						"tokenizer": "standard",
+						"filter":    []string{"lowercase", "asciifolding", "porter_stem"},
+					},
+				},
+			},
+		},
+		"mappings": map[string]interface{}{
+			// The pipeline adds properties of its own; those are still
+			// mapped as they come
+			"dynamic": true,
+			"properties": map[string]interface{}{
+				"embedding": map[string]interface{}{
+					"type":       "dense_vector",
+					"dims":       m.Dimensions,
+					"index":      true,
+					"similarity": "cosine",
+				},
+				"text_representation": map[string]interface{}{
+					"type":     "text",
+					"analyzer": "chunk_text",
+				},
+				"type": id,
+				"properties": map[string]interface{}{
+					"properties": map[string]interface{}{
+						"page_number":        map[string]interface{}{"type": "integer"},
+						"image_key":          id,
+						"image_content_type": id,
+						"properties": map[string]interface{}{
+							"properties": map[string]interface{}{
+								"table_id":          id,
+								"document_id":       id,
+								"user_id":           id,
+								"generation":        id,
+								"path":              id,
+								"file_name":         text,
+								"embedding_model":   id,
+								"embedding_version": map[string]interface{}{"type": "integer"},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// createChunkIndex creates the index of m with the current mapping and
+// returns its name. With alias set, the index is created behind the alias of
+// m; otherwise it is left for the caller to move the alias to.
+func (s *Server) createChunkIndex(ctx context.Context, m embeddingModel, alias bool) (string, error) {
+	indexName := versionedIndex(s.chunkIndex(m), chunkMappingVersion)
+	body := chunkIndexBody(m)
+	if alias {
+		body["aliases"] = map[string]interface{}{
+			s.chunkIndex(m): map[string]interface{}{"is_write_index": true},
+		}
+	}
+
+	res, err := s.es.Indices.Create(
+		indexName,
+		s.es.Indices.Create.WithContext(ctx),
+		s.es.Indices.Create.WithBody(strings.NewReader(mustToJSON(body))),
+	)
+	if err != nil {
+		return "", searchFailure("error creating index "+indexName, nil, err)
+	}
+	defer res.Body.Close()
+	// Another replica may have created it meanwhile
+	if res.IsError() && !strings.Contains(res.String(), "resource_already_exists_exception") {
+		return "", searchFailure("error creating index "+indexName, res, nil)
+	}
+
+	slog.InfoContext(ctx, "Created index", "index", indexName, "model", m.Name)
+	return indexName, nil
+}
+
+// ensureIndex creates the index of m behind its alias if there is neither
+// the alias nor an index of that name, so that chunks written to it are
+// mapped for search rather than as they come.
+func (s *Server) ensureIndex(ctx context.Context, m embeddingModel) error {
+	alias := s.chunkIndex(m)
+
+	res, err := s.es.Indices.ExistsAlias([]string{alias}, s.es.Indices.ExistsAlias.WithContext(ctx))
+	if err != nil {
+		return searchFailure("error checking alias "+alias, nil, err)
+	}
+	res.Body.Close()
+	if res.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	// Indices from before aliases are used as they are until migrated
+	res, err = s.es.Indices.Exists([]string{alias}, s.es.Indices.Exists.WithContext(ctx))
+	if err != nil {
+		return searchFailure("error checking index "+alias, nil, err)
+	}
+	res.Body.Close()
+	if res.StatusCode == http.StatusOK {
+		return nil
+	}
+	if res.StatusCode != http.StatusNotFound {
+		return searchFailure("error checking index "+alias, res, nil)
+	}
+
+	_, err = s.createChunkIndex(ctx, m, true)
+	return err
+}
+
+// chunkIndexState describes the index behind the alias of a model.
+type chunkIndexState struct {
+	Alias string
+	// Index is the index the alias points at, or an index named like the
+	// alias from before aliases were used; "" if there is none.
+	Index string
+	// MappingVersion is the version of the mapping Index was created with,
+	// or 0 if it was not created by this server.
+	MappingVersion int
+}
+
+// indexState looks up the index behind alias.
+func (s *Server) indexState(ctx context.Context, alias string) (chunkIndexState, error) {
+	state := chunkIndexState{Alias: alias}
+
+	res, err := s.es.Indices.GetAlias(s.es.Indices.GetAlias.WithName(alias), s.es.Indices.GetAlias.WithContext(ctx))
+	if err != nil {
+		return state, searchFailure("error getting alias "+alias, nil, err)
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		var indices map[string]json.RawMessage
+		if err := json.NewDecoder(res.Body).Decode(&indices); err != nil {
+			return state, fmt.Errorf("error parsing alias %s: %v", alias, err)
+		}
+		if len(indices) != 1 {
+			return state, fmt.Errorf("alias %s points at %d indices; want 1", alias, len(indices))
+		}
+		for index := range indices {
+			state.Index = index
+		}
+		if version, ok := strings.CutPrefix(state.Index, alias+"-m"); ok {
+			state.MappingVersion, _ = strconv.Atoi(version)
+		}
+		return state, nil
+	case http.StatusNotFound:
+	default:
+		return state, searchFailure("error getting alias "+alias, res, nil)
+	}
+
+	res, err = s.es.Indices.Exists([]string{alias}, s.es.Indices.Exists.WithContext(ctx))
+	if err != nil {
+		return state, searchFailure("error checking index "+alias, nil, err)
+	}
+	res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+		state.Index = alias
+	case http.StatusNotFound:
+	default:
+		return state, searchFailure("error checking index "+alias, res, nil)
+	}
+	return state, nil
+}
+
+// setupIndices creates the missing indices of every model and warns about
+// those whose mapping is out of date.
+func (s *Server) setupIndices(ctx context.Context) error {
+	for _, m := range sortedModels() {
+		state, err := s.indexState(ctx, s.chunkIndex(m))
+		if err != nil {
+			return err
+		}
+		if state.Index == "" {
+			if _, err := s.createChunkIndex(ctx, m, true); err != nil {
+				return err
+			}
+			continue
+		}
+		if state.MappingVersion < chunkMappingVersion {
+			slog.WarnContext(ctx, "Chunk index has an outdated mapping; migrate it with the admin command",
+				"alias", state.Alias, "index", state.Index, "mapping_version", state.MappingVersion, "current", chunkMappingVersion)
+		}
+	}
+	return nil
+}
+
+// migrateIndex copies the chunks of the index in state, whose mapping is out
+// of date, to a new index of m with the current mapping and moves the alias
+// to it, deleting the old index in the same step. Writes to the old index are
+// blocked while its chunks are copied, so none are lost; searches go on. It
+// returns the name of the new index and how many chunks were copied.
+func (s *Server) migrateIndex(ctx context.Context, m embeddingModel, state chunkIndexState) (string, int, error) {
+	// A failed earlier run may have left its copy behind
+	target := versionedIndex(state.Alias, chunkMappingVersion)
+	res, err := s.es.Indices.Delete([]string{target}, s.es.Indices.Delete.WithContext(ctx), s.es.Indices.Delete.WithIgnoreUnavailable(true))
+	if err != nil {
+		return "", 0, searchFailure("error deleting index "+target, nil, err)
+	}
+	res.Body.Close()
+	if res.IsError() {
+		return "", 0, searchFailure("error deleting index "+target, res, nil)
+	}
+	if _, err := s.createChunkIndex(ctx, m, false); err != nil {
+		return "", 0, err
+	}
+
+	if err := s.blockWrites(ctx, state.Index, true); err != nil {
+		return "", 0, err
+	}
+	copied, err := s.copyIndex(ctx, state.Index, target)
+	if err == nil {
+		err = s.updateAliases(ctx, []map[string]interface{}{
+			{"add": map[string]interface{}{"index": target, "alias": state.Alias, "is_write_index": true}},
+			{"remove_index": map[string]interface{}{"index": state.Index}},
+		})
+	}
+	if err != nil {
+		// The migration may have failed because ctx was cancelled
+		if unblockErr := s.blockWrites(context.WithoutCancel(ctx), state.Index, false); unblockErr != nil {
+			slog.ErrorContext(ctx, "Error unblocking writes to index", "index", state.Index, "err", unblockErr)
+		}
+		return "", 0, err
+	}
+	return target, copied, nil
+}
+
+// blockWrites blocks or allows writes to indexName.
+func (s *Server) blockWrites(ctx context.Context, indexName string, block bool) error {
+	settings := map[string]interface{}{"index.blocks.write": block}
+	res, err := s.es.Indices.PutSettings(
+		strings.NewReader(mustToJSON(settings)),
+		s.es.Indices.PutSettings.WithIndex(indexName),
+		s.es.Indices.PutSettings.WithContext(ctx),
+	)
+	if err != nil {
+		return searchFailure("error updating settings of "+indexName, nil, err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return searchFailure("error updating settings of "+indexName, res, nil)
+	}
+	return nil
+}
+
+// copyIndex copies every document of src to dst and returns how many were
+// copied.
+func (s *Server) copyIndex(ctx context.Context, src, dst string) (int, error) {
+	body := map[string]interface{}{
+		"source": map[string]interface{}{"index": src},
+		"dest":   map[string]interface{}{"index": dst},
+	}
+	res, err := s.es.Reindex(
+		strings.NewReader(mustToJSON(body)),
+		s.es.Reindex.WithContext(ctx),
+		s.es.Reindex.WithWaitForCompletion(true),
+		s.es.Reindex.WithRefresh(true),
+	)
+	if err != nil {
+		return 0, searchFailure("error copying "+src, nil, err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return 0, searchFailure("error copying "+src, res, nil)
+	}
+
+	var result struct {
+		Total    int               `json:"total"`
+		Failures []json.RawMessage `json:"failures"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return 0, fmt.Errorf("error parsing reindex response: %v", err)
+	}
+	if len(result.Failures) > 0 {
+		return 0, fmt.Errorf("error copying %s: %d chunks failed, first: %s", src, len(result.Failures), result.Failures[0])
+	}
+	return result.Total, nil
+}
+
+// updateAliases applies actions to aliases in one atomic step.
+func (s *Server) updateAliases(ctx context.Context, actions []map[string]interface{}) error {
+	body := map[string]interface{}{"actions": actions}
+	res, err := s.es.Indices.UpdateAliases(
+		strings.NewReader(mustToJSON(body)),
+		s.es.Indices.UpdateAliases.WithContext(ctx),
+	)
+	if err != nil {
+		return searchFailure("error updating aliases", nil, err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return searchFailure("error updating aliases", res, nil)
+	}
+	return nil
+}
+
+// newElasticsearchClient creates a client of the cluster cfg configures,
+// tracing and measuring its requests.
+func newElasticsearchClient(cfg config.Elasticsearch) (*elasticsearch.Client, error) {
+	return elasticsearch.NewClient(elasticsearch.Config{
+		Addresses: []string{cfg.URL},
+		APIKey:    cfg.APIKey,
+		Transport: tracedTransport(instrumentedTransport{next: http.DefaultTransport}, func(r *http.Request) string {
+			return "elasticsearch " + searchOperation(r.URL.Path)
+		}),
+	})
+}
+
+// newIndexAdmin returns a server that can only manage the indices cfg
+// configures, for the admin commands.
+func newIndexAdmin(cfg *config.Config) (*Server, error) {
+	es, err := newElasticsearchClient(cfg.Elasticsearch)
+	if err != nil {
+		return nil, fmt.Errorf("error creating Elasticsearch client: %v", err)
+	}
+	return &Server{index: cfg.Elasticsearch.Index, es: es}, nil
+}
+
+// IndexStatus writes to w the index behind the alias of every embedding
+// model and whether its mapping is current.
+func IndexStatus(ctx context.Context, cfg *config.Config, w io.Writer) error {
+	s, err := newIndexAdmin(cfg)
+	if err != nil {
+		return err
+	}
+	for _, m := range sortedModels() {
+		state, err := s.indexState(ctx, s.chunkIndex(m))
+		if err != nil {
+			return err
+		}
+		switch {
+		case state.Index == "":
+			fmt.Fprintf(w, "%s: missing (%s)\n", state.Alias, m.Name)
+		case state.MappingVersion < chunkMappingVersion:
+			fmt.Fprintf(w, "%s: %s, mapping version %d, out of date (%s)\n", state.Alias, state.Index, state.MappingVersion, m.Name)
+		default:
+			fmt.Fprintf(w, "%s: %s, mapping version %d (%s)\n", state.Alias, state.Index, state.MappingVersion, m.Name)
+		}
+	}
+	return nil
+}
+
+// SetupIndices creates the missing indices of every embedding model, as the
+// API does when it starts.
+func SetupIndices(ctx context.Context, cfg *config.Config, w io.Writer) error {
+	s, err := newIndexAdmin(cfg)
+	if err != nil {
+		return err
+	}
+	if err := s.setupIndices(ctx); err != nil {
+		return err
+	}
+	return IndexStatus(ctx, cfg, w)
+}
+
+// MigrateIndices moves the chunks of every embedding model whose index has an
+// out of date mapping to a new index with the current one, reporting each to
+// w. Missing indices are created.
+func MigrateIndices(ctx context.Context, cfg *config.Config, w io.Writer) error {
+	s, err := newIndexAdmin(cfg)
+	if err != nil {
+		return err
+	}
+	for _, m := range sortedModels() {
+		state, err := s.indexState(ctx, s.chunkIndex(m))
+		if err != nil {
+			return err
+		}
+		switch {
+		case state.Index == "":
+			index, err := s.createChunkIndex(ctx, m, true)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "%s: created %s\n", state.Alias, index)
+		case state.MappingVersion >= chunkMappingVersion:
+			fmt.Fprintf(w, "%s: %s is up to date\n", state.Alias, state.Index)
+		default:
+			index, copied, err := s.migrateIndex(ctx, m, state)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "%s: copied %d chunks from %s to %s\n", state.Alias, copied, state.Index, index)
+		}
+	}
+	return nil
+}
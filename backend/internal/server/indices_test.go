@@ -0,0 +1,193 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"backend/internal/config"
+)
+
+// newIndexCluster starts an HTTP server that answers requests by method and
+// path from responses, with 404 for the others, and returns a config pointed
+// at it along with a function that reports the requests received so far.
+func newIndexCluster(t *testing.T, responses map[string]string) (*config.Config, func() []esRequest) {
+	t.Helper()
+
+	var mu sync.Mutex
+	var requests []esRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		requests = append(requests, esRequest{Method: r.Method, Path: r.URL.Path, Body: string(b)})
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Elastic-Product", "Elasticsearch")
+		body, ok := responses[r.Method+" "+r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `{"error":{"type":"index_not_found_exception"},"status":404}`)
+			return
+		}
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(srv.Close)
+
+	cfg := config.Default()
+	cfg.Elasticsearch.URL = srv.URL
+	cfg.Elasticsearch.Index = "chunks"
+	return cfg, func() []esRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]esRequest(nil), requests...)
+	}
+}
+
+func TestSetupIndices(t *testing.T) {
+	cfg, esRequests := newIndexCluster(t, map[string]string{
+		"PUT /chunks-m1":    `{"acknowledged":true}`,
+		"PUT /chunks_v2-m1": `{"acknowledged":true}`,
+	})
+
+	var out strings.Builder
+	if err := SetupIndices(context.Background(), cfg, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	created := make(map[string]esRequest)
+	for _, r := range esRequests() {
+		if r.Method == http.MethodPut {
+			created[r.Path] = r
+		}
+	}
+	for path, m := range map[string]embeddingModel{"/chunks-m1": embeddingModels[1], "/chunks_v2-m1": embeddingModels[2]} {
+		r, ok := created[path]
+		if !ok {
+			t.Errorf("index %s was not created; requests: %+v", path, esRequests())
+			continue
+		}
+		var body struct {
+			Aliases  map[string]json.RawMessage `json:"aliases"`
+			Mappings struct {
+				Properties struct {
+					Embedding struct {
+						Type string `json:"type"`
+						Dims int    `json:"dims"`
+					} `json:"embedding"`
+					Properties struct {
+						Properties struct {
+							Properties struct {
+								Properties struct {
+									TableID struct {
+										Type string `json:"type"`
+									} `json:"table_id"`
+								} `json:"properties"`
+							} `json:"properties"`
+						} `json:"properties"`
+					} `json:"properties"`
+				} `json:"properties"`
+			} `json:"mappings"`
+		}
+		if err := json.Unmarshal([]byte(r.Body), &body); err != nil {
+			t.Fatalf("error parsing body of %s: %v", path, err)
+		}
+		props := body.Mappings.Properties
+		if props.Embedding.Type != "dense_vector" || props.Embedding.Dims != m.Dimensions {
+			t.Errorf("%s maps embedding as %+v; want a dense_vector of %d dimensions", path, props.Embedding, m.Dimensions)
+		}
+		if typ := props.Properties.Properties.Properties.Properties.TableID.Type; typ != "keyword" {
+			t.Errorf("%s maps table_id as %q; want keyword", path, typ)
+		}
+		alias := strings.TrimSuffix(strings.TrimPrefix(path, "/"), "-m1")
+		if _, ok := body.Aliases[alias]; !ok || len(body.Aliases) != 1 {
+			t.Errorf("%s has aliases %v; want %s", path, body.Aliases, alias)
+		}
+	}
+}
+
+func TestMigrateIndices(t *testing.T) {
+	cfg, esRequests := newIndexCluster(t, map[string]string{
+		// The first model's chunks are in an index the pipeline created
+		"HEAD /chunks":          ``,
+		"DELETE /chunks-m1":     `{"acknowledged":true}`,
+		"PUT /chunks-m1":        `{"acknowledged":true}`,
+		"PUT /chunks/_settings": `{"acknowledged":true}`,
+		"POST /_reindex":        `{"total":3,"created":3,"failures":[]}`,
+		"POST /_aliases":        `{"acknowledged":true}`,
+		"GET /_alias/chunks_v2": `{"chunks_v2-m1":{"aliases":{"chunks_v2":{}}}}`,
+	})
+
+	var out strings.Builder
+	if err := MigrateIndices(context.Background(), cfg, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	var steps []string
+	for _, r := range esRequests() {
+		switch r.Method + " " + r.Path {
+		case "PUT /chunks-m1":
+			if strings.Contains(r.Body, `"aliases"`) {
+				t.Errorf("new index created behind the alias before the chunks were copied: %s", r.Body)
+			}
+		case "PUT /chunks/_settings":
+			if !strings.Contains(r.Body, `"index.blocks.write":true`) {
+				t.Errorf("settings = %s; want writes blocked", r.Body)
+			}
+		case "POST /_reindex":
+			if !strings.Contains(r.Body, `"source":{"index":"chunks"}`) || !strings.Contains(r.Body, `"dest":{"index":"chunks-m1"}`) {
+				t.Errorf("reindex body = %s; want chunks copied to chunks-m1", r.Body)
+			}
+		case "POST /_aliases":
+			for _, want := range []string{`"add":{"alias":"chunks","index":"chunks-m1","is_write_index":true}`, `"remove_index":{"index":"chunks"}`} {
+				if !strings.Contains(r.Body, want) {
+					t.Errorf("aliases body = %s; want it to contain %s", r.Body, want)
+				}
+			}
+		case "PUT /chunks_v2-m1", "DELETE /chunks_v2-m1":
+			t.Errorf("up to date index migrated: %s %s", r.Method, r.Path)
+		}
+		if r.Method != http.MethodHead && r.Method != http.MethodGet {
+			steps = append(steps, r.Method+" "+r.Path)
+		}
+	}
+	want := "DELETE /chunks-m1, PUT /chunks-m1, PUT /chunks/_settings, POST /_reindex, POST /_aliases"
+	if got := strings.Join(steps, ", "); got != want {
+		t.Errorf("steps = %s; want %s", got, want)
+	}
+	if !strings.Contains(out.String(), "copied 3 chunks from chunks to chunks-m1") {
+		t.Errorf("output = %q; want the migration reported", out.String())
+	}
+}
+
+func TestMigrateIndicesFailure(t *testing.T) {
+	cfg, esRequests := newIndexCluster(t, map[string]string{
+		"GET /_alias/chunks":       `{"chunks-m0":{"aliases":{"chunks":{}}}}`,
+		"DELETE /chunks-m1":        `{"acknowledged":true}`,
+		"PUT /chunks-m1":           `{"acknowledged":true}`,
+		"PUT /chunks-m0/_settings": `{"acknowledged":true}`,
+		"POST /_reindex":           `{"total":2,"failures":[{"cause":{"type":"mapper_parsing_exception"}}]}`,
+	})
+
+	if err := MigrateIndices(context.Background(), cfg, io.Discard); err == nil {
+		t.Fatal("migration succeeded despite failed chunks")
+	}
+
+	var settings []string
+	for _, r := range esRequests() {
+		if r.Path == "/_aliases" {
+			t.Errorf("alias moved after a failed copy: %s", r.Body)
+		}
+		if r.Path == "/chunks-m0/_settings" {
+			settings = append(settings, r.Body)
+		}
+	}
+	if len(settings) != 2 || !strings.Contains(settings[1], `"index.blocks.write":false`) {
+		t.Errorf("settings = %v; want writes to the old index blocked, then allowed again", settings)
+	}
+}
@@ -0,0 +1,380 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"backend/internal/database"
+)
+
+// scriptRunner runs a pipeline script with the given arguments and returns
+// its combined output.
+type scriptRunner func(ctx context.Context, args ...string) ([]byte, error)
+
+// pythonScript returns a runner for the named Python script, which lives next
+// to this file. The script runs in a span of its own and is given env, on top
+// of the server's environment, and its trace context in TRACEPARENT and
+// TRACESTATE.
+func pythonScript(name string, env ...string) scriptRunner {
+	return func(ctx context.Context, args ...string) ([]byte, error) {
+		ctx, span := tracer.Start(ctx, "python "+name)
+		defer span.End()
+
+		// Get the directory of the current file
+		_, currentFile, _, _ := runtime.Caller(0)
+		scriptPath := filepath.Join(filepath.Dir(currentFile), name)
+
+		cmd := exec.CommandContext(ctx, "python3", append([]string{scriptPath}, args...)...)
+		cmd.Env = append(append(os.Environ(), env...), traceEnv(ctx)...)
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "script failed")
+		}
+		return output, err
+	}
+}
+
+// ingestDocument partitions, embeds and indexes a document. Every run writes
+// its chunks under a fresh generation and only deletes the chunks of earlier
+// generations once the new ones are indexed, so searches never see the
+// document disappear while it is being re-ingested.
+func (s *Server) ingestDocument(ctx context.Context, doc database.TableDocument, recompute bool) (err error) {
+	ctx, span := tracer.Start(ctx, "ingest document", trace.WithAttributes(
+		attribute.String("document.id", doc.DocumentID),
+		attribute.String("table.id", doc.TableID),
+	))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "ingestion failed")
+		}
+		span.End()
+	}()
+
+	model, err := s.documentModel(ctx, doc)
+	if err != nil {
+		return err
+	}
+	if err := s.ensureIndex(ctx, model); err != nil {
+		return err
+	}
+	span.SetAttributes(attribute.String("embedding.model", model.Name))
+
+	localPath, err := s.fetchBlob(ctx, doc.FilePath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(localPath)
+
+	binaryFormat, err := detectBinaryFormat(localPath)
+	if err != nil {
+		return err
+	}
+
+	tablesFile, err := os.CreateTemp("", "tables-*.json")
+	if err != nil {
+		return fmt.Errorf("error creating temporary file: %v", err)
+	}
+	tablesFile.Close()
+	defer os.Remove(tablesFile.Name())
+
+	imagesDir, err := os.MkdirTemp("", "images-")
+	if err != nil {
+		return fmt.Errorf("error creating temporary directory: %v", err)
+	}
+	defer os.RemoveAll(imagesDir)
+
+	generation := uuid.New().String()
+	args := []string{
+		localPath, doc.FileName, doc.UserID, doc.TableID,
+		"--source-path", doc.FilePath,
+		"--binary-format", binaryFormat,
+		"--document-id", doc.DocumentID,
+		"--generation", generation,
+		"--tables-output", tablesFile.Name(),
+		"--images-output", imagesDir,
+		"--embedding-model", model.Name,
+		"--embedding-version", strconv.Itoa(model.Version),
+		"--dimensions", strconv.Itoa(model.Dimensions),
+		"--index", s.chunkIndex(model),
+	}
+	if recompute {
+		args = append(args, "--recompute")
+	}
+
+	slog.DebugContext(ctx, "Running ingestion pipeline", "document_id", doc.DocumentID, "args", args)
+
+	// Until the new generation replaces the old one, a failure leaves the old
+	// chunks searchable and must not leave some of the new ones next to them
+	replaced := false
+	defer func() {
+		if err == nil || replaced {
+			return
+		}
+		if cleanupErr := s.deleteGeneration(context.WithoutCancel(ctx), s.chunkIndex(model), doc.DocumentID, generation); cleanupErr != nil {
+			slog.ErrorContext(ctx, "Error deleting chunks of failed ingestion", "document_id", doc.DocumentID, "generation", generation, "err", cleanupErr)
+		}
+	}()
+
+	output, err := s.runScript(ctx, args...)
+	if err != nil {
+		return fmt.Errorf("script execution failed: %v\nOutput: %s", err, output)
+	}
+
+	slog.InfoContext(ctx, "Processed document", "document_id", doc.DocumentID)
+	slog.DebugContext(ctx, "Ingestion pipeline output", "document_id", doc.DocumentID, "output", string(output))
+
+	if err := s.indexImages(ctx, doc, model, generation, imagesDir); err != nil {
+		return err
+	}
+	if err := s.deleteStaleChunks(ctx, s.chunkIndex(model), doc.DocumentID, generation); err != nil {
+		return err
+	}
+	replaced = true
+	if err := s.followMigration(ctx, doc, model); err != nil {
+		return err
+	}
+	if err := s.storeExtractedTables(ctx, doc, tablesFile.Name()); err != nil {
+		return err
+	}
+	return s.db.MarkDocumentIngested(ctx, doc.DocumentID)
+}
+
+// storeExtractedTables saves the table structures the pipeline wrote to path.
+// An empty file means the script did not report any, and the document's
+// previously extracted tables are kept. Tables that do not validate are
+// dropped rather than failing the ingestion.
+func (s *Server) storeExtractedTables(ctx context.Context, doc database.TableDocument, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading extracted tables: %v", err)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+
+	var tables []database.ExtractedTable
+	if err := json.Unmarshal(data, &tables); err != nil {
+		return fmt.Errorf("error parsing extracted tables: %v", err)
+	}
+	tables = slices.DeleteFunc(tables, func(t database.ExtractedTable) bool {
+		if err := t.Validate(); err != nil {
+			slog.WarnContext(ctx, "Dropping extracted table", "document_id", doc.DocumentID, "err", err)
+			return true
+		}
+		return false
+	})
+	return s.db.ReplaceExtractedTables(ctx, doc.DocumentID, doc.TableID, tables)
+}
+
+// fetchBlob copies the blob stored under key to a temporary file for the
+// pipeline to read and returns its path. The caller must remove the file.
+func (s *Server) fetchBlob(ctx context.Context, key string) (string, error) {
+	src, err := s.blobs.Get(ctx, key)
+	if err != nil {
+		return "", fmt.Errorf("error reading %s: %v", key, err)
+	}
+	defer src.Close()
+
+	dst, err := os.CreateTemp("", "ingest-*"+filepath.Ext(key))
+	if err != nil {
+		return "", fmt.Errorf("error creating temporary file: %v", err)
+	}
+	defer dst.Close()
+
+	if _, err := io.Copy(dst, src); err != nil {
+		os.Remove(dst.Name())
+		return "", fmt.Errorf("error copying %s: %v", key, err)
+	}
+
+	return dst.Name(), nil
+}
+
+// detectBinaryFormat sniffs the file at path and returns the format the
+// pipeline should read it as.
+func detectBinaryFormat(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	contentType, err := sniffContentType(f)
+	if err != nil {
+		return "", fmt.Errorf("error reading %s: %v", path, err)
+	}
+	format, ok := supportedContentTypes[contentType]
+	if !ok {
+		return "", fmt.Errorf("unsupported content type %s", contentType)
+	}
+	return format, nil
+}
+
+// deleteStaleChunks removes the chunks of a document in indexName that were
+// not written by the given generation.
+func (s *Server) deleteStaleChunks(ctx context.Context, indexName, documentID, generation string) error {
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"filter": []map[string]interface{}{
+					{
+						"term": map[string]interface{}{
+							"properties.properties.document_id.keyword": documentID,
+						},
+					},
+				},
+				"must_not": []map[string]interface{}{
+					{
+						"term": map[string]interface{}{
+							"properties.properties.generation.keyword": generation,
+						},
+					},
+				},
+			},
+		},
+	}
+
+	res, err := s.es.DeleteByQuery(
+		[]string{indexName},
+		strings.NewReader(mustToJSON(query)),
+		s.es.DeleteByQuery.WithContext(ctx),
+		s.es.DeleteByQuery.WithRefresh(true),
+	)
+	if err != nil {
+		return fmt.Errorf("error deleting stale chunks: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return fmt.Errorf("error deleting stale chunks: %s", res.String())
+	}
+
+	return nil
+}
+
+// deleteGeneration removes the chunks of a document in indexName that were
+// written by the given generation.
+func (s *Server) deleteGeneration(ctx context.Context, indexName, documentID, generation string) error {
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"filter": []map[string]interface{}{
+					{
+						"term": map[string]interface{}{
+							"properties.properties.document_id.keyword": documentID,
+						},
+					},
+					{
+						"term": map[string]interface{}{
+							"properties.properties.generation.keyword": generation,
+						},
+					},
+				},
+			},
+		},
+	}
+
+	res, err := s.es.DeleteByQuery(
+		[]string{indexName},
+		strings.NewReader(mustToJSON(query)),
+		s.es.DeleteByQuery.WithContext(ctx),
+		s.es.DeleteByQuery.WithRefresh(true),
+	)
+	if err != nil {
+		return fmt.Errorf("error deleting chunks of generation %s: %v", generation, err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return fmt.Errorf("error deleting chunks of generation %s: %s", generation, res.String())
+	}
+
+	return nil
+}
+
+// runIngestionJob ingests docs in the background and records the progress of
+// job after every document. The table stays locked until the job finishes.
+func (s *Server) runIngestionJob(job *database.IngestionJob, docs []database.TableDocument, recompute bool) {
+	s.runJob(job, docs, func(ctx context.Context, doc database.TableDocument) error {
+		return s.ingestDocument(ctx, doc, recompute)
+	}, nil)
+}
+
+// runJob applies process to each of docs, recording the progress of job after
+// every document, and unlocks the job's table when done. If every document
+// succeeds, finish completes the job before it is recorded as succeeded; its
+// error is what the job failed with. A nil finish does nothing.
+func (s *Server) runJob(job *database.IngestionJob, docs []database.TableDocument, process func(context.Context, database.TableDocument) error, finish func(context.Context) error) {
+	defer s.unlockTable(job.TableID)
+
+	ctx, span := tracer.Start(context.Background(), "ingestion job", trace.WithAttributes(
+		attribute.String("job.id", job.JobID),
+		attribute.String("job.kind", job.Kind),
+		attribute.String("table.id", job.TableID),
+		attribute.Int("job.documents", len(docs)),
+	))
+	defer span.End()
+	logger := slog.With("job_id", job.JobID, "table_id", job.TableID)
+
+	start := time.Now()
+	ingestionJobsRunning.WithLabelValues(job.Kind).Inc()
+	defer ingestionJobsRunning.WithLabelValues(job.Kind).Dec()
+
+	job.Status = database.JobStatusRunning
+	if err := s.db.UpdateIngestionJob(ctx, job); err != nil {
+		logger.Error("Error updating ingestion job", "err", err)
+	}
+
+	var failures []string
+	for _, doc := range docs {
+		docStart := time.Now()
+		outcome := "success"
+		if err := process(ctx, doc); err != nil {
+			logger.Error("Ingestion job failed for document", "document_id", doc.DocumentID, "err", err)
+			failures = append(failures, doc.FileName)
+			job.Failed++
+			outcome = "error"
+		} else {
+			job.Completed++
+		}
+		ingestionDocumentDuration.WithLabelValues(job.Kind, outcome).Observe(time.Since(docStart).Seconds())
+
+		if err := s.db.UpdateIngestionJob(ctx, job); err != nil {
+			logger.Error("Error updating ingestion job", "err", err)
+		}
+	}
+
+	job.Status = database.JobStatusSucceeded
+	if len(failures) > 0 {
+		job.Status = database.JobStatusFailed
+		job.Error = fmt.Sprintf("failed to ingest: %s", strings.Join(failures, ", "))
+		span.SetStatus(codes.Error, job.Error)
+	} else if finish != nil {
+		if err := finish(ctx); err != nil {
+			job.Status = database.JobStatusFailed
+			job.Error = err.Error()
+			span.SetStatus(codes.Error, job.Error)
+		}
+	}
+	if err := s.db.UpdateIngestionJob(ctx, job); err != nil {
+		logger.Error("Error updating ingestion job", "err", err)
+	}
+	ingestionJobDuration.WithLabelValues(job.Kind, job.Status).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNewLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := newLogger(&buf, "warn", "json")
+	if err != nil {
+		t.Fatalf("newLogger: %v", err)
+	}
+
+	logger.Info("hidden")
+	logger.Warn("shown", "Authorization", "Bearer alice", "api_key", "sk-123", "table_id", "t1")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("got %d log lines; want only the warning: %s", len(lines), buf.String())
+	}
+	var record map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatalf("log line is not JSON: %v", err)
+	}
+	if record["Authorization"] != redacted || record["api_key"] != redacted {
+		t.Errorf("secrets not redacted: %s", lines[0])
+	}
+	if record["table_id"] != "t1" {
+		t.Errorf("table_id = %v; want t1", record["table_id"])
+	}
+
+	if _, err := newLogger(&buf, "loud", ""); err == nil {
+		t.Error("expected error for invalid level")
+	}
+	if _, err := newLogger(&buf, "", "xml"); err == nil {
+		t.Error("expected error for invalid format")
+	}
+}
+
+func TestRequestLogMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := newLogger(&buf, "info", "json")
+	if err != nil {
+		t.Fatalf("newLogger: %v", err)
+	}
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(logger)
+
+	var handlerRequestID string
+	handler := requestLogMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlerRequestID = requestID(r.Context())
+		http.Error(w, "nope", http.StatusTeapot)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/table/t1?q=secret", nil)
+	req.Header.Set(requestIDHeader, "abc-123")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if got := rr.Header().Get(requestIDHeader); got != "abc-123" || handlerRequestID != "abc-123" {
+		t.Errorf("request ID = %q in response, %q in handler; want the client's abc-123", got, handlerRequestID)
+	}
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("access log is not JSON: %v: %s", err, buf.String())
+	}
+	if record["request_id"] != "abc-123" || record["status"] != float64(http.StatusTeapot) || record["path"] != "/table/t1" {
+		t.Errorf("access log = %v; want request ID, status and path without query", record)
+	}
+	if _, ok := record["duration_ms"]; !ok {
+		t.Error("access log has no latency")
+	}
+
+	// IDs that could forge log lines are replaced
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(requestIDHeader, "x\nlevel=ERROR")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if got := rr.Header().Get(requestIDHeader); got == "" || strings.Contains(got, "\n") {
+		t.Errorf("request ID = %q; want a generated one", got)
+	}
+}
@@ -0,0 +1,285 @@
+package server
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// metricsNamespace prefixes the names of all metrics the server exports.
+const metricsNamespace = "sharetome"
+
+var (
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Time taken to serve HTTP requests, by route, method and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	httpRequestsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "http",
+		Name:      "requests_in_flight",
+		Help:      "HTTP requests being served.",
+	})
+
+	embeddingRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "embedding",
+		Name:      "request_duration_seconds",
+		Help:      "Time taken by requests to the embedding API, by outcome.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"outcome"})
+
+	embeddingTokens = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "embedding",
+		Name:      "tokens_total",
+		Help:      "Tokens billed by the embedding API, by model.",
+	}, []string{"model"})
+
+	queryCacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "embedding",
+		Name:      "query_cache_lookups_total",
+		Help:      "Lookups of search query embeddings in the cache, by tier and result (hit or miss).",
+	}, []string{"tier", "result"})
+
+	searchRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "search",
+		Name:      "request_duration_seconds",
+		Help:      "Time taken by requests to Elasticsearch, by operation and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation", "status"})
+
+	searchErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "search",
+		Name:      "errors_total",
+		Help:      "Requests to Elasticsearch that failed or returned a server error, by operation.",
+	}, []string{"operation"})
+
+	rateLimitedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "http",
+		Name:      "rate_limited_requests_total",
+		Help:      "Requests refused for exceeding a rate limit, by limit.",
+	}, []string{"limit"})
+
+	ingestionJobsRunning = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "ingestion",
+		Name:      "jobs_running",
+		Help:      "Ingestion jobs running, by kind.",
+	}, []string{"kind"})
+
+	ingestionJobDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "ingestion",
+		Name:      "job_duration_seconds",
+		Help:      "Time taken by ingestion jobs, by kind and final status.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 14),
+	}, []string{"kind", "status"})
+
+	ingestionDocumentDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "ingestion",
+		Name:      "document_duration_seconds",
+		Help:      "Time taken to process a document in an ingestion job, by kind and outcome.",
+		Buckets:   prometheus.ExponentialBuckets(0.5, 2, 12),
+	}, []string{"kind", "outcome"})
+)
+
+// serverCollectors are the metrics shared by every server in the process.
+var serverCollectors = []prometheus.Collector{
+	httpRequestDuration,
+	httpRequestsInFlight,
+	rateLimitedRequests,
+	embeddingRequestDuration,
+	embeddingTokens,
+	queryCacheLookups,
+	searchRequestDuration,
+	searchErrors,
+	ingestionJobsRunning,
+	ingestionJobDuration,
+	ingestionDocumentDuration,
+}
+
+// metricsHandler serves the server's metrics, along with those of the Go
+// runtime, the process and the database connection pool, in the Prometheus
+// text format.
+func (s *Server) metricsHandler() http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(serverCollectors...)
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		// The pool is only read when metrics are scraped
+		newDBStatsCollector(func() sql.DBStats { return s.db.Stats() }),
+	)
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// metricsMiddleware records the duration of every request under the route it
+// was served by, and names the request's span after the route.
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		httpRequestsInFlight.Inc()
+		defer httpRequestsInFlight.Dec()
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		// The mux sets the pattern of the route it matched on r
+		route := routeLabel(r.Pattern)
+		httpRequestDuration.WithLabelValues(
+			route,
+			methodLabel(r.Method),
+			strconv.Itoa(rec.status),
+		).Observe(time.Since(start).Seconds())
+
+		span := trace.SpanFromContext(r.Context())
+		span.SetName(methodLabel(r.Method) + " " + route)
+		span.SetAttributes(semconv.HTTPRoute(route))
+	})
+}
+
+// routeLabel names the route a request was served by after the pattern it
+// matched, without the method. Patterns name IDs with wildcards, so the number
+// of labels stays bounded. Requests no route matched share one label.
+func routeLabel(pattern string) string {
+	if pattern == "" {
+		return "unmatched"
+	}
+	if _, path, ok := strings.Cut(pattern, " "); ok {
+		return path
+	}
+	return pattern
+}
+
+// methodLabel bounds the methods metrics are labeled with.
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodOptions:
+		return method
+	}
+	return "OTHER"
+}
+
+// observeEmbedding records a request to the embedding API that took since
+// start and billed tokens.
+func observeEmbedding(start time.Time, model string, tokens int, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+	}
+	embeddingRequestDuration.WithLabelValues(outcome).Observe(time.Since(start).Seconds())
+	if tokens > 0 {
+		embeddingTokens.WithLabelValues(model).Add(float64(tokens))
+	}
+}
+
+// instrumentedTransport records the duration and errors of the requests the
+// Elasticsearch client makes.
+type instrumentedTransport struct {
+	next http.RoundTripper
+}
+
+func (t instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+
+	operation := searchOperation(req.URL.Path)
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	searchRequestDuration.WithLabelValues(operation, status).Observe(time.Since(start).Seconds())
+	if err != nil || resp.StatusCode >= http.StatusInternalServerError {
+		searchErrors.WithLabelValues(operation).Inc()
+	}
+	return resp, err
+}
+
+// searchOperation names the Elasticsearch API a request path calls, such as
+// "_search" or "_bulk", from its first segment starting with an underscore.
+// Requests for a document by ID are "_doc".
+func searchOperation(path string) string {
+	for _, segment := range strings.Split(strings.Trim(path, "/"), "/") {
+		if strings.HasPrefix(segment, "_") {
+			return segment
+		}
+	}
+	return "other"
+}
+
+// dbStatsCollector exports the statistics of a database connection pool.
+type dbStatsCollector struct {
+	stats func() sql.DBStats
+
+	maxOpen           *prometheus.Desc
+	open              *prometheus.Desc
+	inUse             *prometheus.Desc
+	idle              *prometheus.Desc
+	waitCount         *prometheus.Desc
+	waitDuration      *prometheus.Desc
+	maxIdleClosed     *prometheus.Desc
+	maxIdleTimeClosed *prometheus.Desc
+	maxLifetimeClosed *prometheus.Desc
+}
+
+func newDBStatsCollector(stats func() sql.DBStats) *dbStatsCollector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "db", name), help, nil, nil)
+	}
+	return &dbStatsCollector{
+		stats:             stats,
+		maxOpen:           desc("max_open_connections", "Maximum number of open connections to the database."),
+		open:              desc("open_connections", "Established connections, in use and idle."),
+		inUse:             desc("in_use_connections", "Connections in use."),
+		idle:              desc("idle_connections", "Idle connections."),
+		waitCount:         desc("wait_count_total", "Connections waited for."),
+		waitDuration:      desc("wait_duration_seconds_total", "Time blocked waiting for a new connection."),
+		maxIdleClosed:     desc("max_idle_closed_total", "Connections closed due to the maximum of idle connections."),
+		maxIdleTimeClosed: desc("max_idle_time_closed_total", "Connections closed due to the maximum idle time."),
+		maxLifetimeClosed: desc("max_lifetime_closed_total", "Connections closed due to the maximum connection lifetime."),
+	}
+}
+
+func (c *dbStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.maxOpen
+	ch <- c.open
+	ch <- c.inUse
+	ch <- c.idle
+	ch <- c.waitCount
+	ch <- c.waitDuration
+	ch <- c.maxIdleClosed
+	ch <- c.maxIdleTimeClosed
+	ch <- c.maxLifetimeClosed
+}
+
+func (c *dbStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.stats()
+	ch <- prometheus.MustNewConstMetric(c.maxOpen, prometheus.GaugeValue, float64(stats.MaxOpenConnections))
+	ch <- prometheus.MustNewConstMetric(c.open, prometheus.GaugeValue, float64(stats.OpenConnections))
+	ch <- prometheus.MustNewConstMetric(c.inUse, prometheus.GaugeValue, float64(stats.InUse))
+	ch <- prometheus.MustNewConstMetric(c.idle, prometheus.GaugeValue, float64(stats.Idle))
+	ch <- prometheus.MustNewConstMetric(c.waitCount, prometheus.CounterValue, float64(stats.WaitCount))
+	ch <- prometheus.MustNewConstMetric(c.waitDuration, prometheus.CounterValue, stats.WaitDuration.Seconds())
+	ch <- prometheus.MustNewConstMetric(c.maxIdleClosed, prometheus.CounterValue, float64(stats.MaxIdleClosed))
+	ch <- prometheus.MustNewConstMetric(c.maxIdleTimeClosed, prometheus.CounterValue, float64(stats.MaxIdleTimeClosed))
+	ch <- prometheus.MustNewConstMetric(c.maxLifetimeClosed, prometheus.CounterValue, float64(stats.MaxLifetimeClosed))
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	handler := (&Server{db: newFakeDB()}).RegisterRoutes()
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/table/0b7c6a1e-9f3d-4d2a-8e5b-1f2a3b4c5d6e/activity", nil))
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d; want 200", rr.Code)
+	}
+
+	body := rr.Body.String()
+	for _, want := range []string{
+		`sharetome_http_request_duration_seconds_count{method="GET",route="/table/{id}/activity",status="401"}`,
+		"sharetome_db_open_connections 2",
+		"sharetome_db_max_open_connections 10",
+		"go_goroutines",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics have no %s", want)
+		}
+	}
+}
+
+func TestRouteLabel(t *testing.T) {
+	tests := map[string]string{
+		"":                          "unmatched",
+		"GET /api/v1/tables":        "/api/v1/tables",
+		"PATCH /api/v1/tables/{id}": "/api/v1/tables/{id}",
+		"/api/v1/uploads/{id}":      "/api/v1/uploads/{id}",
+		"GET /table/{id}/documents/{document_id}/reindex": "/table/{id}/documents/{document_id}/reindex",
+	}
+	for pattern, want := range tests {
+		if got := routeLabel(pattern); got != want {
+			t.Errorf("routeLabel(%q) = %q; want %q", pattern, got, want)
+		}
+	}
+}
+
+func TestSearchOperation(t *testing.T) {
+	tests := map[string]string{
+		"/sbhacks/_search":          "_search",
+		"/_search/scroll":           "_search",
+		"/_bulk":                    "_bulk",
+		"/sbhacks/_doc/chunk-1":     "_doc",
+		"/sbhacks/_delete_by_query": "_delete_by_query",
+		"/":                         "other",
+	}
+	for path, want := range tests {
+		if got := searchOperation(path); got != want {
+			t.Errorf("searchOperation(%q) = %q; want %q", path, got, want)
+		}
+	}
+}
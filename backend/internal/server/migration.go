@@ -0,0 +1,343 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+
+	"backend/internal/database"
+)
+
+// errOtherModel is returned when chunks cannot be shared between documents
+// because their tables are embedded with different models.
+var errOtherModel = errors.New("embedded with another model")
+
+// documentModel returns the model the chunks of doc are embedded with, which
+// is the one its table uses.
+func (s *Server) documentModel(ctx context.Context, doc database.TableDocument) (embeddingModel, error) {
+	table, err := s.db.GetTableByID(ctx, doc.TableID)
+	if err != nil {
+		return embeddingModel{}, err
+	}
+	if table == nil {
+		return embeddingModel{}, fmt.Errorf("table %s no longer exists", doc.TableID)
+	}
+	return tableModel(table), nil
+}
+
+// migrateTableHandler starts re-embedding the chunks of a table with the
+// model this server embeds new tables with. The new embeddings go to the
+// index of that model, and searches keep using the old ones until every
+// document has been migrated, so the table stays searchable throughout.
+func (s *Server) migrateTableHandler(w http.ResponseWriter, r *http.Request) {
+	tableID := r.PathValue("id")
+
+	userID := userIDFromRequest(r)
+	if userID == "" {
+		writeError(w, r, http.StatusUnauthorized, "Invalid or missing Authorization header")
+		return
+	}
+
+	ctx := r.Context()
+	table, err := s.db.GetTableByID(ctx, tableID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error getting table", "err", err)
+		writeFailure(w, r, err, "Failed to get table")
+		return
+	}
+	if table == nil || table.UserID != userID {
+		writeError(w, r, http.StatusNotFound, "Table not found")
+		return
+	}
+	from := tableModel(table)
+	if from == s.model {
+		writeError(w, r, http.StatusConflict, fmt.Sprintf("Table is already embedded with %s", s.model.Name))
+		return
+	}
+
+	docs, err := s.db.GetTableDocuments(ctx, tableID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error getting table documents", "err", err)
+		writeFailure(w, r, err, "Failed to get table documents")
+		return
+	}
+	// Creating the index here reports a broken cluster before any job starts
+	if err := s.ensureIndex(ctx, s.model); err != nil {
+		slog.ErrorContext(ctx, "Error creating index", "model", s.model.Name, "err", err)
+		writeFailure(w, r, err, "Failed to create index")
+		return
+	}
+
+	// The migration writes every document again, so it excludes other jobs
+	if err := s.lockTable(ctx, tableID); err != nil {
+		writeLockFailure(w, r, err)
+		return
+	}
+
+	job, err := s.db.CreateIngestionJob(ctx, tableID, userID, database.JobKindMigrate, len(docs))
+	if err != nil {
+		s.unlockTable(tableID)
+		slog.ErrorContext(ctx, "Error creating ingestion job", "err", err)
+		writeFailure(w, r, err, "Failed to create migration job")
+		return
+	}
+
+	// The job is updated in place while it runs
+	snapshot := *job
+	go s.runMigrationJob(job, docs, from, s.model)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", apiPrefix+"/jobs/"+job.JobID)
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(snapshot); err != nil {
+		slog.ErrorContext(ctx, "Failed to encode response", "err", err)
+	}
+}
+
+// runMigrationJob migrates the chunks of docs from the index of from to that
+// of to and, once all of them are there, switches the table over. A failed job
+// leaves the table on from; it can be started again, replacing what the failed
+// run indexed.
+func (s *Server) runMigrationJob(job *database.IngestionJob, docs []database.TableDocument, from, to embeddingModel) {
+	s.runJob(job, docs, func(ctx context.Context, doc database.TableDocument) error {
+		return s.migrateChunks(ctx, doc, from, to)
+	}, func(ctx context.Context) error {
+		return s.switchModel(ctx, job, docs, from, to)
+	})
+}
+
+// switchModel makes the table of job, whose docs have been migrated from one
+// model to the other, search the chunks of to, then deletes the chunks of the
+// migrated documents from the index of from. If documents added during the
+// job cannot be migrated, the table is switched back and the old chunks are
+// kept, so the job fails as if it had never switched.
+func (s *Server) switchModel(ctx context.Context, job *database.IngestionJob, docs []database.TableDocument, from, to embeddingModel) error {
+	logger := slog.With("job_id", job.JobID, "table_id", job.TableID)
+	if err := s.db.SetTableEmbedding(ctx, job.TableID, to.Name, to.Version); err != nil {
+		logger.Error("Error switching table to new embedding model", "model", to.Name, "err", err)
+		return fmt.Errorf("failed to switch the table to %s", to.Name)
+	}
+	switchBack := func() {
+		if err := s.db.SetTableEmbedding(context.WithoutCancel(ctx), job.TableID, from.Name, from.Version); err != nil {
+			logger.Error("Error switching table back to old embedding model", "model", from.Name, "err", err)
+		}
+	}
+
+	// Every ingestion path takes the lock the job holds, so no document
+	// should have been added during it. One ingested by a replica that lost
+	// its lock is migrated here all the same; one still being ingested
+	// migrates its own chunks when it finds the table switched.
+	current, err := s.db.GetTableDocuments(ctx, job.TableID)
+	if err != nil {
+		logger.Error("Error getting table documents", "err", err)
+		switchBack()
+		return fmt.Errorf("failed to get the documents added during the migration")
+	}
+	migrated := make(map[string]bool, len(docs))
+	for _, doc := range docs {
+		migrated[doc.DocumentID] = true
+	}
+	ids := make([]string, 0, len(current))
+	for _, doc := range current {
+		if !migrated[doc.DocumentID] {
+			if !doc.Ingested {
+				continue
+			}
+			if err := s.migrateChunks(ctx, doc, from, to); err != nil {
+				logger.Error("Error migrating chunks of document added during migration", "document_id", doc.DocumentID, "err", err)
+				switchBack()
+				return fmt.Errorf("failed to migrate document %s, added during the migration", doc.DocumentID)
+			}
+		}
+		ids = append(ids, doc.DocumentID)
+	}
+
+	// Nothing searches the old chunks of the migrated documents any more.
+	// They are deleted by document, so that the chunks of one still being
+	// ingested are left for it to migrate.
+	if err := s.deleteDocumentChunks(ctx, s.chunkIndex(from), ids); err != nil {
+		logger.Error("Error deleting chunks embedded with old model", "model", from.Name, "err", err)
+	}
+	s.recordEvent(ctx, job.TableID, job.UserID, database.EventEmbeddingsMigrated, "", map[string]interface{}{
+		"job_id":     job.JobID,
+		"from_model": from.Name,
+		"to_model":   to.Name,
+	})
+	return nil
+}
+
+// embeddingBatchSize is how many chunks migrateChunks embeds per request.
+// Chunks have at most 8191 tokens, so a batch stays within the tokens the API
+// accepts in one request.
+const embeddingBatchSize = 32
+
+// migrateChunks embeds the chunks doc has in the index of from again with to
+// and indexes them in the index of to under a fresh generation, replacing any
+// chunks doc had there. The chunks in the old index are left as they are.
+func (s *Server) migrateChunks(ctx context.Context, doc database.TableDocument, from, to embeddingModel) (err error) {
+	indexName := s.chunkIndex(to)
+	generation := uuid.New().String()
+	var pending []map[string]interface{}
+	var body bytes.Buffer
+	count, batched := 0, 0
+	defer func() {
+		// A document migrated in part would be searched with half its chunks
+		// once the table is switched
+		if err == nil || count == 0 {
+			return
+		}
+		if cleanupErr := s.deleteGeneration(context.WithoutCancel(ctx), indexName, doc.DocumentID, generation); cleanupErr != nil {
+			slog.ErrorContext(ctx, "Error deleting chunks of failed migration", "document_id", doc.DocumentID, "generation", generation, "err", cleanupErr)
+		}
+	}()
+
+	// flush embeds the pending chunks and adds them to the bulk body,
+	// indexing it whenever it holds importBatchSize chunks
+	flush := func() error {
+		if err := s.embedChunks(ctx, to, pending); err != nil {
+			return err
+		}
+		for _, source := range pending {
+			props := chunkProperties(source)
+			props["generation"] = generation
+			props["embedding_model"] = to.Name
+			props["embedding_version"] = to.Version
+
+			body.WriteString(`{"index":{}}` + "\n")
+			body.WriteString(mustToJSON(source) + "\n")
+			count++
+			batched++
+
+			if batched == importBatchSize {
+				if err := s.bulkIndex(ctx, indexName, &body); err != nil {
+					return err
+				}
+				body.Reset()
+				batched = 0
+			}
+		}
+		pending = pending[:0]
+		return nil
+	}
+
+	err = s.scrollChunks(ctx, s.chunkIndex(from), "document_id", doc.DocumentID, func(source map[string]interface{}) error {
+		pending = append(pending, source)
+		if len(pending) == embeddingBatchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	// Without chunks in the old index, there is nothing to migrate or the
+	// document has been migrated already
+	if count == 0 {
+		return nil
+	}
+	if batched > 0 {
+		if err := s.bulkIndex(ctx, indexName, &body); err != nil {
+			return err
+		}
+	}
+	return s.deleteStaleChunks(ctx, indexName, doc.DocumentID, generation)
+}
+
+// embedChunks replaces the embeddings of chunks with ones made with model.
+// Chunks without text were never embedded and are left without.
+func (s *Server) embedChunks(ctx context.Context, model embeddingModel, chunks []map[string]interface{}) error {
+	var texts []string
+	var embedded []map[string]interface{}
+	for _, source := range chunks {
+		delete(source, "embedding")
+		if text, _ := source["text_representation"].(string); text != "" {
+			texts = append(texts, text)
+			embedded = append(embedded, source)
+		}
+	}
+	if len(texts) == 0 {
+		return nil
+	}
+
+	var embeddings [][]float32
+	if s.embedBatch != nil {
+		var err error
+		embeddings, err = s.embedBatch(ctx, model.Name, texts)
+		if err != nil {
+			return fmt.Errorf("error embedding chunks: %v", err)
+		}
+	} else {
+		for _, text := range texts {
+			embedding, err := s.embed(ctx, model.Name, text)
+			if err != nil {
+				return fmt.Errorf("error embedding chunk: %v", err)
+			}
+			embeddings = append(embeddings, embedding)
+		}
+	}
+	for i, source := range embedded {
+		source["embedding"] = embeddings[i]
+	}
+	return nil
+}
+
+// deleteDocumentChunks removes the chunks of the documents ids from
+// indexName, importBatchSize documents per request. A missing index is
+// skipped.
+func (s *Server) deleteDocumentChunks(ctx context.Context, indexName string, ids []string) error {
+	for len(ids) > 0 {
+		batch := ids[:min(len(ids), importBatchSize)]
+		ids = ids[len(batch):]
+
+		query := map[string]interface{}{
+			"query": map[string]interface{}{
+				"terms": map[string]interface{}{
+					"properties.properties.document_id.keyword": batch,
+				},
+			},
+		}
+		res, err := s.es.DeleteByQuery(
+			[]string{indexName},
+			strings.NewReader(mustToJSON(query)),
+			s.es.DeleteByQuery.WithContext(ctx),
+			s.es.DeleteByQuery.WithRefresh(true),
+			s.es.DeleteByQuery.WithIgnoreUnavailable(true),
+		)
+		if err != nil {
+			return searchFailure("error deleting chunks", nil, err)
+		}
+		if res.IsError() {
+			err = searchFailure("error deleting chunks", res, nil)
+		}
+		res.Body.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// followMigration moves the chunks of doc, just indexed with model, to the
+// model its table uses now, in case a migration switched the table over while
+// doc was being ingested.
+func (s *Server) followMigration(ctx context.Context, doc database.TableDocument, model embeddingModel) error {
+	current, err := s.documentModel(ctx, doc)
+	if err != nil || current == model {
+		return err
+	}
+	if err := s.migrateChunks(ctx, doc, model, current); err != nil {
+		return err
+	}
+	return s.deleteChunks(ctx, []string{s.chunkIndex(model)}, "document_id", doc.DocumentID)
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"backend/internal/database"
+)
+
+func TestMigrateTable(t *testing.T) {
+	db := newFakeDB()
+	db.tables["t1"] = &database.UserTable{UserID: "alice", TableID: "t1", TableName: "notes", EmbeddingModel: firstModel.Name, EmbeddingVersion: 1}
+	db.docs["d1"] = &database.TableDocument{DocumentID: "d1", TableID: "t1", UserID: "alice", FileName: "a.pdf"}
+	db.docs["d2"] = &database.TableDocument{DocumentID: "d2", TableID: "t1", UserID: "alice", FileName: "b.pdf"}
+
+	es, esRequests := newFakeES(t, `{"errors":false,"deleted":1,"hits":{"hits":[{"_source":{"text_representation":"hello","embedding":[0.1,0.2],"properties":{"properties":{"document_id":"d1","table_id":"t1","generation":"old"}}}}]}}`)
+
+	large := embeddingModels[2]
+	var mu sync.Mutex
+	var models []string
+	s := &Server{
+		index: "chunks",
+		model: large,
+		db:    db,
+		es:    es,
+		embed: func(ctx context.Context, model, text string) ([]float32, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			models = append(models, model)
+			return []float32{0.75}, nil
+		},
+	}
+	handler := s.RegisterRoutes()
+
+	migrate := func(userID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/tables/t1/embedding-migration", nil)
+		req.Header.Set("Authorization", "Bearer "+userID)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := migrate("bob"); rr.Code != http.StatusNotFound {
+		t.Errorf("non-owner: status = %d; want 404", rr.Code)
+	}
+
+	rr := migrate("alice")
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("status = %d; want 202: %s", rr.Code, rr.Body)
+	}
+	var job database.IngestionJob
+	if err := json.NewDecoder(rr.Body).Decode(&job); err != nil {
+		t.Fatalf("error decoding response: %v", err)
+	}
+	if job.Kind != database.JobKindMigrate || job.Total != 2 {
+		t.Errorf("job = %+v; want a migration of 2 documents", job)
+	}
+
+	done := waitForJob(t, db, job.JobID)
+	if done.Status != database.JobStatusSucceeded {
+		t.Fatalf("job = %+v; want it to succeed", done)
+	}
+	if table := db.tables["t1"]; table.EmbeddingModel != large.Name || table.EmbeddingVersion != large.Version {
+		t.Errorf("table uses %s version %d; want %s version %d", table.EmbeddingModel, table.EmbeddingVersion, large.Name, large.Version)
+	}
+	for _, m := range models {
+		if m != large.Name {
+			t.Errorf("chunk embedded with %s; want %s", m, large.Name)
+		}
+	}
+
+	var bulks int
+	var oldDeleted bool
+	for _, r := range esRequests() {
+		switch r.Path {
+		case "/chunks_v2/_bulk":
+			bulks++
+			for _, want := range []string{`"embedding":[0.75]`, `"embedding_model":"` + large.Name + `"`, `"embedding_version":2`} {
+				if !strings.Contains(r.Body, want) {
+					t.Errorf("bulk body %s does not contain %s", r.Body, want)
+				}
+			}
+		case "/chunks/_bulk":
+			t.Errorf("chunks indexed in the old index: %s", r.Body)
+		case "/chunks/_delete_by_query":
+			oldDeleted = oldDeleted || strings.Contains(r.Body, `document_id.keyword":["d1","d2"]`) || strings.Contains(r.Body, `document_id.keyword":["d2","d1"]`)
+		}
+	}
+	if bulks != 2 {
+		t.Errorf("got %d bulk requests to the new index; want one per document", bulks)
+	}
+	if !oldDeleted {
+		t.Error("chunks in the old index were not deleted")
+	}
+	if n := len(db.events); n == 0 || db.events[n-1].Action != database.EventEmbeddingsMigrated {
+		t.Errorf("events = %+v; want the migration recorded", db.events)
+	}
+
+	if rr := migrate("alice"); rr.Code != http.StatusConflict {
+		t.Errorf("migrated table: status = %d; want 409", rr.Code)
+	}
+}
+
+func TestSwitchModelKeepsOldChunksOnFailure(t *testing.T) {
+	db := newFakeDB()
+	db.tables["t1"] = &database.UserTable{UserID: "alice", TableID: "t1", TableName: "notes", EmbeddingModel: firstModel.Name, EmbeddingVersion: 1}
+	db.docs["d1"] = &database.TableDocument{DocumentID: "d1", TableID: "t1", UserID: "alice", FileName: "a.pdf"}
+	db.docs["d2"] = &database.TableDocument{DocumentID: "d2", TableID: "t1", UserID: "alice", FileName: "b.pdf", Ingested: true}
+	es, esRequests := newFakeES(t, `{"errors":false,"hits":{"hits":[{"_source":{"text_representation":"hello","properties":{"properties":{"document_id":"d2","table_id":"t1"}}}}]}}`)
+	s := &Server{
+		index: "chunks",
+		db:    db,
+		es:    es,
+		embed: func(ctx context.Context, model, text string) ([]float32, error) {
+			return nil, errors.New("embedding API unavailable")
+		},
+	}
+
+	// d2 was added while d1 was being migrated, and cannot be embedded
+	job := &database.IngestionJob{JobID: "j1", TableID: "t1", UserID: "alice"}
+	docs := []database.TableDocument{*db.docs["d1"]}
+	if err := s.switchModel(context.Background(), job, docs, firstModel, embeddingModels[2]); err == nil {
+		t.Fatal("switch succeeded despite a document that could not be migrated")
+	}
+
+	if table := db.tables["t1"]; table.EmbeddingModel != firstModel.Name {
+		t.Errorf("table uses %s; want it switched back to %s", table.EmbeddingModel, firstModel.Name)
+	}
+	for _, r := range esRequests() {
+		if strings.HasSuffix(r.Path, "/_delete_by_query") {
+			t.Errorf("chunks deleted after a failed switch: %s %s", r.Path, r.Body)
+		}
+	}
+}
+
+func TestEmbedChunksInOneRequest(t *testing.T) {
+	var calls [][]string
+	s := &Server{
+		embedBatch: func(ctx context.Context, model string, texts []string) ([][]float32, error) {
+			calls = append(calls, texts)
+			embeddings := make([][]float32, len(texts))
+			for i := range texts {
+				embeddings[i] = []float32{float32(i)}
+			}
+			return embeddings, nil
+		},
+	}
+
+	chunks := []map[string]interface{}{
+		{"text_representation": "a", "embedding": []float32{9}},
+		{"embedding": []float32{9}},
+		{"text_representation": "c"},
+	}
+	if err := s.embedChunks(context.Background(), embeddingModels[2], chunks); err != nil {
+		t.Fatalf("embedChunks: %v", err)
+	}
+	if len(calls) != 1 || len(calls[0]) != 2 {
+		t.Fatalf("embedding requests = %v; want one for both texts", calls)
+	}
+	if _, ok := chunks[1]["embedding"]; ok {
+		t.Error("chunk without text kept its old embedding")
+	}
+	if got := chunks[2]["embedding"].([]float32); got[0] != 1 {
+		t.Errorf("third chunk got embedding %v; want that of the second text", got)
+	}
+}
+
+func TestSearchUsesTableModel(t *testing.T) {
+	db := newFakeDB()
+	db.tables["t1"] = &database.UserTable{UserID: "alice", TableID: "t1", TableName: "notes", IsPublic: true, EmbeddingVersion: 2}
+	es, esRequests := newFakeES(t, `{"hits":{"hits":[]}}`)
+
+	var embeddedWith string
+	s := &Server{
+		index: "chunks",
+		model: firstModel,
+		db:    db,
+		es:    es,
+		embed: func(ctx context.Context, model, text string) ([]float32, error) {
+			embeddedWith = model
+			return []float32{0.5}, nil
+		},
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/tables/t1/search?q=budget", nil)
+	rr := httptest.NewRecorder()
+	s.RegisterRoutes().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d; want 200: %s", rr.Code, rr.Body)
+	}
+	if embeddedWith != embeddingModels[2].Name {
+		t.Errorf("query embedded with %q; want the table's model %s", embeddedWith, embeddingModels[2].Name)
+	}
+	if reqs := esRequests(); len(reqs) != 1 || reqs[0].Path != "/chunks_v2/_search" {
+		t.Errorf("elasticsearch requests = %+v; want a search of the table's index", reqs)
+	}
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"strconv"
+	"sync"
+
+	"golang.org/x/sync/singleflight"
+
+	"backend/internal/database"
+)
+
+// pageCacheBytes is how many bytes of rendered pages a server keeps.
+const pageCacheBytes = 64 << 20
+
+// pageCache keeps rendered pages of documents in memory, dropping the least
+// recently used beyond its size, so that a page viewed again is not rendered
+// again. Files of documents never change, so pages never go stale.
+type pageCache struct {
+	maxBytes int
+
+	mu      sync.Mutex
+	bytes   int
+	entries map[string]*list.Element
+	// order holds the *pageCacheEntry values, most recently used first.
+	order *list.List
+
+	// misses makes concurrent misses of one page share a render.
+	misses singleflight.Group
+}
+
+type pageCacheEntry struct {
+	key string
+	png []byte
+}
+
+func newPageCache(maxBytes int) *pageCache {
+	return &pageCache{
+		maxBytes: maxBytes,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// documentPage returns page pageNumber of doc as a PNG, with the bounding box
+// bbox of the chunk highlight outlined if it is set, from the page cache or
+// else rendered.
+func (s *Server) documentPage(ctx context.Context, doc *database.TableDocument, pageNumber int, highlight string, bbox []float64) ([]byte, error) {
+	if s.pages == nil {
+		return s.renderDocumentPage(ctx, doc, pageNumber, bbox)
+	}
+
+	key := doc.DocumentID + "\x00" + strconv.Itoa(pageNumber) + "\x00" + highlight
+	if png, ok := s.pages.get(key); ok {
+		return png, nil
+	}
+	v, err, _ := s.pages.misses.Do(key, func() (interface{}, error) {
+		png, err := s.renderDocumentPage(ctx, doc, pageNumber, bbox)
+		if err != nil {
+			return nil, err
+		}
+		s.pages.add(key, png)
+		return png, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]byte), nil
+}
+
+// get returns the page cached under key.
+func (c *pageCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*pageCacheEntry).png, true
+}
+
+// add caches png under key, dropping the least recently used pages beyond the
+// size of the cache. Pages larger than the whole cache are not kept.
+func (c *pageCache) add(key string, png []byte) {
+	if len(png) > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.bytes -= len(elem.Value.(*pageCacheEntry).png)
+		c.order.Remove(elem)
+	}
+	c.entries[key] = c.order.PushFront(&pageCacheEntry{key: key, png: png})
+	c.bytes += len(png)
+	for c.bytes > c.maxBytes {
+		oldest := c.order.Back()
+		entry := oldest.Value.(*pageCacheEntry)
+		c.order.Remove(oldest)
+		delete(c.entries, entry.key)
+		c.bytes -= len(entry.png)
+	}
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+
+	"backend/internal/config"
+	"backend/internal/database"
+)
+
+// queryCache keeps the embeddings of search queries, so that popular queries
+// of public tables are only paid for once. Recent embeddings are kept in
+// memory, dropping the least recently used; they may also be kept in the
+// database, which outlives restarts and is shared between replicas.
+type queryCache struct {
+	size int
+	ttl  time.Duration
+	// db is the persistent tier; nil keeps embeddings in memory only.
+	db  database.Service
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// order holds the *queryCacheEntry values, most recently used first.
+	order *list.List
+	swept time.Time
+
+	// misses makes concurrent misses of one query share a request to the API.
+	misses singleflight.Group
+}
+
+type queryCacheEntry struct {
+	key       string
+	embedding []float32
+	expires   time.Time
+}
+
+// newQueryCache creates the cache cfg configures, or returns nil if it keeps
+// nothing.
+func newQueryCache(cfg config.QueryCache, db database.Service) *queryCache {
+	if cfg.Size <= 0 && !cfg.Persistent {
+		return nil
+	}
+	c := &queryCache{
+		size:    cfg.Size,
+		ttl:     cfg.TTL,
+		now:     time.Now,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+	if cfg.Persistent {
+		c.db = db
+	}
+	return c
+}
+
+// embedQuery embeds a search query with model, reusing the embedding of the
+// same query if it is cached.
+func (s *Server) embedQuery(ctx context.Context, model, query string) ([]float32, error) {
+	if s.queryCache == nil {
+		return s.embed(ctx, model, query)
+	}
+	return s.queryCache.embed(ctx, model, query, s.embed)
+}
+
+// normalizeQuery reduces the queries that mean the same to one text: lower
+// case, with single spaces between words.
+func normalizeQuery(query string) string {
+	return strings.ToLower(strings.Join(strings.Fields(query), " "))
+}
+
+// embed returns the embedding of the normalized query with model from the
+// cache, or else from embed, caching it. The model is part of the key, since
+// embeddings of different models cannot be compared. Failures of the
+// persistent tier are logged and skipped; only those of embed are returned.
+func (c *queryCache) embed(ctx context.Context, model, query string, embed embedder) ([]float32, error) {
+	query = normalizeQuery(query)
+	sum := sha256.Sum256([]byte(model + "\x00" + query))
+	key := hex.EncodeToString(sum[:])
+
+	if c.size > 0 {
+		if embedding, ok := c.get(key); ok {
+			queryCacheLookups.WithLabelValues("memory", "hit").Inc()
+			return embedding, nil
+		}
+		queryCacheLookups.WithLabelValues("memory", "miss").Inc()
+	}
+
+	v, err, _ := c.misses.Do(key, func() (interface{}, error) {
+		if c.db != nil {
+			embedding, err := c.db.GetQueryEmbedding(ctx, key, c.ttl)
+			if err != nil {
+				slog.WarnContext(ctx, "Error getting cached query embedding", "err", err)
+			}
+			if embedding != nil {
+				queryCacheLookups.WithLabelValues("postgres", "hit").Inc()
+				c.add(key, embedding)
+				return embedding, nil
+			}
+			queryCacheLookups.WithLabelValues("postgres", "miss").Inc()
+		}
+
+		embedding, err := embed(ctx, model, query)
+		if err != nil {
+			return nil, err
+		}
+		c.add(key, embedding)
+		if c.db != nil {
+			c.store(ctx, key, model, embedding)
+		}
+		return embedding, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]float32), nil
+}
+
+// get returns the embedding cached in memory under key, if it has not expired.
+func (c *queryCache) get(key string) ([]float32, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*queryCacheEntry)
+	if !c.now().Before(entry.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return entry.embedding, true
+}
+
+// add caches embedding in memory under key, dropping the least recently used
+// embeddings beyond the size of the cache.
+func (c *queryCache) add(key string, embedding []float32) {
+	if c.size <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires := c.now().Add(c.ttl)
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = &queryCacheEntry{key: key, embedding: embedding, expires: expires}
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&queryCacheEntry{key: key, embedding: embedding, expires: expires})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*queryCacheEntry).key)
+	}
+}
+
+// store keeps embedding in the database, deleting expired embeddings now and
+// then.
+func (c *queryCache) store(ctx context.Context, key, model string, embedding []float32) {
+	if err := c.db.PutQueryEmbedding(ctx, key, model, embedding); err != nil {
+		slog.WarnContext(ctx, "Error caching query embedding", "err", err)
+	}
+
+	c.mu.Lock()
+	sweep := c.now().Sub(c.swept) > sweepInterval
+	if sweep {
+		c.swept = c.now()
+	}
+	c.mu.Unlock()
+	if sweep {
+		if err := c.db.DeleteQueryEmbeddings(ctx, c.ttl); err != nil {
+			slog.WarnContext(ctx, "Error deleting expired query embeddings", "err", err)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"backend/internal/config"
+)
+
+// countingEmbedder embeds text as its length, counting the texts it embeds.
+func countingEmbedder(calls map[string]int) embedder {
+	return func(ctx context.Context, model, text string) ([]float32, error) {
+		calls[text]++
+		return []float32{float32(len(text))}, nil
+	}
+}
+
+func TestQueryCache(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	cache := newQueryCache(config.QueryCache{Size: 2, TTL: time.Hour}, nil)
+	cache.now = func() time.Time { return now }
+	calls := make(map[string]int)
+	embed := countingEmbedder(calls)
+	ctx := context.Background()
+
+	for _, query := range []string{"Annual  report", "annual report", " ANNUAL REPORT\n", "budget", "annual report", "minutes"} {
+		if _, err := cache.embed(ctx, firstModel.Name, query, embed); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// "budget" was the least recently used when "minutes" was added
+	if _, err := cache.embed(ctx, firstModel.Name, "budget", embed); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{"annual report": 1, "budget": 2, "minutes": 1}
+	for query, n := range want {
+		if calls[query] != n {
+			t.Errorf("%q embedded %d times; want %d", query, calls[query], n)
+		}
+	}
+	if len(calls) != len(want) {
+		t.Errorf("embedded %v; want %v", calls, want)
+	}
+
+	now = now.Add(time.Hour)
+	if _, err := cache.embed(ctx, firstModel.Name, "minutes", embed); err != nil {
+		t.Fatal(err)
+	}
+	if calls["minutes"] != 2 {
+		t.Errorf("expired query embedded %d times; want 2", calls["minutes"])
+	}
+}
+
+func TestQueryCachePersistent(t *testing.T) {
+	db := newFakeDB()
+	cfg := config.QueryCache{TTL: time.Hour, Persistent: true}
+	calls := make(map[string]int)
+	embed := countingEmbedder(calls)
+	ctx := context.Background()
+
+	// Another replica, or the next run, finds the embeddings of the first
+	for i := 0; i < 2; i++ {
+		embedding, err := newQueryCache(cfg, db).embed(ctx, firstModel.Name, "Budget", embed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(embedding) != 1 || embedding[0] != 6 {
+			t.Errorf("embedding = %v; want [6]", embedding)
+		}
+	}
+	if calls["budget"] != 1 {
+		t.Errorf("embedded %d times; want 1", calls["budget"])
+	}
+
+	// Embeddings of other models are not reused
+	if _, err := newQueryCache(cfg, db).embed(ctx, embeddingModels[2].Name, "budget", embed); err != nil {
+		t.Fatal(err)
+	}
+	if calls["budget"] != 2 {
+		t.Errorf("embedded %d times with two models; want 2", calls["budget"])
+	}
+}
+
+func TestRetryTransport(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		// retryAfter is the Retry-After of failed responses.
+		retryAfter string
+		status     int
+		attempts   int
+	}{
+		{"succeeds after failures", []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK}, "", http.StatusOK, 3},
+		{"gives up", []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway}, "", http.StatusBadGateway, 3},
+		{"client error", []int{http.StatusBadRequest}, "", http.StatusBadRequest, 1},
+		{"long Retry-After", []int{http.StatusTooManyRequests}, "60", http.StatusTooManyRequests, 1},
+		{"short Retry-After", []int{http.StatusTooManyRequests, http.StatusOK}, "0", http.StatusOK, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts int
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// Every attempt sends the whole body
+				if body, _ := io.ReadAll(r.Body); string(body) != `{"input":"budget"}` {
+					t.Errorf("attempt %d sent %q", attempts+1, body)
+				}
+				status := tt.statuses[attempts]
+				attempts++
+				if status != http.StatusOK && tt.retryAfter != "" {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				w.WriteHeader(status)
+			}))
+			defer srv.Close()
+
+			client := &http.Client{Transport: retryTransport{next: http.DefaultTransport, attempts: 3, backoff: time.Millisecond}}
+			req, err := http.NewRequest(http.MethodPost, srv.URL, strings.NewReader(`{"input":"budget"}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.status || attempts != tt.attempts {
+				t.Errorf("got status %d after %d attempts; want %d after %d", resp.StatusCode, attempts, tt.status, tt.attempts)
+			}
+		})
+	}
+}
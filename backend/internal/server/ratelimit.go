@@ -0,0 +1,232 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"backend/internal/config"
+	"backend/internal/database"
+)
+
+// Names of the rate limits, which key their buckets and label their metrics.
+const (
+	limitSearch    = "search"
+	limitUpload    = "upload"
+	limitIngestion = "ingestion"
+	limitRender    = "render"
+)
+
+// rateLimit is a token bucket each client has for one kind of request. It
+// holds burst tokens and gains one every interval.
+type rateLimit struct {
+	interval time.Duration
+	burst    int
+}
+
+// rateLimitStore keeps the buckets of a rateLimiter.
+type rateLimitStore interface {
+	// take takes a token from the bucket key, returning 0 if there was one
+	// and otherwise how long until there is.
+	take(ctx context.Context, key string, limit rateLimit) (time.Duration, error)
+}
+
+// rateLimiter throttles costly requests per client IP and, for requests with
+// credentials, per user as well, so that anonymous searches of public tables
+// cannot run up the embedding bill. Bearer tokens are not verified, so a
+// client could name a new user for every request; the IP limit holds anyway.
+type rateLimiter struct {
+	store  rateLimitStore
+	limits map[string]rateLimit
+	// trustProxy identifies clients by X-Forwarded-For.
+	trustProxy bool
+}
+
+// newRateLimiter creates the rate limiter cfg configures, keeping its buckets
+// in db if they are shared between replicas.
+func newRateLimiter(cfg config.RateLimits, db database.Service) *rateLimiter {
+	l := &rateLimiter{limits: make(map[string]rateLimit), trustProxy: cfg.TrustProxy}
+	for name, limit := range map[string]config.RateLimit{
+		limitSearch:    cfg.Search,
+		limitUpload:    cfg.Upload,
+		limitIngestion: cfg.Ingestion,
+		limitRender:    cfg.Render,
+	} {
+		if limit.PerMinute > 0 {
+			l.limits[name] = rateLimit{interval: time.Minute / time.Duration(limit.PerMinute), burst: limit.Burst}
+		}
+	}
+	if cfg.Store == "postgres" {
+		l.store = &postgresRateLimits{db: db}
+	} else {
+		l.store = newMemoryRateLimits()
+	}
+	return l
+}
+
+// limited serves handler with the requests the named limit lets through.
+func (s *Server) limited(name string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.limiter.allow(w, r, name) {
+			handler(w, r)
+		}
+	}
+}
+
+// allow takes a token of the named limit for the client of r, reporting
+// whether there was one. If not, it answers 429 with Retry-After. A nil
+// limiter allows everything.
+func (l *rateLimiter) allow(w http.ResponseWriter, r *http.Request, name string) bool {
+	if l == nil {
+		return true
+	}
+	limit, ok := l.limits[name]
+	if !ok {
+		return true
+	}
+
+	ctx := r.Context()
+	var wait time.Duration
+	for _, client := range l.clients(r) {
+		var err error
+		wait, err = l.store.take(ctx, name+":"+client, limit)
+		if err != nil {
+			// An unreachable store should not take the API down with it
+			slog.WarnContext(ctx, "Error checking rate limit", "limit", name, "err", err)
+			return true
+		}
+		if wait > 0 {
+			break
+		}
+	}
+	if wait <= 0 {
+		return true
+	}
+
+	rateLimitedRequests.WithLabelValues(name).Inc()
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	writeProblem(w, r, http.StatusTooManyRequests, codeRateLimited,
+		fmt.Sprintf("Too many %s requests; retry in %d seconds", name, seconds))
+	return false
+}
+
+// clients returns the buckets a request of r takes a token from: that of its
+// IP address and, if it has credentials, that of its user.
+func (l *rateLimiter) clients(r *http.Request) []string {
+	clients := []string{"ip:" + clientIP(r, l.trustProxy)}
+	if userID := userIDFromRequest(r); userID != "" {
+		clients = append(clients, "user:"+userID)
+	}
+	return clients
+}
+
+// clientIP returns the address r came from: that of the connection or, behind
+// a trusted proxy, the last one of X-Forwarded-For, which the proxy added.
+// IPv6 addresses are cut to their /64 network, which is usually one host's.
+func clientIP(r *http.Request, trustProxy bool) string {
+	addr := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	if trustProxy {
+		if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+			list := strings.Split(forwarded[len(forwarded)-1], ",")
+			if last := strings.TrimSpace(list[len(list)-1]); last != "" {
+				addr = last
+			}
+		}
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return addr
+	}
+	if ip.To4() == nil {
+		return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+	}
+	return ip.String()
+}
+
+// takeToken takes a token of limit from a bucket that is full at fullAt. It
+// returns how long until there is a token, 0 if it took one, and when the
+// bucket is full again afterwards. A bucket lacks one token for every
+// interval until it is full, so it is empty once that is burst intervals away.
+func takeToken(fullAt, now time.Time, limit rateLimit) (time.Duration, time.Time) {
+	if fullAt.Before(now) {
+		fullAt = now
+	}
+	next := fullAt.Add(limit.interval)
+	if wait := next.Sub(now) - time.Duration(limit.burst)*limit.interval; wait > 0 {
+		return wait, fullAt
+	}
+	return 0, next
+}
+
+// sweepInterval is how often stores drop the buckets that are full.
+const sweepInterval = 10 * time.Minute
+
+// memoryRateLimits keeps buckets in memory, limiting each replica on its own.
+type memoryRateLimits struct {
+	now func() time.Time
+
+	mu sync.Mutex
+	// fullAt holds when each bucket is full again. Missing buckets are full.
+	fullAt map[string]time.Time
+	swept  time.Time
+}
+
+func newMemoryRateLimits() *memoryRateLimits {
+	return &memoryRateLimits{now: time.Now, fullAt: make(map[string]time.Time)}
+}
+
+func (m *memoryRateLimits) take(ctx context.Context, key string, limit rateLimit) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	if now.Sub(m.swept) > sweepInterval {
+		for k, fullAt := range m.fullAt {
+			if !fullAt.After(now) {
+				delete(m.fullAt, k)
+			}
+		}
+		m.swept = now
+	}
+
+	wait, fullAt := takeToken(m.fullAt[key], now, limit)
+	m.fullAt[key] = fullAt
+	return wait, nil
+}
+
+// postgresRateLimits keeps buckets in the database, where every replica sees
+// them.
+type postgresRateLimits struct {
+	db database.Service
+
+	mu    sync.Mutex
+	swept time.Time
+}
+
+func (p *postgresRateLimits) take(ctx context.Context, key string, limit rateLimit) (time.Duration, error) {
+	p.mu.Lock()
+	sweep := time.Since(p.swept) > sweepInterval
+	if sweep {
+		p.swept = time.Now()
+	}
+	p.mu.Unlock()
+	if sweep {
+		if err := p.db.DeleteFullRateLimits(ctx); err != nil {
+			slog.WarnContext(ctx, "Error deleting full rate limit buckets", "err", err)
+		}
+	}
+
+	return p.db.TakeRateLimitToken(ctx, key, limit.interval, limit.burst)
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMemoryRateLimits(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	store := newMemoryRateLimits()
+	store.now = func() time.Time { return now }
+	limit := rateLimit{interval: time.Second, burst: 2}
+	ctx := context.Background()
+
+	take := func(key string, want time.Duration) {
+		t.Helper()
+		wait, err := store.take(ctx, key, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wait != want {
+			t.Errorf("take(%q) at %s = %s; want %s", key, now.Format(time.TimeOnly), wait, want)
+		}
+	}
+
+	// A full bucket allows a burst, then one request per interval
+	take("a", 0)
+	take("a", 0)
+	take("a", time.Second)
+	take("b", 0)
+	now = now.Add(500 * time.Millisecond)
+	take("a", 500*time.Millisecond)
+	now = now.Add(500 * time.Millisecond)
+	take("a", 0)
+	take("a", time.Second)
+
+	// Refused requests take nothing, and buckets fill up to the burst
+	now = now.Add(time.Hour)
+	take("a", 0)
+	take("a", 0)
+	take("a", time.Second)
+}
+
+func TestRateLimitedRoutes(t *testing.T) {
+	s := &Server{db: newFakeDB()}
+	s.limiter = &rateLimiter{
+		store:  newMemoryRateLimits(),
+		limits: map[string]rateLimit{limitSearch: {interval: time.Minute, burst: 1}},
+	}
+	handler := s.RegisterRoutes()
+
+	search := func(userID, remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/tables/t1/search?q=notes", nil)
+		req.RemoteAddr = remoteAddr
+		if userID != "" {
+			req.Header.Set("Authorization", "Bearer "+userID)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// The table does not exist, so requests that get through are not found
+	if rr := search("", "192.0.2.1:1234"); rr.Code != http.StatusNotFound {
+		t.Fatalf("first search: status = %d; want %d", rr.Code, http.StatusNotFound)
+	}
+	rr := search("", "192.0.2.1:5678")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("second search: status = %d; want %d", rr.Code, http.StatusTooManyRequests)
+	}
+	if got := rr.Header().Get("Retry-After"); got != "60" {
+		t.Errorf("Retry-After = %q; want 60", got)
+	}
+	var p problem
+	if err := json.NewDecoder(rr.Body).Decode(&p); err != nil || p.Code != codeRateLimited {
+		t.Errorf("problem = %+v, %v; want code %s", p, err, codeRateLimited)
+	}
+
+	// Other clients have buckets of their own
+	if rr := search("", "192.0.2.2:1234"); rr.Code != http.StatusNotFound {
+		t.Errorf("search from another IP: status = %d; want %d", rr.Code, http.StatusNotFound)
+	}
+	if rr := search("alice", "192.0.2.3:1234"); rr.Code != http.StatusNotFound {
+		t.Errorf("search of a user: status = %d; want %d", rr.Code, http.StatusNotFound)
+	}
+	if rr := search("alice", "192.0.2.4:1234"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("search of the same user from another IP: status = %d; want %d", rr.Code, http.StatusTooManyRequests)
+	}
+	// Bearer tokens are not verified, so naming another user does not get
+	// past the limit of the IP
+	if rr := search("mallory", "192.0.2.1:1234"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("search of another user from a limited IP: status = %d; want %d", rr.Code, http.StatusTooManyRequests)
+	}
+
+	// Other kinds of request are not limited
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/tables/t1/chunks", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code == http.StatusTooManyRequests {
+		t.Errorf("listing chunks: status = %d", rr.Code)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		remoteAddr string
+		forwarded  []string
+		trustProxy bool
+		want       string
+	}{
+		{"192.0.2.1:1234", nil, false, "192.0.2.1"},
+		{"192.0.2.1:1234", []string{"198.51.100.7"}, false, "192.0.2.1"},
+		{"192.0.2.1:1234", []string{"203.0.113.9, 198.51.100.7"}, true, "198.51.100.7"},
+		{"192.0.2.1:1234", []string{"203.0.113.9", "198.51.100.7"}, true, "198.51.100.7"},
+		{"192.0.2.1:1234", nil, true, "192.0.2.1"},
+		{"[2001:db8:1:2:3:4:5:6]:1234", nil, false, "2001:db8:1:2::/64"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tt.remoteAddr
+		for _, value := range tt.forwarded {
+			req.Header.Add("X-Forwarded-For", value)
+		}
+		if got := clientIP(req, tt.trustProxy); got != tt.want {
+			t.Errorf("clientIP(%s, %q, %v) = %q; want %q", tt.remoteAddr, tt.forwarded, tt.trustProxy, got, tt.want)
+		}
+	}
+}
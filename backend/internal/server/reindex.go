@@ -0,0 +1,150 @@
+package server
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"backend/internal/database"
+)
+
+// reindexTableHandler re-ingests every document registered in a table from
+// its stored original.
+func (s *Server) reindexTableHandler(w http.ResponseWriter, r *http.Request) {
+	tableID := r.PathValue("id")
+
+	userID := userIDFromRequest(r)
+	if userID == "" {
+		writeError(w, r, http.StatusUnauthorized, "Invalid or missing Authorization header")
+		return
+	}
+
+	ctx := r.Context()
+	table, err := s.db.GetTableByID(ctx, tableID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error getting table", "err", err)
+		writeFailure(w, r, err, "Failed to get table")
+		return
+	}
+	if table == nil || table.UserID != userID {
+		writeError(w, r, http.StatusNotFound, "Table not found")
+		return
+	}
+
+	docs, err := s.db.GetTableDocuments(ctx, tableID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error getting table documents", "err", err)
+		writeFailure(w, r, err, "Failed to get table documents")
+		return
+	}
+	if len(docs) == 0 {
+		writeError(w, r, http.StatusBadRequest, "Table has no documents to reindex")
+		return
+	}
+
+	s.startReindexJob(w, r, userID, tableID, "", docs)
+}
+
+// reindexDocumentHandler re-ingests a single document of a table from its
+// stored original.
+func (s *Server) reindexDocumentHandler(w http.ResponseWriter, r *http.Request) {
+	tableID := r.PathValue("id")
+	documentID := r.PathValue("document_id")
+
+	userID := userIDFromRequest(r)
+	if userID == "" {
+		writeError(w, r, http.StatusUnauthorized, "Invalid or missing Authorization header")
+		return
+	}
+
+	ctx := r.Context()
+	table, err := s.db.GetTableByID(ctx, tableID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error getting table", "err", err)
+		writeFailure(w, r, err, "Failed to get table")
+		return
+	}
+	if table == nil || table.UserID != userID {
+		writeError(w, r, http.StatusNotFound, "Table not found")
+		return
+	}
+
+	doc, err := s.db.GetTableDocument(ctx, documentID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error getting document", "err", err)
+		writeFailure(w, r, err, "Failed to get document")
+		return
+	}
+	if doc == nil || doc.TableID != tableID {
+		writeError(w, r, http.StatusNotFound, "Document not found")
+		return
+	}
+
+	s.startReindexJob(w, r, userID, tableID, documentID, []database.TableDocument{*doc})
+}
+
+// startReindexJob records a reindex job for docs, starts it in the background
+// and responds with the job so the caller can poll its progress. documentID
+// is the document being reindexed, or "" for the whole table.
+func (s *Server) startReindexJob(w http.ResponseWriter, r *http.Request, userID, tableID, documentID string, docs []database.TableDocument) {
+	// Two concurrent runs over the same document would each delete the
+	// other's freshly indexed chunks, so only one job per table may run.
+	if err := s.lockTable(r.Context(), tableID); err != nil {
+		writeLockFailure(w, r, err)
+		return
+	}
+
+	job, err := s.db.CreateIngestionJob(r.Context(), tableID, userID, database.JobKindReindex, len(docs))
+	if err != nil {
+		s.unlockTable(tableID)
+		slog.ErrorContext(r.Context(), "Error creating ingestion job", "err", err)
+		writeFailure(w, r, err, "Failed to create reindex job")
+		return
+	}
+
+	action := database.EventTableReindexed
+	if documentID != "" {
+		action = database.EventDocumentReindexed
+	}
+	s.recordEvent(r.Context(), tableID, userID, action, documentID, map[string]interface{}{
+		"job_id": job.JobID,
+	})
+
+	// The job is updated in place while it runs
+	snapshot := *job
+	go s.runIngestionJob(job, docs, true)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", apiPrefix+"/jobs/"+job.JobID)
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(snapshot); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode response", "err", err)
+	}
+}
+
+// getJobHandler reports the progress of an ingestion job to the user that
+// started it.
+func (s *Server) getJobHandler(w http.ResponseWriter, r *http.Request) {
+	userID := userIDFromRequest(r)
+	if userID == "" {
+		writeError(w, r, http.StatusUnauthorized, "Invalid or missing Authorization header")
+		return
+	}
+
+	jobID := r.PathValue("id")
+	job, err := s.db.GetIngestionJob(r.Context(), jobID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error getting ingestion job", "err", err)
+		writeFailure(w, r, err, "Failed to get job")
+		return
+	}
+	if job == nil || job.UserID != userID {
+		writeError(w, r, http.StatusNotFound, "Job not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(job); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode response", "err", err)
+	}
+}
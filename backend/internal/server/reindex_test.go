@@ -0,0 +1,229 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"backend/internal/database"
+	"backend/internal/storage"
+)
+
+func newReindexTestServer(t *testing.T) (*Server, *fakeDB, func() []esRequest, func() [][]string) {
+	t.Helper()
+
+	db := newFakeDB()
+	db.tables["t1"] = &database.UserTable{UserID: "alice", TableID: "t1", TableName: "notes"}
+	db.docs["d1"] = &database.TableDocument{DocumentID: "d1", TableID: "t1", UserID: "alice", FileName: "a.pdf", FilePath: "alice/a.pdf"}
+	db.docs["d2"] = &database.TableDocument{DocumentID: "d2", TableID: "t1", UserID: "alice", FileName: "b.pdf", FilePath: "alice/b.pdf"}
+
+	blobs, err := storage.NewLocalStore(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("error creating blob store: %v", err)
+	}
+	for _, doc := range db.docs {
+		if err := blobs.Put(context.Background(), doc.FilePath, strings.NewReader("%PDF-1.7"), 8, "application/pdf"); err != nil {
+			t.Fatalf("error storing %s: %v", doc.FilePath, err)
+		}
+	}
+
+	es, esRequests := newFakeES(t, `{"deleted":1}`)
+
+	var mu sync.Mutex
+	var runs [][]string
+	s := &Server{
+		index: "chunks",
+		db:    db,
+		es:    es,
+		blobs: blobs,
+		runScript: func(ctx context.Context, args ...string) ([]byte, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			runs = append(runs, args)
+			return nil, nil
+		},
+	}
+
+	return s, db, esRequests, func() [][]string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([][]string(nil), runs...)
+	}
+}
+
+func waitForJob(t *testing.T, db *fakeDB, jobID string) *database.IngestionJob {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		job, _ := db.GetIngestionJob(context.Background(), jobID)
+		if job != nil && (job.Status == database.JobStatusSucceeded || job.Status == database.JobStatusFailed) {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %s did not finish", jobID)
+	return nil
+}
+
+func TestReindexTable(t *testing.T) {
+	s, db, esRequests, runs := newReindexTestServer(t)
+	handler := s.RegisterRoutes()
+
+	req := httptest.NewRequest(http.MethodPost, "/table/t1/reindex", nil)
+	req.Header.Set("Authorization", "Bearer alice")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected status 202; got %d: %s", rr.Code, rr.Body.String())
+	}
+	var job database.IngestionJob
+	if err := json.NewDecoder(rr.Body).Decode(&job); err != nil {
+		t.Fatalf("error decoding response: %v", err)
+	}
+	if job.Total != 2 {
+		t.Errorf("expected job to cover 2 documents; got %d", job.Total)
+	}
+
+	done := waitForJob(t, db, job.JobID)
+	if done.Status != database.JobStatusSucceeded || done.Completed != 2 {
+		t.Errorf("expected job to succeed for 2 documents; got %+v", done)
+	}
+
+	for _, args := range runs() {
+		if !slices.Contains(args, "--recompute") {
+			t.Errorf("expected reindex to recompute partitions; got args %v", args)
+		}
+	}
+
+	deletes := esRequests()
+	if len(deletes) != 2 {
+		t.Fatalf("expected 2 stale chunk deletions; got %d", len(deletes))
+	}
+	for _, r := range deletes {
+		if r.Path != "/chunks/_delete_by_query" {
+			t.Errorf("expected delete by query on chunks index; got %s", r.Path)
+		}
+		if !strings.Contains(r.Body, "must_not") {
+			t.Errorf("expected delete to keep the new generation; got %s", r.Body)
+		}
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/jobs/"+job.JobID, nil)
+	req.Header.Set("Authorization", "Bearer alice")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected job status 200; got %d", rr.Code)
+	}
+}
+
+func TestReindexDocument(t *testing.T) {
+	s, db, _, runs := newReindexTestServer(t)
+	handler := s.RegisterRoutes()
+
+	req := httptest.NewRequest(http.MethodPost, "/table/t1/documents/d2/reindex", nil)
+	req.Header.Set("Authorization", "Bearer alice")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected status 202; got %d: %s", rr.Code, rr.Body.String())
+	}
+	var job database.IngestionJob
+	if err := json.NewDecoder(rr.Body).Decode(&job); err != nil {
+		t.Fatalf("error decoding response: %v", err)
+	}
+	waitForJob(t, db, job.JobID)
+
+	got := runs()
+	if len(got) != 1 {
+		t.Fatalf("expected a single document to be reindexed; got %v", got)
+	}
+	i := slices.Index(got[0], "--source-path")
+	if i < 0 || got[0][i+1] != "alice/b.pdf" {
+		t.Errorf("expected b.pdf to be reindexed; got args %v", got[0])
+	}
+}
+
+func TestReindexRequiresOwner(t *testing.T) {
+	s, _, _, _ := newReindexTestServer(t)
+	handler := s.RegisterRoutes()
+
+	tests := []struct {
+		name   string
+		path   string
+		auth   string
+		status int
+	}{
+		{"missing auth", "/table/t1/reindex", "", http.StatusUnauthorized},
+		{"other user", "/table/t1/reindex", "Bearer bob", http.StatusNotFound},
+		{"document of other table", "/table/t2/documents/d1/reindex", "Bearer alice", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tt.path, nil)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if rr.Code != tt.status {
+				t.Errorf("expected status %d; got %d", tt.status, rr.Code)
+			}
+		})
+	}
+}
+
+func TestReindexRejectsConcurrentJobs(t *testing.T) {
+	s, db, _, _ := newReindexTestServer(t)
+	// Another replica runs a job on the table
+	db.locks["t1"] = "other-replica"
+
+	req := httptest.NewRequest(http.MethodPost, "/table/t1/reindex", nil)
+	req.Header.Set("Authorization", "Bearer alice")
+	rr := httptest.NewRecorder()
+	s.RegisterRoutes().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusConflict {
+		t.Errorf("expected status 409; got %d", rr.Code)
+	}
+}
+
+func TestReindexFailureDeletesPartialGeneration(t *testing.T) {
+	s, db, esRequests, _ := newReindexTestServer(t)
+	s.runScript = func(ctx context.Context, args ...string) ([]byte, error) {
+		return []byte("partitioning failed"), errors.New("exit status 1")
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/table/t1/documents/d1/reindex", nil)
+	req.Header.Set("Authorization", "Bearer alice")
+	rr := httptest.NewRecorder()
+	s.RegisterRoutes().ServeHTTP(rr, req)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected status 202; got %d: %s", rr.Code, rr.Body.String())
+	}
+	var job database.IngestionJob
+	if err := json.NewDecoder(rr.Body).Decode(&job); err != nil {
+		t.Fatalf("error decoding response: %v", err)
+	}
+	if done := waitForJob(t, db, job.JobID); done.Status != database.JobStatusFailed {
+		t.Fatalf("expected job to fail; got %+v", done)
+	}
+
+	deletes := esRequests()
+	if len(deletes) != 1 {
+		t.Fatalf("expected the new generation to be deleted; got %+v", deletes)
+	}
+	// The old generation stays searchable
+	if strings.Contains(deletes[0].Body, "must_not") || !strings.Contains(deletes[0].Body, "generation.keyword") {
+		t.Errorf("expected delete of the failed generation only; got %s", deletes[0].Body)
+	}
+}
@@ -0,0 +1,63 @@
+import argparse
+import sys
+
+from pdf2image import convert_from_path, pdfinfo_from_path
+from PIL import Image, ImageDraw
+
+# Exit status when the document has no such page; the server answers 404.
+PAGE_NOT_FOUND = 3
+
+
+def render_page(file_path, page_number, output_path, binary_format="pdf", bbox=None, dpi=100):
+    if binary_format == "pdf":
+        page_count = pdfinfo_from_path(file_path)["Pages"]
+        if page_number > page_count:
+            print(f"page {page_number} out of range, document has {page_count}")
+            sys.exit(PAGE_NOT_FOUND)
+        image = convert_from_path(
+            file_path, dpi=dpi, first_page=page_number, last_page=page_number
+        )[0]
+    else:
+        # Images are documents of a single page
+        if page_number != 1:
+            print(f"page {page_number} out of range, document has 1")
+            sys.exit(PAGE_NOT_FOUND)
+        image = Image.open(file_path)
+
+    image = image.convert("RGB")
+
+    if bbox:
+        # The partitioner records boxes as fractions of the page size
+        width, height = image.size
+        left, top, right, bottom = bbox
+        box = (left * width, top * height, right * width, bottom * height)
+
+        overlay = Image.new("RGBA", image.size, (0, 0, 0, 0))
+        draw = ImageDraw.Draw(overlay)
+        draw.rectangle(box, fill=(255, 230, 0, 70), outline=(230, 80, 0, 255), width=3)
+        image = Image.alpha_composite(image.convert("RGBA"), overlay).convert("RGB")
+
+    image.save(output_path, "PNG")
+
+
+if __name__ == "__main__":
+    parser = argparse.ArgumentParser(description="Render a page of a document as a PNG")
+    parser.add_argument("file_path")
+    parser.add_argument("page_number", type=int)
+    parser.add_argument("output_path")
+    parser.add_argument("--binary-format", default="pdf", choices=["pdf", "png", "jpeg"])
+    parser.add_argument(
+        "--bbox",
+        default="",
+        help="left,top,right,bottom as fractions of the page size to highlight",
+    )
+    args = parser.parse_args()
+
+    bbox = [float(c) for c in args.bbox.split(",")] if args.bbox else None
+    render_page(
+        args.file_path,
+        args.page_number,
+        args.output_path,
+        binary_format=args.binary_format,
+        bbox=bbox,
+    )
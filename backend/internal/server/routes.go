@@ -1,97 +1,198 @@
 package server
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
-	"os"
-	"os/exec"
-	"path/filepath"
-	"runtime"
+	"net/url"
 	"strings"
-	"time"
+
+	"backend/internal/database"
 )
 
+// apiPrefix is the root of the current version of the API.
+const apiPrefix = "/api/v1"
+
 func (s *Server) RegisterRoutes() http.Handler {
 	mux := http.NewServeMux()
 
-	// Register routes
-	mux.HandleFunc("/es/search", s.searchDocumentsHandler) // Search endpoint
-	mux.HandleFunc("/es/all", s.getAllDocumentsHandler)    // More specific routes first
-	mux.HandleFunc("/health", s.healthHandler)
-	mux.HandleFunc("/hello", s.HelloWorldHandler) // Move hello world to /hello endpoint
-	mux.HandleFunc("/create_table", s.createUserTableHandler)
-	mux.HandleFunc("/tables", s.getUserTablesHandler)
-	mux.HandleFunc("/upload", s.uploadHandler) // Add upload endpoint
-	mux.HandleFunc("/table", s.getTableByIDHandler) // Add get table by ID endpoint
-	mux.HandleFunc("/table/", s.updateTableVisibilityHandler) // Add update table visibility endpoint
-
-	// Wrap the mux with CORS middleware
-	return s.corsMiddleware(mux)
+	// Operational endpoints are not part of the versioned API
+	mux.HandleFunc("GET /health", s.healthHandler)
+	mux.HandleFunc("GET /livez", s.livezHandler)      // Liveness probe
+	mux.HandleFunc("GET /readyz", s.readyzHandler)    // Readiness probe: checks dependencies
+	mux.Handle("GET /metrics", s.metricsHandler())    // Prometheus metrics
+	mux.HandleFunc("GET /hello", s.HelloWorldHandler) // Move hello world to /hello endpoint
+
+	// Reads of public tables, which any web page may make without credentials
+	open := make(map[string]bool)
+	read := func(pattern string, handler http.HandlerFunc) {
+		mux.HandleFunc(pattern, handler)
+		open[pattern] = true
+	}
+
+	// Tables and their sub-resources
+	mux.HandleFunc("GET "+apiPrefix+"/tables", s.getUserTablesHandler)
+	mux.HandleFunc("POST "+apiPrefix+"/tables", s.limited(limitIngestion, s.createUserTableHandler))
+	mux.HandleFunc("POST "+apiPrefix+"/tables/import", s.limited(limitUpload, s.importTableHandler))
+	read("GET "+apiPrefix+"/tables/{id}", s.getTableByIDHandler)
+	mux.HandleFunc("PATCH "+apiPrefix+"/tables/{id}", s.patchTableHandler)
+	mux.HandleFunc("DELETE "+apiPrefix+"/tables/{id}", s.deleteTableHandler)
+	read("GET "+apiPrefix+"/tables/{id}/search", s.limited(limitSearch, s.searchDocumentsHandler))
+	read("GET "+apiPrefix+"/tables/{id}/chunks", s.getAllDocumentsHandler)
+	mux.HandleFunc("GET "+apiPrefix+"/tables/{id}/activity", s.tableActivityHandler)
+	mux.HandleFunc("PUT "+apiPrefix+"/tables/{id}/star", s.starTableHandler)
+	mux.HandleFunc("DELETE "+apiPrefix+"/tables/{id}/star", s.starTableHandler)
+	mux.HandleFunc("POST "+apiPrefix+"/tables/{id}/fork", s.limited(limitIngestion, s.forkTableHandler))
+	mux.HandleFunc("POST "+apiPrefix+"/tables/{id}/pull", s.limited(limitIngestion, s.pullUpstreamHandler))
+	mux.HandleFunc("GET "+apiPrefix+"/tables/{id}/export", s.exportTableHandler)
+	mux.HandleFunc("POST "+apiPrefix+"/tables/{id}/reindex", s.limited(limitIngestion, s.reindexTableHandler))
+	mux.HandleFunc("POST "+apiPrefix+"/tables/{id}/embedding-migration", s.limited(limitIngestion, s.migrateTableHandler))
+	read("GET "+apiPrefix+"/tables/{id}/extracted-tables", s.listExtractedTablesHandler)
+	read("GET "+apiPrefix+"/tables/{id}/extracted-tables/{name}", s.downloadExtractedTableHandler)
+	mux.HandleFunc("POST "+apiPrefix+"/tables/{id}/documents/{document_id}/reindex", s.limited(limitIngestion, s.reindexDocumentHandler))
+	read("GET "+apiPrefix+"/public/tables", s.publicTablesHandler) // Directory of public tables
+
+	// Documents, chunks and the jobs that ingest them
+	read("GET "+apiPrefix+"/documents/{id}/file", s.documentFileHandler)
+	read("GET "+apiPrefix+"/documents/{id}/pages/{page}", s.limited(limitRender, s.documentPageHandler)) // {page} is "{n}.png"
+	read("GET "+apiPrefix+"/chunks/{id}/image", s.chunkImageHandler)
+	mux.HandleFunc("GET "+apiPrefix+"/jobs/{id}", s.getJobHandler)
+
+	// Uploads. The tus protocol has its own methods, which tusHandler checks.
+	mux.HandleFunc("POST "+apiPrefix+"/files", s.limited(limitUpload, s.uploadHandler))
+	mux.HandleFunc(apiPrefix+"/uploads", s.tusHandler)
+	mux.HandleFunc(apiPrefix+"/uploads/{id}", s.tusHandler)
+
+	// The calling user
+	mux.HandleFunc("PUT "+apiPrefix+"/me/profile", s.updateProfileHandler)
+	mux.HandleFunc("GET "+apiPrefix+"/me/starred", s.starredTablesHandler)
+	mux.HandleFunc("GET "+apiPrefix+"/me/feed", s.feedHandler) // New documents of starred tables
+	mux.HandleFunc("GET "+apiPrefix+"/me/activity", s.myActivityHandler)
+
+	// The unversioned paths served before /api/v1, kept for existing clients
+	deprecated := func(pattern, successor string, handler http.HandlerFunc) {
+		mux.Handle(pattern, deprecatedRoute(apiPrefix+successor, handler))
+		if method, _, ok := strings.Cut(pattern, " "); ok && open[method+" "+apiPrefix+successor] {
+			open[pattern] = true
+		}
+	}
+	deprecated("GET /es/search", "/tables/{id}/search", s.limited(limitSearch, s.searchDocumentsHandler))
+	deprecated("GET /es/all", "/tables/{id}/chunks", s.getAllDocumentsHandler)
+	deprecated("POST /create_table", "/tables", s.limited(limitIngestion, s.createUserTableHandler))
+	deprecated("GET /tables", "/tables", s.getUserTablesHandler)
+	deprecated("POST /tables/import", "/tables/import", s.limited(limitUpload, s.importTableHandler))
+	deprecated("GET /public/tables", "/public/tables", s.publicTablesHandler)
+	deprecated("PUT /me/profile", "/me/profile", s.updateProfileHandler)
+	deprecated("GET /me/starred", "/me/starred", s.starredTablesHandler)
+	deprecated("GET /me/feed", "/me/feed", s.feedHandler)
+	deprecated("GET /me/activity", "/me/activity", s.myActivityHandler)
+	deprecated("POST /upload", "/files", s.limited(limitUpload, s.uploadHandler))
+	deprecated("/uploads", "/uploads", s.tusHandler)
+	deprecated("/uploads/{id}", "/uploads/{id}", s.tusHandler)
+	deprecated("GET /table", "/tables/{id}", s.getTableByIDHandler)
+	deprecated("PATCH /table/{id}/visibility", "/tables/{id}", s.updateTableVisibilityHandler)
+	deprecated("PUT /table/{id}/details", "/tables/{id}", s.updateTableDetailsHandler)
+	deprecated("PUT /table/{id}/content-types", "/tables/{id}", s.updateTableContentTypesHandler)
+	deprecated("GET /table/{id}/activity", "/tables/{id}/activity", s.tableActivityHandler)
+	deprecated("PUT /table/{id}/star", "/tables/{id}/star", s.starTableHandler)
+	deprecated("DELETE /table/{id}/star", "/tables/{id}/star", s.starTableHandler)
+	deprecated("POST /table/{id}/fork", "/tables/{id}/fork", s.limited(limitIngestion, s.forkTableHandler))
+	deprecated("POST /table/{id}/pull", "/tables/{id}/pull", s.limited(limitIngestion, s.pullUpstreamHandler))
+	deprecated("GET /table/{id}/export", "/tables/{id}/export", s.exportTableHandler)
+	deprecated("POST /table/{id}/reindex", "/tables/{id}/reindex", s.limited(limitIngestion, s.reindexTableHandler))
+	deprecated("GET /table/{id}/extracted-tables", "/tables/{id}/extracted-tables", s.listExtractedTablesHandler)
+	deprecated("GET /table/{id}/extracted-tables/{name}", "/tables/{id}/extracted-tables/{name}", s.downloadExtractedTableHandler)
+	deprecated("POST /table/{id}/documents/{document_id}/reindex", "/tables/{id}/documents/{document_id}/reindex", s.limited(limitIngestion, s.reindexDocumentHandler))
+	deprecated("GET /jobs/{id}", "/jobs/{id}", s.getJobHandler)
+	deprecated("GET /documents/{id}/file", "/documents/{id}/file", s.documentFileHandler)
+	deprecated("GET /documents/{id}/pages/{page}", "/documents/{id}/pages/{page}", s.limited(limitRender, s.documentPageHandler))
+	deprecated("GET /chunks/{id}/image", "/chunks/{id}/image", s.chunkImageHandler)
+
+	cors := &corsPolicy{cfg: s.cors, mux: mux, open: open}
+	return tracingMiddleware(requestLogMiddleware(metricsMiddleware(cors.middleware(problemResponses(mux)))))
 }
 
-func (s *Server) corsMiddleware(next http.Handler) http.Handler {
+// deprecatedRoute serves an unversioned path with handler, marking responses
+// as deprecated and linking to successor, the path that replaces it.
+// Wildcards in successor are filled in from those of the request; the link is
+// left out if the request does not have them all, as with the table_id query
+// parameter of the old table routes.
+func deprecatedRoute(successor string, handler http.HandlerFunc) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Set CORS headers
-		w.Header().Set("Access-Control-Allow-Origin", "*") // Replace "*" with specific origins if needed
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS, PATCH")
-		w.Header().Set("Access-Control-Allow-Headers", "Accept, Authorization, Content-Type, X-CSRF-Token")
-		w.Header().Set("Access-Control-Allow-Credentials", "false") // Set to "true" if credentials are required
-
-		// Handle preflight OPTIONS requests
-		if r.Method == http.MethodOptions {
-			w.WriteHeader(http.StatusNoContent)
-			return
+		w.Header().Set("Deprecation", "true")
+		if link, ok := expandPath(successor, r); ok {
+			w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", link))
 		}
-
-		// Proceed with the next handler
-		//
-		next.ServeHTTP(w, r)
+		handler(w, r)
 	})
 }
 
+// expandPath replaces the {name} wildcards of pattern with the values r
+// matched them with, reporting false if r has no value for one of them.
+func expandPath(pattern string, r *http.Request) (string, bool) {
+	segments := strings.Split(pattern, "/")
+	for i, segment := range segments {
+		name, ok := strings.CutPrefix(segment, "{")
+		if !ok {
+			continue
+		}
+		value := r.PathValue(strings.TrimSuffix(name, "}"))
+		if value == "" {
+			return "", false
+		}
+		segments[i] = url.PathEscape(value)
+	}
+	return strings.Join(segments, "/"), true
+}
+
+// tableIDFromRequest returns the table a request is about: the {id} of the
+// path, or the table_id query parameter on the deprecated routes that took it.
+func tableIDFromRequest(r *http.Request) string {
+	if tableID := r.PathValue("id"); tableID != "" {
+		return tableID
+	}
+	return r.URL.Query().Get("table_id")
+}
+
 func (s *Server) HelloWorldHandler(w http.ResponseWriter, r *http.Request) {
 	resp := map[string]string{"message": "Hello World"}
 	jsonResp, err := json.Marshal(resp)
 	if err != nil {
-		http.Error(w, "Failed to marshal response", http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, "Failed to marshal response")
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	if _, err := w.Write(jsonResp); err != nil {
-		log.Printf("Failed to write response: %v", err)
+		slog.ErrorContext(r.Context(), "Failed to write response", "err", err)
 	}
 }
 
 func (s *Server) healthHandler(w http.ResponseWriter, r *http.Request) {
 	resp, err := json.Marshal(s.db.Health())
 	if err != nil {
-		http.Error(w, "Failed to marshal health check response", http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, "Failed to marshal health check response")
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	if _, err := w.Write(resp); err != nil {
-		log.Printf("Failed to write response: %v", err)
+		slog.ErrorContext(r.Context(), "Failed to write response", "err", err)
 	}
 }
 
 func (s *Server) getAllDocumentsHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	tableID := r.URL.Query().Get("table_id")
+	tableID := tableIDFromRequest(r)
 	if tableID == "" {
-		http.Error(w, "Query parameter 'table_id' is required", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, "Query parameter 'table_id' is required")
 		return
 	}
-
-	indexName := os.Getenv("ELASTICSEARCH_INDEX")
-	if indexName == "" {
-		http.Error(w, "Elasticsearch index not configured", http.StatusInternalServerError)
+	table := s.readableTable(w, r, tableID)
+	if table == nil {
 		return
 	}
 
@@ -108,84 +209,51 @@ func (s *Server) getAllDocumentsHandler(w http.ResponseWriter, r *http.Request)
 				},
 			},
 		},
-		"_source": []string{"properties", "text_representation"},
+		"_source": []string{"properties", "text_representation", "type"},
 	}
 
-	res, err := s.es.Search(
-		s.es.Search.WithContext(r.Context()),
-		s.es.Search.WithIndex(indexName),
-		s.es.Search.WithSize(1000), // Limit to 1000 documents for safety
-		s.es.Search.WithBody(strings.NewReader(mustToJSON(query))),
-	)
+	hits, err := s.searchChunks(r.Context(), s.chunkIndex(tableModel(table)), query)
 	if err != nil {
-		log.Printf("Error searching documents: %s", err)
-		http.Error(w, fmt.Sprintf("Error searching documents: %s", err), http.StatusInternalServerError)
-		return
-	}
-	defer res.Body.Close()
-
-	// Read the response body
-	var queryResult map[string]interface{}
-	if err := json.NewDecoder(res.Body).Decode(&queryResult); err != nil {
-		log.Printf("Error parsing search response: %s", err)
-		http.Error(w, fmt.Sprintf("Error parsing the response: %s", err), http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error searching documents", "err", err)
+		writeFailure(w, r, err, "Failed to search documents")
 		return
 	}
-
-	result := queryResult["hits"].(map[string]interface{})
-	hits := result["hits"].([]interface{})
-
-	// Print out the hits for debugging
-	for _, hit := range hits {
-		log.Printf("Hit: %v", hit)
-	}
+	slog.DebugContext(r.Context(), "Listed chunks", "table_id", tableID, "hits", len(hits))
 
 	// Send the response
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(hits); err != nil {
-		log.Printf("Failed to write response: %v", err)
+		slog.ErrorContext(r.Context(), "Failed to write response", "err", err)
 	}
 }
 
 func (s *Server) searchDocumentsHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
 	query := r.URL.Query().Get("q")
 	if query == "" {
-		http.Error(w, "Query parameter 'q' is required", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, "Query parameter 'q' is required")
 		return
 	}
 
-	tableID := r.URL.Query().Get("table_id")
+	tableID := tableIDFromRequest(r)
 	if tableID == "" {
-		http.Error(w, "Query parameter 'table_id' is required", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, "Query parameter 'table_id' is required")
 		return
 	}
-
-	// embed query using text-embedding-3-small
-	apiKey := os.Getenv("OPENAI_API_KEY")
-	if apiKey == "" {
-		http.Error(w, "OpenAI API key not configured", http.StatusInternalServerError)
+	table := s.readableTable(w, r, tableID)
+	if table == nil {
 		return
 	}
 
-	// Get embedding for the query
-	queryVector, err := getEmbedding(query, apiKey)
+	// Get embedding for the query, in the space of the table's chunks. During
+	// a migration to another model these are still the old ones.
+	model := tableModel(table)
+	queryVector, err := s.embedQuery(r.Context(), model.Name, query)
 	if err != nil {
-		log.Printf("Error getting embedding: %s", err)
-		http.Error(w, "Failed to process query", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error getting embedding", "err", err)
+		writeFailure(w, r, err, "Failed to process query")
 		return
 	}
 
-	log.Printf("Query: %s", query)
-	log.Printf("Query Vector length: %d", len(queryVector))
-	if len(queryVector) > 0 {
-		log.Printf("First few values: %v", queryVector[:5])
-	}
-
 	// Prepare the search request
 	searchRequest := map[string]interface{}{
 		"knn": map[string]interface{}{
@@ -205,135 +273,151 @@ func (s *Server) searchDocumentsHandler(w http.ResponseWriter, r *http.Request)
 				},
 			},
 		},
-		"_source": []string{"properties", "text_representation"},
+		"_source": []string{"properties", "text_representation", "type"},
 	}
 
-	// Convert the search request to JSON
-	searchBody := strings.NewReader(mustToJSON(searchRequest))
+	hits, err := s.searchChunks(r.Context(), s.chunkIndex(model), searchRequest)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error searching documents", "err", err)
+		writeFailure(w, r, err, "Failed to search documents")
+		return
+	}
+	slog.DebugContext(r.Context(), "Searched chunks", "table_id", tableID, "hits", len(hits))
 
-	indexName := os.Getenv("ELASTICSEARCH_INDEX")
-	if indexName == "" {
-		http.Error(w, "Elasticsearch index not configured", http.StatusInternalServerError)
+	// Send the response
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(hits); err != nil {
+		slog.ErrorContext(r.Context(), "Error encoding search results", "err", err)
+		writeFailure(w, r, err, "Failed to encode search results")
 		return
 	}
+}
 
-	// Perform the search
+// searchChunks runs request against the chunk index indexName and returns
+// the hits.
+func (s *Server) searchChunks(ctx context.Context, indexName string, request map[string]interface{}) ([]interface{}, error) {
 	res, err := s.es.Search(
-		s.es.Search.WithContext(r.Context()),
+		s.es.Search.WithContext(ctx),
 		s.es.Search.WithIndex(indexName),
-		s.es.Search.WithBody(searchBody),
+		s.es.Search.WithBody(strings.NewReader(mustToJSON(request))),
 		s.es.Search.WithSize(1000), // Limit to 1000 documents for safety
 		s.es.Search.WithTrackTotalHits(true),
 	)
 	if err != nil {
-		log.Printf("Error searching documents: %s", err)
-		http.Error(w, "Failed to search documents", http.StatusInternalServerError)
-		return
+		return nil, searchFailure("error searching chunks", nil, err)
 	}
 	defer res.Body.Close()
-
-	// Parse the response
-	var searchResult map[string]interface{}
-	if err := json.NewDecoder(res.Body).Decode(&searchResult); err != nil {
-		log.Printf("Error parsing search response: %s", err)
-		http.Error(w, "Failed to parse search results", http.StatusInternalServerError)
-		return
+	if res.IsError() {
+		return nil, searchFailure("error searching chunks", res, nil)
 	}
 
-	// Extract just the hits array
-	result := searchResult["hits"].(map[string]interface{})
-	hits := result["hits"].([]interface{})
-	
-	// Print out the hits
-	for _, hit := range hits {
-		log.Printf("Hit: %v", hit)
+	var result struct {
+		Hits struct {
+			Hits []interface{} `json:"hits"`
+		} `json:"hits"`
 	}
-
-	fmt.Printf("5")
-
-	// Send the response
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(hits); err != nil {
-		log.Printf("Error encoding search results: %s", err)
-		http.Error(w, "Failed to encode search results", http.StatusInternalServerError)
-		return
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("error parsing search response: %v", err)
 	}
+	return result.Hits.Hits, nil
 }
 
 func (s *Server) uploadHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("uploadHandler: Received POST request to /upload from %s", r.RemoteAddr)
-
-	if r.Method != http.MethodPost {
-		log.Printf("uploadHandler: Invalid method %s from %s", r.Method, r.RemoteAddr)
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
 	// Extract user ID from Authorization header
 	authToken := r.Header.Get("Authorization")
-	log.Printf("uploadHandler: Received Authorization header: %s", authToken)
 	userID := ""
 	if strings.HasPrefix(authToken, "Bearer ") {
 		userID = strings.TrimPrefix(authToken, "Bearer ")
 	}
 	if userID == "" {
-		log.Printf("uploadHandler: Invalid or missing Authorization header from %s", r.RemoteAddr)
-		http.Error(w, "Invalid or missing Authorization header", http.StatusUnauthorized)
+		writeError(w, r, http.StatusUnauthorized, "Invalid or missing Authorization header")
 		return
 	}
 
+	// The file is read and stored within the request, which the server-wide
+	// timeouts are too short for
+	extendDeadlines(w, r, uploadTimeout)
+
+	// Cap the whole request body, so oversized files fail while being read
+	r.Body = http.MaxBytesReader(w, r.Body, s.uploadPolicy.maxFileSize+multipartOverhead)
+
 	// Parse the multipart form with a reasonable max memory
 	if err := r.ParseMultipartForm(32 << 20); err != nil { // 32MB max memory
-		log.Printf("uploadHandler: Failed to parse form: %v", err)
-		http.Error(w, fmt.Sprintf("Failed to parse form: %v", err), http.StatusBadRequest)
+		slog.InfoContext(r.Context(), "Failed to parse upload form", "err", err)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			writeError(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("File exceeds the maximum size of %d bytes", s.uploadPolicy.maxFileSize))
+			return
+		}
+		writeError(w, r, http.StatusBadRequest, "Request body is not a valid multipart form")
 		return
 	}
 
 	file, header, err := r.FormFile("file")
 	if err != nil {
-		log.Printf("uploadHandler: Failed to get file from form: %v", err)
-		http.Error(w, fmt.Sprintf("Failed to get file from form: %v", err), http.StatusBadRequest)
+		slog.InfoContext(r.Context(), "Failed to get file from upload form", "err", err)
+		writeError(w, r, http.StatusBadRequest, "Form has no file field")
 		return
 	}
 	defer file.Close()
 
-	log.Printf("uploadHandler: Received file %s of size %d and type %s", 
-		header.Filename, header.Size, header.Header.Get("Content-Type"))
-
-	// Create uploads directory if it doesn't exist
-	uploadsDir := filepath.Join("uploads", userID)
-	absPath, _ := filepath.Abs(uploadsDir)
-	log.Printf("uploadHandler: Creating directory at %s", absPath)
+	ctx := r.Context()
+	slog.DebugContext(ctx, "Received file", "file_name", header.Filename, "size", header.Size,
+		"content_type", header.Header.Get("Content-Type"))
 
-	// Create the directory
-	if err := os.MkdirAll(uploadsDir, 0755); err != nil {
-		http.Error(w, fmt.Sprintf("Error creating uploads directory: %s", err), http.StatusInternalServerError)
+	table, err := s.uploadTable(ctx, userID, r.FormValue("table_id"))
+	if err != nil {
+		slog.InfoContext(ctx, "Rejected upload", "table_id", r.FormValue("table_id"), "err", err)
+		writePolicyError(w, r, err)
+		return
+	}
+	if err := s.checkUploadSize(ctx, userID, header.Size); err != nil {
+		slog.InfoContext(ctx, "Rejected upload", "file_name", header.Filename, "err", err)
+		writePolicyError(w, r, err)
 		return
 	}
 
-	// Create a unique filename to avoid collisions
-	filename := fmt.Sprintf("%d_%s", time.Now().UnixNano(), header.Filename)
-	filePath := filepath.Join(uploadsDir, filename)
-
-	log.Println("uploadHandler: Saving file to", filePath)
+	// Trust the file's magic bytes, not the type the client claims
+	contentType, err := sniffContentType(file)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Failed to read file")
+		return
+	}
+	if err := checkContentType(contentType, uploadContentTypes(table)); err != nil {
+		slog.InfoContext(ctx, "Rejected upload", "file_name", header.Filename, "content_type", contentType, "err", err)
+		writePolicyError(w, r, err)
+		return
+	}
 
-	// Create the file
-	dst, err := os.Create(filePath)
+	upload, err := s.db.CreateUpload(ctx, userID, header.Filename, contentType, header.Size)
 	if err != nil {
-		http.Error(w, "Failed to create file", http.StatusInternalServerError)
+		slog.ErrorContext(ctx, "Failed to register upload", "err", err)
+		writeFailure(w, r, err, "Failed to save file")
 		return
 	}
-	defer dst.Close()
 
-	// Copy the uploaded file to the destination file
-	if _, err := io.Copy(dst, file); err != nil {
-		http.Error(w, "Failed to save file", http.StatusInternalServerError)
+	// Store the file under a unique key to avoid collisions
+	key := newBlobKey(header.Filename)
+
+	// Hash the file while storing it to find duplicates later
+	hash := sha256.New()
+	if err := s.blobs.Put(ctx, key, io.TeeReader(file, hash), header.Size, contentType); err != nil {
+		slog.ErrorContext(ctx, "Failed to store file", "key", key, "err", err)
+		if err := s.db.DeleteUpload(ctx, upload.UploadID); err != nil {
+			slog.ErrorContext(ctx, "Failed to delete upload", "upload_id", upload.UploadID, "err", err)
+		}
+		writeError(w, r, http.StatusInternalServerError, "Failed to save file")
+		return
+	}
+	if err := s.db.CompleteUpload(ctx, upload.UploadID, key, contentType, hex.EncodeToString(hash.Sum(nil))); err != nil {
+		slog.ErrorContext(ctx, "Failed to complete upload", "upload_id", upload.UploadID, "err", err)
+		writeFailure(w, r, err, "Failed to save file")
 		return
 	}
 
 	// Return the file path
-	response := map[string]string{"filePath": filePath}
-	log.Println("uploadHandler: Response", response)
+	response := map[string]string{"filePath": key, "upload_id": upload.UploadID}
+	slog.InfoContext(ctx, "Stored upload", "upload_id", upload.UploadID, "key", key, "size", header.Size)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
@@ -343,22 +427,19 @@ type createUserTableRequest struct {
 	IsPublic         bool       `json:"is_public"`
 	Documents        []Document `json:"documents"`
 	SkipTableCreation bool       `json:"skip_table_creation"`
+	// AllowedContentTypes restricts the file types a new table accepts
+	AllowedContentTypes []string `json:"allowed_content_types"`
 }
 
+// Document is a file to add to a table: either the storage key returned by
+// /upload or the ID of a completed resumable upload.
 type Document struct {
 	FilePath string `json:"file_path"`
 	FileName string `json:"file_name"`
+	UploadID string `json:"upload_id"`
 }
 
 func (s *Server) createUserTableHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("createUserTableHandler: Received %s request to %s", r.Method, r.URL.Path)
-	log.Printf("Headers: %v", r.Header)
-
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
 	// Extract user ID from Authorization header
 	authToken := r.Header.Get("Authorization")
 	userID := ""
@@ -366,90 +447,146 @@ func (s *Server) createUserTableHandler(w http.ResponseWriter, r *http.Request)
 		userID = strings.TrimPrefix(authToken, "Bearer ")
 	}
 	if userID == "" {
-		http.Error(w, "Invalid or missing Authorization header", http.StatusUnauthorized)
+		writeError(w, r, http.StatusUnauthorized, "Invalid or missing Authorization header")
 		return
 	}
-	log.Printf("User ID: %s", userID)
-
 	var req createUserTableRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, "Invalid request body")
 		return
 	}
-	log.Printf("Request body: %+v", req)
 
 	ctx := r.Context()
+
+	// Resolve every document to a stored upload of this user before touching
+	// the table, so a rejected file leaves nothing half created
+	uploads := make([]*database.Upload, len(req.Documents))
+	for i, doc := range req.Documents {
+		upload, err := s.resolveDocument(ctx, userID, doc)
+		if err != nil {
+			slog.InfoContext(ctx, "Rejected document", "file_name", doc.FileName, "upload_id", doc.UploadID, "err", err)
+			writePolicyError(w, r, err)
+			return
+		}
+		uploads[i] = upload
+	}
+
 	var tableID string
-	var err error
+	var table *database.UserTable
 
 	if !req.SkipTableCreation {
-		tableID, err = s.db.CreateUserTable(ctx, userID, req.TableName, req.IsPublic)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to create table: %v", err), http.StatusInternalServerError)
+		if err := validateContentTypes(req.AllowedContentTypes); err != nil {
+			writePolicyError(w, r, err)
 			return
 		}
+		table = &database.UserTable{AllowedContentTypes: req.AllowedContentTypes}
 	} else {
 		// If skipping table creation, get the existing table ID
 		tables, err := s.db.GetUserTables(ctx, userID)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to get user tables: %v", err), http.StatusInternalServerError)
+			slog.ErrorContext(ctx, "Error getting user tables", "err", err)
+			writeFailure(w, r, err, "Failed to get user tables")
 			return
 		}
 		
 		// Find the matching table
-		found := false
-		for _, table := range tables {
-			if table.TableName == req.TableName {
+		for i := range tables {
+			if tables[i].TableName == req.TableName {
+				table = &tables[i]
 				tableID = table.TableID
-				found = true
 				break
 			}
 		}
 		
-		if !found {
-			http.Error(w, "Table not found", http.StatusNotFound)
+		if table == nil {
+			writeError(w, r, http.StatusNotFound, "Table not found")
 			return
 		}
 	}
 
-	// Process uploaded documents if any
-	if len(req.Documents) > 0 {
-		// Get the directory of the current file
-		_, currentFile, _, _ := runtime.Caller(0)
-		scriptPath := filepath.Join(filepath.Dir(currentFile), "doc_upload.py")
-		for _, doc := range req.Documents {
-			// Prepare command arguments
-			cmdArgs := append([]string{scriptPath}, doc.FilePath, doc.FileName, userID, tableID)
-
-			log.Println("Executing command:", cmdArgs)
-
-			cmd := exec.Command("python3", cmdArgs...)
-
-			// Capture both stdout and stderr
-			output, err := cmd.CombinedOutput()
-			if err != nil {
-				log.Printf("Script execution failed for document %s: %v\nOutput: %s", doc.FilePath, err, output)
-				// Continue execution as document processing error shouldn't fail table creation
-				continue
+	for _, upload := range uploads {
+		if err := checkContentType(upload.ContentType, allowedContentTypes(table)); err != nil {
+			writePolicyError(w, r, err)
+			return
+		}
+	}
+
+	if !req.SkipTableCreation {
+		var err error
+		tableID, err = s.db.CreateUserTable(ctx, userID, req.TableName, req.IsPublic)
+		if errors.Is(err, database.ErrConflict) {
+			writeError(w, r, http.StatusConflict, fmt.Sprintf("A table named %q already exists", req.TableName))
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "Error creating table", "err", err)
+			writeFailure(w, r, err, "Failed to create table")
+			return
+		}
+		if len(req.AllowedContentTypes) > 0 {
+			if err := s.db.UpdateTableContentTypes(ctx, tableID, req.AllowedContentTypes); err != nil {
+				slog.ErrorContext(ctx, "Failed to set content types of table", "table_id", tableID, "err", err)
 			}
+		}
+		// On failure the table keeps the model it was given, which its
+		// documents are then ingested with, and can be migrated later
+		if err := s.db.SetTableEmbedding(ctx, tableID, s.model.Name, s.model.Version); err != nil {
+			slog.ErrorContext(ctx, "Failed to set embedding model of table", "table_id", tableID, "err", err)
+		}
+		s.recordEvent(ctx, tableID, userID, database.EventTableCreated, "", map[string]interface{}{
+			"table_name": req.TableName,
+			"public":     req.IsPublic,
+		})
+	}
 
-			log.Printf("Successfully processed document %s. Output:\n%s", doc.FilePath, output)
+	// Ingesting here races jobs and deletions of the table like any job would
+	if len(uploads) > 0 {
+		if err := s.lockTable(ctx, tableID); err != nil {
+			writeLockFailure(w, r, err)
+			return
 		}
+		defer s.unlockTable(tableID)
 	}
 
-	response := map[string]string{"table_id": tableID}
+	// Process uploaded documents if any
+	var duplicates []database.TableDocument
+	for i, upload := range uploads {
+		fileName := req.Documents[i].FileName
+		if fileName == "" {
+			fileName = upload.FileName
+		}
+
+		// Register the document first so it can be reindexed from the stored original
+		tableDoc, existing, err := s.addTableDocument(ctx, tableID, userID, fileName, upload)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to register document", "table_id", tableID, "upload_id", upload.UploadID, "err", err)
+			continue
+		}
+		if existing != nil {
+			slog.InfoContext(ctx, "Document is already in table", "table_id", tableID, "document_id", existing.DocumentID)
+			duplicates = append(duplicates, *existing)
+			continue
+		}
+
+		if err := s.ingestNewDocument(ctx, *tableDoc); err != nil {
+			slog.ErrorContext(ctx, "Failed to process document", "table_id", tableID, "document_id", tableDoc.DocumentID, "err", err)
+			// Continue execution as document processing error shouldn't fail table creation
+			continue
+		}
+	}
+
+	response := map[string]interface{}{"table_id": tableID}
+	if len(duplicates) > 0 {
+		// Exact copies of documents already in the table are linked to the
+		// existing document instead of being added again
+		response["duplicates"] = duplicates
+	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
-	log.Printf("Successfully created table %s for user %s", tableID, userID)
+	slog.InfoContext(ctx, "Created table", "table_id", tableID, "documents", len(uploads))
 }
 
 func (s *Server) getUserTablesHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("getUserTablesHandler: Received %s request to %s", r.Method, r.URL.Path)
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
 	// Extract user ID from Authorization header
 	authToken := r.Header.Get("Authorization")
 	userID := ""
@@ -457,53 +594,39 @@ func (s *Server) getUserTablesHandler(w http.ResponseWriter, r *http.Request) {
 		userID = strings.TrimPrefix(authToken, "Bearer ")
 	}
 	if userID == "" {
-		http.Error(w, "Invalid or missing Authorization header", http.StatusUnauthorized)
+		writeError(w, r, http.StatusUnauthorized, "Invalid or missing Authorization header")
 		return
 	}
-	log.Printf("User ID: %s", userID)
-
 	ctx := r.Context()
 	tables, err := s.db.GetUserTables(ctx, userID)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get user tables: %v", err), http.StatusInternalServerError)
+		slog.ErrorContext(ctx, "Error getting user tables", "err", err)
+		writeFailure(w, r, err, "Failed to get user tables")
 		return
 	}
 	
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(tables); err != nil {
-		log.Printf("Failed to encode response: %v", err)
+		slog.ErrorContext(ctx, "Failed to encode response", "err", err)
 	}
 }
 
 func (s *Server) getTableByIDHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("getTableByIDHandler: Received %s request to %s", r.Method, r.URL.Path)
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	tableID := r.URL.Query().Get("table_id")
+	tableID := tableIDFromRequest(r)
 	if tableID == "" {
-		http.Error(w, "table_id is required", http.StatusBadRequest)
-		return
-	}
-
-	ctx := r.Context()
-	table, err := s.db.GetTableByID(ctx, tableID)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error getting table: %v", err), http.StatusInternalServerError)
+		writeError(w, r, http.StatusBadRequest, "table_id is required")
 		return
 	}
 
+	table := s.readableTable(w, r, tableID)
 	if table == nil {
-		http.Error(w, "Table not found", http.StatusNotFound)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(table); err != nil {
-		log.Printf("Error encoding response: %v", err)
+		slog.ErrorContext(r.Context(), "Error encoding response", "err", err)
 	}
 }
 
@@ -512,38 +635,96 @@ type updateTableVisibilityRequest struct {
 }
 
 func (s *Server) updateTableVisibilityHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPatch {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
+	tableID := r.PathValue("id")
 
-	// Extract table ID from URL path
-	pathParts := strings.Split(r.URL.Path, "/")
-	if len(pathParts) != 4 || pathParts[3] != "visibility" {
-		http.Error(w, "Invalid path", http.StatusBadRequest)
+	userID := userIDFromRequest(r)
+	if userID == "" {
+		writeError(w, r, http.StatusUnauthorized, "Invalid or missing Authorization header")
 		return
 	}
-	tableID := pathParts[2]
 
 	// Parse request body
 	var req updateTableVisibilityRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, "Invalid request body")
 		return
 	}
 
-	// Update table visibility in database
 	ctx := r.Context()
-	err := s.db.UpdateTableVisibility(ctx, tableID, req.IsPublic)
+	table, err := s.db.GetTableByID(ctx, tableID)
 	if err != nil {
-		if err.Error() == "table not found" {
-			http.Error(w, "Table not found", http.StatusNotFound)
-			return
-		}
-		log.Printf("Error updating table visibility: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		slog.ErrorContext(ctx, "Error getting table", "err", err)
+		writeFailure(w, r, err, "Failed to get table")
+		return
+	}
+	if table == nil || table.UserID != userID {
+		writeError(w, r, http.StatusNotFound, "Table not found")
+		return
+	}
+
+	// Update table visibility in database. The table may have been deleted
+	// since it was read, which is reported as not found.
+	if err := s.db.UpdateTableVisibility(ctx, tableID, req.IsPublic); err != nil {
+		slog.ErrorContext(ctx, "Error updating table visibility", "err", err)
+		writeFailure(w, r, err, "Failed to update table visibility")
+		return
+	}
+	s.recordEvent(ctx, tableID, userID, database.EventVisibilityChanged, "", map[string]interface{}{
+		"public": req.IsPublic,
+	})
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// userIDFromRequest returns the user ID carried in the bearer token of the
+// Authorization header, or "" if there is none.
+func userIDFromRequest(r *http.Request) string {
+	authToken := r.Header.Get("Authorization")
+	if strings.HasPrefix(authToken, "Bearer ") {
+		return strings.TrimPrefix(authToken, "Bearer ")
+	}
+	return ""
+}
+
+type updateTableContentTypesRequest struct {
+	ContentTypes []string `json:"content_types"`
+}
+
+// updateTableContentTypesHandler replaces the allowlist of file types a table
+// accepts. An empty list restores the server default.
+func (s *Server) updateTableContentTypesHandler(w http.ResponseWriter, r *http.Request) {
+	tableID := r.PathValue("id")
+
+	userID := userIDFromRequest(r)
+	if userID == "" {
+		writeError(w, r, http.StatusUnauthorized, "Invalid or missing Authorization header")
+		return
+	}
+
+	var req updateTableContentTypesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid request body")
 		return
 	}
+	if err := validateContentTypes(req.ContentTypes); err != nil {
+		writePolicyError(w, r, err)
+		return
+	}
+
+	ctx := r.Context()
+	if _, err := s.uploadTable(ctx, userID, tableID); err != nil {
+		writePolicyError(w, r, err)
+		return
+	}
+
+	if err := s.db.UpdateTableContentTypes(ctx, tableID, req.ContentTypes); err != nil {
+		slog.ErrorContext(ctx, "Error updating table content types", "err", err)
+		writeFailure(w, r, err, "Failed to update table content types")
+		return
+	}
+	s.recordEvent(ctx, tableID, userID, database.EventContentTypesChanged, "", map[string]interface{}{
+		"content_types": req.ContentTypes,
+	})
 
 	w.WriteHeader(http.StatusOK)
 }
@@ -551,7 +732,7 @@ func (s *Server) updateTableVisibilityHandler(w http.ResponseWriter, r *http.Req
 func mustToJSON(data interface{}) string {
 	jsonData, err := json.Marshal(data)
 	if err != nil {
-		log.Fatalf("Failed to marshal data to JSON: %v", err)
+		panic(fmt.Sprintf("failed to marshal data to JSON: %v", err))
 	}
 	return string(jsonData)
 }
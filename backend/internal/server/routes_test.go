@@ -1,10 +1,15 @@
 package server
 
 import (
+	"encoding/json"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
+
+	"backend/internal/database"
 )
 
 func TestHandler(t *testing.T) {
@@ -29,3 +34,120 @@ func TestHandler(t *testing.T) {
 		t.Errorf("expected response body to be %v; got %v", expected, string(body))
 	}
 }
+
+func TestAPIRoutes(t *testing.T) {
+	db := newFakeDB()
+	db.tables["t1"] = &database.UserTable{UserID: "alice", TableID: "t1", TableName: "notes"}
+	handler := (&Server{db: db}).RegisterRoutes()
+
+	tests := []struct {
+		method, path string
+		status       int
+		deprecation  string
+		link         string
+	}{
+		{http.MethodGet, "/api/v1/tables/t1", http.StatusOK, "", ""},
+		{http.MethodGet, "/table?table_id=t1", http.StatusOK, "true", ""},
+		{http.MethodGet, "/table/t1/activity", http.StatusOK, "true", `</api/v1/tables/t1/activity>; rel="successor-version"`},
+		{http.MethodPost, "/api/v1/tables/t1", http.StatusMethodNotAllowed, "", ""},
+		{http.MethodGet, "/table/t1/visibility", http.StatusMethodNotAllowed, "", ""},
+		{http.MethodGet, "/api/v1/tables/t1/nope", http.StatusNotFound, "", ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		req.Header.Set("Authorization", "Bearer alice")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != tt.status {
+			t.Errorf("%s %s: status = %d; want %d", tt.method, tt.path, rr.Code, tt.status)
+		}
+		if got := rr.Header().Get("Deprecation"); got != tt.deprecation {
+			t.Errorf("%s %s: Deprecation = %q; want %q", tt.method, tt.path, got, tt.deprecation)
+		}
+		if got := rr.Header().Get("Link"); got != tt.link {
+			t.Errorf("%s %s: Link = %q; want %q", tt.method, tt.path, got, tt.link)
+		}
+	}
+}
+
+func TestPatchTable(t *testing.T) {
+	db := newFakeDB()
+	db.tables["t1"] = &database.UserTable{UserID: "alice", TableID: "t1", TableName: "notes", Description: "Lecture notes"}
+	handler := (&Server{db: db}).RegisterRoutes()
+
+	patch := func(user, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPatch, "/api/v1/tables/t1", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+user)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := patch("alice", `{"is_public":true,"tags":["CS"],"allowed_content_types":["application/pdf"]}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d; want 200: %s", rr.Code, rr.Body)
+	}
+	var table database.UserTable
+	if err := json.NewDecoder(rr.Body).Decode(&table); err != nil {
+		t.Fatal(err)
+	}
+	if !table.IsPublic || table.Description != "Lecture notes" || !reflect.DeepEqual(table.Tags, []string{"cs"}) ||
+		!reflect.DeepEqual(table.AllowedContentTypes, []string{"application/pdf"}) {
+		t.Errorf("table = %+v; want it public, tagged and limited to PDFs with its description kept", table)
+	}
+	if len(db.events) != 3 {
+		t.Errorf("recorded %d events; want one per setting", len(db.events))
+	}
+
+	// Nothing changes if any part of the request is invalid
+	if rr := patch("alice", `{"is_public":false,"allowed_content_types":["text/x-nope"]}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("invalid content type: status = %d; want 400", rr.Code)
+	}
+	if !db.tables["t1"].IsPublic {
+		t.Error("rejected request changed the visibility")
+	}
+	if rr := patch("bob", `{"is_public":false}`); rr.Code != http.StatusNotFound {
+		t.Errorf("non-owner: status = %d; want 404", rr.Code)
+	}
+}
+
+func TestDeleteTable(t *testing.T) {
+	db := newFakeDB()
+	db.tables["t1"] = &database.UserTable{UserID: "alice", TableID: "t1", TableName: "notes"}
+	es, requests := newFakeES(t, `{"deleted":3}`)
+	s := &Server{index: "chunks", db: db, es: es}
+	handler := s.RegisterRoutes()
+
+	del := func(user string) int {
+		req := httptest.NewRequest(http.MethodDelete, "/api/v1/tables/t1", nil)
+		req.Header.Set("Authorization", "Bearer "+user)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if code := del("bob"); code != http.StatusNotFound {
+		t.Errorf("non-owner: status = %d; want 404", code)
+	}
+
+	db.locks["t1"] = "other-replica"
+	if code := del("alice"); code != http.StatusConflict {
+		t.Errorf("during a job: status = %d; want 409", code)
+	}
+	delete(db.locks, "t1")
+
+	if code := del("alice"); code != http.StatusNoContent {
+		t.Fatalf("status = %d; want 204", code)
+	}
+	if _, ok := db.tables["t1"]; ok {
+		t.Error("table was not deleted")
+	}
+	reqs := requests()
+	if len(reqs) != 1 || reqs[0].Path != "/chunks,chunks_v2/_delete_by_query" || !strings.Contains(reqs[0].Body, `"t1"`) {
+		t.Errorf("elasticsearch requests = %+v; want the table's chunks deleted from every index", reqs)
+	}
+	if len(db.events) != 1 || db.events[0].Action != database.EventTableDeleted {
+		t.Errorf("events = %+v; want the deletion recorded", db.events)
+	}
+}
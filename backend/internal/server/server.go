@@ -1,54 +1,160 @@
 package server
 
 import (
+	"context"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
-	"strconv"
+	"sync"
 	"time"
 
 	"github.com/elastic/go-elasticsearch/v8"
-	_ "github.com/joho/godotenv/autoload"
 
+	"backend/internal/config"
 	"backend/internal/database"
+	"backend/internal/storage"
 )
 
 type Server struct {
 	port int
+	// index is the Elasticsearch alias of chunks embedded with the first
+	// model; see chunkIndex for the others.
+	index string
+	// model is the embedding model new tables use and tables are migrated to.
+	model embeddingModel
 
-	db database.Service
-	es *elasticsearch.Client
+	db    database.Service
+	es    *elasticsearch.Client
+	blobs storage.BlobStore
+
+	runScript scriptRunner
+	// renderPage runs render_page.py, which draws a page of a document.
+	renderPage scriptRunner
+	// pages keeps rendered pages; nil renders every request.
+	pages *pageCache
+	// captioner describes extracted images; nil disables image search.
+	captioner imageCaptioner
+	embed     embedder
+	// embedBatch embeds chunks being migrated; nil embeds them one by one
+	// with embed.
+	embedBatch batchEmbedder
+	// queryCache keeps the embeddings of search queries; nil keeps none.
+	queryCache *queryCache
+	// checkEmbedder checks that embed can be used; nil skips the check.
+	checkEmbedder healthCheck
+	// ingesting holds the tableLocks this replica holds, by table ID.
+	ingesting sync.Map
+
+	// cors lists the web origins trusted to call the API from a browser.
+	cors config.CORS
+	// limiter throttles costly requests; nil turns rate limiting off.
+	limiter *rateLimiter
+
+	uploadPolicy uploadPolicy
+	// stagingDir buffers the parts of resumable uploads on their way to
+	// the blob store.
+	stagingDir string
 }
 
-func NewServer() *http.Server {
-	port, _ := strconv.Atoi(os.Getenv("PORT"))
-	
-	// Initialize Elasticsearch client with configuration
-	cfg := elasticsearch.Config{
-		Addresses: []string{os.Getenv("ELASTICSEARCH_URL")},
-		APIKey:    os.Getenv("ELASTICSEARCH_API_KEY"),
+// NewServer creates the API server cfg configures.
+func NewServer(cfg *config.Config) *http.Server {
+	logger, err := newLogger(os.Stderr, cfg.Log.Level, cfg.Log.Format)
+	if err != nil {
+		panic(fmt.Sprintf("Error configuring logging: %s", err))
 	}
-	
-	esClient, err := elasticsearch.NewClient(cfg)
+	slog.SetDefault(logger)
+
+	// Initialize Elasticsearch client with configuration
+	esClient, err := newElasticsearchClient(cfg.Elasticsearch)
 	if err != nil {
 		panic(fmt.Sprintf("Error creating Elasticsearch client: %s", err))
 	}
 
+	blobs, err := storage.New(cfg.Storage)
+	if err != nil {
+		panic(fmt.Sprintf("Error creating blob store: %s", err))
+	}
+
+	captioner, err := newImageCaptioner(cfg.Captions, cfg.OpenAI.APIKey)
+	if err != nil {
+		panic(fmt.Sprintf("Error creating image captioner: %s", err))
+	}
+
+	// The pipeline writes to the same index with the same credentials
+	var pipelineEnv []string
+	for name, value := range map[string]string{
+		"ELASTICSEARCH_URL":     cfg.Elasticsearch.URL,
+		"ELASTICSEARCH_API_KEY": cfg.Elasticsearch.APIKey,
+		"ELASTICSEARCH_INDEX":   cfg.Elasticsearch.Index,
+		"OPENAI_API_KEY":        cfg.OpenAI.APIKey,
+		"ARYN_API_KEY":          cfg.Pipeline.ArynAPIKey,
+		"ANTHROPIC_API_KEY":     cfg.Pipeline.AnthropicAPIKey,
+	} {
+		if value != "" {
+			pipelineEnv = append(pipelineEnv, name+"="+value)
+		}
+	}
+
+	model, ok := embeddingModels[cfg.Embeddings.Version]
+	if !ok {
+		panic(fmt.Sprintf("Unknown embedding version %d", cfg.Embeddings.Version))
+	}
+
+	db := database.New(cfg.Database)
+
 	NewServer := &Server{
-		port: port,
+		port:  cfg.Port,
+		index: cfg.Elasticsearch.Index,
+		model: model,
+
+		db:    db,
+		es:    esClient,
+		blobs: blobs,
 
-		db: database.New(),
-		es: esClient,
+		runScript:     pythonScript("doc_upload.py", pipelineEnv...),
+		renderPage:    pythonScript("render_page.py"),
+		pages:         newPageCache(pageCacheBytes),
+		captioner:     captioner,
+		embed:         openAIEmbedder(cfg.OpenAI.APIKey),
+		embedBatch:    openAIBatchEmbedder(cfg.OpenAI.APIKey),
+		queryCache:    newQueryCache(cfg.QueryCache, db),
+		checkEmbedder: openAIHealthCheck(cfg.OpenAI.APIKey, model.Name),
+		cors:          cfg.CORS,
+		limiter:       newRateLimiter(cfg.RateLimits, db),
+		uploadPolicy:  newUploadPolicy(cfg.Uploads),
+		stagingDir:    cfg.Server.StagingDir,
 	}
 
+	// Indices are created before any chunk is written to them, so none is
+	// mapped as it comes; a cluster that is down is reported but not fatal
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	if err := NewServer.setupIndices(ctx); err != nil {
+		slog.Error("Error setting up Elasticsearch indices", "err", err)
+	}
+	cancel()
+
 	// Declare Server config
 	server := &http.Server{
 		Addr:         fmt.Sprintf(":%d", NewServer.port),
 		Handler:      NewServer.RegisterRoutes(),
 		IdleTimeout:  time.Minute,
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 30 * time.Second,
+		ReadTimeout:  cfg.Server.ReadTimeout,
+		WriteTimeout: cfg.Server.WriteTimeout,
 	}
 
 	return server
 }
+
+// extendDeadlines replaces the server-wide ReadTimeout and WriteTimeout of a
+// request with timeout from now, for handlers that move whole files.
+func extendDeadlines(w http.ResponseWriter, r *http.Request, timeout time.Duration) {
+	rc := http.NewResponseController(w)
+	deadline := time.Now().Add(timeout)
+	if err := rc.SetReadDeadline(deadline); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to extend read deadline", "err", err)
+	}
+	if err := rc.SetWriteDeadline(deadline); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to extend write deadline", "err", err)
+	}
+}
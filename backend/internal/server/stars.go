@@ -0,0 +1,102 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+// Sizes of the activity feed
+const (
+	defaultFeedLimit = 50
+	maxFeedLimit     = 200
+)
+
+// starTableHandler stars (PUT) or unstars (DELETE) a table the caller can
+// read. Starring a table follows it: documents its owner adds show up in the
+// caller's feed.
+func (s *Server) starTableHandler(w http.ResponseWriter, r *http.Request) {
+	tableID := r.PathValue("id")
+
+	userID := userIDFromRequest(r)
+	if userID == "" {
+		writeError(w, r, http.StatusUnauthorized, "Invalid or missing Authorization header")
+		return
+	}
+
+	ctx := r.Context()
+	if r.Method == http.MethodDelete {
+		// Unstarring needs no access, so tables made private can be dropped
+		if err := s.db.UnstarTable(ctx, userID, tableID); err != nil {
+			slog.ErrorContext(ctx, "Error unstarring table", "err", err)
+			writeFailure(w, r, err, "Failed to unstar table")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if s.readableTable(w, r, tableID) == nil {
+		return
+	}
+	if err := s.db.StarTable(ctx, userID, tableID); err != nil {
+		slog.ErrorContext(ctx, "Error starring table", "err", err)
+		writeFailure(w, r, err, "Failed to star table")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// starredTablesHandler lists the tables the caller starred.
+func (s *Server) starredTablesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := userIDFromRequest(r)
+	if userID == "" {
+		writeError(w, r, http.StatusUnauthorized, "Invalid or missing Authorization header")
+		return
+	}
+
+	tables, err := s.db.GetStarredTables(r.Context(), userID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error getting starred tables", "err", err)
+		writeFailure(w, r, err, "Failed to get starred tables")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(tables); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode response", "err", err)
+	}
+}
+
+// feedHandler lists documents recently added to the tables the caller
+// starred, newest first.
+func (s *Server) feedHandler(w http.ResponseWriter, r *http.Request) {
+	userID := userIDFromRequest(r)
+	if userID == "" {
+		writeError(w, r, http.StatusUnauthorized, "Invalid or missing Authorization header")
+		return
+	}
+
+	limit := defaultFeedLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxFeedLimit {
+			writeError(w, r, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxFeedLimit))
+			return
+		}
+	}
+
+	items, err := s.db.GetFeed(r.Context(), userID, limit)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error getting feed", "err", err)
+		writeFailure(w, r, err, "Failed to get feed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(items); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode response", "err", err)
+	}
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"backend/internal/database"
+)
+
+func TestStarTable(t *testing.T) {
+	db := newFakeDB()
+	db.tables["public"] = &database.UserTable{UserID: "alice", TableID: "public", TableName: "papers", IsPublic: true}
+	db.tables["private"] = &database.UserTable{UserID: "alice", TableID: "private", TableName: "drafts"}
+	handler := (&Server{db: db}).RegisterRoutes()
+
+	star := func(method, user, tableID string) int {
+		req := httptest.NewRequest(method, "/table/"+tableID+"/star", nil)
+		req.Header.Set("Authorization", "Bearer "+user)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	for i := 0; i < 2; i++ {
+		if code := star(http.MethodPut, "bob", "public"); code != http.StatusNoContent {
+			t.Fatalf("star: expected status 204; got %d", code)
+		}
+	}
+	if code := star(http.MethodPut, "carol", "public"); code != http.StatusNoContent {
+		t.Fatalf("star: expected status 204; got %d", code)
+	}
+	if table := getTable(t, handler, "public"); table.StarCount != 2 {
+		t.Errorf("star count = %d; want 2", table.StarCount)
+	}
+
+	if code := star(http.MethodPut, "bob", "private"); code != http.StatusNotFound {
+		t.Errorf("star of private table: expected status 404; got %d", code)
+	}
+	if code := star(http.MethodPut, "bob", "missing"); code != http.StatusNotFound {
+		t.Errorf("star of missing table: expected status 404; got %d", code)
+	}
+
+	if code := star(http.MethodDelete, "bob", "public"); code != http.StatusNoContent {
+		t.Fatalf("unstar: expected status 204; got %d", code)
+	}
+	if table := getTable(t, handler, "public"); table.StarCount != 1 {
+		t.Errorf("star count after unstar = %d; want 1", table.StarCount)
+	}
+}
+
+func getTable(t *testing.T, handler http.Handler, tableID string) database.UserTable {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/table?table_id="+tableID, nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("get table: expected status 200; got %d", rr.Code)
+	}
+	var table database.UserTable
+	if err := json.NewDecoder(rr.Body).Decode(&table); err != nil {
+		t.Fatalf("error decoding table: %v", err)
+	}
+	return table
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// errTableBusy is returned when a job is already running for a table.
+var errTableBusy = errors.New("an ingestion job is already running for this table")
+
+// tableLockTTL is how long a table lock lasts unless it is renewed, which its
+// holder does every third of it. A replica that dies holding a lock keeps the
+// table locked for at most this long.
+const tableLockTTL = time.Minute
+
+// tableLock is a lock on a table this replica holds.
+type tableLock struct {
+	holder string
+	// done stops the renewal of the lock.
+	done chan struct{}
+}
+
+// lockTable takes the lock that keeps two ingestion paths, on any replica,
+// from writing the chunks of a table at once, returning errTableBusy if it is
+// held. The lock is kept until unlockTable, however long that takes.
+func (s *Server) lockTable(ctx context.Context, tableID string) error {
+	lock := &tableLock{holder: uuid.New().String(), done: make(chan struct{})}
+	// Locks this replica holds are not asked for again
+	if _, busy := s.ingesting.LoadOrStore(tableID, lock); busy {
+		return errTableBusy
+	}
+	taken, err := s.db.AcquireTableLock(ctx, tableID, lock.holder, tableLockTTL)
+	if err != nil || !taken {
+		s.ingesting.Delete(tableID)
+		if err != nil {
+			return err
+		}
+		return errTableBusy
+	}
+
+	go func() {
+		ticker := time.NewTicker(tableLockTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-lock.done:
+				return
+			case <-ticker.C:
+				if err := s.db.RenewTableLock(context.Background(), tableID, lock.holder, tableLockTTL); err != nil {
+					slog.Error("Error renewing table lock", "table_id", tableID, "err", err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// unlockTable releases the lock lockTable took on a table.
+func (s *Server) unlockTable(tableID string) {
+	v, ok := s.ingesting.LoadAndDelete(tableID)
+	if !ok {
+		return
+	}
+	lock := v.(*tableLock)
+	close(lock.done)
+	if err := s.db.ReleaseTableLock(context.Background(), tableID, lock.holder); err != nil {
+		slog.Error("Error releasing table lock", "table_id", tableID, "err", err)
+	}
+}
+
+// writeLockFailure responds to a failure of lockTable, with 409 if the table
+// is busy.
+func writeLockFailure(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errTableBusy) {
+		writeError(w, r, http.StatusConflict, "An ingestion job is already running for this table")
+		return
+	}
+	slog.ErrorContext(r.Context(), "Error locking table", "err", err)
+	writeFailure(w, r, err, "Failed to lock table")
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"backend/internal/database"
+)
+
+// patchTableRequest changes the settings of a table. Fields left out keep
+// their current values.
+type patchTableRequest struct {
+	IsPublic            *bool     `json:"is_public"`
+	Description         *string   `json:"description"`
+	Tags                *[]string `json:"tags"`
+	AllowedContentTypes *[]string `json:"allowed_content_types"`
+}
+
+// patchTableHandler updates the visibility, details and accepted file types
+// of a table in one request and responds with the updated table. Everything
+// is validated before anything is changed.
+func (s *Server) patchTableHandler(w http.ResponseWriter, r *http.Request) {
+	tableID := r.PathValue("id")
+
+	userID := userIDFromRequest(r)
+	if userID == "" {
+		writeError(w, r, http.StatusUnauthorized, "Invalid or missing Authorization header")
+		return
+	}
+
+	var req patchTableRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if req.AllowedContentTypes != nil {
+		if err := validateContentTypes(*req.AllowedContentTypes); err != nil {
+			writePolicyError(w, r, err)
+			return
+		}
+	}
+
+	ctx := r.Context()
+	table, err := s.db.GetTableByID(ctx, tableID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error getting table", "err", err)
+		writeFailure(w, r, err, "Failed to get table")
+		return
+	}
+	if table == nil || table.UserID != userID {
+		writeError(w, r, http.StatusNotFound, "Table not found")
+		return
+	}
+
+	// Description and tags are stored together, so one without the other
+	// keeps the current value of the other
+	var description string
+	var tags []string
+	if req.Description != nil || req.Tags != nil {
+		description, tags = table.Description, table.Tags
+		if req.Description != nil {
+			description = *req.Description
+		}
+		if req.Tags != nil {
+			tags = *req.Tags
+		}
+		if description, tags, err = normalizeTableDetails(description, tags); err != nil {
+			writePolicyError(w, r, err)
+			return
+		}
+	}
+
+	if req.IsPublic != nil && *req.IsPublic != table.IsPublic {
+		if err := s.db.UpdateTableVisibility(ctx, tableID, *req.IsPublic); err != nil {
+			slog.ErrorContext(ctx, "Error updating table visibility", "err", err)
+			writeFailure(w, r, err, "Failed to update table visibility")
+			return
+		}
+		s.recordEvent(ctx, tableID, userID, database.EventVisibilityChanged, "", map[string]interface{}{
+			"public": *req.IsPublic,
+		})
+	}
+	if req.Description != nil || req.Tags != nil {
+		if err := s.db.UpdateTableDetails(ctx, tableID, description, tags); err != nil {
+			slog.ErrorContext(ctx, "Error updating table details", "err", err)
+			writeFailure(w, r, err, "Failed to update table details")
+			return
+		}
+		s.recordEvent(ctx, tableID, userID, database.EventDetailsChanged, "", map[string]interface{}{
+			"description": description,
+			"tags":        tags,
+		})
+	}
+	if req.AllowedContentTypes != nil {
+		if err := s.db.UpdateTableContentTypes(ctx, tableID, *req.AllowedContentTypes); err != nil {
+			slog.ErrorContext(ctx, "Error updating table content types", "err", err)
+			writeFailure(w, r, err, "Failed to update table content types")
+			return
+		}
+		s.recordEvent(ctx, tableID, userID, database.EventContentTypesChanged, "", map[string]interface{}{
+			"content_types": *req.AllowedContentTypes,
+		})
+	}
+
+	updated, err := s.db.GetTableByID(ctx, tableID)
+	if err != nil || updated == nil {
+		slog.ErrorContext(ctx, "Error getting table", "err", err)
+		writeFailure(w, r, err, "Failed to get table")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(updated); err != nil {
+		slog.ErrorContext(ctx, "Failed to encode response", "err", err)
+	}
+}
+
+// deleteTableHandler deletes a table and its indexed chunks. Stored files are
+// kept, since identical documents of other tables may share them.
+func (s *Server) deleteTableHandler(w http.ResponseWriter, r *http.Request) {
+	tableID := r.PathValue("id")
+
+	userID := userIDFromRequest(r)
+	if userID == "" {
+		writeError(w, r, http.StatusUnauthorized, "Invalid or missing Authorization header")
+		return
+	}
+
+	ctx := r.Context()
+	table, err := s.db.GetTableByID(ctx, tableID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error getting table", "err", err)
+		writeFailure(w, r, err, "Failed to get table")
+		return
+	}
+	if table == nil || table.UserID != userID {
+		writeError(w, r, http.StatusNotFound, "Table not found")
+		return
+	}
+
+	// A running job would index chunks again after they are deleted
+	if err := s.lockTable(ctx, tableID); err != nil {
+		writeLockFailure(w, r, err)
+		return
+	}
+	defer s.unlockTable(tableID)
+
+	// Chunks go first, so a failure leaves a table that can be deleted again
+	// rather than chunks no table owns. A failed migration may have left some
+	// in the index of another model.
+	if err := s.deleteChunks(ctx, s.chunkIndices(), "table_id", tableID); err != nil {
+		slog.ErrorContext(ctx, "Error deleting chunks of table", "table_id", tableID, "err", err)
+		writeFailure(w, r, err, "Failed to delete table")
+		return
+	}
+	if err := s.db.DeleteTable(ctx, tableID); err != nil {
+		slog.ErrorContext(ctx, "Error deleting table", "table_id", tableID, "err", err)
+		writeFailure(w, r, err, "Failed to delete table")
+		return
+	}
+	s.recordEvent(ctx, tableID, userID, database.EventTableDeleted, "", map[string]interface{}{
+		"table_name": table.TableName,
+	})
+
+	slog.InfoContext(ctx, "Deleted table", "table_id", tableID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteChunks removes the chunks in indices whose property field (table_id,
+// document_id, ...) equals value. Indices that do not exist are skipped.
+func (s *Server) deleteChunks(ctx context.Context, indices []string, field, value string) error {
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"term": map[string]interface{}{
+				"properties.properties." + field + ".keyword": value,
+			},
+		},
+	}
+
+	res, err := s.es.DeleteByQuery(
+		indices,
+		strings.NewReader(mustToJSON(query)),
+		s.es.DeleteByQuery.WithContext(ctx),
+		s.es.DeleteByQuery.WithRefresh(true),
+		s.es.DeleteByQuery.WithIgnoreUnavailable(true),
+	)
+	if err != nil {
+		return searchFailure("error deleting chunks", nil, err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return searchFailure("error deleting chunks", res, nil)
+	}
+
+	return nil
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// serviceName names the API in traces unless OTEL_SERVICE_NAME is set.
+const serviceName = "sharetome-api"
+
+// tracer starts the spans of the server. It uses the tracer provider set up by
+// SetupTracing, and records nothing until it is called.
+var tracer = otel.Tracer("backend/internal/server")
+
+// SetupTracing exports traces to the exporter named by OTEL_TRACES_EXPORTER:
+// "otlp" sends them over OTLP/HTTP to OTEL_EXPORTER_OTLP_ENDPOINT (by default
+// http://localhost:4318), "stdout" prints them for local use, and "none" or
+// an empty value disables tracing. The returned function flushes the spans
+// not yet exported and must be called before the process exits.
+func SetupTracing(ctx context.Context) (func(context.Context) error, error) {
+	// Trace context is propagated to and from clients, Elasticsearch, the
+	// embedding API and the pipeline either way
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch strings.ToLower(os.Getenv("OTEL_TRACES_EXPORTER")) {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		exporter, err = otlptracehttp.New(ctx)
+	case "stdout", "console":
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	default:
+		return nil, fmt.Errorf("invalid OTEL_TRACES_EXPORTER %q; want otlp, stdout or none", os.Getenv("OTEL_TRACES_EXPORTER"))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error creating trace exporter: %v", err)
+	}
+
+	// Attributes from OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES win
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName(serviceName)),
+		resource.WithFromEnv(),
+		resource.WithHost(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error creating trace resource: %v", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// tracingMiddleware starts a span for every request, continuing the trace of
+// the client if it sent one. Scrapes of the metrics are not traced.
+func tracingMiddleware(next http.Handler) http.Handler {
+	return otelhttp.NewHandler(next, "http.server",
+		otelhttp.WithFilter(func(r *http.Request) bool {
+			return r.URL.Path != "/metrics"
+		}),
+	)
+}
+
+// tracedTransport starts a client span, named after the request by name, for
+// every request made through next and passes the trace context on to the
+// server.
+func tracedTransport(next http.RoundTripper, name func(*http.Request) string) http.RoundTripper {
+	return otelhttp.NewTransport(next,
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return name(r)
+		}),
+	)
+}
+
+// traceEnv returns the environment variables that carry the trace context of
+// ctx to a subprocess, following the TRACEPARENT convention.
+func traceEnv(ctx context.Context) []string {
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+
+	var env []string
+	for key, value := range carrier {
+		env = append(env, strings.ToUpper(key)+"="+value)
+	}
+	return env
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracing(t *testing.T) {
+	t.Setenv("OTEL_TRACES_EXPORTER", "none")
+	if _, err := SetupTracing(context.Background()); err != nil {
+		t.Fatalf("SetupTracing: %v", err)
+	}
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	handler := (&Server{db: newFakeDB()}).RegisterRoutes()
+	req := httptest.NewRequest(http.MethodGet, "/table/t1/activity", nil)
+	// The client's trace is continued
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans; want 1", len(spans))
+	}
+	if got := spans[0].Name(); got != "GET /table/{id}/activity" {
+		t.Errorf("span name = %q; want it named after the route", got)
+	}
+	if got := spans[0].SpanContext().TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("trace ID = %s; want the client's", got)
+	}
+
+	ctx, span := tracer.Start(context.Background(), "job")
+	defer span.End()
+	env := traceEnv(ctx)
+	if len(env) != 1 || !strings.HasPrefix(env[0], "TRACEPARENT=00-"+span.SpanContext().TraceID().String()) {
+		t.Errorf("traceEnv = %v; want the span's TRACEPARENT", env)
+	}
+
+	t.Setenv("OTEL_TRACES_EXPORTER", "zipkin")
+	if _, err := SetupTracing(context.Background()); err == nil {
+		t.Error("expected error for unknown exporter")
+	}
+}
@@ -0,0 +1,409 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"backend/internal/database"
+	"backend/internal/storage"
+)
+
+// Resumable uploads follow the tus protocol, version 1.0.0, with the creation
+// and termination extensions: https://tus.io/protocols/resumable-upload
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination"
+
+	// tusChunkTimeout bounds how long a single PATCH may take to arrive and be
+	// answered, replacing the server-wide ReadTimeout and WriteTimeout for
+	// upload bodies.
+	tusChunkTimeout = 10 * time.Minute
+
+	// tusPartPrefix is the blob store prefix of the parts of unfinished
+	// uploads.
+	tusPartPrefix = "tus"
+)
+
+// tusHandler serves /uploads and /uploads/{id}.
+func (s *Server) tusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", tusExtensions)
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(s.uploadPolicy.maxFileSize, 10))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		writeError(w, r, http.StatusPreconditionFailed, "Unsupported tus version")
+		return
+	}
+
+	userID := userIDFromRequest(r)
+	if userID == "" {
+		writeError(w, r, http.StatusUnauthorized, "Invalid or missing Authorization header")
+		return
+	}
+
+	uploadID := r.PathValue("id")
+	if uploadID == "" {
+		if r.Method != http.MethodPost {
+			writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		// Only creating an upload counts, not sending its parts
+		if s.limiter.allow(w, r, limitUpload) {
+			s.createUpload(w, r, userID)
+		}
+		return
+	}
+	upload, err := s.db.GetUpload(r.Context(), uploadID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error getting upload", "err", err)
+		writeFailure(w, r, err, "Failed to get upload")
+		return
+	}
+	if upload == nil || upload.UserID != userID {
+		writeError(w, r, http.StatusNotFound, "Upload not found")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(upload.Size, 10))
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPatch:
+		s.appendUpload(w, r, upload)
+	case http.MethodDelete:
+		s.terminateUpload(w, r, upload)
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// createUpload implements the creation extension.
+func (s *Server) createUpload(w http.ResponseWriter, r *http.Request, userID string) {
+	size, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || size < 0 {
+		writeError(w, r, http.StatusBadRequest, "Invalid or missing Upload-Length header")
+		return
+	}
+
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid Upload-Metadata header")
+		return
+	}
+	fileName := metadata["filename"]
+	if fileName == "" {
+		writeError(w, r, http.StatusBadRequest, "Upload-Metadata must include a filename")
+		return
+	}
+
+	// The whole declared length counts against the quota from the start
+	if err := s.checkUploadSize(r.Context(), userID, size); err != nil {
+		writePolicyError(w, r, err)
+		return
+	}
+
+	upload, err := s.db.CreateUpload(r.Context(), userID, fileName, metadata["filetype"], size)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error creating upload", "err", err)
+		writeFailure(w, r, err, "Failed to create upload")
+		return
+	}
+
+	if size == 0 {
+		if err := s.finishUpload(r, upload); err != nil {
+			slog.ErrorContext(r.Context(), "Error finishing upload", "upload_id", upload.UploadID, "err", err)
+			writeFailure(w, r, err, "Failed to store upload")
+			return
+		}
+	}
+
+	// Uploads live under the path they were created at, versioned or not
+	w.Header().Set("Location", strings.TrimSuffix(r.URL.Path, "/")+"/"+upload.UploadID)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// appendUpload implements PATCH, storing the request body as the part of the
+// upload that starts at Upload-Offset. Whatever part of the body arrives
+// before a dropped connection is kept, so the client can resume from the
+// offset reported by HEAD. Parts live in the blob store and are recorded in
+// the database, so the next request may go to any replica.
+func (s *Server) appendUpload(w http.ResponseWriter, r *http.Request, upload *database.Upload) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		writeError(w, r, http.StatusUnsupportedMediaType, "Content-Type must be application/offset+octet-stream")
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		writeError(w, r, http.StatusBadRequest, "Invalid or missing Upload-Offset header")
+		return
+	}
+	if upload.Completed || offset != upload.Offset {
+		writeError(w, r, http.StatusConflict, "Upload-Offset does not match the current offset")
+		return
+	}
+	if r.ContentLength > 0 && offset+r.ContentLength > upload.Size {
+		writeError(w, r, http.StatusRequestEntityTooLarge, "Upload exceeds its declared length")
+		return
+	}
+
+	// The response is only written once the whole body has arrived
+	extendDeadlines(w, r, tusChunkTimeout)
+
+	// The body is buffered so that the part can be stored with its size once
+	// the client is done, however the request ends
+	if err := os.MkdirAll(s.stagingDir, 0755); err != nil {
+		slog.ErrorContext(r.Context(), "Error creating staging directory", "err", err)
+		writeFailure(w, r, err, "Failed to store upload")
+		return
+	}
+	f, err := os.CreateTemp(s.stagingDir, "tus-*")
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error creating staging file", "err", err)
+		writeFailure(w, r, err, "Failed to store upload")
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	n, copyErr := io.Copy(f, io.LimitReader(r.Body, upload.Size-offset))
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		slog.ErrorContext(r.Context(), "Error seeking staging file", "err", err)
+		writeFailure(w, r, err, "Failed to store upload")
+		return
+	}
+
+	// Store the bytes we got even if the client has already gone away
+	if n > 0 {
+		ctx := context.WithoutCancel(r.Context())
+		key := path.Join(tusPartPrefix, upload.UploadID, uuid.New().String())
+		if err := s.blobs.Put(ctx, key, f, n, "application/octet-stream"); err != nil {
+			slog.ErrorContext(r.Context(), "Error storing upload part", "err", err)
+			writeFailure(w, r, err, "Failed to store upload")
+			return
+		}
+		if err := s.db.AppendUploadPart(ctx, upload.UploadID, offset, n, key); err != nil {
+			s.deleteBlob(ctx, key)
+			if errors.Is(err, database.ErrConflict) {
+				writeError(w, r, http.StatusConflict, "Upload-Offset does not match the current offset")
+				return
+			}
+			slog.ErrorContext(r.Context(), "Error recording upload part", "err", err)
+			writeFailure(w, r, err, "Failed to store upload")
+			return
+		}
+		upload.Offset = offset + n
+	}
+	if copyErr != nil {
+		slog.InfoContext(r.Context(), "Upload interrupted", "upload_id", upload.UploadID, "offset", upload.Offset, "err", copyErr)
+		writeError(w, r, http.StatusBadRequest, "Failed to read request body")
+		return
+	}
+
+	if upload.Offset == upload.Size {
+		if err := s.finishUpload(r, upload); err != nil {
+			slog.ErrorContext(r.Context(), "Error finishing upload", "upload_id", upload.UploadID, "err", err)
+			writeFailure(w, r, err, "Failed to store upload")
+			return
+		}
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finishUpload joins the parts of a fully received upload into a single blob
+// and registers it as completed, so it can be attached to a table by its
+// upload ID.
+func (s *Server) finishUpload(r *http.Request, upload *database.Upload) error {
+	ctx := r.Context()
+	parts, err := s.db.GetUploadParts(ctx, upload.UploadID)
+	if err != nil {
+		return err
+	}
+	contents := newPartReader(ctx, s.blobs, parts)
+	defer contents.Close()
+
+	// Trust the file's magic bytes, not the filetype the client claimed
+	head := bufio.NewReaderSize(contents, 512)
+	sniffed, err := head.Peek(512)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("error reading upload parts: %v", err)
+	}
+	contentType, _, _ := strings.Cut(http.DetectContentType(sniffed), ";")
+	if err := checkContentType(contentType, uploadContentTypes(nil)); err != nil {
+		s.discardUpload(r, upload)
+		return err
+	}
+
+	key := newBlobKey(upload.FileName)
+	hash := sha256.New()
+	if err := s.blobs.Put(ctx, key, io.TeeReader(head, hash), upload.Size, contentType); err != nil {
+		return err
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+
+	// Another request may have finished the upload meanwhile
+	if err := s.db.CompleteUpload(ctx, upload.UploadID, key, contentType, sum); err != nil {
+		s.deleteBlob(ctx, key)
+		return err
+	}
+	upload.SHA256 = sum
+	upload.Completed = true
+	upload.FilePath = key
+	upload.ContentType = contentType
+
+	s.deleteUploadParts(ctx, parts)
+	return nil
+}
+
+// terminateUpload implements the termination extension for unfinished
+// uploads. A completed upload may be attached to tables, which keep referring
+// to its file, and it counts against the user's quota for as long as the file
+// is kept, so it cannot be terminated.
+func (s *Server) terminateUpload(w http.ResponseWriter, r *http.Request, upload *database.Upload) {
+	if upload.Completed {
+		writeError(w, r, http.StatusConflict, "Completed uploads cannot be terminated")
+		return
+	}
+
+	parts, err := s.db.GetUploadParts(r.Context(), upload.UploadID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error getting upload parts", "err", err)
+		writeFailure(w, r, err, "Failed to delete upload")
+		return
+	}
+	if err := s.db.DeleteUpload(r.Context(), upload.UploadID); err != nil {
+		slog.ErrorContext(r.Context(), "Error deleting upload", "err", err)
+		writeFailure(w, r, err, "Failed to delete upload")
+		return
+	}
+
+	s.deleteUploadParts(r.Context(), parts)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// discardUpload drops an upload that violates the upload policy, releasing
+// its share of the user's quota.
+func (s *Server) discardUpload(r *http.Request, upload *database.Upload) {
+	parts, err := s.db.GetUploadParts(r.Context(), upload.UploadID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error getting upload parts", "upload_id", upload.UploadID, "err", err)
+	}
+	if err := s.db.DeleteUpload(r.Context(), upload.UploadID); err != nil {
+		slog.ErrorContext(r.Context(), "Error deleting upload", "upload_id", upload.UploadID, "err", err)
+	}
+	s.deleteUploadParts(r.Context(), parts)
+}
+
+// deleteUploadParts removes the blobs of parts, which are no longer needed.
+func (s *Server) deleteUploadParts(ctx context.Context, parts []database.UploadPart) {
+	for _, part := range parts {
+		s.deleteBlob(ctx, part.FilePath)
+	}
+}
+
+// deleteBlob removes the blob stored under key, logging any failure.
+func (s *Server) deleteBlob(ctx context.Context, key string) {
+	if err := s.blobs.Delete(ctx, key); err != nil {
+		slog.ErrorContext(ctx, "Error deleting blob", "key", key, "err", err)
+	}
+}
+
+// partReader reads the parts of an upload one after the other, opening each
+// when the one before it is exhausted.
+type partReader struct {
+	ctx     context.Context
+	blobs   storage.BlobStore
+	parts   []database.UploadPart
+	current io.ReadCloser
+}
+
+func newPartReader(ctx context.Context, blobs storage.BlobStore, parts []database.UploadPart) *partReader {
+	return &partReader{ctx: ctx, blobs: blobs, parts: parts}
+}
+
+func (p *partReader) Read(b []byte) (int, error) {
+	for {
+		if p.current == nil {
+			if len(p.parts) == 0 {
+				return 0, io.EOF
+			}
+			rc, err := p.blobs.Get(p.ctx, p.parts[0].FilePath)
+			if err != nil {
+				return 0, fmt.Errorf("error opening upload part: %v", err)
+			}
+			// A part holds exactly the bytes it was recorded with
+			p.current = struct {
+				io.Reader
+				io.Closer
+			}{io.LimitReader(rc, p.parts[0].Size), rc}
+			p.parts = p.parts[1:]
+		}
+		n, err := p.current.Read(b)
+		if err == io.EOF {
+			p.current.Close()
+			p.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (p *partReader) Close() error {
+	if p.current == nil {
+		return nil
+	}
+	return p.current.Close()
+}
+
+// parseTusMetadata decodes an Upload-Metadata header: comma separated pairs
+// of a key and an optional base64 encoded value.
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, fmt.Errorf("empty metadata key")
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for metadata key %q: %v", key, err)
+		}
+		metadata[key] = string(value)
+	}
+
+	return metadata, nil
+}
@@ -0,0 +1,272 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"backend/internal/storage"
+)
+
+func newTusTestServer(t *testing.T) (*Server, *fakeDB) {
+	t.Helper()
+	db := newFakeDB()
+	blobs, err := storage.NewLocalStore(t.TempDir(), []byte("secret"))
+	if err != nil {
+		t.Fatalf("error creating blob store: %v", err)
+	}
+	return &Server{
+		db:           db,
+		blobs:        blobs,
+		uploadPolicy: uploadPolicy{maxFileSize: 1 << 20, userQuota: 1 << 20},
+		stagingDir:   t.TempDir(),
+	}, db
+}
+
+func tusRequest(method, path string, body []byte, headers map[string]string) *http.Request {
+	req := httptest.NewRequest(method, path, bytes.NewReader(body))
+	req.Header.Set("Tus-Resumable", tusVersion)
+	req.Header.Set("Authorization", "Bearer alice")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	return req
+}
+
+func TestTusUpload(t *testing.T) {
+	s, db := newTusTestServer(t)
+	handler := s.RegisterRoutes()
+	content := []byte("%PDF-1.7 resumable upload body")
+
+	// "cmVwb3J0LnBkZg==" is base64 for "report.pdf"
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, tusRequest(http.MethodPost, "/uploads", nil, map[string]string{
+		"Upload-Length":   "30",
+		"Upload-Metadata": "filename cmVwb3J0LnBkZg==,filetype YXBwbGljYXRpb24vcGRm",
+	}))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected status 201; got %d: %s", rr.Code, rr.Body.String())
+	}
+	location := rr.Header().Get("Location")
+	if !strings.HasPrefix(location, "/uploads/") {
+		t.Fatalf("expected Location under /uploads/; got %q", location)
+	}
+
+	patch := func(offset string, chunk []byte) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, tusRequest(http.MethodPatch, location, chunk, map[string]string{
+			"Content-Type":  "application/offset+octet-stream",
+			"Upload-Offset": offset,
+		}))
+		return rr
+	}
+
+	if rr := patch("0", content[:10]); rr.Code != http.StatusNoContent || rr.Header().Get("Upload-Offset") != "10" {
+		t.Fatalf("expected first chunk to advance offset to 10; got %d, offset %q", rr.Code, rr.Header().Get("Upload-Offset"))
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, tusRequest(http.MethodHead, location, nil, nil))
+	if rr.Header().Get("Upload-Offset") != "10" || rr.Header().Get("Upload-Length") != "30" {
+		t.Errorf("expected HEAD to report offset 10 of 30; got %q of %q", rr.Header().Get("Upload-Offset"), rr.Header().Get("Upload-Length"))
+	}
+
+	if rr := patch("0", content); rr.Code != http.StatusConflict {
+		t.Errorf("expected stale offset to conflict; got %d", rr.Code)
+	}
+
+	if rr := patch("10", content[10:]); rr.Code != http.StatusNoContent || rr.Header().Get("Upload-Offset") != "30" {
+		t.Fatalf("expected last chunk to complete the upload; got %d, offset %q", rr.Code, rr.Header().Get("Upload-Offset"))
+	}
+
+	upload := db.uploads[strings.TrimPrefix(location, "/uploads/")]
+	if !upload.Completed {
+		t.Fatal("expected upload to be registered as completed")
+	}
+	if !strings.HasSuffix(upload.FilePath, "/report.pdf") || upload.ContentType != "application/pdf" {
+		t.Errorf("expected a sniffed PDF stored as report.pdf; got %s of type %s", upload.FilePath, upload.ContentType)
+	}
+	rc, err := s.blobs.Get(context.Background(), upload.FilePath)
+	if err != nil {
+		t.Fatalf("error opening stored upload: %v", err)
+	}
+	defer rc.Close()
+	stored, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("error reading stored upload: %v", err)
+	}
+	if !bytes.Equal(stored, content) {
+		t.Errorf("expected stored file to equal the uploaded content; got %q", stored)
+	}
+}
+
+func TestTusTermination(t *testing.T) {
+	s, db := newTusTestServer(t)
+	handler := s.RegisterRoutes()
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, tusRequest(http.MethodPost, "/uploads", nil, map[string]string{
+		"Upload-Length":   "100",
+		"Upload-Metadata": "filename YS5wZGY=",
+	}))
+	location := rr.Header().Get("Location")
+	uploadID := strings.TrimPrefix(location, "/uploads/")
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, tusRequest(http.MethodPatch, location, []byte("%PDF-1.7"), map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": "0",
+	}))
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("expected first chunk to be stored; got %d: %s", rr.Code, rr.Body.String())
+	}
+	parts := db.uploadParts[uploadID]
+	if len(parts) != 1 {
+		t.Fatalf("expected one stored part; got %+v", parts)
+	}
+
+	req := tusRequest(http.MethodDelete, location, nil, nil)
+	req.Header.Set("Authorization", "Bearer bob")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected other users to get 404; got %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, tusRequest(http.MethodDelete, location, nil, nil))
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204; got %d", rr.Code)
+	}
+	if len(db.uploads) != 0 {
+		t.Error("expected upload to be removed from the registry")
+	}
+	if _, err := s.blobs.Stat(context.Background(), parts[0].FilePath); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("expected stored part to be removed; got %v", err)
+	}
+}
+
+func TestTusTerminationKeepsCompletedUploads(t *testing.T) {
+	s, db := newTusTestServer(t)
+	handler := s.RegisterRoutes()
+	content := []byte("%PDF-1.7 attached")
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, tusRequest(http.MethodPost, "/uploads", nil, map[string]string{
+		"Upload-Length":   strconv.Itoa(len(content)),
+		"Upload-Metadata": "filename YS5wZGY=",
+	}))
+	location := rr.Header().Get("Location")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, tusRequest(http.MethodPatch, location, content, map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": "0",
+	}))
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("expected upload to complete; got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, tusRequest(http.MethodDelete, location, nil, nil))
+	if rr.Code != http.StatusConflict {
+		t.Errorf("expected terminating a completed upload to conflict; got %d", rr.Code)
+	}
+	// The file still counts against the quota
+	if usage, _ := db.GetUserStorageUsage(context.Background(), "alice"); usage != int64(len(content)) {
+		t.Errorf("expected usage of %d bytes; got %d", len(content), usage)
+	}
+}
+
+func TestTusResumeOnOtherReplica(t *testing.T) {
+	s, db := newTusTestServer(t)
+	// Replicas share the database and the blob store, not their disks
+	other := &Server{db: db, blobs: s.blobs, uploadPolicy: s.uploadPolicy, stagingDir: t.TempDir()}
+	content := []byte("%PDF-1.7 resumed elsewhere")
+
+	rr := httptest.NewRecorder()
+	s.RegisterRoutes().ServeHTTP(rr, tusRequest(http.MethodPost, "/uploads", nil, map[string]string{
+		"Upload-Length":   strconv.Itoa(len(content)),
+		"Upload-Metadata": "filename YS5wZGY=",
+	}))
+	location := rr.Header().Get("Location")
+
+	for i, replica := range []*Server{s, other} {
+		offset := i * 10
+		chunk := content[offset:]
+		if i == 0 {
+			chunk = content[:10]
+		}
+		rr := httptest.NewRecorder()
+		replica.RegisterRoutes().ServeHTTP(rr, tusRequest(http.MethodPatch, location, chunk, map[string]string{
+			"Content-Type":  "application/offset+octet-stream",
+			"Upload-Offset": strconv.Itoa(offset),
+		}))
+		if rr.Code != http.StatusNoContent {
+			t.Fatalf("chunk %d: expected status 204; got %d: %s", i, rr.Code, rr.Body.String())
+		}
+	}
+
+	upload := db.uploads[strings.TrimPrefix(location, "/uploads/")]
+	if !upload.Completed {
+		t.Fatal("expected upload to be completed")
+	}
+	rc, err := s.blobs.Get(context.Background(), upload.FilePath)
+	if err != nil {
+		t.Fatalf("error opening stored upload: %v", err)
+	}
+	defer rc.Close()
+	if stored, _ := io.ReadAll(rc); !bytes.Equal(stored, content) {
+		t.Errorf("expected stored file to equal the uploaded content; got %q", stored)
+	}
+	if parts := db.uploadParts[upload.UploadID]; len(parts) != 0 {
+		t.Errorf("expected parts to be forgotten once joined; got %+v", parts)
+	}
+}
+
+func TestTusProtocolErrors(t *testing.T) {
+	s, _ := newTusTestServer(t)
+	handler := s.RegisterRoutes()
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodOptions, "/uploads", nil))
+	if rr.Code != http.StatusNoContent || rr.Header().Get("Tus-Extension") != tusExtensions {
+		t.Errorf("expected OPTIONS to advertise tus extensions; got %d %q", rr.Code, rr.Header().Get("Tus-Extension"))
+	}
+
+	req := tusRequest(http.MethodPost, "/uploads", nil, map[string]string{"Upload-Length": "1"})
+	req.Header.Set("Tus-Resumable", "0.2.2")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusPreconditionFailed {
+		t.Errorf("expected unsupported version to fail with 412; got %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, tusRequest(http.MethodPost, "/uploads", nil, map[string]string{"Upload-Length": "1"}))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected missing filename to fail with 400; got %d", rr.Code)
+	}
+}
+
+func TestParseTusMetadata(t *testing.T) {
+	metadata, err := parseTusMetadata("filename d29ybGQucGRm, is_confidential")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if metadata["filename"] != "world.pdf" {
+		t.Errorf("expected filename world.pdf; got %q", metadata["filename"])
+	}
+	if v, ok := metadata["is_confidential"]; !ok || v != "" {
+		t.Errorf("expected key without value to be present and empty; got %q, %v", v, ok)
+	}
+
+	if _, err := parseTusMetadata("filename not-base64!"); err == nil {
+		t.Error("expected invalid base64 to fail")
+	}
+}
@@ -0,0 +1,246 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"backend/internal/config"
+	"backend/internal/database"
+)
+
+// supportedContentTypes are the file types the ingestion pipeline can
+// partition, mapped to the binary format it reads them as.
+var supportedContentTypes = map[string]string{
+	"application/pdf": "pdf",
+	"image/png":       "png",
+	"image/jpeg":      "jpeg",
+}
+
+// defaultContentTypes apply to tables that do not set their own allowlist.
+var defaultContentTypes = []string{"application/pdf"}
+
+// multipartOverhead leaves room for the multipart boundaries and headers
+// around the file in an /upload request body.
+const multipartOverhead = 1 << 20
+
+// uploadTimeout bounds how long an /upload request may take to arrive and be
+// answered, replacing the server-wide ReadTimeout and WriteTimeout, like
+// tusChunkTimeout does for a single PATCH.
+const uploadTimeout = 10 * time.Minute
+
+// uploadPolicy limits what users can upload.
+type uploadPolicy struct {
+	// maxFileSize is the largest single file accepted, in bytes.
+	maxFileSize int64
+	// userQuota is the total number of bytes a user may have stored.
+	userQuota int64
+}
+
+// newUploadPolicy returns the policy cfg configures.
+func newUploadPolicy(cfg config.Uploads) uploadPolicy {
+	return uploadPolicy{maxFileSize: cfg.MaxBytes, userQuota: cfg.UserQuotaBytes}
+}
+
+// policyError is a policy violation, reported to the client with status and
+// code, which defaults to the one of the status.
+type policyError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *policyError) Error() string {
+	return e.message
+}
+
+// errorCode returns the code the violation is reported with.
+func (e *policyError) errorCode() string {
+	if e.code != "" {
+		return e.code
+	}
+	return statusCode(e.status)
+}
+
+// writePolicyError responds with the status of a policy violation, or as
+// writeFailure does for any other error.
+func writePolicyError(w http.ResponseWriter, r *http.Request, err error) {
+	writeFailure(w, r, err, "Failed to check upload policy")
+}
+
+// checkUploadSize rejects files over the size limit and files that would take
+// the user over their storage quota.
+func (s *Server) checkUploadSize(ctx context.Context, userID string, size int64) error {
+	if size > s.uploadPolicy.maxFileSize {
+		return &policyError{
+			status:  http.StatusRequestEntityTooLarge,
+			message: fmt.Sprintf("File exceeds the maximum size of %d bytes", s.uploadPolicy.maxFileSize),
+		}
+	}
+
+	usage, err := s.db.GetUserStorageUsage(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if usage+size > s.uploadPolicy.userQuota {
+		return &policyError{
+			status:  http.StatusForbidden,
+			code:    codeQuotaExceeded,
+			message: fmt.Sprintf("Storage quota exceeded: %d of %d bytes used", usage, s.uploadPolicy.userQuota),
+		}
+	}
+
+	return nil
+}
+
+// allowedContentTypes returns the allowlist of a table, or the default one.
+func allowedContentTypes(table *database.UserTable) []string {
+	if table == nil || len(table.AllowedContentTypes) == 0 {
+		return defaultContentTypes
+	}
+	return table.AllowedContentTypes
+}
+
+// uploadContentTypes returns the types accepted for an upload. Files uploaded
+// without naming a table may be of any type the pipeline supports; the
+// table's own allowlist is enforced again when they are attached to it.
+func uploadContentTypes(table *database.UserTable) []string {
+	if table != nil {
+		return allowedContentTypes(table)
+	}
+	types := make([]string, 0, len(supportedContentTypes))
+	for ct := range supportedContentTypes {
+		types = append(types, ct)
+	}
+	slices.Sort(types)
+	return types
+}
+
+// checkContentType rejects content types outside allowed.
+func checkContentType(contentType string, allowed []string) error {
+	if !slices.Contains(allowed, contentType) {
+		return &policyError{
+			status:  http.StatusUnsupportedMediaType,
+			code:    codeContentTypeNotAccepted,
+			message: fmt.Sprintf("Files of type %s are not accepted; allowed types: %s", contentType, strings.Join(allowed, ", ")),
+		}
+	}
+	return nil
+}
+
+// validateContentTypes checks that a table allowlist only names types the
+// pipeline can ingest.
+func validateContentTypes(contentTypes []string) error {
+	for _, ct := range contentTypes {
+		if _, ok := supportedContentTypes[ct]; !ok {
+			return &policyError{
+				status:  http.StatusBadRequest,
+				message: fmt.Sprintf("Unsupported content type %q", ct),
+			}
+		}
+	}
+	return nil
+}
+
+// sniffContentType detects the type of r from its first bytes, ignoring
+// whatever the client claimed, and rewinds r.
+func sniffContentType(r io.ReadSeeker) (string, error) {
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(r, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	contentType, _, _ := strings.Cut(http.DetectContentType(buf[:n]), ";")
+	return contentType, nil
+}
+
+// resolveDocument finds the completed upload of userID that doc refers to,
+// either by upload ID or by the storage key /upload returned.
+func (s *Server) resolveDocument(ctx context.Context, userID string, doc Document) (*database.Upload, error) {
+	var upload *database.Upload
+	var err error
+	if doc.UploadID != "" {
+		upload, err = s.db.GetUpload(ctx, doc.UploadID)
+	} else {
+		upload, err = s.db.GetUploadByFilePath(ctx, doc.FilePath)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if upload == nil || upload.UserID != userID || !upload.Completed {
+		name := doc.UploadID
+		if name == "" {
+			name = doc.FilePath
+		}
+		return nil, &policyError{
+			status:  http.StatusBadRequest,
+			message: fmt.Sprintf("Unknown or unfinished upload %q", name),
+		}
+	}
+
+	return upload, nil
+}
+
+// uploadTable returns the table an upload is destined for, if the client
+// named one, after checking that userID owns it.
+func (s *Server) uploadTable(ctx context.Context, userID, tableID string) (*database.UserTable, error) {
+	if tableID == "" {
+		return nil, nil
+	}
+	table, err := s.db.GetTableByID(ctx, tableID)
+	if err != nil {
+		return nil, err
+	}
+	if table == nil || table.UserID != userID {
+		return nil, &policyError{status: http.StatusNotFound, message: "Table not found"}
+	}
+	return table, nil
+}
+
+// newBlobKey returns a storage key for an uploaded file. Keys are random so
+// they reveal nothing about the user, and the file name is reduced to a safe
+// subset of characters.
+func newBlobKey(fileName string) string {
+	return path.Join(uuid.New().String(), sanitizeFileName(fileName))
+}
+
+// sanitizeFileName strips any directory components from a client supplied
+// file name and replaces everything but letters, digits, '.', '-' and '_'.
+func sanitizeFileName(name string) string {
+	name = name[strings.LastIndexAny(name, `/\`)+1:]
+
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			b.WriteRune(r)
+		default:
+			b.WriteRune('_')
+		}
+	}
+
+	clean := strings.TrimLeft(b.String(), ".")
+	if len(clean) > 100 {
+		ext := path.Ext(clean)
+		if len(ext) > 10 {
+			ext = ""
+		}
+		clean = clean[:100-len(ext)] + ext
+	}
+	if clean == "" {
+		clean = "file"
+	}
+	return clean
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"backend/internal/database"
+	"backend/internal/storage"
+)
+
+func newUploadTestServer(t *testing.T) (*Server, *fakeDB) {
+	t.Helper()
+	db := newFakeDB()
+	db.tables["t1"] = &database.UserTable{UserID: "alice", TableID: "t1", TableName: "scans", AllowedContentTypes: []string{"image/png"}}
+	blobs, err := storage.NewLocalStore(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("error creating blob store: %v", err)
+	}
+	return &Server{
+		db:           db,
+		blobs:        blobs,
+		uploadPolicy: uploadPolicy{maxFileSize: 1024, userQuota: 2048},
+	}, db
+}
+
+func multipartUpload(t *testing.T, auth, fileName string, content []byte, fields map[string]string) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	fw, err := mw.CreateFormFile("file", fileName)
+	if err != nil {
+		t.Fatalf("error creating form file: %v", err)
+	}
+	fw.Write(content)
+	mw.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/upload", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Authorization", auth)
+	return req
+}
+
+var pdfContent = []byte("%PDF-1.7\n1 0 obj\n<<>>\nendobj\n")
+
+func TestUploadSanitizesStorageKey(t *testing.T) {
+	s, db := newUploadTestServer(t)
+
+	rr := httptest.NewRecorder()
+	s.RegisterRoutes().ServeHTTP(rr, multipartUpload(t, "Bearer ../../etc", "../../passwd.pdf", pdfContent, nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200; got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	var resp map[string]string
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatalf("error decoding response: %v", err)
+	}
+	key := resp["filePath"]
+	if strings.Contains(key, "..") || strings.Contains(key, "etc") || !strings.HasSuffix(key, "/passwd.pdf") {
+		t.Errorf("expected a sanitized key independent of the user; got %q", key)
+	}
+	if u := db.uploads[resp["upload_id"]]; u == nil || u.ContentType != "application/pdf" {
+		t.Errorf("expected upload to be registered as a PDF; got %+v", u)
+	}
+}
+
+func TestUploadPolicyViolations(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content []byte
+		fields  map[string]string
+		status  int
+	}{
+		{"too large", "big.pdf", append(pdfContent, make([]byte, 2048)...), nil, http.StatusRequestEntityTooLarge},
+		{"disguised type", "notes.pdf", []byte("just some text pretending to be a PDF"), nil, http.StatusUnsupportedMediaType},
+		{"outside table allowlist", "scan.pdf", pdfContent, map[string]string{"table_id": "t1"}, http.StatusUnsupportedMediaType},
+		{"table of another user", "scan.pdf", pdfContent, map[string]string{"table_id": "t2"}, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, db := newUploadTestServer(t)
+			rr := httptest.NewRecorder()
+			s.RegisterRoutes().ServeHTTP(rr, multipartUpload(t, "Bearer alice", tt.file, tt.content, tt.fields))
+			if rr.Code != tt.status {
+				t.Errorf("expected status %d; got %d: %s", tt.status, rr.Code, rr.Body.String())
+			}
+			if len(db.uploads) != 0 {
+				t.Errorf("expected rejected file not to be registered")
+			}
+		})
+	}
+}
+
+func TestUploadMalformedForm(t *testing.T) {
+	s, _ := newUploadTestServer(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("--x\r\nnot a part"))
+	req.Header.Set("Content-Type", "multipart/form-data; boundary=x")
+	req.Header.Set("Authorization", "Bearer alice")
+	rr := httptest.NewRecorder()
+	s.RegisterRoutes().ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400; got %d: %s", rr.Code, rr.Body.String())
+	}
+	// The parser's error is logged, not shown to the client
+	if body := rr.Body.String(); !strings.Contains(body, "Request body is not a valid multipart form") || strings.Contains(body, "multipart:") {
+		t.Errorf("expected a generic message; got %s", body)
+	}
+}
+
+func TestUploadQuota(t *testing.T) {
+	s, db := newUploadTestServer(t)
+	db.uploads["old"] = &database.Upload{UploadID: "old", UserID: "alice", Size: 2040, Completed: true}
+
+	rr := httptest.NewRecorder()
+	s.RegisterRoutes().ServeHTTP(rr, multipartUpload(t, "Bearer alice", "a.pdf", pdfContent, nil))
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected quota to be enforced with 403; got %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	s.RegisterRoutes().ServeHTTP(rr, multipartUpload(t, "Bearer bob", "a.pdf", pdfContent, nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected other users to have their own quota; got %d", rr.Code)
+	}
+}
+
+func TestCreateTableRejectsForeignUploads(t *testing.T) {
+	s, db := newUploadTestServer(t)
+	db.uploads["u1"] = &database.Upload{UploadID: "u1", UserID: "bob", FilePath: "k/a.pdf", ContentType: "application/pdf", Completed: true}
+
+	body := `{"table_name":"stolen","documents":[{"file_path":"k/a.pdf","file_name":"a.pdf"}]}`
+	req := httptest.NewRequest(http.MethodPost, "/create_table", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer alice")
+	rr := httptest.NewRecorder()
+	s.RegisterRoutes().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected another user's upload to be rejected; got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestSanitizeFileName(t *testing.T) {
+	tests := map[string]string{
+		"report.pdf":                      "report.pdf",
+		"../../etc/passwd":                "passwd",
+		`C:\Users\me\scan (1).png`:        "scan__1_.png",
+		"..hidden":                        "hidden",
+		"":                                "file",
+		"résumé.pdf":                      "r_sum_.pdf",
+		strings.Repeat("a", 200) + ".pdf": strings.Repeat("a", 96) + ".pdf",
+	}
+	for in, want := range tests {
+		if got := sanitizeFileName(in); got != want {
+			t.Errorf("sanitizeFileName(%q) = %q; want %q", in, got, want)
+		}
+	}
+}
+
+func TestAddDocumentsToLockedTable(t *testing.T) {
+	s, db := newUploadTestServer(t)
+	db.uploads["u1"] = &database.Upload{UploadID: "u1", UserID: "alice", FilePath: "k/a.png", ContentType: "image/png", Completed: true}
+	// Another replica is reindexing the table
+	db.locks["t1"] = "other-replica"
+
+	body := `{"table_name":"scans","skip_table_creation":true,"documents":[{"upload_id":"u1","file_name":"a.png"}]}`
+	req := httptest.NewRequest(http.MethodPost, "/create_table", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer alice")
+	rr := httptest.NewRecorder()
+	s.RegisterRoutes().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusConflict {
+		t.Errorf("expected status 409; got %d: %s", rr.Code, rr.Body.String())
+	}
+	if len(db.docs) != 0 {
+		t.Errorf("expected no document to be added; got %v", db.docs)
+	}
+}
@@ -0,0 +1,194 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LocalStore keeps blobs as files below a root directory. It is meant for
+// development and single instance deployments.
+type LocalStore struct {
+	root       string
+	signingKey []byte
+}
+
+// NewLocalStore creates a store rooted at dir. Signed URLs are authenticated
+// with signingKey; if it is empty a random key is generated, so URLs stop
+// working when the process restarts.
+func NewLocalStore(dir string, signingKey []byte) (*LocalStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating blob directory: %v", err)
+	}
+
+	if len(signingKey) == 0 {
+		signingKey = make([]byte, 32)
+		if _, err := rand.Read(signingKey); err != nil {
+			return nil, fmt.Errorf("error generating signing key: %v", err)
+		}
+	}
+
+	return &LocalStore{root: dir, signingKey: signingKey}, nil
+}
+
+// path maps a key to a file below the root, rejecting keys that would escape it.
+func (l *LocalStore) path(key string) (string, error) {
+	clean := path.Clean("/" + key)
+	if key == "" || clean == "/" || clean[1:] != key {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return filepath.Join(l.root, filepath.FromSlash(key)), nil
+}
+
+// Put writes the blob to a temporary file and renames it into place, so
+// readers never see a partially written blob.
+func (l *LocalStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return fmt.Errorf("error creating blob directory: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".put-*")
+	if err != nil {
+		return fmt.Errorf("error creating blob: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing blob: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing blob: %v", err)
+	}
+
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		return fmt.Errorf("error storing blob: %v", err)
+	}
+	return nil
+}
+
+func (l *LocalStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening blob: %v", err)
+	}
+	return f, nil
+}
+
+func (l *LocalStore) Delete(ctx context.Context, key string) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error deleting blob: %v", err)
+	}
+	return nil
+}
+
+func (l *LocalStore) Stat(ctx context.Context, key string) (*BlobInfo, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(p)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading blob: %v", err)
+	}
+
+	return &BlobInfo{
+		Key:          key,
+		Size:         fi.Size(),
+		ContentType:  mime.TypeByExtension(path.Ext(key)),
+		LastModified: fi.ModTime(),
+	}, nil
+}
+
+// SignedURL returns a path relative to the API that Handler serves until the
+// URL expires.
+func (l *LocalStore) SignedURL(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	if _, err := l.path(key); err != nil {
+		return "", err
+	}
+
+	expires := strconv.FormatInt(time.Now().Add(expiry).Unix(), 10)
+	q := url.Values{}
+	q.Set("expires", expires)
+	q.Set("signature", l.sign(key, expires))
+
+	return "/blobs/" + (&url.URL{Path: key}).EscapedPath() + "?" + q.Encode(), nil
+}
+
+func (l *LocalStore) sign(key, expires string) string {
+	mac := hmac.New(sha256.New, l.signingKey)
+	mac.Write([]byte(key + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Handler serves the blobs behind URLs returned by SignedURL. It must be
+// mounted at /blobs/.
+func (l *LocalStore) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		key := strings.TrimPrefix(r.URL.Path, "/blobs/")
+		expires := r.URL.Query().Get("expires")
+		signature := r.URL.Query().Get("signature")
+
+		unix, err := strconv.ParseInt(expires, 10, 64)
+		if err != nil || time.Now().Unix() > unix ||
+			!hmac.Equal([]byte(signature), []byte(l.sign(key, expires))) {
+			http.Error(w, "Invalid or expired signature", http.StatusForbidden)
+			return
+		}
+
+		p, err := l.path(key)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+
+		fi, err := f.Stat()
+		if err != nil {
+			http.Error(w, "Failed to read blob", http.StatusInternalServerError)
+			return
+		}
+		http.ServeContent(w, r, path.Base(key), fi.ModTime(), f)
+	})
+}
@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLocalStore(t *testing.T) {
+	store, err := NewLocalStore(t.TempDir(), []byte("secret"))
+	if err != nil {
+		t.Fatalf("error creating store: %v", err)
+	}
+	testBlobStore(t, store)
+}
+
+func TestLocalStoreRejectsEscapingKeys(t *testing.T) {
+	store, err := NewLocalStore(t.TempDir(), []byte("secret"))
+	if err != nil {
+		t.Fatalf("error creating store: %v", err)
+	}
+
+	for _, key := range []string{"", "../etc/passwd", "a/../../b", "/abs", "a//b"} {
+		if err := store.Put(context.Background(), key, strings.NewReader("x"), 1, ""); err == nil {
+			t.Errorf("expected key %q to be rejected", key)
+		}
+	}
+}
+
+func TestLocalStoreSignedURL(t *testing.T) {
+	store, err := NewLocalStore(t.TempDir(), []byte("secret"))
+	if err != nil {
+		t.Fatalf("error creating store: %v", err)
+	}
+	ctx := context.Background()
+	if err := store.Put(ctx, "alice/report.pdf", strings.NewReader("%PDF-1.7"), 8, "application/pdf"); err != nil {
+		t.Fatalf("error storing blob: %v", err)
+	}
+
+	signed, err := store.SignedURL(ctx, "alice/report.pdf", time.Minute)
+	if err != nil {
+		t.Fatalf("error signing URL: %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	store.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, signed, nil))
+	if rr.Code != http.StatusOK || rr.Body.String() != "%PDF-1.7" {
+		t.Errorf("expected signed URL to serve the blob; got %d %q", rr.Code, rr.Body.String())
+	}
+
+	tampered := strings.Replace(signed, "alice", "bob", 1)
+	rr = httptest.NewRecorder()
+	store.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tampered, nil))
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected tampered URL to be forbidden; got %d", rr.Code)
+	}
+
+	expired, err := store.SignedURL(ctx, "alice/report.pdf", -time.Minute)
+	if err != nil {
+		t.Fatalf("error signing URL: %v", err)
+	}
+	rr = httptest.NewRecorder()
+	store.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, expired, nil))
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected expired URL to be forbidden; got %d", rr.Code)
+	}
+}
+
+// testBlobStore exercises the BlobStore contract against any implementation.
+func testBlobStore(t *testing.T, store BlobStore) {
+	t.Helper()
+	ctx := context.Background()
+	key := "alice/1_notes.txt"
+
+	if _, err := store.Stat(ctx, key); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound before Put; got %v", err)
+	}
+	if _, err := store.Get(ctx, key); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound before Put; got %v", err)
+	}
+
+	if err := store.Put(ctx, key, strings.NewReader("hello blob"), 10, "text/plain"); err != nil {
+		t.Fatalf("error storing blob: %v", err)
+	}
+
+	info, err := store.Stat(ctx, key)
+	if err != nil {
+		t.Fatalf("error reading blob info: %v", err)
+	}
+	if info.Size != 10 || !strings.HasPrefix(info.ContentType, "text/plain") {
+		t.Errorf("expected 10 bytes of text/plain; got %d bytes of %q", info.Size, info.ContentType)
+	}
+
+	rc, err := store.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("error opening blob: %v", err)
+	}
+	body, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil || string(body) != "hello blob" {
+		t.Errorf("expected blob contents %q; got %q (%v)", "hello blob", body, err)
+	}
+
+	if _, err := store.SignedURL(ctx, key, time.Minute); err != nil {
+		t.Errorf("error signing URL: %v", err)
+	}
+
+	if err := store.Delete(ctx, key); err != nil {
+		t.Fatalf("error deleting blob: %v", err)
+	}
+	if _, err := store.Stat(ctx, key); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound after Delete; got %v", err)
+	}
+	if err := store.Delete(ctx, key); err != nil {
+		t.Errorf("expected deleting a missing blob to succeed; got %v", err)
+	}
+}
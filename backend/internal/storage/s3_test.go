@@ -0,0 +1,27 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"testing"
+)
+
+// TestS3Store runs against the MinIO service from docker-compose.yml, e.g.
+// S3_TEST_ENDPOINT=localhost:9000 go test ./internal/storage
+func TestS3Store(t *testing.T) {
+	endpoint := os.Getenv("S3_TEST_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("S3_TEST_ENDPOINT not set")
+	}
+
+	store, err := NewS3Store(context.Background(), S3Config{
+		Endpoint:        endpoint,
+		Bucket:          "sharetome-test",
+		AccessKeyID:     "minioadmin",
+		SecretAccessKey: "minioadmin",
+	})
+	if err != nil {
+		t.Fatalf("error creating store: %v", err)
+	}
+	testBlobStore(t, store)
+}
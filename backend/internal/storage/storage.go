@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"backend/internal/config"
+)
+
+// ErrNotFound is returned when a blob does not exist.
+var ErrNotFound = errors.New("blob not found")
+
+// BlobStore stores uploaded files under slash separated keys.
+type BlobStore interface {
+	// Put stores the contents of r under key, replacing any existing blob.
+	// size may be -1 if it is not known in advance.
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+
+	// Get opens the blob stored under key. The caller must close it.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+
+	// Delete removes the blob stored under key. Deleting a missing blob is
+	// not an error.
+	Delete(ctx context.Context, key string) error
+
+	// Stat returns information about the blob stored under key.
+	Stat(ctx context.Context, key string) (*BlobInfo, error)
+
+	// SignedURL returns a URL that grants read access to the blob for the
+	// given duration without further authentication.
+	SignedURL(ctx context.Context, key string, expiry time.Duration) (string, error)
+}
+
+// BlobInfo describes a stored blob.
+type BlobInfo struct {
+	Key          string
+	Size         int64
+	ContentType  string
+	LastModified time.Time
+}
+
+// New creates the blob store cfg selects: "local" (the default) stores files
+// under cfg.LocalDir, "s3" stores them in an S3 compatible bucket such as
+// MinIO.
+func New(cfg config.Storage) (BlobStore, error) {
+	switch cfg.Backend {
+	case "", "local":
+		dir := cfg.LocalDir
+		if dir == "" {
+			dir = "uploads"
+		}
+		return NewLocalStore(dir, []byte(cfg.SigningKey))
+	case "s3":
+		return NewS3Store(context.Background(), S3Config{
+			Endpoint:        cfg.S3.Endpoint,
+			Region:          cfg.S3.Region,
+			Bucket:          cfg.S3.Bucket,
+			AccessKeyID:     cfg.S3.AccessKeyID,
+			SecretAccessKey: cfg.S3.SecretAccessKey,
+			UseSSL:          cfg.S3.UseSSL,
+		})
+	default:
+		return nil, fmt.Errorf("unknown blob store %q", cfg.Backend)
+	}
+}
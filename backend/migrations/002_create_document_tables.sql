@@ -0,0 +1,29 @@
+-- Create table_documents table
+CREATE TABLE IF NOT EXISTS table_documents (
+    id SERIAL PRIMARY KEY,
+    document_id TEXT NOT NULL UNIQUE,
+    table_id TEXT NOT NULL REFERENCES user_tables(table_id) ON DELETE CASCADE,
+    user_id TEXT NOT NULL,
+    file_name TEXT NOT NULL,
+    file_path TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS table_documents_table_id_idx ON table_documents (table_id);
+
+-- Create ingestion_jobs table
+CREATE TABLE IF NOT EXISTS ingestion_jobs (
+    id SERIAL PRIMARY KEY,
+    job_id TEXT NOT NULL UNIQUE,
+    table_id TEXT NOT NULL REFERENCES user_tables(table_id) ON DELETE CASCADE,
+    user_id TEXT NOT NULL,
+    kind TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    total INTEGER NOT NULL DEFAULT 0,
+    completed INTEGER NOT NULL DEFAULT 0,
+    failed INTEGER NOT NULL DEFAULT 0,
+    error TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,16 @@
+-- Create uploads table tracking resumable (tus) uploads
+CREATE TABLE IF NOT EXISTS uploads (
+    id SERIAL PRIMARY KEY,
+    upload_id TEXT NOT NULL UNIQUE,
+    user_id TEXT NOT NULL,
+    file_name TEXT NOT NULL,
+    content_type TEXT NOT NULL DEFAULT '',
+    size BIGINT NOT NULL,
+    upload_offset BIGINT NOT NULL DEFAULT 0,
+    file_path TEXT NOT NULL DEFAULT '',
+    completed BOOLEAN NOT NULL DEFAULT false,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS uploads_user_id_idx ON uploads (user_id);
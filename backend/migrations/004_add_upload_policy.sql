@@ -0,0 +1,4 @@
+-- Comma separated list of content types a table accepts; empty means the server default
+ALTER TABLE user_tables ADD COLUMN IF NOT EXISTS allowed_content_types TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS uploads_file_path_idx ON uploads (file_path);
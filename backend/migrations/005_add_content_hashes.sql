@@ -0,0 +1,10 @@
+-- SHA-256 of the stored bytes, used to find duplicate documents
+ALTER TABLE uploads ADD COLUMN IF NOT EXISTS sha256 TEXT NOT NULL DEFAULT '';
+ALTER TABLE table_documents ADD COLUMN IF NOT EXISTS sha256 TEXT NOT NULL DEFAULT '';
+
+-- Set once a document's chunks are indexed, so other tables can reuse them
+ALTER TABLE table_documents ADD COLUMN IF NOT EXISTS ingested BOOLEAN NOT NULL DEFAULT false;
+
+CREATE UNIQUE INDEX IF NOT EXISTS table_documents_table_id_sha256_idx
+    ON table_documents (table_id, sha256) WHERE sha256 <> '';
+CREATE INDEX IF NOT EXISTS table_documents_sha256_idx ON table_documents (sha256) WHERE sha256 <> '';
@@ -0,0 +1,19 @@
+-- Create extracted_tables table holding the cell structure of tables the
+-- partitioner found in documents
+CREATE TABLE IF NOT EXISTS extracted_tables (
+    id SERIAL PRIMARY KEY,
+    element_id TEXT NOT NULL UNIQUE,
+    document_id TEXT NOT NULL REFERENCES table_documents(document_id) ON DELETE CASCADE,
+    table_id TEXT NOT NULL REFERENCES user_tables(table_id) ON DELETE CASCADE,
+    element_index INTEGER NOT NULL,
+    page_number INTEGER NOT NULL DEFAULT 0,
+    caption TEXT NOT NULL DEFAULT '',
+    bbox JSONB,
+    num_rows INTEGER NOT NULL DEFAULT 0,
+    num_cols INTEGER NOT NULL DEFAULT 0,
+    cells JSONB NOT NULL DEFAULT '[]',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS extracted_tables_table_id_idx ON extracted_tables (table_id);
+CREATE INDEX IF NOT EXISTS extracted_tables_document_id_idx ON extracted_tables (document_id);
@@ -0,0 +1,9 @@
+-- Lineage of forked tables: the table a fork was copied from and when it
+-- last pulled that table's documents
+ALTER TABLE user_tables ADD COLUMN IF NOT EXISTS forked_from TEXT REFERENCES user_tables(table_id) ON DELETE SET NULL;
+ALTER TABLE user_tables ADD COLUMN IF NOT EXISTS synced_at TIMESTAMP WITH TIME ZONE;
+
+CREATE INDEX IF NOT EXISTS user_tables_forked_from_idx ON user_tables (forked_from);
+
+-- The upstream document a forked document is a copy of
+ALTER TABLE table_documents ADD COLUMN IF NOT EXISTS source_document_id TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,14 @@
+-- Descriptions and comma separated tags shown in the public table directory
+ALTER TABLE user_tables ADD COLUMN IF NOT EXISTS description TEXT NOT NULL DEFAULT '';
+ALTER TABLE user_tables ADD COLUMN IF NOT EXISTS tags TEXT NOT NULL DEFAULT '';
+
+-- Names users choose to be shown under as owners of public tables
+CREATE TABLE IF NOT EXISTS user_profiles (
+    user_id TEXT PRIMARY KEY,
+    display_name TEXT NOT NULL,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS user_tables_public_idx ON user_tables (updated_at) WHERE public;
+CREATE INDEX IF NOT EXISTS user_tables_search_idx ON user_tables
+    USING GIN (to_tsvector('simple', table_name || ' ' || description)) WHERE public;
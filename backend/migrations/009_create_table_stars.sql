@@ -0,0 +1,10 @@
+-- Tables users starred to keep track of them and follow their new documents
+CREATE TABLE IF NOT EXISTS table_stars (
+    user_id TEXT NOT NULL,
+    table_id TEXT NOT NULL REFERENCES user_tables(table_id) ON DELETE CASCADE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, table_id)
+);
+
+CREATE INDEX IF NOT EXISTS table_stars_table_id_idx ON table_stars (table_id);
+CREATE INDEX IF NOT EXISTS table_documents_table_created_idx ON table_documents (table_id, created_at);
@@ -0,0 +1,25 @@
+-- Append-only log of changes made to tables. Events outlive the tables they
+-- describe, so table_id is not a foreign key.
+CREATE TABLE IF NOT EXISTS table_events (
+    id BIGSERIAL PRIMARY KEY,
+    table_id TEXT NOT NULL,
+    actor_id TEXT NOT NULL,
+    action TEXT NOT NULL,
+    target TEXT NOT NULL DEFAULT '',
+    metadata JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS table_events_table_id_idx ON table_events (table_id, id);
+CREATE INDEX IF NOT EXISTS table_events_actor_id_idx ON table_events (actor_id, id);
+
+CREATE OR REPLACE FUNCTION table_events_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'table_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS table_events_append_only ON table_events;
+CREATE TRIGGER table_events_append_only
+    BEFORE UPDATE OR DELETE ON table_events
+    FOR EACH ROW EXECUTE FUNCTION table_events_append_only();
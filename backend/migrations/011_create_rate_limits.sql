@@ -0,0 +1,8 @@
+-- Token buckets of the rate limiter, shared by the API's replicas. A bucket is
+-- stored as the time it is full again; full buckets may be deleted.
+CREATE TABLE IF NOT EXISTS rate_limits (
+    key TEXT PRIMARY KEY,
+    full_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS rate_limits_full_at_idx ON rate_limits (full_at);
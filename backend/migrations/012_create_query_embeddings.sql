@@ -0,0 +1,10 @@
+-- Embeddings of search queries, kept so repeated queries do not call the
+-- embedding API again. key hashes the model and the normalized query.
+CREATE TABLE IF NOT EXISTS query_embeddings (
+    key TEXT PRIMARY KEY,
+    model TEXT NOT NULL,
+    embedding BYTEA NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS query_embeddings_created_at_idx ON query_embeddings (created_at);
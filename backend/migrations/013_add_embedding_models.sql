@@ -0,0 +1,5 @@
+-- The embedding model the chunks of each table are embedded with and its
+-- version, which selects the index the chunks are kept in. Tables from before
+-- versions were recorded use the first model.
+ALTER TABLE user_tables ADD COLUMN IF NOT EXISTS embedding_model TEXT NOT NULL DEFAULT 'text-embedding-3-small';
+ALTER TABLE user_tables ADD COLUMN IF NOT EXISTS embedding_version INTEGER NOT NULL DEFAULT 1;
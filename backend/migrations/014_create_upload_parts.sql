@@ -0,0 +1,10 @@
+-- Parts of unfinished resumable uploads, stored in the blob store so that any
+-- replica can continue an upload. A part starts at part_offset and holds size
+-- bytes; the parts of an upload are concatenated once all have arrived.
+CREATE TABLE IF NOT EXISTS upload_parts (
+    upload_id TEXT NOT NULL REFERENCES uploads (upload_id) ON DELETE CASCADE,
+    part_offset BIGINT NOT NULL,
+    size BIGINT NOT NULL,
+    file_path TEXT NOT NULL,
+    PRIMARY KEY (upload_id, part_offset)
+);
@@ -0,0 +1,8 @@
+-- Locks that keep two ingestion paths from writing the chunks of a table at
+-- once, across the API's replicas. A lock lasts until expires_at unless its
+-- holder renews it, so one held by a replica that died frees itself.
+CREATE TABLE IF NOT EXISTS table_locks (
+    table_id TEXT PRIMARY KEY REFERENCES user_tables (table_id) ON DELETE CASCADE,
+    holder TEXT NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
@@ -2,6 +2,17 @@ import { getSession } from "next-auth/react";
 
 const API_BASE_URL = process.env.NEXT_PUBLIC_API_URL || "http://localhost:8080";
 
+// Error responses are problem details objects; their detail is the message to show
+async function errorMessage(response: Response): Promise<string> {
+  const text = await response.text();
+  try {
+    const problem = JSON.parse(text);
+    return problem.detail || problem.title || response.statusText;
+  } catch {
+    return text || response.statusText;
+  }
+}
+
 export async function fetchWithAuth(
   endpoint: string,
   options: RequestInit = {}
@@ -24,8 +35,7 @@ export async function fetchWithAuth(
   });
 
   if (!response.ok) {
-    const error = await response.text();
-    throw new Error(error || response.statusText);
+    throw new Error(await errorMessage(response));
   }
 
   return response.json();
@@ -43,8 +53,7 @@ export async function fetchPublicTable(endpoint: string, options: RequestInit =
   });
 
   if (!response.ok) {
-    const error = await response.text();
-    throw new Error(error || response.statusText);
+    throw new Error(await errorMessage(response));
   }
 
   return response.json();
@@ -146,8 +155,7 @@ export const api = {
       );
 
       if (!response.ok) {
-        const errorText = await response.text();
-        throw new Error(errorText);
+        throw new Error(await errorMessage(response));
       }
     } catch (error) {
       console.error("Error updating table visibility:", error);